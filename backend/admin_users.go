@@ -0,0 +1,581 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AdminUserFilter selects users for the admin user directory
+type AdminUserFilter struct {
+	Search            string // name, username, nickname or phone number
+	Role              string
+	Status            string
+	Flagged           bool // only users with open anti-cheat flags
+	MinBalance        *int
+	MinStreak         *int
+	MinCompletedTasks *int
+	RegisteredFrom    *time.Time
+	RegisteredTo      *time.Time
+	Sort              string // see adminUserSortColumns
+	Ascending         bool
+}
+
+var adminUserSortColumns = map[string]string{
+	"created_at": "users.created_at",
+	"balance":    "users.balance",
+	"streak":     "users.current_streak",
+	"completed":  "completed_tasks_count",
+	"name":       "LOWER(users.first_name || ' ' || users.last_name)",
+}
+
+// adminUserQuery selects users with their completed task count in a single
+// query; the count comes from a grouped subquery instead of one COUNT per row
+func adminUserQuery(filter AdminUserFilter) *gorm.DB {
+	completed := DB.Model(&UserTask{}).
+		Select("user_id, COUNT(*) AS cnt").
+		Where("status = ?", "completed").
+		Group("user_id")
+
+	query := DB.Table("users").
+		Joins("LEFT JOIN (?) AS ct ON ct.user_id = users.id", completed)
+
+	if search := strings.TrimSpace(filter.Search); search != "" {
+		pattern := "%" + likeEscaper.Replace(strings.ToLower(search)) + "%"
+		query = query.Where(`(LOWER(users.first_name) LIKE ? OR LOWER(users.last_name) LIKE ?
+			OR LOWER(users.first_name || ' ' || users.last_name) LIKE ? OR LOWER(users.username) LIKE ?
+			OR LOWER(users.nickname) LIKE ? OR users.phone_number LIKE ?)`,
+			pattern, pattern, pattern, pattern, pattern, pattern)
+	}
+	if filter.Role != "" {
+		query = query.Where("users.role = ?", filter.Role)
+	}
+	if filter.Status != "" {
+		query = query.Where("users.status = ?", filter.Status)
+	}
+	if filter.Flagged {
+		query = query.Where("users.id IN (?)", DB.Model(&UserFlag{}).Select("user_id").Where("status = ?", FlagOpen))
+	}
+	if filter.MinBalance != nil {
+		query = query.Where("users.balance >= ?", *filter.MinBalance)
+	}
+	if filter.MinStreak != nil {
+		query = query.Where("users.current_streak >= ?", *filter.MinStreak)
+	}
+	if filter.MinCompletedTasks != nil {
+		query = query.Where("COALESCE(ct.cnt, 0) >= ?", *filter.MinCompletedTasks)
+	}
+	if filter.RegisteredFrom != nil {
+		query = query.Where("users.created_at >= ?", *filter.RegisteredFrom)
+	}
+	if filter.RegisteredTo != nil {
+		query = query.Where("users.created_at < ?", *filter.RegisteredTo)
+	}
+	return query
+}
+
+// GetAdminUsers gets a page of the user directory with the totals of all
+// matching users (admin only)
+func GetAdminUsers(filter AdminUserFilter, page, pageSize int) (*AdminUsersResponse, error) {
+	response := &AdminUsersResponse{
+		Users:    []AdminUserResponse{},
+		Page:     page,
+		PageSize: pageSize,
+	}
+
+	var totals struct {
+		Total          int64
+		TotalBalance   int64
+		TotalCompleted int64
+	}
+	if err := adminUserQuery(filter).
+		Select("COUNT(*) AS total, COALESCE(SUM(users.balance), 0) AS total_balance, COALESCE(SUM(ct.cnt), 0) AS total_completed").
+		Scan(&totals).Error; err != nil {
+		return nil, err
+	}
+	response.Total = totals.Total
+	response.TotalBalance = totals.TotalBalance
+	response.TotalCompletedTasks = totals.TotalCompleted
+
+	column, ok := adminUserSortColumns[filter.Sort]
+	if !ok {
+		column = adminUserSortColumns["created_at"]
+	}
+	direction := " DESC"
+	if filter.Ascending {
+		direction = " ASC"
+	}
+
+	var rows []struct {
+		User
+		CompletedTasksCount int
+	}
+	if err := adminUserQuery(filter).
+		Select("users.*, COALESCE(ct.cnt, 0) AS completed_tasks_count").
+		Order(column + direction).Order("users.id" + direction).
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		response.Users = append(response.Users, AdminUserResponse{
+			ID:                  int(row.ID),
+			Username:            row.Username,
+			FirstName:           row.FirstName,
+			LastName:            row.LastName,
+			PhoneNumber:         row.PhoneNumber,
+			Balance:             row.Balance,
+			CurrentStreak:       row.CurrentStreak,
+			CompletedTasksCount: row.CompletedTasksCount,
+			Role:                row.Role,
+			Status:              row.Status,
+			CreatedAt:           row.CreatedAt.Format("2006-01-02 15:04:05"),
+		})
+	}
+	return response, nil
+}
+
+// User moderation. Every change an admin makes to an account is written to
+// the admin audit log in the same transaction, so it can be reviewed later.
+
+// User statuses
+const (
+	UserActive       = "active"
+	UserShadowBanned = "shadow_banned"
+	UserBanned       = "banned"
+)
+
+var userStatuses = map[string]bool{UserActive: true, UserShadowBanned: true, UserBanned: true}
+
+// Admin audit log actions
+const (
+	AuditBalanceAdjustment = "balance_adjustment"
+	AuditTaskReset         = "task_reset"
+	AuditRoleChange        = "role_change"
+	AuditBan               = "ban"
+	AuditShadowBan         = "shadow_ban"
+	AuditUnban             = "unban"
+	AuditFlagsReviewed     = "flags_reviewed"
+)
+
+var userRoles = map[string]bool{"student": true, "admin": true}
+
+// adminUserDetailLimit caps the recent attempts, purchases, balance history
+// and audit entries on the user page; the full lists have their own endpoints
+const adminUserDetailLimit = 50
+
+func recordAdminAction(tx *gorm.DB, adminID, targetUserID uint, action, details, reason string) error {
+	return tx.Create(&AdminAuditLog{
+		AdminID:      adminID,
+		TargetUserID: targetUserID,
+		Action:       action,
+		Details:      details,
+		Reason:       reason,
+	}).Error
+}
+
+// lockUser loads a user for update inside a moderation transaction
+func lockUser(tx *gorm.DB, userID uint) (User, error) {
+	var user User
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error
+	return user, err
+}
+
+// AdjustUserBalance credits or debits a user's balance by hand (admin only)
+func AdjustUserBalance(userID uint, delta int, reason string, adminID uint) (*BalanceTransactionResponse, error) {
+	reason = strings.TrimSpace(reason)
+	if delta == 0 {
+		return nil, fmt.Errorf("delta must not be zero")
+	}
+	if reason == "" {
+		return nil, fmt.Errorf("reason is required")
+	}
+
+	var transaction BalanceTransaction
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockUser(tx, userID); err != nil {
+			return err
+		}
+		if err := changeBalance(tx, userID, delta, balanceChange{Reason: BalanceAdminAdjustment, AdminID: &adminID, Note: reason}); err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Order("id DESC").First(&transaction).Error; err != nil {
+			return err
+		}
+		return recordAdminAction(tx, adminID, userID, AuditBalanceAdjustment,
+			fmt.Sprintf("%+d (balance %d)", delta, transaction.BalanceAfter), reason)
+	})
+	if err != nil {
+		return nil, err
+	}
+	response := balanceTransactionToResponse(transaction)
+	return &response, nil
+}
+
+// ResetUserTask puts a task back to its initial state for the user so they
+// can take it again. With revokeReward the points earned for it are taken back.
+func ResetUserTask(userID, taskID uint, revokeReward bool, reason string, adminID uint) error {
+	reason = strings.TrimSpace(reason)
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockUser(tx, userID); err != nil {
+			return err
+		}
+		var task Task
+		if err := tx.First(&task, taskID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("task not found")
+			}
+			return err
+		}
+		var userTask UserTask
+		if err := tx.Where("user_id = ? AND task_id = ?", userID, taskID).First(&userTask).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("task not started")
+			}
+			return err
+		}
+		if err := tx.Delete(&userTask).Error; err != nil {
+			return err
+		}
+
+		details := fmt.Sprintf("%s (%s)", task.Title, userTask.Status)
+		if revokeReward && userTask.Earned > 0 {
+			if err := changeBalance(tx, userID, -userTask.Earned, balanceChange{
+				Reason:  BalanceTaskReset,
+				TaskID:  &taskID,
+				AdminID: &adminID,
+				Note:    reason,
+			}); err != nil {
+				return err
+			}
+			details += fmt.Sprintf(", revoked %d", userTask.Earned)
+		}
+		return recordAdminAction(tx, adminID, userID, AuditTaskReset, details, reason)
+	})
+}
+
+// ChangeUserRole makes a user a student or an admin (admin only)
+func ChangeUserRole(userID uint, role, reason string, adminID uint) error {
+	if !userRoles[role] {
+		return fmt.Errorf("invalid role")
+	}
+	if userID == adminID {
+		return fmt.Errorf("cannot change your own role")
+	}
+	return DB.Transaction(func(tx *gorm.DB) error {
+		user, err := lockUser(tx, userID)
+		if err != nil {
+			return err
+		}
+		if user.Role == role {
+			return fmt.Errorf("user already has this role")
+		}
+		if err := tx.Model(&user).Update("role", role).Error; err != nil {
+			return err
+		}
+		return recordAdminAction(tx, adminID, userID, AuditRoleChange, user.Role+" -> "+role, strings.TrimSpace(reason))
+	})
+}
+
+// SetUserStatus bans, shadow-bans or unbans a user (admin only)
+func SetUserStatus(userID uint, status, reason string, adminID uint) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		user, err := lockUser(tx, userID)
+		if err != nil {
+			return err
+		}
+		return setUserStatus(tx, user, status, reason, adminID)
+	})
+}
+
+// setUserStatus changes a locked user's status. Bans and shadow bans need a
+// reason, which is kept on the account. Banned users can't log in or use
+// their existing token; shadow-banned users keep using the app but are left
+// out of leaderboards.
+func setUserStatus(tx *gorm.DB, user User, status, reason string, adminID uint) error {
+	reason = strings.TrimSpace(reason)
+	if !userStatuses[status] {
+		return fmt.Errorf("invalid status")
+	}
+	if user.Status == status {
+		if status == UserActive {
+			return fmt.Errorf("user is not banned")
+		}
+		return fmt.Errorf("user already has this status")
+	}
+
+	if status == UserActive {
+		if err := tx.Model(&user).Updates(map[string]interface{}{
+			"status":     UserActive,
+			"ban_reason": "",
+			"banned_at":  nil,
+		}).Error; err != nil {
+			return err
+		}
+		return recordAdminAction(tx, adminID, user.ID, AuditUnban, user.Status, reason)
+	}
+
+	if reason == "" {
+		return fmt.Errorf("reason is required")
+	}
+	if user.ID == adminID || user.Role == "admin" {
+		return fmt.Errorf("admins cannot be banned")
+	}
+	now := time.Now()
+	if err := tx.Model(&user).Updates(map[string]interface{}{
+		"status":     status,
+		"ban_reason": reason,
+		"banned_at":  &now,
+	}).Error; err != nil {
+		return err
+	}
+	action := AuditBan
+	if status == UserShadowBanned {
+		action = AuditShadowBan
+	}
+	return recordAdminAction(tx, adminID, user.ID, action, "", reason)
+}
+
+// GetAdminUserProfile returns the profile shown on the admin user page (admin only)
+func GetAdminUserProfile(userID uint) (*AdminUserProfile, error) {
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var completed int64
+	if err := DB.Model(&UserTask{}).Where("user_id = ? AND status = ?", userID, "completed").Count(&completed).Error; err != nil {
+		return nil, err
+	}
+	profile := adminUserProfile(*user, int(completed))
+	return &profile, nil
+}
+
+// GetAdminUserDetail returns everything the admin user page shows (admin only)
+func GetAdminUserDetail(userID uint) (*AdminUserDetailResponse, error) {
+	profile, err := GetAdminUserProfile(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &AdminUserDetailResponse{
+		Profile:        *profile,
+		Tasks:          []AdminUserTaskProgress{},
+		Attempts:       []TaskAttemptResponse{},
+		Purchases:      []AdminPurchaseEntry{},
+		BalanceHistory: []BalanceTransactionResponse{},
+		Flags:          []UserFlagResponse{},
+		AuditLog:       []AdminAuditLogEntry{},
+	}
+
+	if response.Tasks, err = adminUserTaskProgress(userID); err != nil {
+		return nil, err
+	}
+
+	var attempts []TaskAttempt
+	if err := DB.Preload("Task").Where("user_id = ?", userID).
+		Order("id DESC").Limit(adminUserDetailLimit).Find(&attempts).Error; err != nil {
+		return nil, err
+	}
+	for _, attempt := range attempts {
+		response.Attempts = append(response.Attempts, TaskAttemptResponse{
+			ID:        int(attempt.ID),
+			TaskID:    int(attempt.TaskID),
+			TaskTitle: attempt.Task.Title,
+			Answer:    attempt.Answer,
+			Answers:   attempt.Answers,
+			Correct:   attempt.Correct,
+			CreatedAt: attempt.CreatedAt.Format(time.RFC3339),
+		})
+	}
+
+	purchases, _, err := listPurchases(PurchaseFilter{UserID: userID}, "", adminUserDetailLimit)
+	if err != nil {
+		return nil, err
+	}
+	for _, purchase := range purchases {
+		response.Purchases = append(response.Purchases, purchaseToAdminEntry(purchase))
+	}
+
+	history, err := GetBalanceHistory(userID, 1, adminUserDetailLimit)
+	if err != nil {
+		return nil, err
+	}
+	response.BalanceHistory = history.Transactions
+
+	var flags []UserFlag
+	if err := DB.Where("user_id = ?", userID).Order("id DESC").Limit(adminUserDetailLimit).Find(&flags).Error; err != nil {
+		return nil, err
+	}
+	for _, flag := range flags {
+		response.Flags = append(response.Flags, userFlagToResponse(flag))
+	}
+
+	audit, err := GetAdminAuditLog(AdminAuditFilter{TargetUserID: userID}, 1, adminUserDetailLimit)
+	if err != nil {
+		return nil, err
+	}
+	response.AuditLog = audit.Entries
+	return response, nil
+}
+
+func adminUserProfile(user User, completedTasks int) AdminUserProfile {
+	profile := AdminUserProfile{
+		AdminUserResponse: AdminUserResponse{
+			ID:                  int(user.ID),
+			Username:            user.Username,
+			FirstName:           user.FirstName,
+			LastName:            user.LastName,
+			PhoneNumber:         user.PhoneNumber,
+			Balance:             user.Balance,
+			CurrentStreak:       user.CurrentStreak,
+			CompletedTasksCount: completedTasks,
+			Role:                user.Role,
+			Status:              user.Status,
+			CreatedAt:           user.CreatedAt.Format("2006-01-02 15:04:05"),
+		},
+		TelegramID:   user.TelegramID,
+		PhotoURL:     user.PhotoURL,
+		Nickname:     user.Nickname,
+		University:   user.University,
+		Track:        user.Track,
+		Language:     user.Language,
+		ReferralCode: user.ReferralCode,
+		BanReason:    user.BanReason,
+	}
+	if user.LastTaskDate != nil {
+		profile.LastTaskDate = user.LastTaskDate.Format("2006-01-02")
+	}
+	if user.BannedAt != nil {
+		profile.BannedAt = user.BannedAt.Format(time.RFC3339)
+	}
+	return profile
+}
+
+// adminUserTaskProgress lists the tasks as the user sees them, with the
+// reward earned and the number of attempts for each
+func adminUserTaskProgress(userID uint) ([]AdminUserTaskProgress, error) {
+	tasks, err := GetTasksWithStatus(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var userTasks []UserTask
+	if err := DB.Where("user_id = ?", userID).Find(&userTasks).Error; err != nil {
+		return nil, err
+	}
+	progress := make(map[uint]UserTask, len(userTasks))
+	for _, userTask := range userTasks {
+		progress[userTask.TaskID] = userTask
+	}
+
+	var attemptRows []struct {
+		TaskID uint
+		Count  int
+		LastAt time.Time
+	}
+	if err := DB.Model(&TaskAttempt{}).Where("user_id = ?", userID).
+		Select("task_id, COUNT(*) AS count, MAX(created_at) AS last_at").
+		Group("task_id").
+		Scan(&attemptRows).Error; err != nil {
+		return nil, err
+	}
+	attempts := make(map[uint]int, len(attemptRows))
+	lastAttempt := make(map[uint]time.Time, len(attemptRows))
+	for _, row := range attemptRows {
+		attempts[row.TaskID] = row.Count
+		lastAttempt[row.TaskID] = row.LastAt
+	}
+
+	result := make([]AdminUserTaskProgress, 0, len(tasks))
+	for _, task := range tasks {
+		taskID := uint(task.ID)
+		entry := AdminUserTaskProgress{
+			TaskID:   task.ID,
+			Title:    task.Title,
+			Type:     task.Type,
+			Position: task.Position,
+			Status:   task.Status,
+			Reward:   task.Reward,
+			Attempts: attempts[taskID],
+		}
+		if userTask, ok := progress[taskID]; ok {
+			entry.Earned = userTask.Earned
+			if userTask.CompletedAt != nil {
+				entry.CompletedAt = userTask.CompletedAt.Format(time.RFC3339)
+			}
+		}
+		if last, ok := lastAttempt[taskID]; ok {
+			entry.LastAttemptAt = last.Format(time.RFC3339)
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+// AdminAuditFilter selects entries for GET /api/admin/audit-log
+type AdminAuditFilter struct {
+	AdminID      uint
+	TargetUserID uint
+	Action       string
+}
+
+// GetAdminAuditLog lists admin changes to user accounts, newest first (admin only)
+func GetAdminAuditLog(filter AdminAuditFilter, page, pageSize int) (*AdminAuditLogResponse, error) {
+	scope := func(db *gorm.DB) *gorm.DB {
+		if filter.AdminID > 0 {
+			db = db.Where("admin_id = ?", filter.AdminID)
+		}
+		if filter.TargetUserID > 0 {
+			db = db.Where("target_user_id = ?", filter.TargetUserID)
+		}
+		if filter.Action != "" {
+			db = db.Where("action = ?", filter.Action)
+		}
+		return db
+	}
+
+	var total int64
+	if err := DB.Model(&AdminAuditLog{}).Scopes(scope).Count(&total).Error; err != nil {
+		return nil, err
+	}
+
+	var entries []AdminAuditLog
+	if err := DB.Preload("Admin").Preload("TargetUser").Scopes(scope).
+		Order("id DESC").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	response := &AdminAuditLogResponse{
+		Entries:  make([]AdminAuditLogEntry, 0, len(entries)),
+		Page:     page,
+		PageSize: pageSize,
+		Total:    total,
+	}
+	for _, entry := range entries {
+		adminName := userFullName(entry.Admin)
+		if adminName == "" {
+			adminName = entry.Admin.Username
+		}
+		response.Entries = append(response.Entries, AdminAuditLogEntry{
+			ID:             int(entry.ID),
+			AdminID:        int(entry.AdminID),
+			AdminName:      adminName,
+			TargetUserID:   int(entry.TargetUserID),
+			TargetUserName: userFullName(entry.TargetUser),
+			Action:         entry.Action,
+			Details:        entry.Details,
+			Reason:         entry.Reason,
+			CreatedAt:      entry.CreatedAt.Format(time.RFC3339),
+		})
+	}
+	return response, nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Admin analytics: time series over a date range, bucketed by day, week or
+// month in SQL with date_trunc. Periods are generated with generate_series so
+// periods without activity are reported as zero instead of being skipped.
+// Dates are in server time; ranges are inclusive of both ends.
+
+const maxAnalyticsPeriods = 1000
+
+var analyticsGranularities = map[string]string{
+	"day":   "1 day",
+	"week":  "1 week",
+	"month": "1 month",
+}
+
+// AnalyticsRange is the date range and bucket size of a time series
+type AnalyticsRange struct {
+	From        time.Time // first day
+	To          time.Time // day after the last day
+	Granularity string    // "day", "week" or "month"
+}
+
+// NewAnalyticsRange validates a range given as inclusive YYYY-MM-DD dates
+func NewAnalyticsRange(from, to, granularity string) (AnalyticsRange, error) {
+	r := AnalyticsRange{Granularity: granularity}
+	if _, ok := analyticsGranularities[granularity]; !ok {
+		return r, fmt.Errorf("invalid granularity")
+	}
+	var err error
+	if r.From, err = time.ParseInLocation("2006-01-02", from, time.Local); err != nil {
+		return r, fmt.Errorf("invalid from")
+	}
+	last, err := time.ParseInLocation("2006-01-02", to, time.Local)
+	if err != nil {
+		return r, fmt.Errorf("invalid to")
+	}
+	if last.Before(r.From) {
+		return r, fmt.Errorf("to must not be before from")
+	}
+	r.To = last.AddDate(0, 0, 1)
+
+	periods := int(r.To.Sub(r.From).Hours() / 24)
+	switch granularity {
+	case "week":
+		periods /= 7
+	case "month":
+		periods /= 28
+	}
+	if periods > maxAnalyticsPeriods {
+		return r, fmt.Errorf("range too large")
+	}
+	return r, nil
+}
+
+// periodsSQL lists the periods of the range as rows of "period"; it takes
+// the arguments returned by periodsArgs
+const periodsSQL = `SELECT generate_series(date_trunc(?, ?::timestamptz), date_trunc(?, ?::timestamptz), ?::interval) AS period`
+
+func (r AnalyticsRange) periodsArgs() []interface{} {
+	last := r.To.AddDate(0, 0, -1)
+	return []interface{}{r.Granularity, r.From, r.Granularity, last, analyticsGranularities[r.Granularity]}
+}
+
+func (r AnalyticsRange) response() AnalyticsSeriesRange {
+	return AnalyticsSeriesRange{
+		From:        r.From.Format("2006-01-02"),
+		To:          r.To.AddDate(0, 0, -1).Format("2006-01-02"),
+		Granularity: r.Granularity,
+	}
+}
+
+func formatPeriod(period time.Time) string {
+	return period.Format("2006-01-02")
+}
+
+// GetRegistrationSeries counts new users per period (admin only)
+func GetRegistrationSeries(r AnalyticsRange) (*CountSeriesResponse, error) {
+	var rows []struct {
+		Period time.Time
+		Count  int64
+	}
+	args := append(r.periodsArgs(), r.Granularity, r.From, r.To)
+	if err := DB.Raw(`SELECT p.period, COALESCE(c.count, 0) AS count
+		FROM (`+periodsSQL+`) AS p
+		LEFT JOIN (
+			SELECT date_trunc(?, created_at) AS period, COUNT(*) AS count
+			FROM users WHERE created_at >= ? AND created_at < ?
+			GROUP BY 1
+		) AS c ON c.period = p.period
+		ORDER BY p.period`, args...).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	response := &CountSeriesResponse{
+		AnalyticsSeriesRange: r.response(),
+		Points:               make([]CountPoint, 0, len(rows)),
+	}
+	for _, row := range rows {
+		response.Points = append(response.Points, CountPoint{Period: formatPeriod(row.Period), Count: row.Count})
+		response.Total += row.Count
+	}
+	return response, nil
+}
+
+// GetActiveUserSeries counts distinct active users per period. A user is
+// active when they log in, submit an answer or complete a task. DAU, WAU and
+// MAU are measured over the last 1, 7 and 30 days of each period.
+func GetActiveUserSeries(r AnalyticsRange) (*ActiveUsersResponse, error) {
+	activityFrom := r.From.AddDate(0, 0, -30)
+	var rows []struct {
+		Period      time.Time
+		ActiveUsers int64
+		DAU         int64 `gorm:"column:dau"`
+		WAU         int64 `gorm:"column:wau"`
+		MAU         int64 `gorm:"column:mau"`
+	}
+	args := []interface{}{
+		activityFrom, r.To, activityFrom, r.To, activityFrom, r.To,
+		r.From, analyticsGranularities[r.Granularity], r.To,
+	}
+	args = append(args, r.periodsArgs()...)
+	if err := DB.Raw(`WITH activity AS (
+			SELECT user_id, created_at AS at FROM login_events WHERE created_at >= ? AND created_at < ?
+			UNION ALL
+			SELECT user_id, created_at FROM task_attempts WHERE created_at >= ? AND created_at < ?
+			UNION ALL
+			SELECT user_id, completed_at FROM user_tasks WHERE completed_at >= ? AND completed_at < ?
+		), periods AS (
+			SELECT GREATEST(period, ?::timestamptz) AS period_start, period,
+				LEAST(period + ?::interval, ?::timestamptz) AS period_end
+			FROM (`+periodsSQL+`) AS p
+		)
+		SELECT p.period,
+			(SELECT COUNT(DISTINCT user_id) FROM activity a WHERE a.at >= p.period_start AND a.at < p.period_end) AS active_users,
+			(SELECT COUNT(DISTINCT user_id) FROM activity a WHERE a.at >= p.period_end - interval '1 day' AND a.at < p.period_end) AS dau,
+			(SELECT COUNT(DISTINCT user_id) FROM activity a WHERE a.at >= p.period_end - interval '7 days' AND a.at < p.period_end) AS wau,
+			(SELECT COUNT(DISTINCT user_id) FROM activity a WHERE a.at >= p.period_end - interval '30 days' AND a.at < p.period_end) AS mau
+		FROM periods p
+		ORDER BY p.period`, args...).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	response := &ActiveUsersResponse{
+		AnalyticsSeriesRange: r.response(),
+		Points:               make([]ActiveUsersPoint, 0, len(rows)),
+	}
+	for _, row := range rows {
+		response.Points = append(response.Points, ActiveUsersPoint{
+			Period:      formatPeriod(row.Period),
+			ActiveUsers: row.ActiveUsers,
+			DAU:         row.DAU,
+			WAU:         row.WAU,
+			MAU:         row.MAU,
+		})
+	}
+	return response, nil
+}
+
+// GetTaskCompletionSeries counts completed tasks and the users who completed
+// them per period, optionally for one task (admin only)
+func GetTaskCompletionSeries(r AnalyticsRange, taskID uint) (*CountSeriesResponse, error) {
+	taskFilter := ""
+	args := append(r.periodsArgs(), r.Granularity, r.From, r.To)
+	if taskID > 0 {
+		taskFilter = " AND task_id = ?"
+		args = append(args, taskID)
+	}
+
+	var rows []struct {
+		Period time.Time
+		Count  int64
+		Users  int64
+	}
+	if err := DB.Raw(`SELECT p.period, COALESCE(c.count, 0) AS count, COALESCE(c.users, 0) AS users
+		FROM (`+periodsSQL+`) AS p
+		LEFT JOIN (
+			SELECT date_trunc(?, completed_at) AS period, COUNT(*) AS count, COUNT(DISTINCT user_id) AS users
+			FROM user_tasks WHERE status = 'completed' AND completed_at >= ? AND completed_at < ?`+taskFilter+`
+			GROUP BY 1
+		) AS c ON c.period = p.period
+		ORDER BY p.period`, args...).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	response := &CountSeriesResponse{
+		AnalyticsSeriesRange: r.response(),
+		Points:               make([]CountPoint, 0, len(rows)),
+	}
+	for _, row := range rows {
+		users := row.Users
+		response.Points = append(response.Points, CountPoint{Period: formatPeriod(row.Period), Count: row.Count, Users: &users})
+		response.Total += row.Count
+	}
+	return response, nil
+}
+
+// GetPointsSeries sums the balance ledger per period: points earned from
+// tasks and referrals, spent in the shop, refunded, and adjusted by admins
+// (admin only). The ledger starts with the balance history feature, so
+// earlier periods are empty.
+func GetPointsSeries(r AnalyticsRange) (*PointsResponse, error) {
+	var rows []struct {
+		Period   time.Time
+		Earned   int64
+		Spent    int64
+		Refunded int64
+		Adjusted int64
+	}
+	args := append(r.periodsArgs(), r.Granularity,
+		[]string{BalanceTaskReward, BalanceReferral}, BalancePurchase, BalanceRefund,
+		[]string{BalanceAdminAdjustment, BalanceTaskReset},
+		r.From, r.To)
+	if err := DB.Raw(`SELECT p.period, COALESCE(b.earned, 0) AS earned, COALESCE(b.spent, 0) AS spent,
+			COALESCE(b.refunded, 0) AS refunded, COALESCE(b.adjusted, 0) AS adjusted
+		FROM (`+periodsSQL+`) AS p
+		LEFT JOIN (
+			SELECT date_trunc(?, created_at) AS period,
+				COALESCE(SUM(delta) FILTER (WHERE reason IN ?), 0) AS earned,
+				COALESCE(-SUM(delta) FILTER (WHERE reason = ?), 0) AS spent,
+				COALESCE(SUM(delta) FILTER (WHERE reason = ?), 0) AS refunded,
+				COALESCE(SUM(delta) FILTER (WHERE reason IN ?), 0) AS adjusted
+			FROM balance_transactions WHERE created_at >= ? AND created_at < ?
+			GROUP BY 1
+		) AS b ON b.period = p.period
+		ORDER BY p.period`, args...).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	response := &PointsResponse{
+		AnalyticsSeriesRange: r.response(),
+		Points:               make([]PointsPoint, 0, len(rows)),
+	}
+	for _, row := range rows {
+		point := PointsPoint{
+			Period:   formatPeriod(row.Period),
+			Earned:   row.Earned,
+			Spent:    row.Spent,
+			Refunded: row.Refunded,
+			Adjusted: row.Adjusted,
+			Net:      row.Earned - row.Spent + row.Refunded + row.Adjusted,
+		}
+		response.Points = append(response.Points, point)
+		response.TotalEarned += point.Earned
+		response.TotalSpent += point.Spent
+	}
+	return response, nil
+}
+
+// GetPurchaseSeries counts purchases and the points paid per item and
+// period, leaving out cancelled purchases (admin only)
+func GetPurchaseSeries(r AnalyticsRange, itemID uint) (*PurchaseSeriesResponse, error) {
+	var periods []struct {
+		Period time.Time
+	}
+	if err := DB.Raw(periodsSQL, r.periodsArgs()...).Scan(&periods).Error; err != nil {
+		return nil, err
+	}
+
+	query := DB.Model(&Purchase{}).
+		Select("date_trunc(?, purchases.purchased_at) AS period, purchases.item_id, shop_items.name AS item_name, COUNT(*) AS count, COALESCE(SUM(purchases.price), 0) AS points", r.Granularity).
+		Joins("JOIN shop_items ON shop_items.id = purchases.item_id").
+		Where("purchases.status <> ? AND purchases.purchased_at >= ? AND purchases.purchased_at < ?", PurchaseCancelled, r.From, r.To)
+	if itemID > 0 {
+		query = query.Where("purchases.item_id = ?", itemID)
+	}
+	var rows []struct {
+		Period   time.Time
+		ItemID   uint
+		ItemName string
+		Count    int64
+		Points   int64
+	}
+	if err := query.Group("1, purchases.item_id, shop_items.name").
+		Order("purchases.item_id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	// One dense series per item, items with the most purchases first
+	index := make(map[string]int, len(periods))
+	for i, period := range periods {
+		index[formatPeriod(period.Period)] = i
+	}
+	response := &PurchaseSeriesResponse{
+		AnalyticsSeriesRange: r.response(),
+		Items:                []PurchaseSeries{},
+	}
+	seriesByItem := map[uint]int{}
+	for _, row := range rows {
+		i, ok := seriesByItem[row.ItemID]
+		if !ok {
+			series := PurchaseSeries{
+				ItemID:   int(row.ItemID),
+				ItemName: row.ItemName,
+				Points:   make([]PurchasePoint, len(periods)),
+			}
+			for j, period := range periods {
+				series.Points[j].Period = formatPeriod(period.Period)
+			}
+			response.Items = append(response.Items, series)
+			i = len(response.Items) - 1
+			seriesByItem[row.ItemID] = i
+		}
+		series := &response.Items[i]
+		if j, ok := index[formatPeriod(row.Period)]; ok {
+			series.Points[j].Count = row.Count
+			series.Points[j].PointsSpent = row.Points
+		}
+		series.TotalCount += row.Count
+		series.TotalPoints += row.Points
+	}
+	sort.SliceStable(response.Items, func(a, b int) bool {
+		return response.Items[a].TotalCount > response.Items[b].TotalCount
+	})
+	return response, nil
+}
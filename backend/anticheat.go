@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Anti-cheat. Suspicious activity raises a UserFlag: answers submitted faster
+// than a human can read a task, many accounts logging in from one IP address
+// or device, and sudden balance spikes. A user has at most one open flag of
+// each kind. Admins work through the accounts with open flags in the review
+// queue and dismiss the flags or (shadow-)ban the account.
+
+// Flag kinds
+const (
+	FlagFastAnswer   = "fast_answer"
+	FlagSharedIP     = "shared_ip"
+	FlagSharedDevice = "shared_device"
+	FlagBalanceSpike = "balance_spike"
+)
+
+// Flag statuses
+const (
+	FlagOpen      = "open"
+	FlagDismissed = "dismissed"
+	FlagConfirmed = "confirmed"
+)
+
+// flagReviewDecisions maps review decisions to the user status they set
+// ("" keeps the status)
+var flagReviewDecisions = map[string]string{
+	"dismiss":    "",
+	"shadow_ban": UserShadowBanned,
+	"ban":        UserBanned,
+}
+
+// earnedBalanceReasons are the balance changes counted for balance spikes
+var earnedBalanceReasons = map[string]bool{BalanceTaskReward: true, BalanceReferral: true}
+
+func minAnswerInterval() time.Duration {
+	return time.Duration(getEnvInt("ANTICHEAT_MIN_ANSWER_SECONDS", 3)) * time.Second
+}
+
+func accountsPerIPLimit() int {
+	return getEnvInt("ANTICHEAT_ACCOUNTS_PER_IP", 5)
+}
+
+func accountsPerDeviceLimit() int {
+	return getEnvInt("ANTICHEAT_ACCOUNTS_PER_DEVICE", 3)
+}
+
+func balanceSpikeLimit() int {
+	return getEnvInt("ANTICHEAT_BALANCE_SPIKE", 1000)
+}
+
+// raiseFlag flags a user unless a flag of the same kind is already open
+func raiseFlag(tx *gorm.DB, userID uint, kind, details string) error {
+	var open int64
+	if err := tx.Model(&UserFlag{}).Where("user_id = ? AND kind = ? AND status = ?", userID, kind, FlagOpen).
+		Count(&open).Error; err != nil {
+		return err
+	}
+	if open > 0 {
+		return nil
+	}
+	return tx.Create(&UserFlag{UserID: userID, Kind: kind, Details: details, Status: FlagOpen}).Error
+}
+
+// checkAnswerSpeed flags a user whose answer comes right after their
+// previous one; it runs before the new attempt is recorded
+func checkAnswerSpeed(tx *gorm.DB, userID, taskID uint, now time.Time) error {
+	var previous TaskAttempt
+	err := tx.Where("user_id = ?", userID).Order("id DESC").Limit(1).Find(&previous).Error
+	if err != nil || previous.ID == 0 {
+		return err
+	}
+	interval := now.Sub(previous.CreatedAt)
+	if interval >= minAnswerInterval() {
+		return nil
+	}
+	return raiseFlag(tx, userID, FlagFastAnswer,
+		fmt.Sprintf("answered task %d %.1fs after the previous answer", taskID, interval.Seconds()))
+}
+
+// checkBalanceSpike flags a user who earned more than the spike limit within
+// the last hour
+func checkBalanceSpike(tx *gorm.DB, userID uint, now time.Time) error {
+	reasons := make([]string, 0, len(earnedBalanceReasons))
+	for reason := range earnedBalanceReasons {
+		reasons = append(reasons, reason)
+	}
+	var earned int
+	if err := tx.Model(&BalanceTransaction{}).
+		Where("user_id = ? AND reason IN ? AND delta > 0 AND created_at >= ?", userID, reasons, now.Add(-time.Hour)).
+		Select("COALESCE(SUM(delta), 0)").Scan(&earned).Error; err != nil {
+		return err
+	}
+	if earned < balanceSpikeLimit() {
+		return nil
+	}
+	return raiseFlag(tx, userID, FlagBalanceSpike, fmt.Sprintf("earned %d points within an hour", earned))
+}
+
+// RecordLogin stores the IP address and device of a login and flags the
+// user when too many accounts share them: per IP within a day, per device
+// ever. deviceID comes from the optional X-Device-ID header.
+func RecordLogin(userID uint, ip, deviceID string) error {
+	deviceID = strings.TrimSpace(deviceID)
+	if len(deviceID) > 64 {
+		deviceID = deviceID[:64]
+	}
+	if err := DB.Create(&LoginEvent{UserID: userID, IP: ip, DeviceID: deviceID}).Error; err != nil {
+		return err
+	}
+
+	if ip != "" {
+		var accounts int64
+		if err := DB.Model(&LoginEvent{}).Where("ip = ? AND created_at >= ?", ip, time.Now().AddDate(0, 0, -1)).
+			Distinct("user_id").Count(&accounts).Error; err != nil {
+			return err
+		}
+		if accounts > int64(accountsPerIPLimit()) {
+			if err := raiseFlag(DB, userID, FlagSharedIP,
+				fmt.Sprintf("%d accounts logged in from %s within a day", accounts, ip)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if deviceID != "" {
+		var accounts int64
+		if err := DB.Model(&LoginEvent{}).Where("device_id = ?", deviceID).
+			Distinct("user_id").Count(&accounts).Error; err != nil {
+			return err
+		}
+		if accounts > int64(accountsPerDeviceLimit()) {
+			return raiseFlag(DB, userID, FlagSharedDevice,
+				fmt.Sprintf("%d accounts logged in from device %s", accounts, deviceID))
+		}
+	}
+	return nil
+}
+
+func userFlagToResponse(flag UserFlag) UserFlagResponse {
+	response := UserFlagResponse{
+		ID:        int(flag.ID),
+		Kind:      flag.Kind,
+		Details:   flag.Details,
+		Status:    flag.Status,
+		CreatedAt: flag.CreatedAt.Format(time.RFC3339),
+	}
+	if flag.ReviewedByID != nil {
+		reviewedBy := int(*flag.ReviewedByID)
+		response.ReviewedByID = &reviewedBy
+	}
+	if flag.ReviewedAt != nil {
+		response.ReviewedAt = flag.ReviewedAt.Format(time.RFC3339)
+	}
+	return response
+}
+
+// GetFlagQueue lists accounts with open flags, longest waiting first, with
+// their open flags (admin only)
+func GetFlagQueue(kind string, page, pageSize int) (*FlagQueueResponse, error) {
+	flagged := DB.Model(&UserFlag{}).
+		Select("user_id, MIN(created_at) AS first_flagged_at").
+		Where("status = ?", FlagOpen)
+	if kind != "" {
+		flagged = flagged.Where("kind = ?", kind)
+	}
+	flagged = flagged.Group("user_id")
+
+	var total int64
+	if err := DB.Table("(?) AS flagged", flagged).Count(&total).Error; err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		UserID         uint
+		FirstFlaggedAt time.Time
+	}
+	if err := DB.Table("(?) AS flagged", flagged).
+		Order("first_flagged_at, user_id").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	response := &FlagQueueResponse{
+		Users:    make([]FlagQueueEntry, 0, len(rows)),
+		Page:     page,
+		PageSize: pageSize,
+		Total:    total,
+	}
+	for _, row := range rows {
+		profile, err := GetAdminUserProfile(row.UserID)
+		if err != nil {
+			return nil, err
+		}
+		var flags []UserFlag
+		if err := DB.Where("user_id = ? AND status = ?", row.UserID, FlagOpen).Order("id").Find(&flags).Error; err != nil {
+			return nil, err
+		}
+		entry := FlagQueueEntry{
+			User:           *profile,
+			Flags:          make([]UserFlagResponse, 0, len(flags)),
+			FirstFlaggedAt: row.FirstFlaggedAt.Format(time.RFC3339),
+		}
+		for _, flag := range flags {
+			entry.Flags = append(entry.Flags, userFlagToResponse(flag))
+		}
+		response.Users = append(response.Users, entry)
+	}
+	return response, nil
+}
+
+// ReviewUserFlags closes all open flags of a user. "dismiss" marks them as
+// false alarms; "shadow_ban" and "ban" confirm them and change the user's
+// status, which needs a reason (admin only).
+func ReviewUserFlags(userID uint, decision, reason string, adminID uint) error {
+	status, ok := flagReviewDecisions[decision]
+	if !ok {
+		return fmt.Errorf("invalid decision")
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		user, err := lockUser(tx, userID)
+		if err != nil {
+			return err
+		}
+		var flags []UserFlag
+		if err := tx.Where("user_id = ? AND status = ?", userID, FlagOpen).Order("id").Find(&flags).Error; err != nil {
+			return err
+		}
+		if len(flags) == 0 {
+			return fmt.Errorf("no open flags")
+		}
+
+		flagStatus := FlagDismissed
+		if status != "" {
+			flagStatus = FlagConfirmed
+			if user.Status != status {
+				if err := setUserStatus(tx, user, status, reason, adminID); err != nil {
+					return err
+				}
+			}
+		}
+
+		now := time.Now()
+		kinds := make([]string, 0, len(flags))
+		ids := make([]uint, 0, len(flags))
+		for _, flag := range flags {
+			kinds = append(kinds, flag.Kind)
+			ids = append(ids, flag.ID)
+		}
+		if err := tx.Model(&UserFlag{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+			"status":         flagStatus,
+			"reviewed_by_id": adminID,
+			"reviewed_at":    &now,
+		}).Error; err != nil {
+			return err
+		}
+		return recordAdminAction(tx, adminID, userID, AuditFlagsReviewed,
+			fmt.Sprintf("%s %s", flagStatus, strings.Join(kinds, ", ")), strings.TrimSpace(reason))
+	})
+}
@@ -72,28 +72,44 @@ func ValidateToken(tokenString string) (*Claims, error) {
 	return claims, nil
 }
 
-func AuthMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		var tokenString string
+// tokenFromRequest reads the JWT from the auth cookie or the Authorization
+// header. It returns an empty string if neither is present.
+func tokenFromRequest(c *gin.Context) (string, error) {
+	cookie, err := c.Cookie("auth_token")
+	if err == nil && cookie != "" {
+		return cookie, nil
+	}
 
-		cookie, err := c.Cookie("auth_token")
-		if err == nil && cookie != "" {
-			tokenString = cookie
-		} else {
-			authHeader := c.GetHeader("Authorization")
-			if authHeader == "" {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization required"})
-				c.Abort()
-				return
-			}
+	authHeader := c.GetHeader("Authorization")
+	if authHeader == "" {
+		return "", nil
+	}
 
-			parts := strings.Split(authHeader, " ")
-			if len(parts) != 2 || parts[0] != "Bearer" {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
-				c.Abort()
-				return
-			}
-			tokenString = parts[1]
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return "", fmt.Errorf("invalid authorization header")
+	}
+	return parts[1], nil
+}
+
+func setClaimsInContext(c *gin.Context, claims *Claims) {
+	c.Set("user_id", claims.UserID)
+	c.Set("username", claims.Username)
+	c.Set("role", claims.Role)
+}
+
+func AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString, err := tokenFromRequest(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+			c.Abort()
+			return
+		}
+		if tokenString == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization required"})
+			c.Abort()
+			return
 		}
 
 		claims, err := ValidateToken(tokenString)
@@ -103,9 +119,48 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		c.Set("user_id", claims.UserID)
-		c.Set("username", claims.Username)
-		c.Set("role", claims.Role)
+		account, err := loadAccount(claims)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			c.Abort()
+			return
+		}
+		if account.Status == UserBanned {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Account banned"})
+			c.Abort()
+			return
+		}
+
+		setClaimsInContext(c, claims)
+
+		c.Next()
+	}
+}
+
+// loadAccount reads the token's user so bans and role changes take effect
+// right away instead of when the token expires. The role in the claims is
+// replaced with the current one.
+func loadAccount(claims *Claims) (*User, error) {
+	var user User
+	if err := DB.Select("id", "role", "status").First(&user, claims.UserID).Error; err != nil {
+		return nil, err
+	}
+	claims.Role = user.Role
+	return &user, nil
+}
+
+// OptionalAuthMiddleware sets the user in the context when a valid token is
+// present and silently continues as an anonymous request otherwise
+func OptionalAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString, err := tokenFromRequest(c)
+		if err == nil && tokenString != "" {
+			if claims, err := ValidateToken(tokenString); err == nil {
+				if account, err := loadAccount(claims); err == nil && account.Status != UserBanned {
+					setClaimsInContext(c, claims)
+				}
+			}
+		}
 
 		c.Next()
 	}
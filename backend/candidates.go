@@ -0,0 +1,519 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Candidate pipeline. Recruiters mark promising students as candidates, move
+// them through the hiring stages, tag them and keep notes. The candidate
+// list combines profile data with quiz performance, and can be exported as
+// CSV or JSON Resume (https://jsonresume.org) documents for an ATS.
+
+// Candidate statuses
+const (
+	CandidateNew          = "new"
+	CandidateContacted    = "contacted"
+	CandidateInterviewing = "interviewing"
+	CandidateOffered      = "offered"
+	CandidateRejected     = "rejected"
+)
+
+var candidateStatuses = map[string]bool{
+	CandidateNew: true, CandidateContacted: true, CandidateInterviewing: true,
+	CandidateOffered: true, CandidateRejected: true,
+}
+
+const maxCandidateTags = 20
+
+// candidateTagPattern keeps tags to single words, which also keeps them safe
+// for the text[] column
+var candidateTagPattern = regexp.MustCompile(`^[\p{L}\p{N}_.+#-]{1,32}$`)
+
+// CandidateFilter selects students for the candidate list and export
+type CandidateFilter struct {
+	Search      string // name, username, nickname or phone number
+	Marked      *bool  // only candidates (true) or only unmarked students (false)
+	Status      string // candidate status
+	Tag         string
+	University  string // case-insensitive substring
+	Track       string
+	Stack       string   // case-insensitive, one technology
+	HasResume   bool     // resume link or uploaded file
+	MinLevels   *int     // completed quiz levels
+	MinAccuracy *float64 // share of correct quiz answers, 0 to 1
+	Sort        string   // see candidateSortColumns
+	Ascending   bool
+	userID      uint
+}
+
+// candidateAccuracySQL is the share of correct quiz answers, NULL without
+// answers
+const candidateAccuracySQL = "CASE WHEN COALESCE(qa.attempts, 0) = 0 THEN NULL ELSE qa.correct::float / qa.attempts END"
+
+var candidateSortColumns = map[string]string{
+	"created_at": "users.created_at",
+	"updated_at": "candidates.updated_at",
+	"levels":     "COALESCE(qt.levels, 0)",
+	"accuracy":   candidateAccuracySQL,
+	"points":     "COALESCE(qt.points, 0)",
+}
+
+// candidateQuery selects students with their candidate record and quiz
+// performance; both come from grouped subqueries joined once
+func candidateQuery(filter CandidateFilter) *gorm.DB {
+	completed := DB.Table("user_tasks").
+		Select(`user_tasks.user_id, COUNT(*) FILTER (WHERE tasks.type = 'quiz') AS levels,
+			COALESCE(SUM(user_tasks.earned), 0) AS points`).
+		Joins("JOIN tasks ON tasks.id = user_tasks.task_id").
+		Where("user_tasks.status = ?", "completed").
+		Group("user_tasks.user_id")
+	attempts := DB.Table("task_attempts").
+		Select("task_attempts.user_id, COUNT(*) AS attempts, COUNT(*) FILTER (WHERE task_attempts.correct) AS correct").
+		Joins("JOIN tasks ON tasks.id = task_attempts.task_id").
+		Where("tasks.type = ?", "quiz").
+		Group("task_attempts.user_id")
+
+	query := DB.Table("users").
+		Joins("LEFT JOIN candidates ON candidates.user_id = users.id").
+		Joins("LEFT JOIN resume_files ON resume_files.user_id = users.id").
+		Joins("LEFT JOIN (?) AS qt ON qt.user_id = users.id", completed).
+		Joins("LEFT JOIN (?) AS qa ON qa.user_id = users.id", attempts).
+		Where("users.role = ?", "student")
+
+	if filter.userID > 0 {
+		query = query.Where("users.id = ?", filter.userID)
+	}
+	if search := strings.TrimSpace(filter.Search); search != "" {
+		pattern := "%" + likeEscaper.Replace(strings.ToLower(search)) + "%"
+		query = query.Where(`(LOWER(users.first_name || ' ' || users.last_name) LIKE ? OR LOWER(users.username) LIKE ?
+			OR LOWER(users.nickname) LIKE ? OR users.phone_number LIKE ?)`,
+			pattern, pattern, pattern, pattern)
+	}
+	if filter.Marked != nil {
+		if *filter.Marked {
+			query = query.Where("candidates.user_id IS NOT NULL")
+		} else {
+			query = query.Where("candidates.user_id IS NULL")
+		}
+	}
+	if filter.Status != "" {
+		query = query.Where("candidates.status = ?", filter.Status)
+	}
+	if filter.Tag != "" {
+		query = query.Where("candidates.tags @> ARRAY[?]::text[]", strings.ToLower(filter.Tag))
+	}
+	if university := strings.TrimSpace(filter.University); university != "" {
+		query = query.Where("LOWER(users.university) LIKE ?", "%"+likeEscaper.Replace(strings.ToLower(university))+"%")
+	}
+	if filter.Track != "" {
+		query = query.Where("users.track = ?", filter.Track)
+	}
+	if stack := strings.TrimSpace(filter.Stack); stack != "" {
+		query = query.Where("EXISTS (SELECT 1 FROM unnest(users.stack) AS tech WHERE LOWER(tech) = ?)", strings.ToLower(stack))
+	}
+	if filter.HasResume {
+		query = query.Where("(users.resume_link <> '' OR resume_files.user_id IS NOT NULL)")
+	}
+	if filter.MinLevels != nil {
+		query = query.Where("COALESCE(qt.levels, 0) >= ?", *filter.MinLevels)
+	}
+	if filter.MinAccuracy != nil {
+		query = query.Where(candidateAccuracySQL+" >= ?", *filter.MinAccuracy)
+	}
+	return query
+}
+
+type candidateRow struct {
+	User
+	CandidateStatus    *string
+	CandidateTags      StringArray
+	CandidateUpdatedAt *time.Time
+	HasResumeFile      bool
+	Levels             int
+	Points             int
+	Attempts           int
+	Correct            int
+}
+
+const candidateSelectSQL = `users.*, candidates.status AS candidate_status, candidates.tags AS candidate_tags,
+	candidates.updated_at AS candidate_updated_at, resume_files.user_id IS NOT NULL AS has_resume_file, COALESCE(qt.levels, 0) AS levels, COALESCE(qt.points, 0) AS points,
+	COALESCE(qa.attempts, 0) AS attempts, COALESCE(qa.correct, 0) AS correct`
+
+// listCandidates loads one page of matching students
+func listCandidates(filter CandidateFilter, offset, limit int) ([]candidateRow, error) {
+	column, ok := candidateSortColumns[filter.Sort]
+	if !ok {
+		column = candidateSortColumns["created_at"]
+	}
+	direction := " DESC"
+	if filter.Ascending {
+		direction = " ASC"
+	}
+
+	var rows []candidateRow
+	err := candidateQuery(filter).
+		Select(candidateSelectSQL).
+		Order(column + direction + " NULLS LAST").Order("users.id" + direction).
+		Offset(offset).Limit(limit).
+		Scan(&rows).Error
+	return rows, err
+}
+
+func candidateToResponse(row candidateRow) CandidateResponse {
+	response := CandidateResponse{
+		UserID:          int(row.ID),
+		FirstName:       row.FirstName,
+		LastName:        row.LastName,
+		Username:        row.Username,
+		PhoneNumber:     row.PhoneNumber,
+		TelegramID:      row.TelegramID,
+		University:      row.University,
+		Track:           row.Track,
+		Stack:           row.Stack,
+		ResumeLink:      row.ResumeLink,
+		HasResumeFile:   row.HasResumeFile,
+		UserStatus:      row.Status,
+		RegisteredAt:    row.CreatedAt.Format(time.RFC3339),
+		Tags:            row.CandidateTags,
+		CompletedLevels: row.Levels,
+		QuizAttempts:    row.Attempts,
+		PointsEarned:    row.Points,
+	}
+	if response.Stack == nil {
+		response.Stack = []string{}
+	}
+	if response.Tags == nil {
+		response.Tags = []string{}
+	}
+	if row.CandidateStatus != nil {
+		response.Marked = true
+		response.Status = *row.CandidateStatus
+	}
+	if row.CandidateUpdatedAt != nil {
+		response.UpdatedAt = row.CandidateUpdatedAt.Format(time.RFC3339)
+	}
+	if row.Attempts > 0 {
+		accuracy := float64(row.Correct) / float64(row.Attempts)
+		response.QuizAccuracy = &accuracy
+	}
+	return response
+}
+
+// GetCandidates gets a page of the candidate list (admin only)
+func GetCandidates(filter CandidateFilter, page, pageSize int) (*CandidatesResponse, error) {
+	var total int64
+	if err := candidateQuery(filter).Count(&total).Error; err != nil {
+		return nil, err
+	}
+
+	rows, err := listCandidates(filter, (page-1)*pageSize, pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &CandidatesResponse{
+		Candidates: make([]CandidateResponse, 0, len(rows)),
+		Page:       page,
+		PageSize:   pageSize,
+		Total:      total,
+	}
+	for _, row := range rows {
+		response.Candidates = append(response.Candidates, candidateToResponse(row))
+	}
+	return response, nil
+}
+
+// GetCandidate returns a student's candidate page: profile, pipeline status,
+// quiz performance, task progress and notes (admin only)
+func GetCandidate(userID uint) (*CandidateDetailResponse, error) {
+	rows, err := listCandidates(CandidateFilter{userID: userID}, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	response := &CandidateDetailResponse{
+		Candidate: candidateToResponse(rows[0]),
+		Notes:     []CandidateNoteResponse{},
+	}
+	if response.Tasks, err = adminUserTaskProgress(userID); err != nil {
+		return nil, err
+	}
+
+	var notes []CandidateNote
+	if err := DB.Preload("Author").Where("user_id = ?", userID).Order("id DESC").Find(&notes).Error; err != nil {
+		return nil, err
+	}
+	for _, note := range notes {
+		response.Notes = append(response.Notes, candidateNoteToResponse(note))
+	}
+	return response, nil
+}
+
+// normalizeCandidateTags lowercases and dedupes tags
+func normalizeCandidateTags(tags []string) (StringArray, error) {
+	normalized := StringArray{}
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !candidateTagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("invalid tag")
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > maxCandidateTags {
+		return nil, fmt.Errorf("too many tags")
+	}
+	return normalized, nil
+}
+
+// UpdateCandidate marks a student as a candidate, or changes the status or
+// tags of an existing candidate; nil fields are left alone (admin only)
+func UpdateCandidate(userID uint, status *string, tags []string, adminID uint) error {
+	if status != nil && !candidateStatuses[*status] {
+		return fmt.Errorf("invalid status")
+	}
+	var normalized StringArray
+	if tags != nil {
+		var err error
+		if normalized, err = normalizeCandidateTags(tags); err != nil {
+			return err
+		}
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		user, err := lockUser(tx, userID)
+		if err != nil {
+			return err
+		}
+		if user.Role != "student" {
+			return fmt.Errorf("only students can be candidates")
+		}
+
+		var candidate Candidate
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", userID).Take(&candidate).Error
+		marked := err == nil
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			candidate = Candidate{UserID: userID, Status: CandidateNew, Tags: StringArray{}, MarkedByID: adminID}
+		} else if err != nil {
+			return err
+		}
+
+		if status != nil {
+			candidate.Status = *status
+		}
+		if tags != nil {
+			candidate.Tags = normalized
+		}
+		candidate.UpdatedByID = adminID
+		if !marked {
+			return tx.Create(&candidate).Error
+		}
+		return tx.Save(&candidate).Error
+	})
+}
+
+// UnmarkCandidate drops a student from the pipeline; notes are kept (admin only)
+func UnmarkCandidate(userID uint) error {
+	result := DB.Where("user_id = ?", userID).Delete(&Candidate{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("not a candidate")
+	}
+	return nil
+}
+
+func candidateNoteToResponse(note CandidateNote) CandidateNoteResponse {
+	return CandidateNoteResponse{
+		ID:         int(note.ID),
+		AuthorID:   int(note.AuthorID),
+		AuthorName: strings.TrimSpace(note.Author.FirstName + " " + note.Author.LastName),
+		Body:       note.Body,
+		CreatedAt:  note.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// AddCandidateNote adds a recruiter's note on a student (admin only)
+func AddCandidateNote(userID uint, body string, adminID uint) (*CandidateNoteResponse, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return nil, fmt.Errorf("note is required")
+	}
+	if _, err := GetUserByID(userID); err != nil {
+		return nil, err
+	}
+
+	note := CandidateNote{UserID: userID, AuthorID: adminID, Body: body}
+	if err := DB.Create(&note).Error; err != nil {
+		return nil, err
+	}
+	if err := DB.Preload("Author").First(&note, note.ID).Error; err != nil {
+		return nil, err
+	}
+	response := candidateNoteToResponse(note)
+	return &response, nil
+}
+
+// Candidate export formats
+const (
+	CandidateExportCSV        = "csv"
+	CandidateExportJSONResume = "json_resume"
+)
+
+var candidateCSVHeader = []string{
+	"user_id", "first_name", "last_name", "username", "phone_number", "telegram_id",
+	"university", "track", "stack", "resume_link", "registered_at",
+	"candidate_status", "tags", "completed_levels", "quiz_accuracy", "points_earned",
+}
+
+// eachCandidateBatch runs fn over all matching students in batches, so large
+// exports don't have to fit in memory
+func eachCandidateBatch(filter CandidateFilter, fn func([]CandidateResponse) error) error {
+	filter.Sort, filter.Ascending = "created_at", true
+	for offset := 0; ; offset += csvExportBatchSize {
+		rows, err := listCandidates(filter, offset, csvExportBatchSize)
+		if err != nil {
+			return err
+		}
+		batch := make([]CandidateResponse, 0, len(rows))
+		for _, row := range rows {
+			batch = append(batch, candidateToResponse(row))
+		}
+		if err := fn(batch); err != nil {
+			return err
+		}
+		if len(rows) < csvExportBatchSize {
+			return nil
+		}
+	}
+}
+
+// phoneNumberPattern matches phone numbers such as "+7 (999) 123-45-67"
+var phoneNumberPattern = regexp.MustCompile(`^\+?[0-9][0-9 ()-]*$`)
+
+// csvPhone keeps the leading "+" of phone numbers; csvSafe would prefix it
+// with a quote. Anything that isn't a phone number is still escaped.
+func csvPhone(value string) string {
+	if phoneNumberPattern.MatchString(value) {
+		return value
+	}
+	return csvSafe(value)
+}
+
+// WriteCandidatesCSV exports every matching student as a CSV row (admin only)
+func WriteCandidatesCSV(w io.Writer, filter CandidateFilter) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(candidateCSVHeader); err != nil {
+		return err
+	}
+	return eachCandidateBatch(filter, func(batch []CandidateResponse) error {
+		for _, candidate := range batch {
+			telegramID, accuracy := "", ""
+			if candidate.TelegramID != nil {
+				telegramID = strconv.FormatInt(*candidate.TelegramID, 10)
+			}
+			if candidate.QuizAccuracy != nil {
+				accuracy = strconv.FormatFloat(*candidate.QuizAccuracy, 'f', 2, 64)
+			}
+			if err := writer.Write([]string{
+				strconv.Itoa(candidate.UserID), csvSafe(candidate.FirstName), csvSafe(candidate.LastName),
+				csvSafe(candidate.Username), csvPhone(candidate.PhoneNumber), telegramID,
+				csvSafe(candidate.University), csvSafe(candidate.Track), csvSafe(strings.Join(candidate.Stack, "; ")),
+				csvSafe(candidate.ResumeLink), candidate.RegisteredAt,
+				candidate.Status, strings.Join(candidate.Tags, "; "), strconv.Itoa(candidate.CompletedLevels),
+				accuracy, strconv.Itoa(candidate.PointsEarned),
+			}); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	})
+}
+
+// candidateToJSONResume maps a candidate onto the JSON Resume schema. Pipeline
+// data goes into meta, which the schema leaves open for extensions.
+func candidateToJSONResume(candidate CandidateResponse) JSONResume {
+	resume := JSONResume{
+		Basics: JSONResumeBasics{
+			Name:     strings.TrimSpace(candidate.FirstName + " " + candidate.LastName),
+			Label:    candidate.Track,
+			Phone:    candidate.PhoneNumber,
+			URL:      candidate.ResumeLink,
+			Profiles: []JSONResumeProfile{},
+		},
+		Education: []JSONResumeEducation{},
+		Skills:    []JSONResumeSkill{},
+		Meta: JSONResumeMeta{
+			LastModified: candidate.UpdatedAt,
+			Candidate:    candidate,
+		},
+	}
+	if candidate.Username != "" {
+		resume.Basics.Profiles = append(resume.Basics.Profiles, JSONResumeProfile{
+			Network:  "Telegram",
+			Username: candidate.Username,
+			URL:      "https://t.me/" + candidate.Username,
+		})
+	}
+	if candidate.University != "" {
+		resume.Education = append(resume.Education, JSONResumeEducation{Institution: candidate.University})
+	}
+	for _, tech := range candidate.Stack {
+		resume.Skills = append(resume.Skills, JSONResumeSkill{Name: tech})
+	}
+	if resume.Meta.LastModified == "" {
+		resume.Meta.LastModified = candidate.RegisteredAt
+	}
+	return resume
+}
+
+// WriteCandidatesJSONResume exports every matching student as a JSON array of
+// JSON Resume documents (admin only)
+func WriteCandidatesJSONResume(w io.Writer, filter CandidateFilter) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	first := true
+	err := eachCandidateBatch(filter, func(batch []CandidateResponse) error {
+		for _, candidate := range batch {
+			data, err := json.Marshal(candidateToJSONResume(candidate))
+			if err != nil {
+				return err
+			}
+			if !first {
+				if _, err := io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			first = false
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "]")
+	return err
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The cart lives on the server so it survives reloads and devices. Adding to
+// the cart doesn't reserve stock; Checkout validates every line, the balance
+// and the stock in one transaction and either buys everything or nothing.
+
+const maxCartQuantity = 20
+
+// Checkout error codes besides the lock codes from shop_rules.go
+const (
+	CheckoutItemNotAvailable = "item_not_available"
+	CheckoutVariantRequired  = "variant_required"
+	CheckoutVariantNotFound  = "variant_not_found"
+	CheckoutOutOfStock       = "out_of_stock"
+)
+
+// CheckoutError reports the cart line that made a checkout fail
+type CheckoutError struct {
+	ItemID    uint
+	VariantID uint
+	Code      string
+}
+
+func (e *CheckoutError) Error() string {
+	return "cart item unavailable: " + e.Code
+}
+
+// GetCart returns the user's cart with current prices and availability
+func GetCart(userID uint) (*CartResponse, error) {
+	var user User
+	if err := DB.First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+
+	var lines []CartItem
+	if err := DB.Where("user_id = ?", userID).
+		Preload("Item").
+		Preload("Item.Variants").
+		Order("id").
+		Find(&lines).Error; err != nil {
+		return nil, err
+	}
+
+	response := &CartResponse{Items: make([]CartItemResponse, 0, len(lines)), Balance: user.Balance}
+	for _, line := range lines {
+		entry := CartItemResponse{
+			ItemID:    int(line.ItemID),
+			VariantID: int(line.VariantID),
+			Name:      line.Item.Name,
+			Image:     line.Item.Image,
+			Price:     line.Item.Price,
+			Quantity:  line.Quantity,
+			LineTotal: line.Item.Price * line.Quantity,
+			Stock:     line.Item.Stock,
+		}
+		for _, variant := range line.Item.Variants {
+			if variant.ID == line.VariantID {
+				entry.Variant = variant.Label()
+				entry.Stock = variant.Stock
+			}
+		}
+		entry.Available = line.Item.ArchivedAt == nil && entry.Stock >= line.Quantity
+		response.Total += entry.LineTotal
+		response.Items = append(response.Items, entry)
+	}
+	response.Affordable = user.Balance >= response.Total
+	return response, nil
+}
+
+// AddToCart adds quantity units of an item (variant) to the cart
+func AddToCart(userID, itemID, variantID uint, quantity int) (*CartResponse, error) {
+	if quantity < 1 || quantity > maxCartQuantity {
+		return nil, fmt.Errorf("invalid quantity")
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := validateCartLine(tx, itemID, variantID); err != nil {
+			return err
+		}
+
+		var line CartItem
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND item_id = ? AND variant_id = ?", userID, itemID, variantID).First(&line).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return tx.Create(&CartItem{UserID: userID, ItemID: itemID, VariantID: variantID, Quantity: quantity}).Error
+		}
+		if err != nil {
+			return err
+		}
+		if line.Quantity+quantity > maxCartQuantity {
+			return fmt.Errorf("invalid quantity")
+		}
+		return tx.Model(&line).Update("quantity", line.Quantity+quantity).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetCart(userID)
+}
+
+// SetCartQuantity sets the quantity of a cart line; 0 removes it
+func SetCartQuantity(userID, itemID, variantID uint, quantity int) (*CartResponse, error) {
+	if quantity < 0 || quantity > maxCartQuantity {
+		return nil, fmt.Errorf("invalid quantity")
+	}
+
+	query := DB.Model(&CartItem{}).Where("user_id = ? AND item_id = ? AND variant_id = ?", userID, itemID, variantID)
+	var result *gorm.DB
+	if quantity == 0 {
+		result = query.Delete(&CartItem{})
+	} else {
+		result = query.Update("quantity", quantity)
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return GetCart(userID)
+}
+
+// ClearCart removes all lines from the cart
+func ClearCart(userID uint) error {
+	return DB.Where("user_id = ?", userID).Delete(&CartItem{}).Error
+}
+
+// validateCartLine checks that the item can be put in the cart at all
+func validateCartLine(tx *gorm.DB, itemID, variantID uint) error {
+	var item ShopItem
+	if err := tx.Preload("Variants").First(&item, itemID).Error; err != nil {
+		return err
+	}
+	if item.ArchivedAt != nil {
+		return fmt.Errorf("item not available")
+	}
+	_, err := stockTarget(item, variantID)
+	return err
+}
+
+// Checkout buys everything in the cart as one order. Any unavailable line,
+// an insufficient balance or missing stock fails the whole checkout.
+func Checkout(userID uint, req CheckoutRequest) (*OrderResponse, error) {
+	email, err := normalizePurchaseEmail(req.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	var order Order
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		// The user row lock serializes checkouts and single purchases of the
+		// same user, see BuyItem
+		var user User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
+			return err
+		}
+
+		var lines []CartItem
+		if err := tx.Where("user_id = ?", userID).Preload("Item").Preload("Item.Variants").Order("id").Find(&lines).Error; err != nil {
+			return err
+		}
+		if len(lines) == 0 {
+			return fmt.Errorf("cart is empty")
+		}
+
+		fulfillment, err := resolveFulfillment(tx, req.FulfillmentRequest)
+		if err != nil {
+			return err
+		}
+
+		stats, err := loadShopBuyerStats(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		// Check every line before touching anything so the error names the
+		// first unavailable line
+		now := time.Now()
+		total := 0
+		variantRefs := make([]*uint, len(lines))
+		for i, line := range lines {
+			lineErr := &CheckoutError{ItemID: line.ItemID, VariantID: line.VariantID}
+			if line.Item.ArchivedAt != nil {
+				lineErr.Code = CheckoutItemNotAvailable
+				return lineErr
+			}
+			variantRef, err := stockTarget(line.Item, line.VariantID)
+			if err != nil {
+				lineErr.Code = CheckoutVariantNotFound
+				if err.Error() == "variant required" {
+					lineErr.Code = CheckoutVariantRequired
+				}
+				return lineErr
+			}
+			variantRefs[i] = variantRef
+
+			// Units count towards the per-user limit one by one
+			for unit := 0; unit < line.Quantity; unit++ {
+				if reason := line.Item.LockReason(user, stats, now); reason != "" {
+					lineErr.Code = reason
+					return lineErr
+				}
+				stats.Purchased[line.ItemID]++
+			}
+			total += line.Item.Price * line.Quantity
+		}
+
+		if user.Balance < total {
+			return fmt.Errorf("insufficient balance")
+		}
+		order = Order{
+			OrderID:           uuid.New().String(),
+			UserID:            userID,
+			Total:             total,
+			Email:             email,
+			FulfillmentMethod: fulfillment.Method,
+			PickupLocationID:  fulfillment.PickupLocationID,
+			ShippingAddress:   fulfillment.ShippingAddress,
+		}
+		if err := tx.Create(&order).Error; err != nil {
+			return err
+		}
+		if err := changeBalance(tx, userID, -total, balanceChange{Reason: BalancePurchase, OrderID: order.OrderID}); err != nil {
+			return err
+		}
+
+		for i, line := range lines {
+			for unit := 0; unit < line.Quantity; unit++ {
+				purchase := Purchase{
+					UserID:            userID,
+					ItemID:            line.ItemID,
+					VariantID:         variantRefs[i],
+					PurchaseID:        uuid.New().String(),
+					Status:            PurchasePending,
+					Email:             email,
+					FulfillmentMethod: fulfillment.Method,
+					PickupLocationID:  fulfillment.PickupLocationID,
+					ShippingAddress:   fulfillment.ShippingAddress,
+					OrderID:           &order.ID,
+					Price:             line.Item.Price,
+				}
+				err := changeStock(tx, line.ItemID, variantRefs[i], -1, stockChange{Reason: StockSale, PurchaseID: purchase.PurchaseID})
+				if err != nil {
+					if err.Error() == "item out of stock" {
+						return &CheckoutError{ItemID: line.ItemID, VariantID: line.VariantID, Code: CheckoutOutOfStock}
+					}
+					return err
+				}
+				if err := tx.Create(&purchase).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := enqueueOrderEmail(tx, order); err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&CartItem{}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetOrder(userID, order.OrderID)
+}
+
+// redeemableOrderLines returns the lines of an order that can be handed over
+// with the order QR code
+func redeemableOrderLines(purchases []Purchase) ([]Purchase, error) {
+	var lines []Purchase
+	delivered := 0
+	for _, purchase := range purchases {
+		if checkRedeemable(purchase) == nil {
+			lines = append(lines, purchase)
+		} else if purchase.Status == PurchaseDelivered {
+			delivered++
+		}
+	}
+	if len(lines) == 0 {
+		if delivered > 0 {
+			return nil, fmt.Errorf("purchase already redeemed")
+		}
+		return nil, fmt.Errorf("purchase not redeemable")
+	}
+	return lines, nil
+}
+
+// redeemOrder hands over all open pickup lines of an order, see RedeemPurchase
+func redeemOrder(claims *RedemptionClaims, adminID uint) (*RedeemResponse, error) {
+	now := time.Now()
+	response := &RedeemResponse{
+		Success:   true,
+		OrderID:   claims.OrderID,
+		UndoUntil: now.Add(redemptionUndoWindow()).Format(time.RFC3339),
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var order Order
+		if err := tx.Where("order_id = ? AND user_id = ?", claims.OrderID, claims.UserID).
+			Preload("Purchases", func(db *gorm.DB) *gorm.DB {
+				return db.Clauses(clause.Locking{Strength: "UPDATE"}).Order("id")
+			}).
+			Preload("Purchases.Item").
+			Preload("Purchases.Variant").
+			First(&order).Error; err != nil {
+			return err
+		}
+
+		lines, err := redeemableOrderLines(order.Purchases)
+		if err != nil {
+			return err
+		}
+		if err := consumeRedemptionNonce(tx, claims); err != nil {
+			return err
+		}
+
+		var user User
+		if err := tx.First(&user, order.UserID).Error; err != nil {
+			return err
+		}
+		response.User = userFullName(user)
+
+		var names []string
+		for i := range lines {
+			previousStatus := lines[i].Status
+			if err := applyPurchaseTransition(tx, &lines[i], PurchaseDelivered, ""); err != nil {
+				return err
+			}
+			entry, err := recordRedemption(tx, lines[i], previousStatus, order.OrderID, adminID, now)
+			if err != nil {
+				return err
+			}
+			item := RedeemedItemResponse{
+				PurchaseID:   lines[i].PurchaseID,
+				Item:         lines[i].Item.Name,
+				Variant:      lines[i].VariantLabel(),
+				RedemptionID: int(entry.ID),
+			}
+			response.Items = append(response.Items, item)
+			name := item.Item
+			if item.Variant != "" {
+				name += " (" + item.Variant + ")"
+			}
+			names = append(names, name)
+		}
+		response.Item = strings.Join(names, ", ")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// GetOrders lists the user's orders, newest first
+func GetOrders(userID uint) ([]OrderResponse, error) {
+	var orders []Order
+	if err := orderQuery().Where("user_id = ?", userID).Order("created_at DESC").Find(&orders).Error; err != nil {
+		return nil, err
+	}
+
+	responses := make([]OrderResponse, 0, len(orders))
+	for _, order := range orders {
+		responses = append(responses, orderToResponse(order))
+	}
+	return responses, nil
+}
+
+// GetOrder returns one of the user's orders
+func GetOrder(userID uint, orderID string) (*OrderResponse, error) {
+	var order Order
+	if err := orderQuery().Where("order_id = ? AND user_id = ?", orderID, userID).First(&order).Error; err != nil {
+		return nil, err
+	}
+	response := orderToResponse(order)
+	return &response, nil
+}
+
+func orderQuery() *gorm.DB {
+	return DB.Model(&Order{}).
+		Preload("Purchases", func(db *gorm.DB) *gorm.DB {
+			return db.Order("id")
+		}).
+		Preload("Purchases.Item").
+		Preload("Purchases.Variant").
+		Preload("PickupLocation")
+}
+
+func orderToResponse(order Order) OrderResponse {
+	response := OrderResponse{
+		OrderID:         order.OrderID,
+		Total:           order.Total,
+		Fulfillment:     order.FulfillmentMethod,
+		ShippingAddress: order.ShippingAddress,
+		CreatedAt:       order.CreatedAt.Format(time.RFC3339),
+		Lines:           make([]OrderLineResponse, 0, len(order.Purchases)),
+	}
+	if order.PickupLocation != nil {
+		location := pickupLocationToResponse(*order.PickupLocation)
+		response.PickupLocation = &location
+	}
+	for _, purchase := range order.Purchases {
+		response.Lines = append(response.Lines, OrderLineResponse{
+			PurchaseID:     purchase.PurchaseID,
+			ItemID:         int(purchase.ItemID),
+			ItemName:       purchase.Item.Name,
+			Variant:        purchase.VariantLabel(),
+			Price:          purchase.Price,
+			Status:         purchase.Status,
+			TrackingNumber: purchase.TrackingNumber,
+		})
+		if checkRedeemable(purchase) == nil {
+			response.Redeemable = true
+		}
+	}
+	return response
+}
@@ -44,14 +44,71 @@ func autoMigrate() error {
 		&UserTask{},
 		&ShopItem{},
 		&Purchase{},
+		&Friendship{},
+		&Referral{},
+		&TeamCompetition{},
+		&Team{},
+		&TeamMember{},
+		&ShopItemVariant{},
+		&UsedRedemptionToken{},
+		&PickupLocation{},
+		&Order{},
+		&CartItem{},
+		&EmailOutbox{},
+		&NotificationPreference{},
+		&Notification{},
+		&StockMovement{},
+		&AdminNotification{},
+		&WaitlistEntry{},
+		&PromoCode{},
+		&RedemptionLog{},
+		&BalanceTransaction{},
+		&TaskAttempt{},
+		&AdminAuditLog{},
+		&UserFlag{},
+		&LoginEvent{},
+		&RateLimitBucket{},
+		&Candidate{},
+		&CandidateNote{},
+		&ResumeFile{},
 	); err != nil {
 		return err
 	}
 
+	// Users created before referral codes existed get one now
+	var usersWithoutCode []User
+	DB.Where("referral_code IS NULL OR referral_code = ''").Find(&usersWithoutCode)
+	for _, user := range usersWithoutCode {
+		DB.Model(&User{}).Where("id = ?", user.ID).Update("referral_code", generateReferralCode())
+	}
+
 	if !DB.Migrator().HasIndex(&UserTask{}, "idx_user_task") {
 		DB.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_user_task ON user_tasks(user_id, task_id)")
 	}
 
+	if !DB.Migrator().HasIndex(&User{}, "idx_users_nickname_lower") {
+		DB.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_nickname_lower ON users(LOWER(nickname))")
+	}
+
+	// Team names are unique per competition, ignoring case
+	if err := DB.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_teams_competition_name ON teams(competition_id, LOWER(name))").Error; err != nil {
+		log.Printf("Failed to create team name index (duplicate team names?): %v", err)
+	}
+
+	// Indexes for the date_trunc time series of the admin analytics
+	DB.Exec("CREATE INDEX IF NOT EXISTS idx_users_created_at ON users(created_at)")
+	DB.Exec("CREATE INDEX IF NOT EXISTS idx_user_tasks_completed_at ON user_tasks(completed_at) WHERE status = 'completed'")
+	DB.Exec("CREATE INDEX IF NOT EXISTS idx_purchases_purchased_at ON purchases(purchased_at)")
+
+	// Candidate tag filter
+	DB.Exec("CREATE INDEX IF NOT EXISTS idx_candidates_tags ON candidates USING GIN (tags)")
+
+	// "redeemed" was the only final purchase status before the fulfillment workflow
+	DB.Exec("UPDATE purchases SET status = ? WHERE status = 'redeemed'", PurchaseDelivered)
+
+	// Purchases made before promo codes paid the item's current price
+	DB.Exec("UPDATE purchases SET price = shop_items.price FROM shop_items WHERE purchases.item_id = shop_items.id AND purchases.price IS NULL")
+
 	return nil
 }
 
@@ -75,9 +132,10 @@ func seedData() error {
 			CorrectAnswer: "",
 			Questions: []QuestionItem{
 				{
-					Type:    "text",
-					Text:    "Which university do you attend?",
-					Options: []string{},
+					Type:         "text",
+					Text:         "Which university do you attend?",
+					Options:      []string{},
+					ProfileField: "university",
 				},
 				{
 					Type:    "choice",
@@ -85,9 +143,10 @@ func seedData() error {
 					Options: []string{"Computer Science", "Engineering", "Mathematics", "Physics", "Other"},
 				},
 				{
-					Type:    "choice",
-					Text:    "Which internship program are you interested in?",
-					Options: []string{"Frontend Development", "Backend Development", "Data Science", "DevOps", "QA"},
+					Type:         "choice",
+					Text:         "Which internship program are you interested in?",
+					Options:      []string{"Frontend Development", "Backend Development", "Data Science", "DevOps", "QA"},
+					ProfileField: "track",
 				},
 			},
 			Reward:   50,
@@ -148,9 +207,10 @@ func seedData() error {
 			CorrectAnswer: "",
 			Questions: []QuestionItem{
 				{
-					Type:    "text",
-					Text:    "В каком университете вы учитесь?",
-					Options: []string{},
+					Type:         "text",
+					Text:         "В каком университете вы учитесь?",
+					Options:      []string{},
+					ProfileField: "university",
 				},
 				{
 					Type:    "choice",
@@ -158,9 +218,10 @@ func seedData() error {
 					Options: []string{"Информатика", "Инженерия", "Математика", "Физика", "Другое"},
 				},
 				{
-					Type:    "choice",
-					Text:    "Какая стажировка вас интересует?",
-					Options: []string{"Frontend", "Backend", "Data Science", "DevOps", "QA"},
+					Type:         "choice",
+					Text:         "Какая стажировка вас интересует?",
+					Options:      []string{"Frontend", "Backend", "Data Science", "DevOps", "QA"},
+					ProfileField: "track",
 				},
 			},
 			Reward:   50,
@@ -384,7 +445,6 @@ func seedData() error {
 	}
 	log.Println("Seeded/Updated tasks")
 
-	DB.Exec("DELETE FROM shop_items")
 	items := []ShopItem{
 		{
 			Name:        "Футболка X5Tech",
@@ -392,6 +452,12 @@ func seedData() error {
 			Price:       1500,
 			Image:       "👕",
 			Stock:       50,
+			Variants: []ShopItemVariant{
+				{SKU: "X5-TSHIRT-S", Size: "S", Stock: 10},
+				{SKU: "X5-TSHIRT-M", Size: "M", Stock: 15},
+				{SKU: "X5-TSHIRT-L", Size: "L", Stock: 15},
+				{SKU: "X5-TSHIRT-XL", Size: "XL", Stock: 10},
+			},
 		},
 		{
 			Name:        "Худи X5Tech",
@@ -399,6 +465,12 @@ func seedData() error {
 			Price:       2500,
 			Image:       "🧥",
 			Stock:       30,
+			Variants: []ShopItemVariant{
+				{SKU: "X5-HOODIE-S", Size: "S", Stock: 6},
+				{SKU: "X5-HOODIE-M", Size: "M", Stock: 9},
+				{SKU: "X5-HOODIE-L", Size: "L", Stock: 9},
+				{SKU: "X5-HOODIE-XL", Size: "XL", Stock: 6},
+			},
 		},
 		{
 			Name:        "Кепка X5Tech",
@@ -429,10 +501,18 @@ func seedData() error {
 			Stock:       25,
 		},
 	}
-	if err := DB.Create(&items).Error; err != nil {
+	// Shop items are only seeded into an empty table: admins rename, restock
+	// and archive them, and a restart must not bring the originals back
+	var itemCount int64
+	if err := DB.Model(&ShopItem{}).Count(&itemCount).Error; err != nil {
 		return err
 	}
-	log.Println("Seeded shop items (merch only)")
+	if itemCount == 0 {
+		if err := DB.Create(&items).Error; err != nil {
+			return err
+		}
+		log.Println("Seeded shop items (merch only)")
+	}
 
 	// Seed admin user
 	var adminCount int64
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Purchase emails are written to the email_outbox table in the same
+// transaction as the purchase change and sent later by a background worker,
+// so a mail failure never rolls back a purchase. Failed sends are retried
+// with exponential backoff.
+
+// Email kinds
+const (
+	EmailPurchaseConfirmation = "purchase_confirmation"
+	EmailPurchaseDelivered    = "purchase_delivered"
+	EmailPurchaseCancelled    = "purchase_cancelled"
+	EmailOrderConfirmation    = "order_confirmation"
+)
+
+const (
+	emailBatchSize  = 20
+	emailClaimLease = 10 * time.Minute // how long claimed rows are hidden from other workers
+	baseRetryDelay  = time.Minute
+	maxRetryDelay   = 6 * time.Hour
+)
+
+type emailTemplate struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// emailTemplates holds the ru/en templates per kind. Text and subject use
+// text/template, HTML uses html/template so user data is escaped.
+var emailTemplates = map[string]map[string]emailTemplate{
+	EmailPurchaseConfirmation: {
+		"en": {
+			Subject: "Your order: {{.ItemName}}",
+			Text: `Hi {{.Name}}!
+
+Thank you for your purchase: {{.ItemName}}{{if .Variant}} ({{.Variant}}){{end}} for {{.Price}} points.
+Order number: {{.PurchaseID}}
+{{if .PickupLocation}}
+Pickup point: {{.PickupLocation.Name}}, {{.PickupLocation.Address}}
+Opening hours: {{.PickupLocation.OpeningHours}}
+{{end}}{{if .ShippingAddress}}
+We'll ship it to: {{.ShippingAddress}}
+{{end}}{{if .Redeemable}}
+To pick up your item, show the QR code in the app{{if .QRLink}}: {{.QRLink}}{{end}}
+{{end}}
+X5 Tech`,
+			HTML: `<p>Hi {{.Name}}!</p>
+<p>Thank you for your purchase: <b>{{.ItemName}}</b>{{if .Variant}} ({{.Variant}}){{end}} for {{.Price}} points.<br>Order number: {{.PurchaseID}}</p>
+{{if .PickupLocation}}<p>Pickup point: {{.PickupLocation.Name}}, {{.PickupLocation.Address}}<br>Opening hours: {{.PickupLocation.OpeningHours}}</p>{{end}}
+{{if .ShippingAddress}}<p>We'll ship it to: {{.ShippingAddress}}</p>{{end}}
+{{if .Redeemable}}<p>To pick up your item, show the QR code in {{if .QRLink}}<a href="{{.QRLink}}">the app</a>{{else}}the app{{end}}.</p>{{end}}
+<p>X5 Tech</p>`,
+		},
+		"ru": {
+			Subject: "Ваш заказ: {{.ItemName}}",
+			Text: `Привет, {{.Name}}!
+
+Спасибо за покупку: {{.ItemName}}{{if .Variant}} ({{.Variant}}){{end}} за {{.Price}} баллов.
+Номер заказа: {{.PurchaseID}}
+{{if .PickupLocation}}
+Пункт выдачи: {{.PickupLocation.Name}}, {{.PickupLocation.Address}}
+Часы работы: {{.PickupLocation.OpeningHours}}
+{{end}}{{if .ShippingAddress}}
+Мы отправим заказ по адресу: {{.ShippingAddress}}
+{{end}}{{if .Redeemable}}
+Чтобы получить товар, покажите QR-код в приложении{{if .QRLink}}: {{.QRLink}}{{end}}
+{{end}}
+X5 Tech`,
+			HTML: `<p>Привет, {{.Name}}!</p>
+<p>Спасибо за покупку: <b>{{.ItemName}}</b>{{if .Variant}} ({{.Variant}}){{end}} за {{.Price}} баллов.<br>Номер заказа: {{.PurchaseID}}</p>
+{{if .PickupLocation}}<p>Пункт выдачи: {{.PickupLocation.Name}}, {{.PickupLocation.Address}}<br>Часы работы: {{.PickupLocation.OpeningHours}}</p>{{end}}
+{{if .ShippingAddress}}<p>Мы отправим заказ по адресу: {{.ShippingAddress}}</p>{{end}}
+{{if .Redeemable}}<p>Чтобы получить товар, покажите QR-код в {{if .QRLink}}<a href="{{.QRLink}}">приложении</a>{{else}}приложении{{end}}.</p>{{end}}
+<p>X5 Tech</p>`,
+		},
+	},
+	EmailPurchaseDelivered: {
+		"en": {
+			Subject: "Receipt: {{.ItemName}}",
+			Text: `Hi {{.Name}}!
+
+You have received {{.ItemName}}{{if .Variant}} ({{.Variant}}){{end}}.
+Order number: {{.PurchaseID}}
+Received at: {{.EventTime}}
+
+Enjoy!
+X5 Tech`,
+			HTML: `<p>Hi {{.Name}}!</p>
+<p>You have received <b>{{.ItemName}}</b>{{if .Variant}} ({{.Variant}}){{end}}.<br>Order number: {{.PurchaseID}}<br>Received at: {{.EventTime}}</p>
+<p>Enjoy!<br>X5 Tech</p>`,
+		},
+		"ru": {
+			Subject: "Товар получен: {{.ItemName}}",
+			Text: `Привет, {{.Name}}!
+
+Вы получили {{.ItemName}}{{if .Variant}} ({{.Variant}}){{end}}.
+Номер заказа: {{.PurchaseID}}
+Дата получения: {{.EventTime}}
+
+X5 Tech`,
+			HTML: `<p>Привет, {{.Name}}!</p>
+<p>Вы получили <b>{{.ItemName}}</b>{{if .Variant}} ({{.Variant}}){{end}}.<br>Номер заказа: {{.PurchaseID}}<br>Дата получения: {{.EventTime}}</p>
+<p>X5 Tech</p>`,
+		},
+	},
+	EmailPurchaseCancelled: {
+		"en": {
+			Subject: "Order cancelled: {{.ItemName}}",
+			Text: `Hi {{.Name}}!
+
+Your order {{.PurchaseID}} ({{.ItemName}}{{if .Variant}}, {{.Variant}}{{end}}) has been cancelled.
+{{.Price}} points have been returned to your balance.
+
+X5 Tech`,
+			HTML: `<p>Hi {{.Name}}!</p>
+<p>Your order {{.PurchaseID}} (<b>{{.ItemName}}</b>{{if .Variant}}, {{.Variant}}{{end}}) has been cancelled.<br>{{.Price}} points have been returned to your balance.</p>
+<p>X5 Tech</p>`,
+		},
+		"ru": {
+			Subject: "Заказ отменён: {{.ItemName}}",
+			Text: `Привет, {{.Name}}!
+
+Ваш заказ {{.PurchaseID}} ({{.ItemName}}{{if .Variant}}, {{.Variant}}{{end}}) отменён.
+{{.Price}} баллов возвращены на ваш баланс.
+
+X5 Tech`,
+			HTML: `<p>Привет, {{.Name}}!</p>
+<p>Ваш заказ {{.PurchaseID}} (<b>{{.ItemName}}</b>{{if .Variant}}, {{.Variant}}{{end}}) отменён.<br>{{.Price}} баллов возвращены на ваш баланс.</p>
+<p>X5 Tech</p>`,
+		},
+	},
+	EmailOrderConfirmation: {
+		"en": {
+			Subject: "Your order of {{len .Lines}} item(s)",
+			Text: `Hi {{.Name}}!
+
+Thank you for your order:
+{{range .Lines}}- {{.ItemName}}{{if .Variant}} ({{.Variant}}){{end}} x{{.Quantity}}: {{.Amount}} points
+{{end}}Total: {{.Total}} points
+Order number: {{.OrderID}}
+{{if .PickupLocation}}
+Pickup point: {{.PickupLocation.Name}}, {{.PickupLocation.Address}}
+Opening hours: {{.PickupLocation.OpeningHours}}
+{{end}}{{if .ShippingAddress}}
+We'll ship it to: {{.ShippingAddress}}
+{{end}}{{if .Redeemable}}
+To pick up the whole order, show the QR code in the app{{if .QRLink}}: {{.QRLink}}{{end}}
+{{end}}
+X5 Tech`,
+			HTML: `<p>Hi {{.Name}}!</p>
+<p>Thank you for your order:</p>
+<ul>{{range .Lines}}<li><b>{{.ItemName}}</b>{{if .Variant}} ({{.Variant}}){{end}} &times;{{.Quantity}}: {{.Amount}} points</li>{{end}}</ul>
+<p>Total: <b>{{.Total}}</b> points<br>Order number: {{.OrderID}}</p>
+{{if .PickupLocation}}<p>Pickup point: {{.PickupLocation.Name}}, {{.PickupLocation.Address}}<br>Opening hours: {{.PickupLocation.OpeningHours}}</p>{{end}}
+{{if .ShippingAddress}}<p>We'll ship it to: {{.ShippingAddress}}</p>{{end}}
+{{if .Redeemable}}<p>To pick up the whole order, show the QR code in {{if .QRLink}}<a href="{{.QRLink}}">the app</a>{{else}}the app{{end}}.</p>{{end}}
+<p>X5 Tech</p>`,
+		},
+		"ru": {
+			Subject: "Ваш заказ: {{len .Lines}} поз.",
+			Text: `Привет, {{.Name}}!
+
+Спасибо за заказ:
+{{range .Lines}}- {{.ItemName}}{{if .Variant}} ({{.Variant}}){{end}} x{{.Quantity}}: {{.Amount}} баллов
+{{end}}Итого: {{.Total}} баллов
+Номер заказа: {{.OrderID}}
+{{if .PickupLocation}}
+Пункт выдачи: {{.PickupLocation.Name}}, {{.PickupLocation.Address}}
+Часы работы: {{.PickupLocation.OpeningHours}}
+{{end}}{{if .ShippingAddress}}
+Мы отправим заказ по адресу: {{.ShippingAddress}}
+{{end}}{{if .Redeemable}}
+Чтобы получить весь заказ, покажите QR-код в приложении{{if .QRLink}}: {{.QRLink}}{{end}}
+{{end}}
+X5 Tech`,
+			HTML: `<p>Привет, {{.Name}}!</p>
+<p>Спасибо за заказ:</p>
+<ul>{{range .Lines}}<li><b>{{.ItemName}}</b>{{if .Variant}} ({{.Variant}}){{end}} &times;{{.Quantity}}: {{.Amount}} баллов</li>{{end}}</ul>
+<p>Итого: <b>{{.Total}}</b> баллов<br>Номер заказа: {{.OrderID}}</p>
+{{if .PickupLocation}}<p>Пункт выдачи: {{.PickupLocation.Name}}, {{.PickupLocation.Address}}<br>Часы работы: {{.PickupLocation.OpeningHours}}</p>{{end}}
+{{if .ShippingAddress}}<p>Мы отправим заказ по адресу: {{.ShippingAddress}}</p>{{end}}
+{{if .Redeemable}}<p>Чтобы получить весь заказ, покажите QR-код в {{if .QRLink}}<a href="{{.QRLink}}">приложении</a>{{else}}приложении{{end}}.</p>{{end}}
+<p>X5 Tech</p>`,
+		},
+	},
+}
+
+// purchaseEmailData is the data available to the email templates
+type purchaseEmailData struct {
+	Name            string
+	ItemName        string
+	Variant         string
+	Price           int
+	PurchaseID      string
+	PickupLocation  *PickupLocation
+	ShippingAddress string
+	EventTime       string
+	Redeemable      bool
+	QRLink          string // in-app page with the refreshing pickup QR, see appQRLink
+	// Order emails
+	OrderID string
+	Lines   []orderEmailLine
+	Total   int
+}
+
+// orderEmailLine is one item/variant of an order with its quantity
+type orderEmailLine struct {
+	ItemName string
+	Variant  string
+	Quantity int
+	Amount   int
+}
+
+// appQRLink links to the shop page of the app at APP_URL, which shows the
+// pickup QR of a purchase or order. Emails never carry a redemption token
+// themselves: the in-app code is short-lived and refreshed while on screen.
+func appQRLink(param, id string) string {
+	appURL := strings.TrimRight(os.Getenv("APP_URL"), "/")
+	if appURL == "" {
+		return ""
+	}
+	return appURL + "/shop?" + url.Values{param: {id}}.Encode()
+}
+
+// enqueuePurchaseEmail adds a purchase email to the outbox inside tx. Purchases
+// without an email address are skipped.
+func enqueuePurchaseEmail(tx *gorm.DB, kind string, purchase Purchase) error {
+	if purchase.Email == "" {
+		return nil
+	}
+	return tx.Create(&EmailOutbox{
+		Kind:          kind,
+		ToAddress:     purchase.Email,
+		PurchaseID:    purchase.PurchaseID,
+		Status:        "pending",
+		NextAttemptAt: time.Now(),
+	}).Error
+}
+
+// enqueueOrderEmail adds the confirmation of a cart checkout to the outbox
+func enqueueOrderEmail(tx *gorm.DB, order Order) error {
+	if order.Email == "" {
+		return nil
+	}
+	return tx.Create(&EmailOutbox{
+		Kind:          EmailOrderConfirmation,
+		ToAddress:     order.Email,
+		OrderID:       order.OrderID,
+		Status:        "pending",
+		NextAttemptAt: time.Now(),
+	}).Error
+}
+
+// StartEmailOutboxWorker sends due outbox emails every MAIL_POLL_INTERVAL seconds
+func StartEmailOutboxWorker(mailer Mailer) {
+	interval := time.Duration(getEnvInt("MAIL_POLL_INTERVAL", 10)) * time.Second
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := processEmailOutbox(mailer); err != nil {
+				log.Printf("email outbox: %v", err)
+			}
+		}
+	}()
+}
+
+// processEmailOutbox sends one batch of due emails. The batch is claimed in a
+// short transaction and sent outside it, so a failed update can't roll back
+// (and later resend) emails that already went out.
+func processEmailOutbox(mailer Mailer) error {
+	maxAttempts := getEnvInt("MAIL_MAX_ATTEMPTS", 8)
+
+	batch, err := claimEmailBatch(time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, email := range batch {
+		updates := map[string]interface{}{}
+
+		msg, err := renderOutboxEmail(email)
+		if err == nil {
+			err = mailer.Send(*msg)
+		}
+
+		if err == nil {
+			now := time.Now()
+			updates["status"] = "sent"
+			updates["sent_at"] = &now
+			updates["last_error"] = ""
+		} else {
+			updates["last_error"] = err.Error()
+			if email.Attempts >= maxAttempts {
+				updates["status"] = "failed"
+			} else {
+				updates["next_attempt_at"] = time.Now().Add(retryDelay(email.Attempts))
+			}
+		}
+
+		if err := DB.Model(&EmailOutbox{}).Where("id = ?", email.ID).Updates(updates).Error; err != nil {
+			log.Printf("email outbox: email %d: %v", email.ID, err)
+		}
+	}
+	return nil
+}
+
+// claimEmailBatch takes due emails for this worker: the attempt is counted and
+// next_attempt_at moves past emailClaimLease, so other workers skip the rows
+// while they are sent. Rows of a worker that dies mid-batch become due again
+// once the lease is over. Rows are locked with SKIP LOCKED so several backend
+// instances can run the worker.
+func claimEmailBatch(now time.Time) ([]EmailOutbox, error) {
+	var batch []EmailOutbox
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", "pending", now).
+			Order("id").Limit(emailBatchSize).Find(&batch).Error; err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, 0, len(batch))
+		for i := range batch {
+			ids = append(ids, batch[i].ID)
+			batch[i].Attempts++
+		}
+		return tx.Model(&EmailOutbox{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+			"attempts":        gorm.Expr("attempts + 1"),
+			"next_attempt_at": now.Add(emailClaimLease),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// retryDelay doubles the delay after every failed attempt
+func retryDelay(attempts int) time.Duration {
+	delay := baseRetryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// renderOutboxEmail renders an outbox row with the current purchase data
+func renderOutboxEmail(email EmailOutbox) (*EmailMessage, error) {
+	if email.OrderID != "" {
+		return renderOrderEmail(email)
+	}
+
+	var purchase Purchase
+	if err := DB.Where("purchase_id = ?", email.PurchaseID).
+		Preload("User").
+		Preload("Item").
+		Preload("Variant").
+		Preload("PickupLocation").
+		First(&purchase).Error; err != nil {
+		return nil, err
+	}
+
+	language := normalizeLanguage(purchase.User.Language)
+	tmpl, ok := emailTemplates[email.Kind][language]
+	if !ok {
+		return nil, fmt.Errorf("unknown email kind %q", email.Kind)
+	}
+
+	data := purchaseEmailData{
+		Name:            purchase.User.FirstName,
+		ItemName:        purchase.Item.Name,
+		Variant:         purchase.VariantLabel(),
+		Price:           purchase.Price,
+		PurchaseID:      purchase.PurchaseID,
+		PickupLocation:  purchase.PickupLocation,
+		ShippingAddress: purchase.ShippingAddress,
+	}
+	if data.Name == "" {
+		data.Name = purchase.User.PublicName()
+	}
+	if purchase.StatusUpdatedAt != nil {
+		data.EventTime = purchase.StatusUpdatedAt.Format("02.01.2006 15:04")
+	}
+
+	msg := &EmailMessage{To: email.ToAddress}
+
+	// Pickup instructions are only included while the purchase can still be redeemed
+	if email.Kind == EmailPurchaseConfirmation && checkRedeemable(purchase) == nil {
+		data.Redeemable = true
+		data.QRLink = appQRLink("purchase", purchase.PurchaseID)
+	}
+
+	return renderEmailTemplate(msg, tmpl, data)
+}
+
+// renderOrderEmail renders the confirmation of a cart checkout. Units of the
+// same item and variant are listed as one line.
+func renderOrderEmail(email EmailOutbox) (*EmailMessage, error) {
+	var order Order
+	if err := DB.Where("order_id = ?", email.OrderID).
+		Preload("Purchases", func(db *gorm.DB) *gorm.DB {
+			return db.Order("id")
+		}).
+		Preload("Purchases.Item").
+		Preload("Purchases.Variant").
+		Preload("PickupLocation").
+		First(&order).Error; err != nil {
+		return nil, err
+	}
+	var user User
+	if err := DB.First(&user, order.UserID).Error; err != nil {
+		return nil, err
+	}
+
+	tmpl, ok := emailTemplates[email.Kind][normalizeLanguage(user.Language)]
+	if !ok {
+		return nil, fmt.Errorf("unknown email kind %q", email.Kind)
+	}
+
+	data := purchaseEmailData{
+		Name:            user.FirstName,
+		OrderID:         order.OrderID,
+		Total:           order.Total,
+		PickupLocation:  order.PickupLocation,
+		ShippingAddress: order.ShippingAddress,
+	}
+	if data.Name == "" {
+		data.Name = user.PublicName()
+	}
+	index := map[string]int{}
+	for _, purchase := range order.Purchases {
+		key := fmt.Sprintf("%d:%s", purchase.ItemID, purchase.VariantLabel())
+		i, ok := index[key]
+		if !ok {
+			i = len(data.Lines)
+			index[key] = i
+			data.Lines = append(data.Lines, orderEmailLine{ItemName: purchase.Item.Name, Variant: purchase.VariantLabel()})
+		}
+		data.Lines[i].Quantity++
+		data.Lines[i].Amount += purchase.Price
+	}
+
+	msg := &EmailMessage{To: email.ToAddress}
+	if _, err := redeemableOrderLines(order.Purchases); err == nil {
+		data.Redeemable = true
+		data.QRLink = appQRLink("order", order.OrderID)
+	}
+
+	return renderEmailTemplate(msg, tmpl, data)
+}
+
+func renderEmailTemplate(msg *EmailMessage, tmpl emailTemplate, data purchaseEmailData) (*EmailMessage, error) {
+	var err error
+	if msg.Subject, err = renderTextTemplate(tmpl.Subject, data); err != nil {
+		return nil, err
+	}
+	if msg.Text, err = renderTextTemplate(tmpl.Text, data); err != nil {
+		return nil, err
+	}
+	if msg.HTML, err = renderHTMLTemplate(tmpl.HTML, data); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func renderTextTemplate(source string, data interface{}) (string, error) {
+	tmpl, err := texttemplate.New("email").Parse(source)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func renderHTMLTemplate(source string, data interface{}) (string, error) {
+	tmpl, err := htmltemplate.New("email").Parse(source)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// normalizeLanguage maps a user language to a supported template language
+func normalizeLanguage(language string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if strings.HasPrefix(language, "ru") {
+		return "ru"
+	}
+	if strings.HasPrefix(language, "en") {
+		return "en"
+	}
+	return "ru"
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Purchase statuses. A purchase starts as pending, is reserved by staff once
+// the item is set aside, and then either waits at a pickup point or is
+// shipped. Delivered and cancelled are final.
+const (
+	PurchasePending        = "pending"
+	PurchaseReserved       = "reserved"
+	PurchaseReadyForPickup = "ready_for_pickup"
+	PurchaseShipped        = "shipped"
+	PurchaseDelivered      = "delivered"
+	PurchaseCancelled      = "cancelled"
+)
+
+// Fulfillment methods
+const (
+	FulfillmentPickup   = "pickup"
+	FulfillmentDelivery = "delivery"
+)
+
+// purchaseTransitions lists the valid status edges per fulfillment method.
+// Pickup purchases may be handed over straight away (e.g. at the event booth
+// by scanning the QR code), so delivered is reachable from every open state.
+var purchaseTransitions = map[string]map[string][]string{
+	FulfillmentPickup: {
+		PurchasePending:        {PurchaseReserved, PurchaseDelivered, PurchaseCancelled},
+		PurchaseReserved:       {PurchaseReadyForPickup, PurchaseDelivered, PurchaseCancelled},
+		PurchaseReadyForPickup: {PurchaseDelivered, PurchaseCancelled},
+	},
+	FulfillmentDelivery: {
+		PurchasePending:  {PurchaseReserved, PurchaseCancelled},
+		PurchaseReserved: {PurchaseShipped, PurchaseCancelled},
+		PurchaseShipped:  {PurchaseDelivered},
+	},
+}
+
+const (
+	minShippingAddressLength = 10
+	maxShippingAddressLength = 500
+)
+
+func canTransitionPurchase(purchase Purchase, to string) bool {
+	method := purchase.FulfillmentMethod
+	if method == "" {
+		method = FulfillmentPickup
+	}
+	for _, next := range purchaseTransitions[method][purchase.Status] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRedeemable reports whether a purchase can be handed over by scanning its QR code
+func checkRedeemable(purchase Purchase) error {
+	if purchase.Status == PurchaseDelivered {
+		return fmt.Errorf("purchase already redeemed")
+	}
+	if !canTransitionPurchase(purchase, PurchaseDelivered) || purchase.FulfillmentMethod == FulfillmentDelivery {
+		return fmt.Errorf("purchase not redeemable")
+	}
+	return nil
+}
+
+// normalizePurchaseEmail validates the optional contact email of a purchase
+func normalizePurchaseEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", nil
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || len(email) > 255 {
+		return "", fmt.Errorf("invalid email")
+	}
+	return strings.ToLower(email), nil
+}
+
+type purchaseFulfillment struct {
+	Method           string
+	PickupLocationID *uint
+	ShippingAddress  string
+}
+
+// resolveFulfillment validates how a purchase will be handed over. Pickup
+// purchases without a pickup_location_id go to the first active location, so
+// clients that predate pickup locations keep working.
+func resolveFulfillment(tx *gorm.DB, req FulfillmentRequest) (purchaseFulfillment, error) {
+	result := purchaseFulfillment{Method: req.Fulfillment}
+	if result.Method == "" {
+		result.Method = FulfillmentPickup
+	}
+
+	switch result.Method {
+	case FulfillmentPickup:
+		if req.PickupLocationID == 0 {
+			var location PickupLocation
+			err := tx.Where("active = ?", true).Order("id").Take(&location).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return result, nil
+			}
+			if err != nil {
+				return result, err
+			}
+			result.PickupLocationID = &location.ID
+			return result, nil
+		}
+		var location PickupLocation
+		if err := tx.Where("id = ? AND active = ?", req.PickupLocationID, true).First(&location).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return result, fmt.Errorf("pickup location not found")
+			}
+			return result, err
+		}
+		result.PickupLocationID = &location.ID
+	case FulfillmentDelivery:
+		address := strings.TrimSpace(req.ShippingAddress)
+		if len([]rune(address)) < minShippingAddressLength || len([]rune(address)) > maxShippingAddressLength {
+			return result, fmt.Errorf("shipping address required")
+		}
+		result.ShippingAddress = address
+	default:
+		return result, fmt.Errorf("invalid fulfillment method")
+	}
+	return result, nil
+}
+
+// applyPurchaseTransition moves a locked purchase to a new status and runs
+// the side effects of that status
+func applyPurchaseTransition(tx *gorm.DB, purchase *Purchase, to, trackingNumber string) error {
+	if !canTransitionPurchase(*purchase, to) {
+		return fmt.Errorf("invalid status transition")
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"status":            to,
+		"status_updated_at": &now,
+	}
+	switch to {
+	case PurchaseShipped:
+		updates["tracking_number"] = strings.TrimSpace(trackingNumber)
+	case PurchaseDelivered:
+		updates["redeemed_at"] = &now
+	case PurchaseCancelled:
+		if err := refundPurchase(tx, *purchase); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Model(purchase).Updates(updates).Error; err != nil {
+		return err
+	}
+	purchase.Status = to
+	if to == PurchaseShipped {
+		purchase.TrackingNumber = strings.TrimSpace(trackingNumber)
+	}
+
+	switch to {
+	case PurchaseReadyForPickup, PurchaseShipped:
+		return enqueuePurchaseNotification(tx, *purchase)
+	case PurchaseDelivered:
+		return enqueuePurchaseEmail(tx, EmailPurchaseDelivered, *purchase)
+	case PurchaseCancelled:
+		return enqueuePurchaseEmail(tx, EmailPurchaseCancelled, *purchase)
+	}
+	return nil
+}
+
+// refundPurchase returns the price paid to the buyer and the unit to stock.
+// The promo code use, if any, is given back because cancelled purchases
+// don't count towards its limits.
+func refundPurchase(tx *gorm.DB, purchase Purchase) error {
+	if err := changeBalance(tx, purchase.UserID, purchase.Price, balanceChange{Reason: BalanceRefund, PurchaseID: purchase.PurchaseID}); err != nil {
+		return err
+	}
+
+	return changeStock(tx, purchase.ItemID, purchase.VariantID, 1, stockChange{Reason: StockRefund, PurchaseID: purchase.PurchaseID})
+}
+
+// UpdatePurchaseStatus moves a purchase along the fulfillment workflow (admin only)
+func UpdatePurchaseStatus(purchaseID, status, trackingNumber string) (*FulfillmentEntry, error) {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var purchase Purchase
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("purchase_id = ?", purchaseID).First(&purchase).Error; err != nil {
+			return err
+		}
+		return applyPurchaseTransition(tx, &purchase, status, trackingNumber)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var purchase Purchase
+	if err := fulfillmentQuery().Where("purchase_id = ?", purchaseID).First(&purchase).Error; err != nil {
+		return nil, err
+	}
+	entry := purchaseToFulfillmentEntry(purchase)
+	return &entry, nil
+}
+
+func fulfillmentQuery() *gorm.DB {
+	return DB.Model(&Purchase{}).
+		Preload("User").
+		Preload("Item").
+		Preload("Variant").
+		Preload("PickupLocation")
+}
+
+// FulfillmentFilter selects purchases for the admin fulfillment queue
+type FulfillmentFilter struct {
+	Status           string
+	Method           string
+	PickupLocationID uint
+}
+
+// GetFulfillmentQueue lists purchases oldest first (admin only). Without a
+// status filter, only open purchases are returned.
+func GetFulfillmentQueue(filter FulfillmentFilter) ([]FulfillmentEntry, error) {
+	query := fulfillmentQuery()
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	} else {
+		query = query.Where("status NOT IN ?", []string{PurchaseDelivered, PurchaseCancelled})
+	}
+	if filter.Method != "" {
+		query = query.Where("fulfillment_method = ?", filter.Method)
+	}
+	if filter.PickupLocationID > 0 {
+		query = query.Where("pickup_location_id = ?", filter.PickupLocationID)
+	}
+
+	var purchases []Purchase
+	if err := query.Order("purchased_at ASC").Find(&purchases).Error; err != nil {
+		return nil, err
+	}
+
+	entries := make([]FulfillmentEntry, 0, len(purchases))
+	for _, purchase := range purchases {
+		entries = append(entries, purchaseToFulfillmentEntry(purchase))
+	}
+	return entries, nil
+}
+
+func purchaseToFulfillmentEntry(purchase Purchase) FulfillmentEntry {
+	userName := purchase.User.FirstName
+	if purchase.User.LastName != "" {
+		userName += " " + purchase.User.LastName
+	}
+
+	entry := FulfillmentEntry{
+		PurchaseID:      purchase.PurchaseID,
+		Status:          purchase.Status,
+		Fulfillment:     purchase.FulfillmentMethod,
+		UserID:          int(purchase.UserID),
+		UserName:        userName,
+		Email:           purchase.Email,
+		ItemName:        purchase.Item.Name,
+		Variant:         purchase.VariantLabel(),
+		ShippingAddress: purchase.ShippingAddress,
+		TrackingNumber:  purchase.TrackingNumber,
+		PurchasedAt:     purchase.PurchasedAt.Format(time.RFC3339),
+		NextStatuses:    purchaseTransitions[purchase.FulfillmentMethod][purchase.Status],
+	}
+	if entry.NextStatuses == nil {
+		entry.NextStatuses = []string{}
+	}
+	if purchase.PickupLocation != nil {
+		location := pickupLocationToResponse(*purchase.PickupLocation)
+		entry.PickupLocation = &location
+	}
+	if purchase.StatusUpdatedAt != nil {
+		entry.StatusUpdatedAt = purchase.StatusUpdatedAt.Format(time.RFC3339)
+	}
+	return entry
+}
+
+func pickupLocationToResponse(location PickupLocation) PickupLocationResponse {
+	return PickupLocationResponse{
+		ID:           int(location.ID),
+		Name:         location.Name,
+		Address:      location.Address,
+		OpeningHours: location.OpeningHours,
+		Active:       location.Active,
+	}
+}
+
+// GetPickupLocations lists pickup locations; activeOnly is used for the shop
+func GetPickupLocations(activeOnly bool) ([]PickupLocationResponse, error) {
+	query := DB.Order("id")
+	if activeOnly {
+		query = query.Where("active = ?", true)
+	}
+
+	var locations []PickupLocation
+	if err := query.Find(&locations).Error; err != nil {
+		return nil, err
+	}
+
+	responses := make([]PickupLocationResponse, 0, len(locations))
+	for _, location := range locations {
+		responses = append(responses, pickupLocationToResponse(location))
+	}
+	return responses, nil
+}
+
+// CreatePickupLocation creates a pickup location (admin only)
+func CreatePickupLocation(req PickupLocationRequest) (*PickupLocationResponse, error) {
+	location := PickupLocation{
+		Name:         strings.TrimSpace(req.Name),
+		Address:      strings.TrimSpace(req.Address),
+		OpeningHours: strings.TrimSpace(req.OpeningHours),
+		Active:       true,
+	}
+	if location.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	if req.Active != nil {
+		location.Active = *req.Active
+	}
+	if err := DB.Create(&location).Error; err != nil {
+		return nil, err
+	}
+
+	response := pickupLocationToResponse(location)
+	return &response, nil
+}
+
+// UpdatePickupLocation updates a pickup location (admin only). Locations are
+// deactivated rather than deleted because purchases reference them.
+func UpdatePickupLocation(locationID uint, req PickupLocationRequest) (*PickupLocationResponse, error) {
+	var location PickupLocation
+	if err := DB.First(&location, locationID).Error; err != nil {
+		return nil, err
+	}
+
+	// Update fields if provided
+	if req.Name != "" {
+		location.Name = strings.TrimSpace(req.Name)
+	}
+	if req.Address != "" {
+		location.Address = strings.TrimSpace(req.Address)
+	}
+	if req.OpeningHours != "" {
+		location.OpeningHours = strings.TrimSpace(req.OpeningHours)
+	}
+	if req.Active != nil {
+		location.Active = *req.Active
+	}
+
+	if err := DB.Save(&location).Error; err != nil {
+		return nil, err
+	}
+
+	response := pickupLocationToResponse(location)
+	return &response, nil
+}
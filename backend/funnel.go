@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Recruiting pipeline analytics: where students drop off between
+// registration, the tasks (in position order) and their first purchase,
+// how registration cohorts keep completing tasks week after week, and how
+// long students take from one level to the next. Admin accounts are left
+// out. Tasks exist per language, so steps are keyed by task position.
+
+// CohortFilter restricts pipeline analytics to users registered in a date
+// range; nil bounds are open
+type CohortFilter struct {
+	RegisteredFrom *time.Time
+	RegisteredTo   *time.Time // exclusive
+}
+
+// maxRetentionWeeks caps the weeks after registration a retention report covers
+const maxRetentionWeeks = 52
+
+// NewCohortFilter parses registration dates (YYYY-MM-DD, inclusive, "" for
+// no bound)
+func NewCohortFilter(from, to string) (CohortFilter, error) {
+	var filter CohortFilter
+	if from != "" {
+		first, err := time.ParseInLocation("2006-01-02", from, time.Local)
+		if err != nil {
+			return filter, fmt.Errorf("invalid from")
+		}
+		filter.RegisteredFrom = &first
+	}
+	if to != "" {
+		last, err := time.ParseInLocation("2006-01-02", to, time.Local)
+		if err != nil {
+			return filter, fmt.Errorf("invalid to")
+		}
+		if filter.RegisteredFrom != nil && last.Before(*filter.RegisteredFrom) {
+			return filter, fmt.Errorf("to must not be before from")
+		}
+		end := last.AddDate(0, 0, 1)
+		filter.RegisteredTo = &end
+	}
+	return filter, nil
+}
+
+// sql returns a condition on users aliased as u and its arguments
+func (f CohortFilter) sql() (string, []interface{}) {
+	condition := "u.role = 'student'"
+	var args []interface{}
+	if f.RegisteredFrom != nil {
+		condition += " AND u.created_at >= ?"
+		args = append(args, *f.RegisteredFrom)
+	}
+	if f.RegisteredTo != nil {
+		condition += " AND u.created_at < ?"
+		args = append(args, *f.RegisteredTo)
+	}
+	return condition, args
+}
+
+// funnelStepLabels names each task position after its task in the default
+// language, falling back to any language
+func funnelStepLabels() (map[int]Task, []int, error) {
+	var tasks []Task
+	if err := DB.Select("id", "title", "type", "position", "language").Order("position, id").Find(&tasks).Error; err != nil {
+		return nil, nil, err
+	}
+	byPosition := make(map[int]Task)
+	var positions []int
+	for _, task := range tasks {
+		current, ok := byPosition[task.Position]
+		if !ok {
+			positions = append(positions, task.Position)
+		}
+		if !ok || (current.Language != "ru" && task.Language == "ru") {
+			byPosition[task.Position] = task
+		}
+	}
+	return byPosition, positions, nil
+}
+
+// GetFunnel counts the users reaching each pipeline step (admin only)
+func GetFunnel(filter CohortFilter) (*FunnelResponse, error) {
+	tasks, positions, err := funnelStepLabels()
+	if err != nil {
+		return nil, err
+	}
+	condition, args := filter.sql()
+
+	var registered int64
+	if err := DB.Raw("SELECT COUNT(*) FROM users u WHERE "+condition, args...).Scan(&registered).Error; err != nil {
+		return nil, err
+	}
+
+	var completions []struct {
+		Position int
+		Users    int64
+	}
+	if err := DB.Raw(`SELECT t.position, COUNT(DISTINCT ut.user_id) AS users
+		FROM user_tasks ut
+		JOIN tasks t ON t.id = ut.task_id
+		JOIN users u ON u.id = ut.user_id
+		WHERE ut.status = 'completed' AND `+condition+`
+		GROUP BY t.position`, args...).Scan(&completions).Error; err != nil {
+		return nil, err
+	}
+	completed := make(map[int]int64, len(completions))
+	for _, row := range completions {
+		completed[row.Position] = row.Users
+	}
+
+	var purchased int64
+	if err := DB.Raw(`SELECT COUNT(DISTINCT p.user_id)
+		FROM purchases p
+		JOIN users u ON u.id = p.user_id
+		WHERE p.status <> ? AND `+condition, append([]interface{}{PurchaseCancelled}, args...)...).Scan(&purchased).Error; err != nil {
+		return nil, err
+	}
+
+	steps := []FunnelStep{{Step: "registered", Label: "Registered", Users: registered}}
+	for _, position := range positions {
+		task := tasks[position]
+		pos := position
+		steps = append(steps, FunnelStep{
+			Step:     "task",
+			Label:    task.Title,
+			Position: &pos,
+			TaskType: task.Type,
+			Users:    completed[position],
+		})
+	}
+	steps = append(steps, FunnelStep{Step: "purchase", Label: "First purchase", Users: purchased})
+
+	for i := range steps {
+		if registered > 0 {
+			steps[i].FromStart = float64(steps[i].Users) / float64(registered)
+		}
+		if i > 0 && steps[i-1].Users > 0 {
+			steps[i].FromPrevious = float64(steps[i].Users) / float64(steps[i-1].Users)
+		}
+	}
+	return &FunnelResponse{Steps: steps}, nil
+}
+
+// GetCohortRetention groups users by registration week and reports the
+// share of each cohort completing at least one task in each following week
+// (week 0 being the first 7 days after registering). Weeks that have not
+// ended for every member of a cohort are left out (admin only).
+func GetCohortRetention(filter CohortFilter, weeks int) (*RetentionResponse, error) {
+	condition, args := filter.sql()
+
+	var cohorts []struct {
+		Cohort time.Time
+		Users  int64
+	}
+	if err := DB.Raw(`SELECT date_trunc('week', u.created_at) AS cohort, COUNT(*) AS users
+		FROM users u WHERE `+condition+`
+		GROUP BY 1 ORDER BY 1`, args...).Scan(&cohorts).Error; err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		Cohort time.Time
+		Week   int
+		Users  int64
+	}
+	if err := DB.Raw(`SELECT date_trunc('week', u.created_at) AS cohort,
+			FLOOR(EXTRACT(EPOCH FROM ut.completed_at - u.created_at) / 604800)::int AS week,
+			COUNT(DISTINCT ut.user_id) AS users
+		FROM user_tasks ut
+		JOIN users u ON u.id = ut.user_id
+		WHERE ut.status = 'completed' AND ut.completed_at >= u.created_at
+			AND ut.completed_at < u.created_at + ?::int * interval '1 week' AND `+condition+`
+		GROUP BY 1, 2`, append([]interface{}{weeks}, args...)...).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	retained := make(map[string]map[int]int64)
+	for _, row := range rows {
+		key := formatPeriod(row.Cohort)
+		if retained[key] == nil {
+			retained[key] = make(map[int]int64)
+		}
+		retained[key][row.Week] = row.Users
+	}
+
+	now := time.Now()
+	response := &RetentionResponse{Weeks: weeks, Cohorts: make([]RetentionCohort, 0, len(cohorts))}
+	for _, cohort := range cohorts {
+		key := formatPeriod(cohort.Cohort)
+		entry := RetentionCohort{Cohort: key, Users: cohort.Users, Retention: []RetentionWeek{}}
+		// The last member registered up to a week after the cohort start
+		lastRegistration := cohort.Cohort.AddDate(0, 0, 7)
+		for week := 0; week < weeks; week++ {
+			if lastRegistration.AddDate(0, 0, 7*(week+1)).After(now) {
+				break
+			}
+			users := retained[key][week]
+			entry.Retention = append(entry.Retention, RetentionWeek{
+				Week:  week,
+				Users: users,
+				Rate:  float64(users) / float64(cohort.Users),
+			})
+		}
+		response.Cohorts = append(response.Cohorts, entry)
+	}
+	return response, nil
+}
+
+// GetLevelTimes reports the median time users take from one step to the
+// next: from registration to the first task, then between consecutive task
+// positions (admin only)
+func GetLevelTimes(filter CohortFilter) (*LevelTimesResponse, error) {
+	tasks, _, err := funnelStepLabels()
+	if err != nil {
+		return nil, err
+	}
+	condition, args := filter.sql()
+
+	var rows []struct {
+		Position      int
+		PrevPosition  *int
+		Users         int64
+		MedianSeconds float64
+	}
+	if err := DB.Raw(`WITH done AS (
+			SELECT ut.user_id, t.position, MIN(ut.completed_at) AS completed_at, MIN(u.created_at) AS registered_at
+			FROM user_tasks ut
+			JOIN tasks t ON t.id = ut.task_id
+			JOIN users u ON u.id = ut.user_id
+			WHERE ut.status = 'completed' AND ut.completed_at IS NOT NULL AND `+condition+`
+			GROUP BY ut.user_id, t.position
+		), steps AS (
+			SELECT position, LAG(position) OVER (ORDER BY position) AS prev_position
+			FROM (SELECT DISTINCT position FROM tasks) AS positions
+		)
+		SELECT s.position, s.prev_position, COUNT(*) AS users,
+			percentile_cont(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM cur.completed_at - COALESCE(prev.completed_at, cur.registered_at))) AS median_seconds
+		FROM steps s
+		JOIN done cur ON cur.position = s.position
+		LEFT JOIN done prev ON prev.user_id = cur.user_id AND prev.position = s.prev_position
+		WHERE s.prev_position IS NULL OR prev.user_id IS NOT NULL
+		GROUP BY s.position, s.prev_position`, args...).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Position < rows[j].Position })
+
+	response := &LevelTimesResponse{Steps: make([]LevelTimeStep, 0, len(rows))}
+	for _, row := range rows {
+		step := LevelTimeStep{
+			ToPosition:    row.Position,
+			ToLabel:       tasks[row.Position].Title,
+			FromLabel:     "Registered",
+			Users:         row.Users,
+			MedianSeconds: int64(row.MedianSeconds),
+		}
+		if row.PrevPosition != nil {
+			from := *row.PrevPosition
+			step.FromPosition = &from
+			step.FromLabel = tasks[from].Title
+		}
+		response.Steps = append(response.Steps, step)
+	}
+	return response, nil
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"mime"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 func ping(c *gin.Context) {
@@ -33,11 +39,18 @@ func handleTelegramAuth(c *gin.Context) {
 		return
 	}
 
-	user, err := GetOrCreateUser(req.UserID, req.FirstName, req.LastName, req.Username, req.PhotoURL)
+	user, err := GetOrCreateUser(req.UserID, req.FirstName, req.LastName, req.Username, req.PhotoURL, req.ReferralCode)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
 	}
+	if user.Status == UserBanned {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account banned"})
+		return
+	}
+	if err := RecordLogin(user.ID, c.ClientIP(), c.GetHeader("X-Device-ID")); err != nil {
+		log.Printf("login checks: %v", err)
+	}
 
 	token, err := GenerateToken(int(user.ID), user.Username, user.Role)
 	if err != nil {
@@ -65,11 +78,18 @@ func handlePhoneAuth(c *gin.Context) {
 	}
 
 	// Get or create user
-	user, err := GetOrCreateUserByPhone(req.PhoneNumber, req.FirstName, req.LastName)
+	user, err := GetOrCreateUserByPhone(req.PhoneNumber, req.FirstName, req.LastName, req.ReferralCode)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create/get user"})
 		return
 	}
+	if user.Status == UserBanned {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account banned"})
+		return
+	}
+	if err := RecordLogin(user.ID, c.ClientIP(), c.GetHeader("X-Device-ID")); err != nil {
+		log.Printf("login checks: %v", err)
+	}
 
 	// Generate JWT token
 	token, err := GenerateToken(int(user.ID), user.Username, user.Role)
@@ -105,6 +125,17 @@ func handleGetUserMe(c *gin.Context) {
 	var completedTasksCount int64
 	DB.Model(&UserTask{}).Where("user_id = ? AND status = ?", user.ID, "completed").Count(&completedTasksCount)
 
+	var nickname string
+	if user.Nickname != nil {
+		nickname = *user.Nickname
+	}
+
+	var resume *ResumeFileResponse
+	if file, _, err := GetResume(user.ID); err == nil {
+		response := resumeFileToResponse(*file)
+		resume = &response
+	}
+
 	c.JSON(http.StatusOK, UserResponse{
 		ID:                  int(user.ID),
 		Username:            user.Username,
@@ -115,9 +146,90 @@ func handleGetUserMe(c *gin.Context) {
 		CurrentStreak:       user.CurrentStreak,
 		CompletedTasksCount: int(completedTasksCount),
 		Role:                user.Role,
+		University:          user.University,
+		Track:               user.Track,
+		Nickname:            nickname,
+		PublicName:          user.PublicName(),
+		HideFromLeaderboard: user.HideFromLeaderboard,
+		ReferralCode:        user.ReferralCode,
+		Language:            normalizeLanguage(user.Language),
+		Resume:              resume,
 	})
 }
 
+func handleUpdatePrivacy(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req UpdatePrivacyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if err := UpdatePrivacy(uint(userID), req.Nickname, req.HideFromLeaderboard); err != nil {
+		if err.Error() == "nickname already taken" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Nickname already taken"})
+			return
+		}
+		// Validation errors from ValidateNickname
+		if strings.HasPrefix(err.Error(), "nickname") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update privacy settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Privacy settings updated successfully"})
+}
+
+func handleGetNotificationSettings(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	settings, err := GetNotificationSettings(uint(userID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get notification settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+func handleUpdateNotificationSettings(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req NotificationSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	settings, err := UpdateNotificationSettings(uint(userID), req)
+	if err != nil {
+		switch err.Error() {
+		case "quiet hours need both start and end", "quiet hours must be between 0 and 23", "unknown timezone":
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notification settings"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
 func handleUpdateUserMe(c *gin.Context) {
 	userID, err := GetUserIDFromContext(c)
 	if err != nil {
@@ -131,7 +243,7 @@ func handleUpdateUserMe(c *gin.Context) {
 		return
 	}
 
-	if err := UpdateUser(uint(userID), req.ResumeLink, req.Stack); err != nil {
+	if err := UpdateUser(uint(userID), req); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
 		return
 	}
@@ -177,350 +289,2681 @@ func handleUploadAvatar(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"photo_url": photoURL})
 }
 
-// Metrics handler
-func handleGetUserMetrics(c *gin.Context) {
+func resumeErrorResponse(c *gin.Context, err error, fallback string) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Resume not found"})
+		return
+	}
+	switch err.Error() {
+	case "file is empty", "resume must be a PDF", "invalid PDF", "file rejected by virus scan":
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case "file is too large":
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	default:
+		log.Printf("resume: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
+
+func handleGetResume(c *gin.Context) {
 	userID, err := GetUserIDFromContext(c)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	metrics, err := GetUserMetrics(uint(userID))
+	resume, _, err := GetResume(uint(userID))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get metrics"})
+		resumeErrorResponse(c, err, "Failed to get resume")
 		return
 	}
-
-	c.JSON(http.StatusOK, metrics)
+	c.JSON(http.StatusOK, resumeFileToResponse(*resume))
 }
 
-// Task handlers
-func handleGetTasks(c *gin.Context) {
+// handleUploadResume stores a PDF resume, replacing the previous one
+func handleUploadResume(c *gin.Context) {
 	userID, err := GetUserIDFromContext(c)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	tasks, err := GetTasksWithStatus(uint(userID))
+	// Leave room for the multipart framing around the file
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxResumeSize+1<<20)
+	file, err := c.FormFile("resume")
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tasks"})
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file is too large"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
 		return
 	}
 
-	c.JSON(http.StatusOK, tasks)
+	resume, err := SaveResume(uint(userID), file)
+	if err != nil {
+		resumeErrorResponse(c, err, "Failed to save resume")
+		return
+	}
+	c.JSON(http.StatusOK, resume)
 }
 
-func handleGetTaskByID(c *gin.Context) {
+func handleDeleteResume(c *gin.Context) {
 	userID, err := GetUserIDFromContext(c)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	taskIDStr := c.Param("id")
-	taskID, err := strconv.Atoi(taskIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+	if err := DeleteResume(uint(userID)); err != nil {
+		resumeErrorResponse(c, err, "Failed to delete resume")
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{"message": "Resume deleted"})
+}
 
-	task, err := GetTaskByID(uint(taskID))
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+// handleAdminDownloadResume sends a student's resume as an attachment. The
+// headers keep browsers from rendering it inline on our origin.
+func handleAdminDownloadResume(c *gin.Context) {
+	userID, ok := parseAdminUserID(c)
+	if !ok {
 		return
 	}
 
-	// Check if user has access (task is available or completed)
-	var userTask UserTask
-	result := DB.Where("user_id = ? AND task_id = ?", userID, taskID).First(&userTask)
-
-	if result.Error != nil {
-		// Check if this is the first task or previous task is completed
-		var taskModel Task
-		if err := DB.First(&taskModel, taskID).Error; err == nil {
-			if taskModel.Position == 0 {
-				// First task is always available
-				c.JSON(http.StatusOK, task)
-				return
-			}
-			var prevTask Task
-			if err := DB.Where("position < ? AND language = ?", taskModel.Position, taskModel.Language).Order("position DESC").First(&prevTask).Error; err == nil {
-				var prevUserTask UserTask
-				if DB.Where("user_id = ? AND task_id = ? AND status = ?", userID, prevTask.ID, "completed").First(&prevUserTask).Error != nil {
-					c.JSON(http.StatusForbidden, gin.H{"error": "Task is locked"})
-					return
-				}
-			}
-		}
+	resume, path, err := GetResume(userID)
+	if err != nil {
+		resumeErrorResponse(c, err, "Failed to get resume")
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		resumeErrorResponse(c, err, "Failed to get resume")
+		return
 	}
+	defer file.Close()
 
-	c.JSON(http.StatusOK, task)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": resume.OriginalName}))
+	c.Header("Content-Type", "application/pdf")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "sandbox")
+	c.Header("Cache-Control", "private, no-store")
+	http.ServeContent(c.Writer, c.Request, "", resume.UploadedAt, file)
 }
 
-func handleSubmitTask(c *gin.Context) {
+// Metrics handler
+func handleGetUserMetrics(c *gin.Context) {
 	userID, err := GetUserIDFromContext(c)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	taskIDStr := c.Param("id")
-	taskID, err := strconv.Atoi(taskIDStr)
+	metrics, err := GetUserMetrics(uint(userID))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get metrics"})
 		return
 	}
 
-	var req SubmitTaskRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
-		return
-	}
+	c.JSON(http.StatusOK, metrics)
+}
 
-	// Get answer (either from answer field or answer_index)
-	answer := req.Answer
-	if answer == "" && req.AnswerIndex >= 0 {
-		// Get task options and use index
-		var task Task
-		if err := DB.First(&task, taskID).Error; err == nil && req.AnswerIndex < len(task.Options) {
-			answer = task.Options[req.AnswerIndex]
-		}
+// Referral handlers
+func handleGetReferrals(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
 	}
 
-	isCorrect, earned, err := SubmitTaskAnswer(uint(userID), uint(taskID), answer)
+	stats, err := GetReferralStats(uint(userID))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit answer"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch referrals"})
 		return
 	}
 
-	// Get updated balance
-	var user User
-	if err := DB.First(&user, userID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user balance"})
+	c.JSON(http.StatusOK, stats)
+}
+
+func handleAdminGetReferrals(c *gin.Context) {
+	stats, err := GetAdminReferralStats()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch referral stats"})
 		return
 	}
 
-	// Get correct answer
-	var task Task
-	var correctAnswer string
-	if err := DB.First(&task, taskID).Error; err == nil {
-		correctAnswer = task.CorrectAnswer
-	}
+	c.JSON(http.StatusOK, stats)
+}
 
-	c.JSON(http.StatusOK, SubmitTaskResponse{
-		Success:       isCorrect,
-		Earned:        earned,
-		NewBalance:    user.Balance,
-		CorrectAnswer: correctAnswer,
-	})
+// Team handlers
+
+// teamErrorStatus maps team operation errors to HTTP status codes
+func teamErrorStatus(err error) int {
+	switch err.Error() {
+	case "team not found", "not a team member":
+		return http.StatusNotFound
+	case "only the captain can remove members":
+		return http.StatusForbidden
+	case "already in a team", "team is full", "team name already taken":
+		return http.StatusConflict
+	case "competition is not active", "team name is required", "captain cannot remove themselves":
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
 }
 
-// Shop handlers
-func handleGetShopItems(c *gin.Context) {
-	items, err := GetShopItems()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch shop items"})
+func handleTeamError(c *gin.Context, err error, fallback string) {
+	status := teamErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		c.JSON(status, gin.H{"error": fallback})
 		return
 	}
-
-	c.JSON(http.StatusOK, items)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(status, gin.H{"error": "Not found"})
+		return
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
 }
 
-func handleBuyItem(c *gin.Context) {
-	userID, err := GetUserIDFromContext(c)
+func handleGetCompetitions(c *gin.Context) {
+	competitions, err := ListCompetitions()
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch competitions"})
 		return
 	}
 
-	var req BuyItemRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+	c.JSON(http.StatusOK, competitions)
+}
+
+func handleGetTeamLeaderboard(c *gin.Context) {
+	competitionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid competition ID"})
 		return
 	}
 
-	purchaseID, err := BuyItem(uint(userID), uint(req.ItemID), req.Email)
+	leaderboard, err := GetTeamLeaderboard(uint(competitionID))
 	if err != nil {
-		if err.Error() == "insufficient balance" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient balance"})
-			return
-		}
-		if err.Error() == "item out of stock" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Item out of stock"})
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Competition not found"})
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purchase item"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch team leaderboard"})
 		return
 	}
 
-	c.JSON(http.StatusOK, BuyItemResponse{
-		PurchaseID: purchaseID,
-	})
+	c.JSON(http.StatusOK, leaderboard)
 }
 
-func handleGetInventory(c *gin.Context) {
+func handleGetMyTeams(c *gin.Context) {
 	userID, err := GetUserIDFromContext(c)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	inventory, err := GetUserInventory(uint(userID))
+	teams, err := GetUserTeams(uint(userID))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch inventory"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch teams"})
 		return
 	}
 
-	c.JSON(http.StatusOK, inventory)
+	c.JSON(http.StatusOK, teams)
 }
 
-// Admin handlers
-func handleRedeemPurchase(c *gin.Context) {
-	var req RedeemRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+func handleGetTeam(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	result, err := RedeemPurchase(req.PurchaseID)
+	teamID, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		if err.Error() == "purchase already redeemed" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Purchase already redeemed"})
-			return
-		}
-		c.JSON(http.StatusNotFound, gin.H{"error": "Purchase not found"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid team ID"})
 		return
 	}
 
-	c.JSON(http.StatusOK, result)
+	team, err := GetTeam(uint(teamID), uint(userID))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Team not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, team)
 }
 
-// Leaderboard handler
-func handleGetLeaderboard(c *gin.Context) {
-	// Try to get current user ID (optional)
-	var currentUserID uint
+func handleCreateTeam(c *gin.Context) {
 	userID, err := GetUserIDFromContext(c)
-	if err == nil {
-		currentUserID = uint(userID)
-	}
-
-	leaderboard, err := GetLeaderboard(currentUserID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch leaderboard"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	c.JSON(http.StatusOK, leaderboard)
-}
-
-// Admin login handler
-func handleAdminLogin(c *gin.Context) {
-	var req AdminLoginRequest
+	var req CreateTeamRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
 		return
 	}
 
-	// Check admin credentials (simple check - in production use proper password hashing)
-	adminPassword := os.Getenv("ADMIN_PASSWORD")
-	if adminPassword == "" {
-		adminPassword = "admin123" // Default for development
+	team, err := CreateTeam(uint(userID), uint(req.CompetitionID), req.Name)
+	if err != nil {
+		handleTeamError(c, err, "Failed to create team")
+		return
 	}
 
-	if req.Username != "admin" || req.Password != adminPassword {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	c.JSON(http.StatusCreated, team)
+}
+
+func handleJoinTeam(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	// Get admin user
-	var user User
-	if err := DB.Where("username = ? AND role = ?", "admin", "admin").First(&user).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Admin user not found"})
+	var req JoinTeamRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
 		return
 	}
 
-	// Generate token
-	token, err := GenerateToken(int(user.ID), user.Username, user.Role)
+	team, err := JoinTeam(uint(userID), req.Code)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		handleTeamError(c, err, "Failed to join team")
 		return
 	}
 
-	SetAuthCookie(c, token)
-	c.JSON(http.StatusOK, AuthResponse{Token: token})
+	c.JSON(http.StatusOK, team)
+}
+
+func handleLeaveTeam(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	teamID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid team ID"})
+		return
+	}
+
+	if err := LeaveTeam(uint(userID), uint(teamID)); err != nil {
+		handleTeamError(c, err, "Failed to leave team")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Left team successfully"})
+}
+
+func handleKickTeamMember(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	teamID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid team ID"})
+		return
+	}
+	memberID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	if err := KickTeamMember(uint(userID), uint(teamID), uint(memberID)); err != nil {
+		handleTeamError(c, err, "Failed to remove team member")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed successfully"})
+}
+
+// Task handlers
+func handleGetTasks(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	tasks, err := GetTasksWithStatus(uint(userID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tasks"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tasks)
+}
+
+func handleGetTaskByID(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	taskIDStr := c.Param("id")
+	taskID, err := strconv.Atoi(taskIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+		return
+	}
+
+	task, err := GetTaskByID(uint(taskID))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+		return
+	}
+
+	// Check if user has access (task is available or completed)
+	var userTask UserTask
+	result := DB.Where("user_id = ? AND task_id = ?", userID, taskID).First(&userTask)
+
+	if result.Error != nil {
+		// Check if this is the first task or previous task is completed
+		var taskModel Task
+		if err := DB.First(&taskModel, taskID).Error; err == nil {
+			if taskModel.Position == 0 {
+				// First task is always available
+				c.JSON(http.StatusOK, task)
+				return
+			}
+			var prevTask Task
+			if err := DB.Where("position < ? AND language = ?", taskModel.Position, taskModel.Language).Order("position DESC").First(&prevTask).Error; err == nil {
+				var prevUserTask UserTask
+				if DB.Where("user_id = ? AND task_id = ? AND status = ?", userID, prevTask.ID, "completed").First(&prevUserTask).Error != nil {
+					c.JSON(http.StatusForbidden, gin.H{"error": "Task is locked"})
+					return
+				}
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, task)
+}
+
+func handleSubmitTask(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	taskIDStr := c.Param("id")
+	taskID, err := strconv.Atoi(taskIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+		return
+	}
+
+	var req SubmitTaskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	// Get answer (either from answer field or answer_index)
+	answer := req.Answer
+	if answer == "" && req.AnswerIndex >= 0 {
+		// Get task options and use index
+		var task Task
+		if err := DB.First(&task, taskID).Error; err == nil && req.AnswerIndex < len(task.Options) {
+			answer = task.Options[req.AnswerIndex]
+		}
+	}
+
+	isCorrect, earned, err := SubmitTaskAnswer(uint(userID), uint(taskID), answer, req.Answers)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit answer"})
+		return
+	}
+
+	// Get updated balance
+	var user User
+	if err := DB.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user balance"})
+		return
+	}
+
+	// Get correct answer
+	var task Task
+	var correctAnswer string
+	if err := DB.First(&task, taskID).Error; err == nil {
+		correctAnswer = task.CorrectAnswer
+	}
+
+	c.JSON(http.StatusOK, SubmitTaskResponse{
+		Success:       isCorrect,
+		Earned:        earned,
+		NewBalance:    user.Balance,
+		CorrectAnswer: correctAnswer,
+	})
+}
+
+// Shop handlers
+func handleGetShopItems(c *gin.Context) {
+	// Current user is optional
+	var currentUserID uint
+	if userID, err := GetUserIDFromContext(c); err == nil {
+		currentUserID = uint(userID)
+	}
+
+	items, err := GetShopItems(currentUserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch shop items"})
+		return
+	}
+
+	c.JSON(http.StatusOK, items)
+}
+
+func handleBuyItem(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req BuyItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	purchase, err := BuyItem(uint(userID), req)
+	if err != nil {
+		var restriction *ShopRestrictionError
+		if errors.As(err, &restriction) {
+			c.JSON(http.StatusForbidden, gin.H{"error": restriction.Error(), "code": restriction.Code})
+			return
+		}
+		var promoErr *PromoCodeError
+		if errors.As(err, &promoErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": promoErr.Error(), "code": promoErr.Code})
+			return
+		}
+		if err.Error() == "variant required" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Please choose a variant"})
+			return
+		}
+		if err.Error() == "variant not found" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Variant not found"})
+			return
+		}
+		if err.Error() == "item not available" || errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+			return
+		}
+		if err.Error() == "insufficient balance" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient balance"})
+			return
+		}
+		if err.Error() == "item out of stock" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Item out of stock"})
+			return
+		}
+		switch err.Error() {
+		case "invalid email", "invalid fulfillment method", "pickup location not found",
+			"shipping address required":
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purchase item"})
+		return
+	}
+
+	c.JSON(http.StatusOK, purchase)
+}
+
+func handlePreviewPromoCode(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req PromoCodePreviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	preview, err := PreviewPromoCode(uint(userID), req)
+	if err != nil {
+		var promoErr *PromoCodeError
+		if errors.As(err, &promoErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": promoErr.Error(), "code": promoErr.Code})
+			return
+		}
+		if err.Error() == "item not available" || errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check promo code"})
+		return
+	}
+
+	c.JSON(http.StatusOK, preview)
+}
+
+// Cart handlers
+func cartErrorResponse(c *gin.Context, err error, fallback string) {
+	var checkoutErr *CheckoutError
+	switch {
+	case errors.As(err, &checkoutErr):
+		c.JSON(http.StatusConflict, gin.H{
+			"error":      "Cart item unavailable",
+			"code":       checkoutErr.Code,
+			"item_id":    checkoutErr.ItemID,
+			"variant_id": checkoutErr.VariantID,
+		})
+	case errors.Is(err, gorm.ErrRecordNotFound), err.Error() == "item not available":
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+	case err.Error() == "insufficient balance":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient balance"})
+	case err.Error() == "variant required":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Please choose a variant"})
+	default:
+		switch err.Error() {
+		case "invalid quantity", "variant not found", "cart is empty", "invalid email", "invalid fulfillment method",
+			"pickup location not found", "shipping address required":
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+		}
+	}
+}
+
+func handleGetCart(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	cart, err := GetCart(uint(userID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch cart"})
+		return
+	}
+
+	c.JSON(http.StatusOK, cart)
+}
+
+func handleAddToCart(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req CartItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+
+	cart, err := AddToCart(uint(userID), uint(req.ItemID), uint(req.VariantID), req.Quantity)
+	if err != nil {
+		cartErrorResponse(c, err, "Failed to update cart")
+		return
+	}
+
+	c.JSON(http.StatusOK, cart)
+}
+
+func handleUpdateCartItem(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req CartItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	cart, err := SetCartQuantity(uint(userID), uint(req.ItemID), uint(req.VariantID), req.Quantity)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not in cart"})
+			return
+		}
+		cartErrorResponse(c, err, "Failed to update cart")
+		return
+	}
+
+	c.JSON(http.StatusOK, cart)
+}
+
+func handleRemoveCartItem(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	itemID, err := strconv.Atoi(c.Param("item_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+	variantID, err := strconv.Atoi(c.DefaultQuery("variant_id", "0"))
+	if err != nil || variantID < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid variant ID"})
+		return
+	}
+
+	cart, err := SetCartQuantity(uint(userID), uint(itemID), uint(variantID), 0)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not in cart"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart"})
+		return
+	}
+
+	c.JSON(http.StatusOK, cart)
+}
+
+func handleClearCart(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if err := ClearCart(uint(userID)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear cart"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Cart cleared"})
+}
+
+func handleCheckout(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req CheckoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	order, err := Checkout(uint(userID), req)
+	if err != nil {
+		cartErrorResponse(c, err, "Failed to check out")
+		return
+	}
+
+	c.JSON(http.StatusCreated, order)
+}
+
+func handleGetOrders(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	orders, err := GetOrders(uint(userID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch orders"})
+		return
+	}
+
+	c.JSON(http.StatusOK, orders)
+}
+
+func handleGetOrder(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	order, err := GetOrder(uint(userID), c.Param("order_id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch order"})
+		return
+	}
+
+	c.JSON(http.StatusOK, order)
+}
+
+// Waitlist handlers
+func handleJoinWaitlist(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+
+	// The body is optional; without it the user waits for any variant
+	var req WaitlistRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+
+	if err := JoinWaitlist(uint(userID), uint(itemID), uint(req.VariantID)); err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound), err.Error() == "item not available":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		case err.Error() == "variant not found":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Variant not found"})
+		case err.Error() == "item in stock":
+			c.JSON(http.StatusConflict, gin.H{"error": "Item is in stock"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to join waitlist"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "You will be notified when the item is back in stock"})
+}
+
+func handleLeaveWaitlist(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+	variantID, err := strconv.Atoi(c.DefaultQuery("variant_id", "0"))
+	if err != nil || variantID < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid variant ID"})
+		return
+	}
+
+	if err := LeaveWaitlist(uint(userID), uint(itemID), uint(variantID)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not on the waitlist"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to leave waitlist"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Removed from the waitlist"})
+}
+
+func handleGetWaitlist(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	entries, err := GetUserWaitlist(uint(userID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch waitlist"})
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+func handleGetInventory(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	inventory, err := GetUserInventory(uint(userID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch inventory"})
+		return
+	}
+
+	c.JSON(http.StatusOK, inventory)
+}
+
+// Admin handlers
+func redeemErrorResponse(c *gin.Context, err error, fallback string) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Purchase not found"})
+	case err.Error() == "invalid token":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid QR code"})
+	case err.Error() == "token expired":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "QR code expired, ask the user to refresh it"})
+	case err.Error() == "token already used":
+		c.JSON(http.StatusConflict, gin.H{"error": "QR code already used"})
+	case err.Error() == "purchase already redeemed":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Purchase already redeemed"})
+	case err.Error() == "purchase not redeemable":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Purchase can't be redeemed with a QR code"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
+
+func handleRedeemPurchase(c *gin.Context) {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req RedeemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	result, err := RedeemPurchase(req.Token, uint(adminID))
+	if err != nil {
+		redeemErrorResponse(c, err, "Failed to redeem purchase")
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+func handleAdminPreviewRedemption(c *gin.Context) {
+	var req RedeemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	preview, err := PreviewRedemption(req.Token)
+	if err != nil {
+		redeemErrorResponse(c, err, "Failed to look up QR code")
+		return
+	}
+
+	c.JSON(http.StatusOK, preview)
+}
+
+func handleAdminGetPurchase(c *gin.Context) {
+	preview, err := GetPurchasePreview(c.Param("purchase_id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Purchase not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch purchase"})
+		return
+	}
+
+	c.JSON(http.StatusOK, preview)
+}
+
+func handleAdminUndoRedemption(c *gin.Context) {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	redemptionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid redemption ID"})
+		return
+	}
+
+	entry, err := UndoRedemption(uint(redemptionID), uint(adminID))
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Redemption not found"})
+		case err.Error() == "redemption belongs to another operator":
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the operator who redeemed the purchase can undo it"})
+		case err.Error() == "redemption already undone", err.Error() == "undo window expired",
+			err.Error() == "purchase changed since redemption":
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to undo redemption"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, entry)
+}
+
+// handleAdminGetRedemptions lists the redemptions of one day (date=YYYY-MM-DD,
+// server time, default today), optionally for one operator
+func handleAdminGetRedemptions(c *gin.Context) {
+	day := time.Now()
+	if date := c.Query("date"); date != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", date, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date"})
+			return
+		}
+		day = parsed
+	}
+	from := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+	filter := RedemptionLogFilter{From: from, To: from.AddDate(0, 0, 1)}
+
+	if adminID := c.Query("admin_id"); adminID != "" {
+		id, err := strconv.Atoi(adminID)
+		if err != nil || id < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid admin ID"})
+			return
+		}
+		filter.AdminID = uint(id)
+	}
+
+	page, pageSize := parsePagination(c, 50, 200)
+	redemptions, err := GetRedemptionLog(filter, page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch redemptions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, redemptions)
+}
+
+func redemptionTokenError(c *gin.Context, err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Purchase not found"})
+		return
+	}
+	if err.Error() == "purchase already redeemed" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Purchase already redeemed"})
+		return
+	}
+	if err.Error() == "purchase not redeemable" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Purchase can't be redeemed with a QR code"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create redemption token"})
+}
+
+func handleGetPickupLocations(c *gin.Context) {
+	locations, err := GetPickupLocations(true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pickup locations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, locations)
+}
+
+// issueRedemptionTokenForRequest issues a token for the order or purchase in
+// the URL; the token and QR handlers serve both kinds of routes
+func issueRedemptionTokenForRequest(c *gin.Context, userID uint) (string, time.Time, error) {
+	if orderID := c.Param("order_id"); orderID != "" {
+		return IssueOrderRedemptionToken(userID, orderID)
+	}
+	return IssueRedemptionToken(userID, c.Param("purchase_id"))
+}
+
+// handleGetRedemptionToken issues a fresh short-lived token for the purchase
+// QR code. Clients request a new one before expires_at while the code is shown.
+func handleGetRedemptionToken(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	token, expiresAt, err := issueRedemptionTokenForRequest(c, uint(userID))
+	if err != nil {
+		redemptionTokenError(c, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, RedemptionTokenResponse{
+		Token:     token,
+		ExpiresAt: expiresAt.Format(time.RFC3339),
+	})
+}
+
+// handleGetRedemptionQR renders a fresh redemption token as a QR image
+func handleGetRedemptionQR(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	format := c.DefaultQuery("format", "png")
+	if format != "png" && format != "svg" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be png or svg"})
+		return
+	}
+	size, err := strconv.Atoi(c.DefaultQuery("size", "256"))
+	if err != nil || size < 64 || size > 1024 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "size must be between 64 and 1024"})
+		return
+	}
+
+	token, expiresAt, err := issueRedemptionTokenForRequest(c, uint(userID))
+	if err != nil {
+		redemptionTokenError(c, err)
+		return
+	}
+
+	image, contentType, err := RenderRedemptionQR(token, format, size)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render QR code"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Token-Expires-At", expiresAt.Format(time.RFC3339))
+	c.Data(http.StatusOK, contentType, image)
+}
+
+// Leaderboard handler
+func handleGetLeaderboard(c *gin.Context) {
+	// Try to get current user ID (optional)
+	var currentUserID uint
+	userID, err := GetUserIDFromContext(c)
+	if err == nil {
+		currentUserID = uint(userID)
+	}
+
+	page, pageSize := parsePagination(c, 20, 100)
+
+	filter := LeaderboardFilter{
+		Scope:      c.DefaultQuery("scope", "global"),
+		University: strings.TrimSpace(c.Query("university")),
+		Track:      normalizeTrack(c.Query("track")),
+		UserID:     currentUserID,
+	}
+
+	// University and track scopes default to the current user's own cohort
+	var currentUser *User
+	if currentUserID > 0 {
+		currentUser, _ = GetUserByID(currentUserID)
+	}
+
+	switch filter.Scope {
+	case "global":
+	case "university":
+		if filter.University == "" && currentUser != nil {
+			filter.University = currentUser.University
+		}
+		if filter.University == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "University is required"})
+			return
+		}
+	case "track":
+		if filter.Track == "" && currentUser != nil {
+			filter.Track = currentUser.Track
+		}
+		if filter.Track == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Track is required"})
+			return
+		}
+	case "friends":
+		if currentUserID == 0 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization required"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scope"})
+		return
+	}
+
+	leaderboard, err := GetLeaderboard(filter, currentUserID, page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch leaderboard"})
+		return
+	}
+
+	c.JSON(http.StatusOK, leaderboard)
+}
+
+// parsePagination reads 1-based "page" and "page_size" query parameters
+func parsePagination(c *gin.Context, defaultSize, maxSize int) (int, int) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(defaultSize)))
+	if err != nil || pageSize < 1 {
+		pageSize = defaultSize
+	}
+	if pageSize > maxSize {
+		pageSize = maxSize
+	}
+	return page, pageSize
+}
+
+// Friends handlers
+func handleGetFriends(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	friends, err := GetFriends(uint(userID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch friends"})
+		return
+	}
+
+	c.JSON(http.StatusOK, friends)
+}
+
+func handleAddFriend(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req AddFriendRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	friendID := uint(req.UserID)
+	if req.Nickname != "" {
+		friend, err := FindUserByNickname(req.Nickname)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		friendID = friend.ID
+	}
+	if friendID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id or nickname is required"})
+		return
+	}
+
+	if err := AddFriend(uint(userID), friendID); err != nil {
+		if err.Error() == "cannot add yourself" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot add yourself as a friend"})
+			return
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add friend"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Friend added successfully"})
+}
+
+func handleRemoveFriend(c *gin.Context) {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	friendID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	if err := RemoveFriend(uint(userID), uint(friendID)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove friend"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Friend removed successfully"})
+}
+
+// Admin login handler
+func handleAdminLogin(c *gin.Context) {
+	var req AdminLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	// Check admin credentials (simple check - in production use proper password hashing)
+	adminPassword := os.Getenv("ADMIN_PASSWORD")
+	if adminPassword == "" {
+		adminPassword = "admin123" // Default for development
+	}
+
+	if req.Username != "admin" || req.Password != adminPassword {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+
+	// Get admin user
+	var user User
+	if err := DB.Where("username = ? AND role = ?", "admin", "admin").First(&user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Admin user not found"})
+		return
+	}
+
+	// Generate token
+	token, err := GenerateToken(int(user.ID), user.Username, user.Role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	SetAuthCookie(c, token)
+	c.JSON(http.StatusOK, AuthResponse{Token: token})
 }
 
 // Admin metrics handler
 func handleAdminMetrics(c *gin.Context) {
 	var metrics AdminMetricsResponse
 
-	// Total users
-	DB.Model(&User{}).Count(&metrics.TotalUsers)
+	// Total users
+	DB.Model(&User{}).Count(&metrics.TotalUsers)
+
+	// Total tasks
+	DB.Model(&Task{}).Count(&metrics.TotalTasks)
+
+	// Total completed tasks
+	DB.Model(&UserTask{}).Where("status = ?", "completed").Count(&metrics.TotalCompletedTasks)
+
+	// Total purchases
+	DB.Model(&Purchase{}).Count(&metrics.TotalPurchases)
+
+	// Total revenue (sum of prices paid for purchases)
+	var totalRevenue struct {
+		Total int
+	}
+	DB.Model(&Purchase{}).
+		Where("purchases.status <> ?", PurchaseCancelled).
+		Select("COALESCE(SUM(purchases.price), 0) as total").
+		Scan(&totalRevenue)
+	metrics.TotalRevenue = totalRevenue.Total
+
+	// Active users today (users who completed a task today)
+	today := time.Now().Format("2006-01-02")
+	DB.Model(&UserTask{}).
+		Where("DATE(completed_at) = ? AND status = ?", today, "completed").
+		Distinct("user_id").
+		Count(&metrics.ActiveUsersToday)
+
+	// Average tasks per user
+	if metrics.TotalUsers > 0 {
+		metrics.AvgTasksPerUser = float64(metrics.TotalCompletedTasks) / float64(metrics.TotalUsers)
+	}
+
+	c.JSON(http.StatusOK, metrics)
+}
+
+// parseAnalyticsRange reads from, to (YYYY-MM-DD, default: the last 30
+// days) and granularity, answering 400 when they are invalid
+func parseAnalyticsRange(c *gin.Context) (AnalyticsRange, bool) {
+	today := time.Now().Format("2006-01-02")
+	to := c.DefaultQuery("to", today)
+	from := c.Query("from")
+	if from == "" {
+		last, err := time.ParseInLocation("2006-01-02", to, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to"})
+			return AnalyticsRange{}, false
+		}
+		from = last.AddDate(0, 0, -29).Format("2006-01-02")
+	}
+
+	r, err := NewAnalyticsRange(from, to, c.DefaultQuery("granularity", "day"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return AnalyticsRange{}, false
+	}
+	return r, true
+}
+
+func handleAdminRegistrationAnalytics(c *gin.Context) {
+	r, ok := parseAnalyticsRange(c)
+	if !ok {
+		return
+	}
+	series, err := GetRegistrationSeries(r)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch analytics"})
+		return
+	}
+	c.JSON(http.StatusOK, series)
+}
+
+func handleAdminActiveUserAnalytics(c *gin.Context) {
+	r, ok := parseAnalyticsRange(c)
+	if !ok {
+		return
+	}
+	series, err := GetActiveUserSeries(r)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch analytics"})
+		return
+	}
+	c.JSON(http.StatusOK, series)
+}
+
+func handleAdminTaskCompletionAnalytics(c *gin.Context) {
+	r, ok := parseAnalyticsRange(c)
+	if !ok {
+		return
+	}
+	taskID, err := strconv.Atoi(c.DefaultQuery("task_id", "0"))
+	if err != nil || taskID < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid task_id"})
+		return
+	}
+	series, err := GetTaskCompletionSeries(r, uint(taskID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch analytics"})
+		return
+	}
+	c.JSON(http.StatusOK, series)
+}
+
+func handleAdminPointsAnalytics(c *gin.Context) {
+	r, ok := parseAnalyticsRange(c)
+	if !ok {
+		return
+	}
+	series, err := GetPointsSeries(r)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch analytics"})
+		return
+	}
+	c.JSON(http.StatusOK, series)
+}
+
+func handleAdminPurchaseAnalytics(c *gin.Context) {
+	r, ok := parseAnalyticsRange(c)
+	if !ok {
+		return
+	}
+	itemID, err := strconv.Atoi(c.DefaultQuery("item_id", "0"))
+	if err != nil || itemID < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid item_id"})
+		return
+	}
+	series, err := GetPurchaseSeries(r, uint(itemID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch analytics"})
+		return
+	}
+	c.JSON(http.StatusOK, series)
+}
+
+// parseCohortFilter reads the optional registration dates from and to
+// (YYYY-MM-DD), answering 400 when they are invalid
+func parseCohortFilter(c *gin.Context) (CohortFilter, bool) {
+	filter, err := NewCohortFilter(c.Query("from"), c.Query("to"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return CohortFilter{}, false
+	}
+	return filter, true
+}
+
+func handleAdminFunnelAnalytics(c *gin.Context) {
+	filter, ok := parseCohortFilter(c)
+	if !ok {
+		return
+	}
+	funnel, err := GetFunnel(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch analytics"})
+		return
+	}
+	c.JSON(http.StatusOK, funnel)
+}
+
+func handleAdminRetentionAnalytics(c *gin.Context) {
+	filter, ok := parseCohortFilter(c)
+	if !ok {
+		return
+	}
+	weeks, err := strconv.Atoi(c.DefaultQuery("weeks", "8"))
+	if err != nil || weeks < 1 || weeks > maxRetentionWeeks {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid weeks"})
+		return
+	}
+	retention, err := GetCohortRetention(filter, weeks)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch analytics"})
+		return
+	}
+	c.JSON(http.StatusOK, retention)
+}
+
+func handleAdminLevelTimeAnalytics(c *gin.Context) {
+	filter, ok := parseCohortFilter(c)
+	if !ok {
+		return
+	}
+	times, err := GetLevelTimes(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch analytics"})
+		return
+	}
+	c.JSON(http.StatusOK, times)
+}
+
+// Admin get all users
+// Admin get all users
+func handleAdminGetUsers(c *gin.Context) {
+	filter := AdminUserFilter{
+		Search:    c.Query("q"),
+		Role:      c.Query("role"),
+		Status:    c.Query("status"),
+		Flagged:   c.Query("flagged") == "true",
+		Sort:      c.DefaultQuery("sort", "created_at"),
+		Ascending: c.Query("order") == "asc",
+	}
+	if filter.Status != "" && !userStatuses[filter.Status] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status"})
+		return
+	}
+	if _, ok := adminUserSortColumns[filter.Sort]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid sort"})
+		return
+	}
+	if order := c.Query("order"); order != "" && order != "asc" && order != "desc" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order"})
+		return
+	}
+
+	for name, target := range map[string]**int{
+		"min_balance":   &filter.MinBalance,
+		"min_streak":    &filter.MinStreak,
+		"min_completed": &filter.MinCompletedTasks,
+	} {
+		if value := c.Query(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name})
+				return
+			}
+			*target = &n
+		}
+	}
+
+	for name, target := range map[string]**time.Time{
+		"registered_from": &filter.RegisteredFrom,
+		"registered_to":   &filter.RegisteredTo,
+	} {
+		if value := c.Query(name); value != "" {
+			t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name})
+				return
+			}
+			if name == "registered_to" {
+				t = t.AddDate(0, 0, 1) // inclusive
+			}
+			*target = &t
+		}
+	}
+
+	page, pageSize := parsePagination(c, 50, 200)
+	users, err := GetAdminUsers(filter, page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+		return
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+func adminUserErrorResponse(c *gin.Context, err error, fallback string) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	switch err.Error() {
+	case "task not found", "task not started", "not a candidate":
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case "delta must not be zero", "reason is required", "insufficient balance", "invalid role", "invalid status",
+		"invalid decision", "no open flags",
+		"cannot change your own role", "user already has this role", "admins cannot be banned",
+		"user already has this status", "user is not banned",
+		"invalid tag", "too many tags", "note is required", "only students can be candidates":
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
+
+// parseAdminUserID reads the :id path parameter, answering 400 when it is invalid
+func parseAdminUserID(c *gin.Context) (uint, bool) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil || userID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return 0, false
+	}
+	return uint(userID), true
+}
+
+func handleAdminGetUser(c *gin.Context) {
+	userID, ok := parseAdminUserID(c)
+	if !ok {
+		return
+	}
+
+	detail, err := GetAdminUserDetail(userID)
+	if err != nil {
+		adminUserErrorResponse(c, err, "Failed to fetch user")
+		return
+	}
+
+	c.JSON(http.StatusOK, detail)
+}
+
+func handleAdminGetBalanceHistory(c *gin.Context) {
+	userID, ok := parseAdminUserID(c)
+	if !ok {
+		return
+	}
+
+	page, pageSize := parsePagination(c, 50, 200)
+	history, err := GetBalanceHistory(userID, page, pageSize)
+	if err != nil {
+		adminUserErrorResponse(c, err, "Failed to fetch balance history")
+		return
+	}
+
+	c.JSON(http.StatusOK, history)
+}
+
+func handleAdminAdjustBalance(c *gin.Context) {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID, ok := parseAdminUserID(c)
+	if !ok {
+		return
+	}
+
+	var req BalanceAdjustmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	transaction, err := AdjustUserBalance(userID, req.Delta, req.Reason, uint(adminID))
+	if err != nil {
+		adminUserErrorResponse(c, err, "Failed to adjust balance")
+		return
+	}
+
+	c.JSON(http.StatusOK, transaction)
+}
+
+func handleAdminResetUserTask(c *gin.Context) {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID, ok := parseAdminUserID(c)
+	if !ok {
+		return
+	}
+	taskID, err := strconv.Atoi(c.Param("task_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+		return
+	}
+
+	// The body is optional; without it the reward is kept
+	var req TaskResetRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+
+	if err := ResetUserTask(userID, uint(taskID), req.RevokeReward, req.Reason, uint(adminID)); err != nil {
+		adminUserErrorResponse(c, err, "Failed to reset task")
+		return
+	}
+	respondAdminUserProfile(c, userID)
+}
+
+func handleAdminChangeUserRole(c *gin.Context) {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID, ok := parseAdminUserID(c)
+	if !ok {
+		return
+	}
+
+	var req UserRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if err := ChangeUserRole(userID, req.Role, req.Reason, uint(adminID)); err != nil {
+		adminUserErrorResponse(c, err, "Failed to change role")
+		return
+	}
+	respondAdminUserProfile(c, userID)
+}
+
+func handleAdminBanUser(c *gin.Context) {
+	setAdminUserStatus(c, UserBanned)
+}
+
+func handleAdminShadowBanUser(c *gin.Context) {
+	setAdminUserStatus(c, UserShadowBanned)
+}
+
+func handleAdminUnbanUser(c *gin.Context) {
+	setAdminUserStatus(c, UserActive)
+}
+
+func setAdminUserStatus(c *gin.Context, status string) {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID, ok := parseAdminUserID(c)
+	if !ok {
+		return
+	}
+
+	var req UserBanRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+
+	if err := SetUserStatus(userID, status, req.Reason, uint(adminID)); err != nil {
+		adminUserErrorResponse(c, err, "Failed to update user")
+		return
+	}
+	respondAdminUserProfile(c, userID)
+}
+
+func respondAdminUserProfile(c *gin.Context, userID uint) {
+	profile, err := GetAdminUserProfile(userID)
+	if err != nil {
+		adminUserErrorResponse(c, err, "Failed to fetch user")
+		return
+	}
+	c.JSON(http.StatusOK, profile)
+}
+
+func handleAdminGetFlagQueue(c *gin.Context) {
+	page, pageSize := parsePagination(c, 20, 100)
+	queue, err := GetFlagQueue(c.Query("kind"), page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch flagged users"})
+		return
+	}
+
+	c.JSON(http.StatusOK, queue)
+}
+
+func handleAdminReviewUserFlags(c *gin.Context) {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID, ok := parseAdminUserID(c)
+	if !ok {
+		return
+	}
+
+	var req FlagReviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if err := ReviewUserFlags(userID, req.Decision, req.Reason, uint(adminID)); err != nil {
+		adminUserErrorResponse(c, err, "Failed to review flags")
+		return
+	}
+	respondAdminUserProfile(c, userID)
+}
+
+func parseCandidateFilter(c *gin.Context) (CandidateFilter, error) {
+	filter := CandidateFilter{
+		Search:     c.Query("q"),
+		Status:     c.Query("status"),
+		Tag:        strings.TrimSpace(c.Query("tag")),
+		University: c.Query("university"),
+		Track:      c.Query("track"),
+		Stack:      c.Query("stack"),
+		HasResume:  c.Query("has_resume") == "true",
+		Sort:       c.DefaultQuery("sort", "created_at"),
+		Ascending:  c.Query("order") == "asc",
+	}
+	if filter.Status != "" && !candidateStatuses[filter.Status] {
+		return filter, fmt.Errorf("invalid status")
+	}
+	if _, ok := candidateSortColumns[filter.Sort]; !ok {
+		return filter, fmt.Errorf("invalid sort")
+	}
+	if order := c.Query("order"); order != "" && order != "asc" && order != "desc" {
+		return filter, fmt.Errorf("invalid order")
+	}
+	if marked := c.Query("marked"); marked != "" {
+		if marked != "true" && marked != "false" {
+			return filter, fmt.Errorf("invalid marked")
+		}
+		value := marked == "true"
+		filter.Marked = &value
+	}
+	if value := c.Query("min_levels"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid min_levels")
+		}
+		filter.MinLevels = &n
+	}
+	if value := c.Query("min_accuracy"); value != "" {
+		accuracy, err := strconv.ParseFloat(value, 64)
+		if err != nil || accuracy < 0 || accuracy > 1 {
+			return filter, fmt.Errorf("invalid min_accuracy")
+		}
+		filter.MinAccuracy = &accuracy
+	}
+	return filter, nil
+}
+
+// handleAdminGetCandidates lists students with their pipeline status and quiz
+// performance
+func handleAdminGetCandidates(c *gin.Context) {
+	filter, err := parseCandidateFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, pageSize := parsePagination(c, 50, 200)
+	candidates, err := GetCandidates(filter, page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch candidates"})
+		return
+	}
+	c.JSON(http.StatusOK, candidates)
+}
+
+// handleAdminExportCandidates exports all matching students as CSV or JSON
+// Resume documents for an ATS
+func handleAdminExportCandidates(c *gin.Context) {
+	filter, err := parseCandidateFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	date := time.Now().Format("2006-01-02")
+	var write func(io.Writer, CandidateFilter) error
+	switch c.DefaultQuery("format", CandidateExportCSV) {
+	case CandidateExportCSV:
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="candidates-`+date+`.csv"`)
+		write = WriteCandidatesCSV
+	case CandidateExportJSONResume:
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="candidates-`+date+`.json"`)
+		write = WriteCandidatesJSONResume
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid format"})
+		return
+	}
+
+	c.Status(http.StatusOK)
+	if err := write(c.Writer, filter); err != nil {
+		// Headers are already sent; the truncated file is all we can do
+		log.Printf("candidate export: %v", err)
+	}
+}
+
+func respondCandidate(c *gin.Context, userID uint) {
+	candidate, err := GetCandidate(userID)
+	if err != nil {
+		adminUserErrorResponse(c, err, "Failed to fetch candidate")
+		return
+	}
+	c.JSON(http.StatusOK, candidate)
+}
+
+func handleAdminGetCandidate(c *gin.Context) {
+	userID, ok := parseAdminUserID(c)
+	if !ok {
+		return
+	}
+	respondCandidate(c, userID)
+}
+
+// handleAdminUpdateCandidate marks a student as a candidate or updates the
+// status and tags
+func handleAdminUpdateCandidate(c *gin.Context) {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID, ok := parseAdminUserID(c)
+	if !ok {
+		return
+	}
+
+	var req CandidateUpdateRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+
+	if err := UpdateCandidate(userID, req.Status, req.Tags, uint(adminID)); err != nil {
+		adminUserErrorResponse(c, err, "Failed to update candidate")
+		return
+	}
+	respondCandidate(c, userID)
+}
+
+func handleAdminUnmarkCandidate(c *gin.Context) {
+	userID, ok := parseAdminUserID(c)
+	if !ok {
+		return
+	}
+
+	if err := UnmarkCandidate(userID); err != nil {
+		adminUserErrorResponse(c, err, "Failed to unmark candidate")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Candidate removed"})
+}
+
+func handleAdminAddCandidateNote(c *gin.Context) {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID, ok := parseAdminUserID(c)
+	if !ok {
+		return
+	}
+
+	var req CandidateNoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	note, err := AddCandidateNote(userID, req.Body, uint(adminID))
+	if err != nil {
+		adminUserErrorResponse(c, err, "Failed to add note")
+		return
+	}
+	c.JSON(http.StatusCreated, note)
+}
+
+func handleAdminGetAuditLog(c *gin.Context) {
+	var filter AdminAuditFilter
+	for name, target := range map[string]*uint{"admin_id": &filter.AdminID, "user_id": &filter.TargetUserID} {
+		if value := c.Query(name); value != "" {
+			id, err := strconv.Atoi(value)
+			if err != nil || id <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name})
+				return
+			}
+			*target = uint(id)
+		}
+	}
+	filter.Action = c.Query("action")
+
+	page, pageSize := parsePagination(c, 50, 200)
+	entries, err := GetAdminAuditLog(filter, page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit log"})
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// Admin create team competition
+func handleAdminCreateCompetition(c *gin.Context) {
+	var req CreateCompetitionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	competition, err := CreateCompetition(req)
+	if err != nil {
+		switch err.Error() {
+		case "invalid starts_at", "invalid ends_at", "ends_at must be after starts_at":
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create competition"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, competition)
+}
+
+// Admin close team competition
+func handleAdminCloseCompetition(c *gin.Context) {
+	competitionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid competition ID"})
+		return
+	}
+
+	leaderboard, err := CloseCompetition(uint(competitionID))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Competition not found"})
+			return
+		}
+		if err.Error() == "competition already closed" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Competition already closed"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close competition"})
+		return
+	}
+
+	c.JSON(http.StatusOK, leaderboard)
+}
+
+// Admin fulfillment handlers
+func handleAdminGetFulfillmentQueue(c *gin.Context) {
+	filter := FulfillmentFilter{
+		Status: c.Query("status"),
+		Method: c.Query("fulfillment"),
+	}
+	if locationID := c.Query("location_id"); locationID != "" {
+		id, err := strconv.Atoi(locationID)
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid location ID"})
+			return
+		}
+		filter.PickupLocationID = uint(id)
+	}
+
+	entries, err := GetFulfillmentQueue(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch purchases"})
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// parsePurchaseFilter reads the purchase list filters. Dates are RFC 3339
+// timestamps or YYYY-MM-DD days in server time; a "to" day is inclusive.
+func parsePurchaseFilter(c *gin.Context) (PurchaseFilter, error) {
+	filter := PurchaseFilter{
+		Email:       strings.TrimSpace(c.Query("email")),
+		Fulfillment: c.Query("fulfillment"),
+		Sort:        c.DefaultQuery("sort", "purchased_at"),
+		Ascending:   c.Query("order") == "asc",
+	}
+	if _, ok := purchaseSortColumns[filter.Sort]; !ok {
+		return filter, fmt.Errorf("invalid sort")
+	}
+	if order := c.Query("order"); order != "" && order != "asc" && order != "desc" {
+		return filter, fmt.Errorf("invalid order")
+	}
+	if status := c.Query("status"); status != "" {
+		filter.Statuses = strings.Split(status, ",")
+	}
+
+	for name, target := range map[string]*uint{"item_id": &filter.ItemID, "user_id": &filter.UserID} {
+		if value := c.Query(name); value != "" {
+			id, err := strconv.Atoi(value)
+			if err != nil || id <= 0 {
+				return filter, fmt.Errorf("invalid %s", name)
+			}
+			*target = uint(id)
+		}
+	}
+
+	parseDate := func(name string, endOfDay bool) (*time.Time, error) {
+		value := c.Query(name)
+		if value == "" {
+			return nil, nil
+		}
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return &t, nil
+		}
+		t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s", name)
+		}
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return &t, nil
+	}
+	var err error
+	if filter.From, err = parseDate("from", false); err != nil {
+		return filter, err
+	}
+	if filter.To, err = parseDate("to", true); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// handleAdminGetPurchases lists purchases with filters and cursor pagination,
+// or exports all matching purchases with format=csv
+func handleAdminGetPurchases(c *gin.Context) {
+	filter, err := parsePurchaseFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		filename := fmt.Sprintf("purchases-%s.csv", time.Now().Format("2006-01-02"))
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+		c.Status(http.StatusOK)
+		if err := WritePurchasesCSV(c.Writer, filter); err != nil {
+			// Headers are already sent; the truncated file is all we can do
+			log.Printf("purchase export: %v", err)
+		}
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 {
+		limit = 50
+	}
+	if limit > 200 {
+		limit = 200
+	}
+
+	purchases, err := GetAdminPurchases(filter, c.Query("cursor"), limit)
+	if err != nil {
+		if err.Error() == "invalid cursor" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch purchases"})
+		return
+	}
+
+	c.JSON(http.StatusOK, purchases)
+}
+
+func handleAdminUpdatePurchaseStatus(c *gin.Context) {
+	var req UpdatePurchaseStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	entry, err := UpdatePurchaseStatus(c.Param("purchase_id"), req.Status, req.TrackingNumber)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Purchase not found"})
+			return
+		}
+		if err.Error() == "invalid status transition" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Invalid status transition"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update purchase"})
+		return
+	}
+
+	c.JSON(http.StatusOK, entry)
+}
+
+func handleAdminGetPickupLocations(c *gin.Context) {
+	locations, err := GetPickupLocations(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pickup locations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, locations)
+}
+
+func handleAdminCreatePickupLocation(c *gin.Context) {
+	var req PickupLocationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	location, err := CreatePickupLocation(req)
+	if err != nil {
+		if err.Error() == "name is required" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create pickup location"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, location)
+}
+
+func handleAdminUpdatePickupLocation(c *gin.Context) {
+	locationID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid location ID"})
+		return
+	}
+
+	var req PickupLocationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	location, err := UpdatePickupLocation(uint(locationID), req)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pickup location not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update pickup location"})
+		return
+	}
+
+	c.JSON(http.StatusOK, location)
+}
+
+// Admin promo code handlers
+func promoCodeErrorResponse(c *gin.Context, err error, fallback string) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Promo code not found"})
+		return
+	}
+	switch err.Error() {
+	case "promo code already exists", "promo code in use":
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case "code, discount_type and discount_value are required", "invalid promo code", "invalid discount",
+		"invalid discount type", "item not found", "promo code can be scoped to an item or a category, not both",
+		"limits cannot be negative", "invalid valid_from", "invalid valid_until", "valid_until must be after valid_from":
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
+
+func handleAdminGetPromoCodes(c *gin.Context) {
+	promos, err := GetPromoCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch promo codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, promos)
+}
+
+func handleAdminGetPromoCode(c *gin.Context) {
+	promoID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid promo code ID"})
+		return
+	}
+
+	promo, err := GetPromoCode(uint(promoID))
+	if err != nil {
+		promoCodeErrorResponse(c, err, "Failed to fetch promo code")
+		return
+	}
+
+	c.JSON(http.StatusOK, promo)
+}
+
+func handleAdminCreatePromoCode(c *gin.Context) {
+	var req PromoCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	promo, err := CreatePromoCode(req)
+	if err != nil {
+		promoCodeErrorResponse(c, err, "Failed to create promo code")
+		return
+	}
+
+	c.JSON(http.StatusCreated, promo)
+}
+
+func handleAdminUpdatePromoCode(c *gin.Context) {
+	promoID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid promo code ID"})
+		return
+	}
+
+	var req PromoCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
 
-	// Total tasks
-	DB.Model(&Task{}).Count(&metrics.TotalTasks)
+	promo, err := UpdatePromoCode(uint(promoID), req)
+	if err != nil {
+		promoCodeErrorResponse(c, err, "Failed to update promo code")
+		return
+	}
 
-	// Total completed tasks
-	DB.Model(&UserTask{}).Where("status = ?", "completed").Count(&metrics.TotalCompletedTasks)
+	c.JSON(http.StatusOK, promo)
+}
 
-	// Total purchases
-	DB.Model(&Purchase{}).Count(&metrics.TotalPurchases)
+func handleAdminDeletePromoCode(c *gin.Context) {
+	promoID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid promo code ID"})
+		return
+	}
 
-	// Total revenue (sum of prices from purchases)
-	var totalRevenue struct {
-		Total int
+	if err := DeletePromoCode(uint(promoID)); err != nil {
+		promoCodeErrorResponse(c, err, "Failed to delete promo code")
+		return
 	}
-	DB.Model(&Purchase{}).
-		Joins("JOIN shop_items ON purchases.item_id = shop_items.id").
-		Select("COALESCE(SUM(shop_items.price), 0) as total").
-		Scan(&totalRevenue)
-	metrics.TotalRevenue = totalRevenue.Total
 
-	// Active users today (users who completed a task today)
-	today := time.Now().Format("2006-01-02")
-	DB.Model(&UserTask{}).
-		Where("DATE(completed_at) = ? AND status = ?", today, "completed").
-		Distinct("user_id").
-		Count(&metrics.ActiveUsersToday)
+	c.JSON(http.StatusOK, gin.H{"message": "Promo code deleted successfully"})
+}
 
-	// Average tasks per user
-	if metrics.TotalUsers > 0 {
-		metrics.AvgTasksPerUser = float64(metrics.TotalCompletedTasks) / float64(metrics.TotalUsers)
+// Admin shop item handlers
+func shopItemErrorResponse(c *gin.Context, err error, fallback string) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	switch err.Error() {
+	case "name is required", "price and stock cannot be negative", "quantity must be positive", "variant required", "variant not found",
+		"image is too large", "unsupported image type", "invalid image", "image dimensions are too large",
+		"invalid available_from", "invalid available_until", "available_until must be after available_from", "limits cannot be negative",
+		"delta must not be zero", "note is required", "stock cannot be negative":
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
 	}
+}
 
-	c.JSON(http.StatusOK, metrics)
+func handleAdminGetShopItems(c *gin.Context) {
+	items, err := GetAdminShopItems()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch shop items"})
+		return
+	}
+
+	c.JSON(http.StatusOK, items)
 }
 
-// Admin get all users
-// Admin get all users
-func handleAdminGetUsers(c *gin.Context) {
-	var users []User
-	if err := DB.Order("created_at DESC").Find(&users).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+func handleAdminCreateShopItem(c *gin.Context) {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	responses := make([]AdminUserResponse, 0)
-	for _, user := range users {
-		var completedCount int64
-		DB.Model(&UserTask{}).Where("user_id = ? AND status = ?", user.ID, "completed").Count(&completedCount)
+	var req CreateShopItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
 
-		responses = append(responses, AdminUserResponse{
-			ID:                  int(user.ID),
-			Username:            user.Username,
-			FirstName:           user.FirstName,
-			LastName:            user.LastName,
-			PhoneNumber:         user.PhoneNumber,
-			Balance:             user.Balance,
-			CurrentStreak:       user.CurrentStreak,
-			CompletedTasksCount: int(completedCount),
-			Role:                user.Role,
-			CreatedAt:           user.CreatedAt.Format("2006-01-02 15:04:05"),
-		})
+	item, err := CreateShopItem(req, uint(adminID))
+	if err != nil {
+		shopItemErrorResponse(c, err, "Failed to create shop item")
+		return
 	}
 
-	c.JSON(http.StatusOK, responses)
+	c.JSON(http.StatusCreated, item)
+}
+
+func handleAdminUpdateShopItem(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+
+	var req UpdateShopItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	item, err := UpdateShopItem(uint(itemID), req)
+	if err != nil {
+		shopItemErrorResponse(c, err, "Failed to update shop item")
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+func handleAdminArchiveShopItem(c *gin.Context) {
+	setShopItemArchived(c, true)
+}
+
+func handleAdminUnarchiveShopItem(c *gin.Context) {
+	setShopItemArchived(c, false)
+}
+
+func setShopItemArchived(c *gin.Context, archived bool) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+
+	item, err := SetShopItemArchived(uint(itemID), archived)
+	if err != nil {
+		shopItemErrorResponse(c, err, "Failed to update shop item")
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+func handleAdminRestockShopItem(c *gin.Context) {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+
+	var req RestockRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	item, err := RestockItem(uint(itemID), uint(req.VariantID), req.Quantity, uint(adminID))
+	if err != nil {
+		shopItemErrorResponse(c, err, "Failed to restock item")
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+func handleAdminAdjustStock(c *gin.Context) {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+
+	var req StockAdjustmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	item, err := AdjustStock(uint(itemID), uint(req.VariantID), req.Delta, req.Note, uint(adminID))
+	if err != nil {
+		shopItemErrorResponse(c, err, "Failed to adjust stock")
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+func handleAdminGetStockMovements(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+
+	page, pageSize := parsePagination(c, 50, 200)
+	movements, err := GetStockMovements(uint(itemID), page, pageSize)
+	if err != nil {
+		shopItemErrorResponse(c, err, "Failed to fetch stock movements")
+		return
+	}
+
+	c.JSON(http.StatusOK, movements)
+}
+
+func handleAdminUploadShopItemImage(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+
+	if _, err := getAdminShopItem(uint(itemID)); err != nil {
+		shopItemErrorResponse(c, err, "Failed to upload image")
+		return
+	}
+
+	file, err := c.FormFile("image")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
+		return
+	}
+
+	imageURL, thumbnailURL, err := SaveShopImage(uint(itemID), file)
+	if err != nil {
+		shopItemErrorResponse(c, err, "Failed to save image")
+		return
+	}
+
+	item, err := SetShopItemImage(uint(itemID), imageURL, thumbnailURL)
+	if err != nil {
+		RemoveShopImage(imageURL)
+		RemoveShopImage(thumbnailURL)
+		shopItemErrorResponse(c, err, "Failed to update shop item")
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+// Admin shop variant handlers
+func variantErrorResponse(c *gin.Context, err error, fallback string) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	switch err.Error() {
+	case "sku is required", "stock cannot be negative":
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case "sku already exists", "variant has purchases":
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
+
+func handleAdminGetVariants(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+
+	variants, err := GetItemVariants(uint(itemID))
+	if err != nil {
+		variantErrorResponse(c, err, "Failed to fetch variants")
+		return
+	}
+
+	c.JSON(http.StatusOK, variants)
+}
+
+func handleAdminCreateVariant(c *gin.Context) {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+
+	var req VariantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	variant, err := CreateItemVariant(uint(itemID), req, uint(adminID))
+	if err != nil {
+		variantErrorResponse(c, err, "Failed to create variant")
+		return
+	}
+
+	c.JSON(http.StatusCreated, variant)
+}
+
+func handleAdminUpdateVariant(c *gin.Context) {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	variantID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid variant ID"})
+		return
+	}
+
+	var req VariantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	variant, err := UpdateItemVariant(uint(variantID), req, uint(adminID))
+	if err != nil {
+		variantErrorResponse(c, err, "Failed to update variant")
+		return
+	}
+
+	c.JSON(http.StatusOK, variant)
+}
+
+func handleAdminDeleteVariant(c *gin.Context) {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	variantID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid variant ID"})
+		return
+	}
+
+	if err := DeleteItemVariant(uint(variantID), uint(adminID)); err != nil {
+		variantErrorResponse(c, err, "Failed to delete variant")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Variant deleted successfully"})
+}
+
+// Admin notification handlers
+func handleAdminGetNotifications(c *gin.Context) {
+	page, pageSize := parsePagination(c, 20, 100)
+	notifications, err := GetAdminNotifications(c.Query("unread") == "true", page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch notifications"})
+		return
+	}
+
+	c.JSON(http.StatusOK, notifications)
+}
+
+func handleAdminMarkNotificationRead(c *gin.Context) {
+	notificationID, err := strconv.Atoi(c.Param("id"))
+	if err != nil || notificationID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification ID"})
+		return
+	}
+
+	if err := MarkAdminNotificationsRead(uint(notificationID)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notification"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Notification marked as read"})
+}
+
+func handleAdminMarkAllNotificationsRead(c *gin.Context) {
+	if err := MarkAdminNotificationsRead(0); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notifications"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "All notifications marked as read"})
 }
 
 // Admin get all tasks
@@ -579,6 +3022,13 @@ func handleAdminCreateTask(c *gin.Context) {
 		return
 	}
 
+	// Task lists only show Russian tasks, so only those unlock anything
+	if task.Language == "ru" {
+		if err := enqueueTaskUnlockNotifications(task); err != nil {
+			log.Printf("task %d unlock notifications: %v", task.ID, err)
+		}
+	}
+
 	c.JSON(http.StatusCreated, AdminTaskResponse{
 		ID:            int(task.ID),
 		Title:         task.Title,
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif" // register the GIF decoder for image.Decode
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"golang.org/x/image/draw"
+)
+
+const (
+	maxShopImageSize      = 5 << 20 // 5 MB
+	maxShopImagePixels    = 40_000_000
+	shopImageMaxSide      = 1024
+	shopThumbnailMaxSide  = 256
+	shopImageUploadDir    = "./uploads/shop"
+	shopImageURLPrefix    = "/uploads/shop/"
+	shopImageJPEGQuality  = 85
+	shopImageSniffedBytes = 512
+)
+
+// allowedShopImageTypes maps sniffed MIME types to the output file extension
+var allowedShopImageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".png", // re-encoded as a static PNG
+}
+
+// SaveShopImage validates an uploaded product image, stores a resized copy
+// and a thumbnail under /uploads/shop and returns their public URLs
+func SaveShopImage(itemID uint, fileHeader *multipart.FileHeader) (string, string, error) {
+	if fileHeader.Size > maxShopImageSize {
+		return "", "", fmt.Errorf("image is too large")
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	// The header size can lie; never read more than the limit
+	data, err := io.ReadAll(io.LimitReader(file, maxShopImageSize+1))
+	if err != nil {
+		return "", "", err
+	}
+	if len(data) > maxShopImageSize {
+		return "", "", fmt.Errorf("image is too large")
+	}
+
+	// Trust the content, not the file name or the client's Content-Type
+	sniffLen := len(data)
+	if sniffLen > shopImageSniffedBytes {
+		sniffLen = shopImageSniffedBytes
+	}
+	contentType := http.DetectContentType(data[:sniffLen])
+	ext, ok := allowedShopImageTypes[contentType]
+	if !ok {
+		return "", "", fmt.Errorf("unsupported image type")
+	}
+
+	// Reject decompression bombs before decoding the full image
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid image")
+	}
+	if config.Width*config.Height > maxShopImagePixels {
+		return "", "", fmt.Errorf("image dimensions are too large")
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid image")
+	}
+
+	if err := os.MkdirAll(shopImageUploadDir, 0755); err != nil {
+		return "", "", err
+	}
+
+	base := fmt.Sprintf("%d_%s", itemID, uuid.New().String())
+	imageName := base + ext
+	thumbName := base + "_thumb" + ext
+
+	if err := writeImage(filepath.Join(shopImageUploadDir, imageName), resizeToFit(img, shopImageMaxSide), ext); err != nil {
+		return "", "", err
+	}
+	if err := writeImage(filepath.Join(shopImageUploadDir, thumbName), resizeToFit(img, shopThumbnailMaxSide), ext); err != nil {
+		os.Remove(filepath.Join(shopImageUploadDir, imageName))
+		return "", "", err
+	}
+
+	return shopImageURLPrefix + imageName, shopImageURLPrefix + thumbName, nil
+}
+
+// RemoveShopImage deletes a previously uploaded image. URLs that don't point
+// into the shop upload directory (e.g. emoji images) are ignored.
+func RemoveShopImage(url string) {
+	if !strings.HasPrefix(url, shopImageURLPrefix) {
+		return
+	}
+	name := filepath.Base(strings.TrimPrefix(url, shopImageURLPrefix))
+	os.Remove(filepath.Join(shopImageUploadDir, name))
+}
+
+// resizeToFit scales img down so its longest side is at most maxSide
+func resizeToFit(img image.Image, maxSide int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSide && height <= maxSide {
+		return img
+	}
+
+	if width >= height {
+		height = height * maxSide / width
+		width = maxSide
+	} else {
+		width = width * maxSide / height
+		height = maxSide
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst
+}
+
+func writeImage(path string, img image.Image, ext string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if ext == ".jpg" {
+		return jpeg.Encode(out, img, &jpeg.Options{Quality: shopImageJPEGQuality})
+	}
+	return png.Encode(out, img)
+}
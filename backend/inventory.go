@@ -0,0 +1,502 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// All stock changes go through changeStock, which records a StockMovement,
+// raises admin alerts when an item drops to its low-stock threshold or sells
+// out, and notifies waitlisted users when an item comes back in stock.
+
+// Stock movement reasons
+const (
+	StockSale       = "sale"
+	StockRestock    = "restock"
+	StockRefund     = "refund"
+	StockCorrection = "correction"
+)
+
+// Admin notification kinds
+const (
+	AdminAlertLowStock   = "low_stock"
+	AdminAlertOutOfStock = "out_of_stock"
+)
+
+// Telegram notification kind for waitlisted users, sent under the
+// purchase_updates preference
+const NotifyBackInStock = "back_in_stock"
+
+func init() {
+	notificationTexts[NotifyBackInStock] = map[string]string{
+		"ru": "✅ Снова в наличии: %s. Успейте купить!",
+		"en": "✅ Back in stock: %s. Get it while it lasts!",
+	}
+}
+
+// stockChange describes why stock changes, for the movement history
+type stockChange struct {
+	Reason     string
+	PurchaseID string
+	AdminID    *uint
+	Note       string
+}
+
+// changeStock adds delta to the stock of an item or, when variantID is set,
+// of one of its variants, keeping the item total in sync. Stock never goes
+// below zero: a decrease that doesn't fit fails with "item out of stock".
+func changeStock(tx *gorm.DB, itemID uint, variantID *uint, delta int, change stockChange) error {
+	if delta == 0 {
+		return nil
+	}
+
+	var result *gorm.DB
+	if variantID != nil {
+		result = tx.Model(&ShopItemVariant{}).Where("id = ? AND item_id = ? AND stock + ? >= 0", *variantID, itemID, delta).
+			UpdateColumn("stock", gorm.Expr("stock + ?", delta))
+	} else {
+		result = tx.Model(&ShopItem{}).Where("id = ? AND stock + ? >= 0", itemID, delta).
+			UpdateColumn("stock", gorm.Expr("stock + ?", delta))
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if delta < 0 {
+			return fmt.Errorf("item out of stock")
+		}
+		if variantID != nil {
+			return fmt.Errorf("variant not found")
+		}
+		return gorm.ErrRecordNotFound
+	}
+	if variantID != nil {
+		if err := syncItemStock(tx, itemID); err != nil {
+			return err
+		}
+	}
+
+	var item ShopItem
+	if err := tx.First(&item, itemID).Error; err != nil {
+		return err
+	}
+	movement := StockMovement{
+		ItemID:     itemID,
+		VariantID:  variantID,
+		Delta:      delta,
+		StockAfter: item.Stock,
+		Reason:     change.Reason,
+		PurchaseID: change.PurchaseID,
+		AdminID:    change.AdminID,
+		Note:       change.Note,
+	}
+	var variant *ShopItemVariant
+	if variantID != nil {
+		variant = &ShopItemVariant{}
+		if err := tx.First(variant, *variantID).Error; err != nil {
+			return err
+		}
+		movement.StockAfter = variant.Stock
+		movement.VariantLabel = variant.Label()
+	}
+	if err := tx.Create(&movement).Error; err != nil {
+		return err
+	}
+
+	if delta < 0 {
+		return raiseStockAlerts(tx, item, variant, delta)
+	}
+	return notifyWaitlist(tx, item, variant)
+}
+
+// raiseStockAlerts creates admin notifications when a decrease crosses the
+// item's low-stock threshold or sells out the item or a variant
+func raiseStockAlerts(tx *gorm.DB, item ShopItem, variant *ShopItemVariant, delta int) error {
+	before := item.Stock - delta
+	threshold := item.LowStockThreshold
+
+	var alerts []AdminNotification
+	switch {
+	case item.Stock == 0 && before > 0:
+		alerts = append(alerts, AdminNotification{
+			Kind:    AdminAlertOutOfStock,
+			ItemID:  &item.ID,
+			Message: fmt.Sprintf("%s is out of stock", item.Name),
+		})
+	case threshold > 0 && item.Stock <= threshold && before > threshold:
+		alerts = append(alerts, AdminNotification{
+			Kind:    AdminAlertLowStock,
+			ItemID:  &item.ID,
+			Message: fmt.Sprintf("%s is running low: %d left (threshold %d)", item.Name, item.Stock, threshold),
+		})
+	}
+	// A sold-out variant is worth an alert even while other variants remain
+	if variant != nil && variant.Stock == 0 && variant.Stock-delta > 0 && item.Stock > 0 {
+		alerts = append(alerts, AdminNotification{
+			Kind:      AdminAlertOutOfStock,
+			ItemID:    &item.ID,
+			VariantID: &variant.ID,
+			Message:   fmt.Sprintf("%s (%s) is out of stock", item.Name, variant.Label()),
+		})
+	}
+
+	if len(alerts) == 0 {
+		return nil
+	}
+	return tx.Create(&alerts).Error
+}
+
+// notifyWaitlist notifies users waiting for the item (any variant) or for a
+// variant that is now in stock. Users without Telegram can't be messaged, so
+// their entries are not marked as notified; GET /user/waitlist shows them the
+// item is back in stock.
+func notifyWaitlist(tx *gorm.DB, item ShopItem, variant *ShopItemVariant) error {
+	if item.ArchivedAt != nil || item.Stock == 0 {
+		return nil
+	}
+
+	query := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("item_id = ? AND notified_at IS NULL", item.ID)
+	name := item.Name
+	if variant != nil {
+		if variant.Stock == 0 {
+			return nil
+		}
+		query = query.Where("variant_id IN ?", []uint{0, variant.ID})
+	} else {
+		query = query.Where("variant_id = ?", 0)
+	}
+
+	var entries []WaitlistEntry
+	if err := query.Find(&entries).Error; err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	ids := make([]uint, 0, len(entries))
+	for _, entry := range entries {
+		var user User
+		if err := tx.First(&user, entry.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			}
+			return err
+		}
+		if user.TelegramID == nil {
+			continue
+		}
+		ids = append(ids, entry.ID)
+
+		entryName := name
+		if variant != nil && entry.VariantID == variant.ID {
+			entryName += " (" + variant.Label() + ")"
+		}
+		text := notificationText(NotifyBackInStock, user.Language, entryName)
+		dedupKey := fmt.Sprintf("waitlist:%d:%d", entry.ID, now.Unix())
+		if err := enqueueNotification(tx, user.ID, NotifyBackInStock, text, dedupKey, nil); err != nil {
+			return err
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return tx.Model(&WaitlistEntry{}).Where("id IN ?", ids).Update("notified_at", &now).Error
+}
+
+// AdjustStock applies a manual correction, e.g. after a stock count (admin only)
+func AdjustStock(itemID, variantID uint, delta int, note string, adminID uint) (*AdminShopItemResponse, error) {
+	note = strings.TrimSpace(note)
+	if delta == 0 {
+		return nil, fmt.Errorf("delta must not be zero")
+	}
+	if note == "" {
+		return nil, fmt.Errorf("note is required")
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var item ShopItem
+		if err := tx.Preload("Variants").First(&item, itemID).Error; err != nil {
+			return err
+		}
+		target, err := stockTarget(item, variantID)
+		if err != nil {
+			return err
+		}
+
+		err = changeStock(tx, itemID, target, delta, stockChange{Reason: StockCorrection, AdminID: &adminID, Note: note})
+		if err != nil && err.Error() == "item out of stock" {
+			return fmt.Errorf("stock cannot be negative")
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return getAdminShopItem(itemID)
+}
+
+// stockTarget checks variantID against the item: items with variants keep
+// stock per variant, items without keep it on the item itself
+func stockTarget(item ShopItem, variantID uint) (*uint, error) {
+	if len(item.Variants) == 0 {
+		if variantID != 0 {
+			return nil, fmt.Errorf("variant not found")
+		}
+		return nil, nil
+	}
+	if variantID == 0 {
+		return nil, fmt.Errorf("variant required")
+	}
+	for _, variant := range item.Variants {
+		if variant.ID == variantID {
+			return &variantID, nil
+		}
+	}
+	return nil, fmt.Errorf("variant not found")
+}
+
+// GetStockMovements returns an item's stock history, newest first (admin only)
+func GetStockMovements(itemID uint, page, pageSize int) (*StockMovementsResponse, error) {
+	var item ShopItem
+	if err := DB.First(&item, itemID).Error; err != nil {
+		return nil, err
+	}
+
+	var total int64
+	if err := DB.Model(&StockMovement{}).Where("item_id = ?", itemID).Count(&total).Error; err != nil {
+		return nil, err
+	}
+
+	var movements []StockMovement
+	if err := DB.Where("item_id = ?", itemID).
+		Order("id DESC").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&movements).Error; err != nil {
+		return nil, err
+	}
+
+	response := &StockMovementsResponse{
+		Movements: make([]StockMovementResponse, 0, len(movements)),
+		Page:      page,
+		PageSize:  pageSize,
+		Total:     total,
+	}
+	for _, movement := range movements {
+		entry := StockMovementResponse{
+			ID:         int(movement.ID),
+			Delta:      movement.Delta,
+			StockAfter: movement.StockAfter,
+			Reason:     movement.Reason,
+			PurchaseID: movement.PurchaseID,
+			Note:       movement.Note,
+			CreatedAt:  movement.CreatedAt.Format(time.RFC3339),
+		}
+		if movement.VariantID != nil {
+			variantID := int(*movement.VariantID)
+			entry.VariantID = &variantID
+			entry.Variant = movement.VariantLabel
+		}
+		if movement.AdminID != nil {
+			adminID := int(*movement.AdminID)
+			entry.AdminID = &adminID
+		}
+		response.Movements = append(response.Movements, entry)
+	}
+	return response, nil
+}
+
+// GetAdminNotifications returns the admin alert feed, newest first
+func GetAdminNotifications(unreadOnly bool, page, pageSize int) (*AdminNotificationsResponse, error) {
+	query := DB.Model(&AdminNotification{})
+	if unreadOnly {
+		query = query.Where("read_at IS NULL")
+	}
+
+	var total, unread int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, err
+	}
+	if err := DB.Model(&AdminNotification{}).Where("read_at IS NULL").Count(&unread).Error; err != nil {
+		return nil, err
+	}
+
+	var notifications []AdminNotification
+	if err := query.Order("id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&notifications).Error; err != nil {
+		return nil, err
+	}
+
+	response := &AdminNotificationsResponse{
+		Notifications: make([]AdminNotificationResponse, 0, len(notifications)),
+		Unread:        unread,
+		Page:          page,
+		PageSize:      pageSize,
+		Total:         total,
+	}
+	for _, notification := range notifications {
+		response.Notifications = append(response.Notifications, adminNotificationToResponse(notification))
+	}
+	return response, nil
+}
+
+func adminNotificationToResponse(notification AdminNotification) AdminNotificationResponse {
+	response := AdminNotificationResponse{
+		ID:        int(notification.ID),
+		Kind:      notification.Kind,
+		Message:   notification.Message,
+		Read:      notification.ReadAt != nil,
+		CreatedAt: notification.CreatedAt.Format(time.RFC3339),
+	}
+	if notification.ItemID != nil {
+		itemID := int(*notification.ItemID)
+		response.ItemID = &itemID
+	}
+	if notification.VariantID != nil {
+		variantID := int(*notification.VariantID)
+		response.VariantID = &variantID
+	}
+	return response
+}
+
+// MarkAdminNotificationsRead marks one notification, or all of them when
+// notificationID is 0, as read
+func MarkAdminNotificationsRead(notificationID uint) error {
+	query := DB.Model(&AdminNotification{}).Where("read_at IS NULL")
+	if notificationID != 0 {
+		var notification AdminNotification
+		if err := DB.First(&notification, notificationID).Error; err != nil {
+			return err
+		}
+		query = query.Where("id = ?", notificationID)
+	}
+	return query.Update("read_at", time.Now()).Error
+}
+
+// JoinWaitlist subscribes a user to an out-of-stock item. variantID 0 means
+// any variant of the item.
+func JoinWaitlist(userID, itemID, variantID uint) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var item ShopItem
+		if err := tx.Preload("Variants").First(&item, itemID).Error; err != nil {
+			return err
+		}
+		if item.ArchivedAt != nil {
+			return fmt.Errorf("item not available")
+		}
+
+		inStock := item.Stock > 0
+		if variantID != 0 {
+			var variant *ShopItemVariant
+			for i := range item.Variants {
+				if item.Variants[i].ID == variantID {
+					variant = &item.Variants[i]
+				}
+			}
+			if variant == nil {
+				return fmt.Errorf("variant not found")
+			}
+			inStock = variant.Stock > 0
+		}
+		if inStock {
+			return fmt.Errorf("item in stock")
+		}
+
+		// Joining again after a notification re-arms the entry
+		entry := WaitlistEntry{UserID: userID, ItemID: itemID, VariantID: variantID}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}, {Name: "item_id"}, {Name: "variant_id"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"notified_at": nil, "created_at": time.Now()}),
+		}).Create(&entry).Error
+	})
+}
+
+// LeaveWaitlist removes a waitlist subscription
+func LeaveWaitlist(userID, itemID, variantID uint) error {
+	result := DB.Where("user_id = ? AND item_id = ? AND variant_id = ?", userID, itemID, variantID).Delete(&WaitlistEntry{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetUserWaitlist lists the user's waitlist subscriptions, newest first
+func GetUserWaitlist(userID uint) ([]WaitlistEntryResponse, error) {
+	var entries []WaitlistEntry
+	if err := DB.Where("user_id = ?", userID).
+		Preload("Item").
+		Order("created_at DESC").
+		Find(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	// variant_id 0 means "any variant", so variants are loaded separately
+	// instead of through an association
+	var variantIDs []uint
+	for _, entry := range entries {
+		if entry.VariantID != 0 {
+			variantIDs = append(variantIDs, entry.VariantID)
+		}
+	}
+	variants := make(map[uint]ShopItemVariant)
+	if len(variantIDs) > 0 {
+		var rows []ShopItemVariant
+		if err := DB.Where("id IN ?", variantIDs).Find(&rows).Error; err != nil {
+			return nil, err
+		}
+		for _, variant := range rows {
+			variants[variant.ID] = variant
+		}
+	}
+
+	responses := make([]WaitlistEntryResponse, 0, len(entries))
+	for _, entry := range entries {
+		response := WaitlistEntryResponse{
+			ItemID:   int(entry.ItemID),
+			ItemName: entry.Item.Name,
+			Image:    entry.Item.Image,
+			InStock:  entry.Item.Stock > 0,
+			JoinedAt: entry.CreatedAt.Format(time.RFC3339),
+		}
+		if variant, ok := variants[entry.VariantID]; ok {
+			response.VariantID = int(variant.ID)
+			response.Variant = variant.Label()
+			response.InStock = variant.Stock > 0
+		}
+		if entry.NotifiedAt != nil {
+			response.NotifiedAt = entry.NotifiedAt.Format(time.RFC3339)
+		}
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
+
+// pendingWaitlistCounts returns the number of users waiting per item
+func pendingWaitlistCounts(db *gorm.DB) (map[uint]int64, error) {
+	var rows []struct {
+		ItemID uint
+		Count  int64
+	}
+	if err := db.Model(&WaitlistEntry{}).
+		Select("item_id, COUNT(*) AS count").
+		Where("notified_at IS NULL").
+		Group("item_id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	counts := make(map[uint]int64, len(rows))
+	for _, row := range rows {
+		counts[row.ItemID] = row.Count
+	}
+	return counts, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// All balance changes go through changeBalance, which records a
+// BalanceTransaction so support can explain every point a user has.
+
+// Balance transaction reasons
+const (
+	BalanceTaskReward      = "task_reward"
+	BalanceReferral        = "referral"
+	BalancePurchase        = "purchase"
+	BalanceRefund          = "refund"
+	BalanceTaskReset       = "task_reset"
+	BalanceAdminAdjustment = "admin_adjustment"
+)
+
+// balanceChange describes why a balance changes, for the balance history
+type balanceChange struct {
+	Reason     string
+	TaskID     *uint
+	PurchaseID string
+	OrderID    string
+	AdminID    *uint
+	Note       string
+}
+
+// changeBalance adds delta to a user's balance. The balance never goes below
+// zero: a decrease that doesn't fit fails with "insufficient balance".
+func changeBalance(tx *gorm.DB, userID uint, delta int, change balanceChange) error {
+	if delta == 0 {
+		return nil
+	}
+
+	result := tx.Model(&User{}).Where("id = ? AND balance + ? >= 0", userID, delta).
+		UpdateColumn("balance", gorm.Expr("balance + ?", delta))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if delta < 0 {
+			return fmt.Errorf("insufficient balance")
+		}
+		return gorm.ErrRecordNotFound
+	}
+
+	var balance int
+	if err := tx.Model(&User{}).Where("id = ?", userID).Pluck("balance", &balance).Error; err != nil {
+		return err
+	}
+	if err := tx.Create(&BalanceTransaction{
+		UserID:       userID,
+		Delta:        delta,
+		BalanceAfter: balance,
+		Reason:       change.Reason,
+		TaskID:       change.TaskID,
+		PurchaseID:   change.PurchaseID,
+		OrderID:      change.OrderID,
+		AdminID:      change.AdminID,
+		Note:         change.Note,
+	}).Error; err != nil {
+		return err
+	}
+
+	if delta > 0 && earnedBalanceReasons[change.Reason] {
+		return checkBalanceSpike(tx, userID, time.Now())
+	}
+	return nil
+}
+
+func balanceTransactionToResponse(transaction BalanceTransaction) BalanceTransactionResponse {
+	response := BalanceTransactionResponse{
+		ID:           int(transaction.ID),
+		Delta:        transaction.Delta,
+		BalanceAfter: transaction.BalanceAfter,
+		Reason:       transaction.Reason,
+		PurchaseID:   transaction.PurchaseID,
+		OrderID:      transaction.OrderID,
+		Note:         transaction.Note,
+		CreatedAt:    transaction.CreatedAt.Format(time.RFC3339),
+	}
+	if transaction.TaskID != nil {
+		taskID := int(*transaction.TaskID)
+		response.TaskID = &taskID
+	}
+	if transaction.AdminID != nil {
+		adminID := int(*transaction.AdminID)
+		response.AdminID = &adminID
+	}
+	return response
+}
+
+// GetBalanceHistory returns a user's balance history, newest first (admin only)
+func GetBalanceHistory(userID uint, page, pageSize int) (*BalanceHistoryResponse, error) {
+	if _, err := GetUserByID(userID); err != nil {
+		return nil, err
+	}
+
+	var total int64
+	if err := DB.Model(&BalanceTransaction{}).Where("user_id = ?", userID).Count(&total).Error; err != nil {
+		return nil, err
+	}
+
+	var transactions []BalanceTransaction
+	if err := DB.Where("user_id = ?", userID).
+		Order("id DESC").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&transactions).Error; err != nil {
+		return nil, err
+	}
+
+	response := &BalanceHistoryResponse{
+		Transactions: make([]BalanceTransactionResponse, 0, len(transactions)),
+		Page:         page,
+		PageSize:     pageSize,
+		Total:        total,
+	}
+	for _, transaction := range transactions {
+		response.Transactions = append(response.Transactions, balanceTransactionToResponse(transaction))
+	}
+	return response, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EmailMessage is a rendered email ready to be sent
+type EmailMessage struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers emails. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(msg EmailMessage) error
+}
+
+// NewMailerFromEnv picks the mailer from MAIL_DRIVER: "smtp", "file" or "log" (default)
+func NewMailerFromEnv() Mailer {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "X5 Tech <no-reply@x5tech.local>"
+	}
+
+	switch os.Getenv("MAIL_DRIVER") {
+	case "smtp":
+		return &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     getEnvInt("SMTP_PORT", 587),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "./mail"
+		}
+		return &FileMailer{Dir: dir, From: from}
+	default:
+		return &LogMailer{}
+	}
+}
+
+// SMTPMailer sends mail through an SMTP server, using STARTTLS when the server offers it
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg EmailMessage) error {
+	if m.Host == "" {
+		return fmt.Errorf("smtp host is not configured")
+	}
+	data, err := buildMIMEMessage(m.From, msg)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	addr := m.Host + ":" + strconv.Itoa(m.Port)
+	return smtp.SendMail(addr, auth, envelopeAddress(m.From), []string{msg.To}, data)
+}
+
+// FileMailer writes every email as an .eml file, for local development
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func (m *FileMailer) Send(msg EmailMessage) error {
+	data, err := buildMIMEMessage(m.From, msg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s_%s.eml", time.Now().Format("20060102-150405.000"), unsafeFilenameChars.ReplaceAllString(msg.To, "_"))
+	return os.WriteFile(filepath.Join(m.Dir, name), data, 0644)
+}
+
+// LogMailer only logs emails; it is the default when no driver is configured
+type LogMailer struct{}
+
+func (m *LogMailer) Send(msg EmailMessage) error {
+	log.Printf("mail to=%s subject=%q\n%s", msg.To, msg.Subject, msg.Text)
+	return nil
+}
+
+var angleAddress = regexp.MustCompile(`<([^>]+)>`)
+
+// envelopeAddress extracts "a@b" from "Name <a@b>"
+func envelopeAddress(from string) string {
+	if match := angleAddress.FindStringSubmatch(from); match != nil {
+		return match[1]
+	}
+	return from
+}
+
+// buildMIMEMessage encodes msg as multipart/alternative (text + HTML)
+func buildMIMEMessage(from string, msg EmailMessage) ([]byte, error) {
+	var alternative bytes.Buffer
+	altWriter := multipart.NewWriter(&alternative)
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=UTF-8", msg.Text},
+		{"text/html; charset=UTF-8", msg.HTML},
+	} {
+		if part.body == "" {
+			continue
+		}
+		w, err := altWriter.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := altWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	contentType := "multipart/alternative; boundary=" + altWriter.Boundary()
+	body := alternative.Bytes()
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "From: %s\r\n", from)
+	fmt.Fprintf(&out, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&out, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", msg.Subject))
+	fmt.Fprintf(&out, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&out, "Message-ID: <%s@%s>\r\n", uuid.New().String(), mailDomain(from))
+	out.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&out, "Content-Type: %s\r\n\r\n", contentType)
+	out.Write(body)
+	return out.Bytes(), nil
+}
+
+func mailDomain(from string) string {
+	address := envelopeAddress(from)
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return address[i+1:]
+	}
+	return "localhost"
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -14,14 +18,32 @@ func main() {
 	}
 	defer CloseDB()
 
+	// Send queued purchase emails in the background
+	StartEmailOutboxWorker(NewMailerFromEnv())
+	StartNotificationWorker(NewTelegramSenderFromEnv())
+	resumeScanner = NewVirusScannerFromEnv()
+
 	r := gin.Default()
 
+	// Client IPs key the rate limits and anti-cheat checks, so X-Forwarded-For
+	// is only believed when it comes from a configured proxy
+	if err := r.SetTrustedProxies(trustedProxiesFromEnv()); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
 	// CORS configuration
 	config := cors.DefaultConfig()
 	config.AllowAllOrigins = true
-	config.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization"}
+	config.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization", "X-Device-ID"}
 	r.Use(cors.New(config))
 
+	// Throttling of login, answer submission and purchases
+	limiter := NewRateLimiterFromEnv()
+	authLimit := limiter.Middleware(rateLimitRuleFromEnv("auth", RateLimit{Burst: 20, Period: time.Minute}, RateLimit{}))
+	adminLoginLimit := limiter.Middleware(rateLimitRuleFromEnv("admin_login", RateLimit{Burst: 5, Period: 15 * time.Minute}, RateLimit{}))
+	submitLimit := limiter.Middleware(rateLimitRuleFromEnv("submit", RateLimit{Burst: 120, Period: time.Minute}, RateLimit{Burst: 10, Period: time.Minute}))
+	buyLimit := limiter.Middleware(rateLimitRuleFromEnv("buy", RateLimit{Burst: 60, Period: time.Minute}, RateLimit{Burst: 10, Period: time.Minute}))
+
 	// Health check
 	r.GET("/ping", ping)
 
@@ -33,6 +55,7 @@ func main() {
 	{
 		// Auth routes (no auth required)
 		auth := api.Group("/auth")
+		auth.Use(authLimit)
 		{
 			auth.POST("/telegram", handleTelegramAuth)
 			auth.POST("/phone", handlePhoneAuth)
@@ -44,9 +67,26 @@ func main() {
 		{
 			user.GET("/me", handleGetUserMe)
 			user.PUT("/me", handleUpdateUserMe)
+			user.PUT("/privacy", handleUpdatePrivacy)
+			user.GET("/notifications", handleGetNotificationSettings)
+			user.PUT("/notifications", handleUpdateNotificationSettings)
 			user.POST("/avatar", handleUploadAvatar)
+			user.GET("/resume", handleGetResume)
+			user.POST("/resume", handleUploadResume)
+			user.DELETE("/resume", handleDeleteResume)
 			user.GET("/inventory", handleGetInventory)
+			user.GET("/waitlist", handleGetWaitlist)
+			user.GET("/inventory/:purchase_id/redemption-token", handleGetRedemptionToken)
+			user.GET("/inventory/:purchase_id/qr", handleGetRedemptionQR)
+			user.GET("/orders", handleGetOrders)
+			user.GET("/orders/:order_id", handleGetOrder)
+			user.GET("/orders/:order_id/redemption-token", handleGetRedemptionToken)
+			user.GET("/orders/:order_id/qr", handleGetRedemptionQR)
 			user.GET("/metrics", handleGetUserMetrics) // New metrics endpoint
+			user.GET("/friends", handleGetFriends)
+			user.POST("/friends", handleAddFriend)
+			user.DELETE("/friends/:id", handleRemoveFriend)
+			user.GET("/referrals", handleGetReferrals)
 		}
 
 		// Task routes (auth required)
@@ -55,14 +95,43 @@ func main() {
 		{
 			tasks.GET("", handleGetTasks)
 			tasks.GET("/:id", handleGetTaskByID)
-			tasks.POST("/:id/submit", handleSubmitTask)
+			tasks.POST("/:id/submit", submitLimit, handleSubmitTask)
+		}
+
+		// Team routes (auth required)
+		teams := api.Group("/teams")
+		teams.Use(AuthMiddleware())
+		{
+			teams.GET("/my", handleGetMyTeams)
+			teams.POST("", handleCreateTeam)
+			teams.POST("/join", handleJoinTeam)
+			teams.GET("/:id", handleGetTeam)
+			teams.POST("/:id/leave", handleLeaveTeam)
+			teams.DELETE("/:id/members/:user_id", handleKickTeamMember)
+		}
+
+		// Competition routes (public)
+		competitions := api.Group("/competitions")
+		{
+			competitions.GET("", handleGetCompetitions)
+			competitions.GET("/:id/leaderboard", handleGetTeamLeaderboard)
 		}
 
 		// Shop routes
 		shop := api.Group("/shop")
 		{
-			shop.GET("/items", handleGetShopItems)             // Public endpoint
-			shop.POST("/buy", AuthMiddleware(), handleBuyItem) // Auth required
+			shop.GET("/items", OptionalAuthMiddleware(), handleGetShopItems) // Public endpoint, personalized when logged in
+			shop.POST("/buy", AuthMiddleware(), buyLimit, handleBuyItem)     // Auth required
+			shop.GET("/pickup-locations", handleGetPickupLocations)          // Public endpoint
+			shop.POST("/promo-codes/check", AuthMiddleware(), handlePreviewPromoCode)
+			shop.GET("/cart", AuthMiddleware(), handleGetCart)
+			shop.POST("/cart", AuthMiddleware(), handleAddToCart)
+			shop.PUT("/cart", AuthMiddleware(), handleUpdateCartItem)
+			shop.DELETE("/cart", AuthMiddleware(), handleClearCart)
+			shop.DELETE("/cart/items/:item_id", AuthMiddleware(), handleRemoveCartItem)
+			shop.POST("/checkout", AuthMiddleware(), buyLimit, handleCheckout)
+			shop.POST("/items/:id/waitlist", AuthMiddleware(), handleJoinWaitlist)
+			shop.DELETE("/items/:id/waitlist", AuthMiddleware(), handleLeaveWaitlist)
 		}
 
 		// Admin routes (auth + admin role required)
@@ -70,8 +139,69 @@ func main() {
 		admin.Use(AuthMiddleware(), AdminMiddleware())
 		{
 			admin.POST("/redeem", handleRedeemPurchase)
+			admin.POST("/redeem/preview", handleAdminPreviewRedemption)
+			admin.GET("/redemptions", handleAdminGetRedemptions)
+			admin.POST("/redemptions/:id/undo", handleAdminUndoRedemption)
+			admin.GET("/fulfillment", handleAdminGetFulfillmentQueue)
+			admin.GET("/purchases", handleAdminGetPurchases)
+			admin.GET("/purchases/:purchase_id", handleAdminGetPurchase)
+			admin.POST("/purchases/:purchase_id/status", handleAdminUpdatePurchaseStatus)
+			admin.GET("/pickup-locations", handleAdminGetPickupLocations)
+			admin.POST("/pickup-locations", handleAdminCreatePickupLocation)
+			admin.PUT("/pickup-locations/:id", handleAdminUpdatePickupLocation)
+			admin.GET("/promo-codes", handleAdminGetPromoCodes)
+			admin.POST("/promo-codes", handleAdminCreatePromoCode)
+			admin.GET("/promo-codes/:id", handleAdminGetPromoCode)
+			admin.PUT("/promo-codes/:id", handleAdminUpdatePromoCode)
+			admin.DELETE("/promo-codes/:id", handleAdminDeletePromoCode)
 			admin.GET("/metrics", handleAdminMetrics)
+			admin.GET("/analytics/registrations", handleAdminRegistrationAnalytics)
+			admin.GET("/analytics/active-users", handleAdminActiveUserAnalytics)
+			admin.GET("/analytics/task-completions", handleAdminTaskCompletionAnalytics)
+			admin.GET("/analytics/points", handleAdminPointsAnalytics)
+			admin.GET("/analytics/purchases", handleAdminPurchaseAnalytics)
+			admin.GET("/analytics/funnel", handleAdminFunnelAnalytics)
+			admin.GET("/analytics/retention", handleAdminRetentionAnalytics)
+			admin.GET("/analytics/level-times", handleAdminLevelTimeAnalytics)
+			admin.GET("/notifications", handleAdminGetNotifications)
+			admin.POST("/notifications/read-all", handleAdminMarkAllNotificationsRead)
+			admin.POST("/notifications/:id/read", handleAdminMarkNotificationRead)
 			admin.GET("/users", handleAdminGetUsers)
+			admin.GET("/users/:id", handleAdminGetUser)
+			admin.GET("/users/:id/balance-history", handleAdminGetBalanceHistory)
+			admin.GET("/users/:id/resume", handleAdminDownloadResume)
+			admin.POST("/users/:id/balance", handleAdminAdjustBalance)
+			admin.POST("/users/:id/tasks/:task_id/reset", handleAdminResetUserTask)
+			admin.PUT("/users/:id/role", handleAdminChangeUserRole)
+			admin.POST("/users/:id/ban", handleAdminBanUser)
+			admin.POST("/users/:id/shadow-ban", handleAdminShadowBanUser)
+			admin.POST("/users/:id/unban", handleAdminUnbanUser)
+			admin.POST("/users/:id/flags/review", handleAdminReviewUserFlags)
+			admin.GET("/candidates", handleAdminGetCandidates)
+			admin.GET("/candidates/export", handleAdminExportCandidates)
+			admin.GET("/candidates/:id", handleAdminGetCandidate)
+			admin.PUT("/candidates/:id", handleAdminUpdateCandidate)
+			admin.DELETE("/candidates/:id", handleAdminUnmarkCandidate)
+			admin.POST("/candidates/:id/notes", handleAdminAddCandidateNote)
+			admin.GET("/flags", handleAdminGetFlagQueue)
+			admin.GET("/audit-log", handleAdminGetAuditLog)
+			admin.GET("/referrals", handleAdminGetReferrals)
+			admin.GET("/competitions", handleGetCompetitions)
+			admin.POST("/competitions", handleAdminCreateCompetition)
+			admin.POST("/competitions/:id/close", handleAdminCloseCompetition)
+			admin.GET("/shop/items", handleAdminGetShopItems)
+			admin.POST("/shop/items", handleAdminCreateShopItem)
+			admin.PUT("/shop/items/:id", handleAdminUpdateShopItem)
+			admin.POST("/shop/items/:id/archive", handleAdminArchiveShopItem)
+			admin.POST("/shop/items/:id/unarchive", handleAdminUnarchiveShopItem)
+			admin.POST("/shop/items/:id/restock", handleAdminRestockShopItem)
+			admin.POST("/shop/items/:id/stock-adjustment", handleAdminAdjustStock)
+			admin.GET("/shop/items/:id/stock-movements", handleAdminGetStockMovements)
+			admin.POST("/shop/items/:id/image", handleAdminUploadShopItemImage)
+			admin.GET("/shop/items/:id/variants", handleAdminGetVariants)
+			admin.POST("/shop/items/:id/variants", handleAdminCreateVariant)
+			admin.PUT("/shop/variants/:id", handleAdminUpdateVariant)
+			admin.DELETE("/shop/variants/:id", handleAdminDeleteVariant)
 			admin.GET("/tasks", handleAdminGetTasks)
 			admin.POST("/tasks", handleAdminCreateTask)
 			admin.PUT("/tasks/:id", handleAdminUpdateTask)
@@ -79,11 +209,34 @@ func main() {
 		}
 
 		// Admin login (no auth required)
-		api.POST("/admin/login", handleAdminLogin)
+		api.POST("/admin/login", adminLoginLimit, handleAdminLogin)
 
 		// Leaderboard route (optional auth - works with or without)
-		api.GET("/leaderboard", handleGetLeaderboard)
+		api.GET("/leaderboard", OptionalAuthMiddleware(), handleGetLeaderboard)
 	}
 
 	r.Run(":8080")
 }
+
+// getEnvInt reads an integer environment variable, falling back to def when
+// it is unset or invalid
+func getEnvInt(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// trustedProxiesFromEnv reads the comma-separated IPs and CIDRs of reverse
+// proxies from TRUSTED_PROXIES; by default no proxy is trusted and the client
+// IP is the address of the connection
+func trustedProxiesFromEnv() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/rand"
 	"database/sql/driver"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // StringArray is a custom type for handling string arrays in Postgres
@@ -18,6 +20,9 @@ type StringArray []string
 func (a *StringArray) Scan(value interface{}) error {
 	var str string
 	switch v := value.(type) {
+	case nil:
+		*a = StringArray{}
+		return nil
 	case []byte:
 		str = string(v)
 	case string:
@@ -82,8 +87,55 @@ type User struct {
 	Role          string      `gorm:"type:varchar(50);default:student" json:"role"`
 	ResumeLink    string      `gorm:"type:text" json:"resume_link"`
 	Stack         StringArray `gorm:"type:text[]" json:"stack"`
-	CreatedAt     time.Time   `json:"created_at"`
-	UpdatedAt     time.Time   `json:"updated_at"`
+	University    string      `gorm:"type:varchar(255);index" json:"university"`
+	Track         string      `gorm:"type:varchar(100);index" json:"track"`
+	// Public identity: only the nickname is ever shown on public endpoints
+	Nickname            *string   `gorm:"type:varchar(32)" json:"nickname"`
+	HideFromLeaderboard bool      `gorm:"default:false" json:"hide_from_leaderboard"`
+	ReferralCode        string    `gorm:"type:varchar(16);uniqueIndex" json:"referral_code"`
+	ReferredByID        *uint     `gorm:"index" json:"referred_by_id"`
+	Language            string    `gorm:"type:varchar(5);default:ru" json:"language"` // "ru" or "en", used for emails
+	CreatedAt           time.Time `json:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at"`
+	// Moderation, see admin_users.go
+	Status    string     `gorm:"type:varchar(20);not null;default:active;index" json:"status"` // "active", "shadow_banned" or "banned"
+	BanReason string     `gorm:"type:text" json:"ban_reason"`
+	BannedAt  *time.Time `json:"banned_at"`
+}
+
+// BeforeCreate assigns a referral code to every new user
+func (u *User) BeforeCreate(tx *gorm.DB) error {
+	if u.ReferralCode == "" {
+		u.ReferralCode = generateReferralCode()
+	}
+	return nil
+}
+
+// referralCodeAlphabet omits characters that are easy to confuse (0/O, 1/I)
+const referralCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// generateReferralCode returns a random 8-character invite code
+func generateReferralCode() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// Fall back to a UUID fragment; still unique enough for an invite code
+		return strings.ToUpper(strings.ReplaceAll(uuid.New().String(), "-", "")[:8])
+	}
+	for i := range b {
+		b[i] = referralCodeAlphabet[int(b[i])%len(referralCodeAlphabet)]
+	}
+	return string(b)
+}
+
+// publicNameSQL is the SQL equivalent of User.PublicName
+const publicNameSQL = "COALESCE(users.nickname, 'Player #' || users.id)"
+
+// PublicName returns the name shown on public endpoints (leaderboard, friends)
+func (u User) PublicName() string {
+	if u.Nickname != nil && *u.Nickname != "" {
+		return *u.Nickname
+	}
+	return fmt.Sprintf("Player #%d", u.ID)
 }
 
 type QuestionItem struct {
@@ -91,6 +143,7 @@ type QuestionItem struct {
 	Text          string   `json:"text"`
 	Options       []string `json:"options"`
 	CorrectAnswer string   `json:"correct_answer"`
+	ProfileField  string   `json:"profile_field,omitempty"` // "university" or "track": survey answer is copied to the user profile
 }
 
 // Task model
@@ -126,15 +179,55 @@ func (UserTask) TableName() string {
 	return "user_tasks"
 }
 
-// ShopItem model
+// ShopItem model. For items with variants, Stock is the sum of variant stock.
 type ShopItem struct {
-	ID          uint      `gorm:"primaryKey" json:"id"`
-	Name        string    `gorm:"type:varchar(255);not null" json:"name"`
-	Description string    `gorm:"type:text" json:"description"`
-	Price       int       `gorm:"not null" json:"price"`
-	Image       string    `gorm:"type:text" json:"image"`
-	Stock       int       `gorm:"default:0" json:"stock"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	Name         string     `gorm:"type:varchar(255);not null" json:"name"`
+	Description  string     `gorm:"type:text" json:"description"`
+	Price        int        `gorm:"not null" json:"price"`
+	Image        string     `gorm:"type:text" json:"image"` // emoji or /uploads/shop/... URL
+	ThumbnailURL string     `gorm:"type:text" json:"thumbnail_url"`
+	Category     string     `gorm:"type:varchar(50);index" json:"category"` // e.g. "clothes", used by promo code scopes
+	Stock        int        `gorm:"default:0" json:"stock"`
+	ArchivedAt   *time.Time `gorm:"index" json:"archived_at"` // archived items are hidden from the shop but keep their purchases
+	// Purchase rules, see ShopItem.LockReason. Zero values mean "no restriction".
+	MaxPerUser          int               `gorm:"default:0" json:"max_per_user"`
+	AvailableFrom       *time.Time        `json:"available_from"`
+	AvailableUntil      *time.Time        `json:"available_until"`
+	MinCompletedTasks   int               `gorm:"default:0" json:"min_completed_tasks"`
+	MinStreak           int               `gorm:"default:0" json:"min_streak"`
+	AllowedRoles        StringArray       `gorm:"type:text[]" json:"allowed_roles"`
+	AllowedTracks       StringArray       `gorm:"type:text[]" json:"allowed_tracks"`
+	AllowedUniversities StringArray       `gorm:"type:text[]" json:"allowed_universities"`
+	LowStockThreshold   int               `gorm:"default:0" json:"low_stock_threshold"` // 0 = no low-stock alerts
+	CreatedAt           time.Time         `json:"created_at"`
+	Variants            []ShopItemVariant `gorm:"foreignKey:ItemID" json:"variants"`
+}
+
+// ShopItemVariant model (size/color option with its own SKU and stock)
+type ShopItemVariant struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	ItemID    uint      `gorm:"not null;index" json:"item_id"`
+	SKU       string    `gorm:"type:varchar(64);uniqueIndex;not null" json:"sku"`
+	Size      string    `gorm:"type:varchar(20)" json:"size"`
+	Color     string    `gorm:"type:varchar(50)" json:"color"`
+	Stock     int       `gorm:"default:0" json:"stock"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Label returns a human-readable variant name, e.g. "M / Black"
+func (v ShopItemVariant) Label() string {
+	var parts []string
+	if v.Size != "" {
+		parts = append(parts, v.Size)
+	}
+	if v.Color != "" {
+		parts = append(parts, v.Color)
+	}
+	if len(parts) == 0 {
+		return v.SKU
+	}
+	return strings.Join(parts, " / ")
 }
 
 // Purchase model
@@ -142,19 +235,382 @@ type Purchase struct {
 	ID          uint       `gorm:"primaryKey" json:"id"`
 	UserID      uint       `gorm:"not null;index" json:"user_id"`
 	ItemID      uint       `gorm:"not null;index" json:"item_id"`
+	VariantID   *uint      `gorm:"index" json:"variant_id"`
 	PurchaseID  string     `gorm:"type:uuid;uniqueIndex;not null" json:"purchase_id"`
-	Status      string     `gorm:"type:varchar(50);default:pending" json:"status"`
+	Status      string     `gorm:"type:varchar(50);default:pending;index" json:"status"` // see fulfillment.go
 	Email       string     `gorm:"type:varchar(255)" json:"email"`
 	PurchasedAt time.Time  `json:"purchased_at"`
-	RedeemedAt  *time.Time `json:"redeemed_at"`
-	User        User       `gorm:"foreignKey:UserID" json:"-"`
-	Item        ShopItem   `gorm:"foreignKey:ItemID" json:"-"`
+	RedeemedAt  *time.Time `json:"redeemed_at"` // set when the purchase is delivered
+	// Fulfillment
+	FulfillmentMethod string           `gorm:"type:varchar(20);default:pickup" json:"fulfillment_method"` // "pickup" or "delivery"
+	PickupLocationID  *uint            `gorm:"index" json:"pickup_location_id"`
+	ShippingAddress   string           `gorm:"type:text" json:"shipping_address"`
+	TrackingNumber    string           `gorm:"type:varchar(100)" json:"tracking_number"`
+	StatusUpdatedAt   *time.Time       `json:"status_updated_at"`
+	OrderID           *uint            `gorm:"index" json:"order_id"` // set for purchases made through the cart
+	Price             int              `json:"price"`                 // points paid after Discount; refunds return this amount
+	Discount          int              `gorm:"default:0" json:"discount"`
+	PromoCodeID       *uint            `gorm:"index" json:"promo_code_id"`
+	User              User             `gorm:"foreignKey:UserID" json:"-"`
+	Item              ShopItem         `gorm:"foreignKey:ItemID" json:"-"`
+	Variant           *ShopItemVariant `gorm:"foreignKey:VariantID" json:"-"`
+	PickupLocation    *PickupLocation  `gorm:"foreignKey:PickupLocationID" json:"-"`
+	Order             *Order           `gorm:"foreignKey:OrderID" json:"-"`
+	PromoCode         *PromoCode       `gorm:"foreignKey:PromoCodeID" json:"-"`
+}
+
+// PromoCode model (discount campaign, see promo.go). A code is scoped to
+// one item, to an item category, or to the whole shop when neither is set.
+type PromoCode struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	Code           string     `gorm:"type:varchar(50);uniqueIndex;not null" json:"code"` // stored upper-case
+	Description    string     `gorm:"type:text" json:"description"`
+	DiscountType   string     `gorm:"type:varchar(20);not null" json:"discount_type"` // "percent" or "fixed"
+	DiscountValue  int        `gorm:"not null" json:"discount_value"`
+	ItemID         *uint      `gorm:"index" json:"item_id"`
+	Category       string     `gorm:"type:varchar(50)" json:"category"`
+	MaxUses        int        `gorm:"default:0" json:"max_uses"`          // 0 = unlimited
+	MaxUsesPerUser int        `gorm:"default:0" json:"max_uses_per_user"` // 0 = unlimited
+	ValidFrom      *time.Time `json:"valid_from"`
+	ValidUntil     *time.Time `json:"valid_until"`
+	Active         bool       `json:"active"`
+	CreatedAt      time.Time  `json:"created_at"`
+	Item           *ShopItem  `gorm:"foreignKey:ItemID" json:"-"`
+}
+
+// Order model (one cart checkout). Every unit is a Purchase line with its own
+// status; the order groups them for the confirmation email and pickup QR code.
+type Order struct {
+	ID                uint            `gorm:"primaryKey" json:"id"`
+	OrderID           string          `gorm:"type:uuid;uniqueIndex;not null" json:"order_id"`
+	UserID            uint            `gorm:"not null;index" json:"user_id"`
+	Total             int             `gorm:"not null" json:"total"`
+	Email             string          `gorm:"type:varchar(255)" json:"email"`
+	FulfillmentMethod string          `gorm:"type:varchar(20);default:pickup" json:"fulfillment_method"`
+	PickupLocationID  *uint           `json:"pickup_location_id"`
+	ShippingAddress   string          `gorm:"type:text" json:"shipping_address"`
+	CreatedAt         time.Time       `json:"created_at"`
+	Purchases         []Purchase      `gorm:"foreignKey:OrderID" json:"-"`
+	PickupLocation    *PickupLocation `gorm:"foreignKey:PickupLocationID" json:"-"`
+}
+
+// CartItem model (server-side shopping cart line). VariantID 0 means the
+// item has no variants.
+type CartItem struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_cart_line" json:"user_id"`
+	ItemID    uint      `gorm:"not null;uniqueIndex:idx_cart_line" json:"item_id"`
+	VariantID uint      `gorm:"not null;default:0;uniqueIndex:idx_cart_line" json:"variant_id"`
+	Quantity  int       `gorm:"not null" json:"quantity"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Item      ShopItem  `gorm:"foreignKey:ItemID" json:"-"`
+}
+
+// PickupLocation model (where merch can be collected)
+type PickupLocation struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	Name         string    `gorm:"type:varchar(255);not null" json:"name"`
+	Address      string    `gorm:"type:text" json:"address"`
+	OpeningHours string    `gorm:"type:text" json:"opening_hours"` // free text, e.g. "Mon-Fri 10:00-19:00"
+	Active       bool      `gorm:"default:true" json:"active"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// EmailOutbox model (queued purchase emails, see email_outbox.go)
+type EmailOutbox struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	Kind          string     `gorm:"type:varchar(50);not null" json:"kind"`
+	ToAddress     string     `gorm:"type:varchar(255);not null" json:"to_address"`
+	PurchaseID    string     `gorm:"type:varchar(36);index" json:"purchase_id"`
+	OrderID       string     `gorm:"type:varchar(36);index" json:"order_id"`               // set instead of PurchaseID for order emails
+	Status        string     `gorm:"type:varchar(20);default:pending;index" json:"status"` // "pending", "sent" or "failed"
+	Attempts      int        `gorm:"default:0" json:"attempts"`
+	NextAttemptAt time.Time  `gorm:"index" json:"next_attempt_at"`
+	LastError     string     `gorm:"type:text" json:"last_error"`
+	SentAt        *time.Time `json:"sent_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// TableName specifies the table name for EmailOutbox
+func (EmailOutbox) TableName() string {
+	return "email_outbox"
+}
+
+// NotificationPreference model (Telegram notification settings). Users
+// without a row get the defaults from defaultNotificationPreference.
+type NotificationPreference struct {
+	UserID          uint   `gorm:"primaryKey" json:"user_id"`
+	Enabled         bool   `gorm:"default:true" json:"enabled"`
+	StreakReminders bool   `gorm:"default:true" json:"streak_reminders"`
+	TaskUnlocks     bool   `gorm:"default:true" json:"task_unlocks"`
+	PurchaseUpdates bool   `gorm:"default:true" json:"purchase_updates"`
+	QuietHoursStart *int   `json:"quiet_hours_start"` // local hour 0-23, nil = no quiet hours
+	QuietHoursEnd   *int   `json:"quiet_hours_end"`
+	Timezone        string `gorm:"type:varchar(64);default:Europe/Moscow" json:"timezone"`
+}
+
+// Notification model (queued Telegram messages, see notifications.go)
+type Notification struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	UserID        uint       `gorm:"not null;index" json:"user_id"`
+	Kind          string     `gorm:"type:varchar(50);not null" json:"kind"`
+	Text          string     `gorm:"type:text;not null" json:"text"`
+	DedupKey      *string    `gorm:"type:varchar(100);uniqueIndex" json:"-"`
+	Status        string     `gorm:"type:varchar(20);default:pending;index" json:"status"` // "pending", "sent", "skipped", "expired" or "failed"
+	Attempts      int        `gorm:"default:0" json:"attempts"`
+	NextAttemptAt time.Time  `gorm:"index" json:"next_attempt_at"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	LastError     string     `gorm:"type:text" json:"last_error"`
+	SentAt        *time.Time `json:"sent_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// StockMovement model (stock history of items and variants, see inventory.go).
+// VariantLabel is a snapshot because variants can be deleted.
+type StockMovement struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	ItemID       uint      `gorm:"not null;index" json:"item_id"`
+	VariantID    *uint     `json:"variant_id"`
+	VariantLabel string    `gorm:"type:varchar(100)" json:"variant_label"`
+	Delta        int       `gorm:"not null" json:"delta"`
+	StockAfter   int       `gorm:"not null" json:"stock_after"`             // stock of the variant, or of the item without variants
+	Reason       string    `gorm:"type:varchar(20);not null" json:"reason"` // "sale", "restock", "refund" or "correction"
+	PurchaseID   string    `gorm:"type:varchar(36)" json:"purchase_id"`     // set for sales and refunds
+	AdminID      *uint     `json:"admin_id"`                                // set for admin changes
+	Note         string    `gorm:"type:text" json:"note"`
+	CreatedAt    time.Time `gorm:"index" json:"created_at"`
+}
+
+// AdminNotification model (alerts shown in the admin panel feed)
+type AdminNotification struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	Kind      string     `gorm:"type:varchar(50);not null" json:"kind"` // "low_stock" or "out_of_stock"
+	ItemID    *uint      `gorm:"index" json:"item_id"`
+	VariantID *uint      `json:"variant_id"`
+	Message   string     `gorm:"type:text;not null" json:"message"`
+	ReadAt    *time.Time `gorm:"index" json:"read_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// WaitlistEntry model (user waiting for an out-of-stock item). VariantID 0
+// means any variant of the item.
+type WaitlistEntry struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"not null;uniqueIndex:idx_waitlist_entry" json:"user_id"`
+	ItemID     uint       `gorm:"not null;uniqueIndex:idx_waitlist_entry;index" json:"item_id"`
+	VariantID  uint       `gorm:"not null;default:0;uniqueIndex:idx_waitlist_entry" json:"variant_id"`
+	NotifiedAt *time.Time `json:"notified_at"` // set once the user has been notified of a restock
+	CreatedAt  time.Time  `json:"created_at"`
+	Item       ShopItem   `gorm:"foreignKey:ItemID" json:"-"`
+}
+
+// RedemptionLog model (one row per purchase handed over by scanning a QR
+// code, see redemption_log.go)
+type RedemptionLog struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	PurchaseID     string     `gorm:"type:uuid;index;not null" json:"purchase_id"`
+	OrderID        string     `gorm:"type:varchar(36)" json:"order_id"` // set when an order QR code was scanned
+	UserID         uint       `gorm:"not null;index" json:"user_id"`
+	AdminID        uint       `gorm:"not null;index" json:"admin_id"`
+	PreviousStatus string     `gorm:"type:varchar(50);not null" json:"previous_status"` // restored by an undo
+	RedeemedAt     time.Time  `gorm:"index" json:"redeemed_at"`
+	UndoneAt       *time.Time `json:"undone_at"`
+	UndoneByID     *uint      `json:"undone_by_id"`
+	Purchase       Purchase   `gorm:"foreignKey:PurchaseID;references:PurchaseID" json:"-"`
+	User           User       `gorm:"foreignKey:UserID" json:"-"`
+	Admin          User       `gorm:"foreignKey:AdminID" json:"-"`
+}
+
+// BalanceTransaction model (balance history of users, see ledger.go)
+type BalanceTransaction struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	UserID       uint      `gorm:"not null;index" json:"user_id"`
+	Delta        int       `gorm:"not null" json:"delta"`
+	BalanceAfter int       `gorm:"not null" json:"balance_after"`
+	Reason       string    `gorm:"type:varchar(30);not null" json:"reason"` // see the Balance* reasons in ledger.go
+	TaskID       *uint     `json:"task_id"`                                 // set for task rewards and resets
+	PurchaseID   string    `gorm:"type:varchar(36)" json:"purchase_id"`     // set for purchases and refunds
+	OrderID      string    `gorm:"type:varchar(36)" json:"order_id"`        // set for checkouts
+	AdminID      *uint     `json:"admin_id"`                                // set for admin changes
+	Note         string    `gorm:"type:text" json:"note"`
+	CreatedAt    time.Time `gorm:"index" json:"created_at"`
+}
+
+// TaskAttempt model (every answer submitted for a task, right or wrong)
+type TaskAttempt struct {
+	ID        uint        `gorm:"primaryKey" json:"id"`
+	UserID    uint        `gorm:"not null;index" json:"user_id"`
+	TaskID    uint        `gorm:"not null;index" json:"task_id"`
+	Answer    string      `gorm:"type:text" json:"answer"`
+	Answers   StringArray `gorm:"type:text[]" json:"answers"` // survey responses
+	Correct   bool        `gorm:"not null" json:"correct"`
+	CreatedAt time.Time   `gorm:"index" json:"created_at"`
+	Task      Task        `gorm:"foreignKey:TaskID" json:"-"`
+}
+
+// AdminAuditLog model (changes made by admins to user accounts, see
+// admin_users.go)
+type AdminAuditLog struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	AdminID      uint      `gorm:"not null;index" json:"admin_id"`
+	TargetUserID uint      `gorm:"not null;index" json:"target_user_id"`
+	Action       string    `gorm:"type:varchar(30);not null;index" json:"action"`
+	Details      string    `gorm:"type:text" json:"details"` // human-readable summary, e.g. "student -> admin"
+	Reason       string    `gorm:"type:text" json:"reason"`
+	CreatedAt    time.Time `gorm:"index" json:"created_at"`
+	Admin        User      `gorm:"foreignKey:AdminID" json:"-"`
+	TargetUser   User      `gorm:"foreignKey:TargetUserID" json:"-"`
+}
+
+// UserFlag model (suspicious activity raised by the anti-cheat checks, see
+// anticheat.go)
+type UserFlag struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	UserID       uint       `gorm:"not null;index" json:"user_id"`
+	Kind         string     `gorm:"type:varchar(30);not null" json:"kind"`
+	Details      string     `gorm:"type:text" json:"details"`
+	Status       string     `gorm:"type:varchar(20);not null;default:open;index" json:"status"` // "open", "dismissed" or "confirmed"
+	ReviewedByID *uint      `json:"reviewed_by_id"`
+	ReviewedAt   *time.Time `json:"reviewed_at"`
+	CreatedAt    time.Time  `gorm:"index" json:"created_at"`
+	User         User       `gorm:"foreignKey:UserID" json:"-"`
+}
+
+// LoginEvent model (IP address and device of every login, used to spot
+// many accounts run from one place)
+type LoginEvent struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;index" json:"user_id"`
+	IP        string    `gorm:"type:varchar(45);index" json:"ip"`
+	DeviceID  string    `gorm:"type:varchar(64);index" json:"device_id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+// RateLimitBucket model (token buckets shared between instances, see
+// ratelimit.go)
+type RateLimitBucket struct {
+	Key        string    `gorm:"type:varchar(200);primaryKey" json:"key"`
+	Tokens     float64   `gorm:"not null" json:"tokens"`
+	RefilledAt time.Time `gorm:"not null;index" json:"refilled_at"`
+}
+
+// Candidate model (a student recruiters are following, see candidates.go)
+type Candidate struct {
+	UserID      uint        `gorm:"primaryKey" json:"user_id"`
+	Status      string      `gorm:"type:varchar(20);not null;default:new;index" json:"status"` // "new", "contacted", "interviewing", "offered" or "rejected"
+	Tags        StringArray `gorm:"type:text[]" json:"tags"`
+	MarkedByID  uint        `json:"marked_by_id"`
+	UpdatedByID uint        `json:"updated_by_id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+	User        User        `gorm:"foreignKey:UserID" json:"-"`
+}
+
+// CandidateNote model (a recruiter's note on a student)
+type CandidateNote struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;index" json:"user_id"`
+	AuthorID  uint      `gorm:"not null" json:"author_id"`
+	Body      string    `gorm:"type:text;not null" json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	Author    User      `gorm:"foreignKey:AuthorID" json:"-"`
+}
+
+// ResumeFile model (a student's uploaded PDF resume, stored outside the
+// public uploads, see resumes.go)
+type ResumeFile struct {
+	UserID       uint      `gorm:"primaryKey" json:"user_id"`
+	StoredName   string    `gorm:"type:varchar(64);not null" json:"-"`
+	OriginalName string    `gorm:"type:varchar(255)" json:"original_name"`
+	Size         int64     `gorm:"not null" json:"size"`
+	SHA256       string    `gorm:"column:sha256;type:char(64)" json:"sha256"`
+	UploadedAt   time.Time `gorm:"not null" json:"uploaded_at"`
+	User         User      `gorm:"foreignKey:UserID" json:"-"`
+}
+
+// UsedRedemptionToken records redeemed token nonces so a QR code can't be
+// replayed, see redemption.go
+type UsedRedemptionToken struct {
+	Nonce      string    `gorm:"type:varchar(32);primaryKey" json:"nonce"`
+	PurchaseID string    `gorm:"type:uuid;index;not null" json:"purchase_id"` // order ID for order tokens
+	UsedAt     time.Time `json:"used_at"`
+}
+
+// VariantLabel returns the purchased variant's label, or "" if the item has no variants
+func (p Purchase) VariantLabel() string {
+	if p.Variant == nil {
+		return ""
+	}
+	return p.Variant.Label()
+}
+
+// Friendship model (one-directional friend list used by the friends leaderboard)
+type Friendship struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_friendship" json:"user_id"`
+	FriendID  uint      `gorm:"not null;uniqueIndex:idx_friendship;index" json:"friend_id"`
+	CreatedAt time.Time `json:"created_at"`
+	User      User      `gorm:"foreignKey:UserID" json:"-"`
+	Friend    User      `gorm:"foreignKey:FriendID" json:"-"`
+}
+
+// Referral model (one row per invited user)
+type Referral struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	ReferrerID uint       `gorm:"not null;index" json:"referrer_id"`
+	RefereeID  uint       `gorm:"not null;uniqueIndex" json:"referee_id"`         // a user can be referred only once
+	Status     string     `gorm:"type:varchar(50);default:pending" json:"status"` // "pending" or "rewarded"
+	Reward     int        `gorm:"default:0" json:"reward"`
+	RewardedAt *time.Time `json:"rewarded_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Referrer   User       `gorm:"foreignKey:ReferrerID" json:"-"`
+	Referee    User       `gorm:"foreignKey:RefereeID" json:"-"`
+}
+
+// TeamCompetition model (an event window in which teams compete)
+type TeamCompetition struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	Name         string     `gorm:"type:varchar(255);not null" json:"name"`
+	Description  string     `gorm:"type:text" json:"description"`
+	StartsAt     time.Time  `gorm:"not null" json:"starts_at"`
+	EndsAt       time.Time  `gorm:"not null" json:"ends_at"`
+	TeamCapacity int        `gorm:"not null;default:5" json:"team_capacity"`
+	Status       string     `gorm:"type:varchar(50);default:active" json:"status"` // "active" or "closed"
+	ClosedAt     *time.Time `json:"closed_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// Team model
+type Team struct {
+	ID            uint            `gorm:"primaryKey" json:"id"`
+	CompetitionID uint            `gorm:"not null;index" json:"competition_id"`
+	Name          string          `gorm:"type:varchar(100);not null" json:"name"`
+	JoinCode      string          `gorm:"type:varchar(16);uniqueIndex;not null" json:"join_code"`
+	CaptainID     uint            `gorm:"not null" json:"captain_id"`
+	FinalScore    *int            `json:"final_score"` // frozen when the competition is closed
+	FinalRank     *int            `json:"final_rank"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Competition   TeamCompetition `gorm:"foreignKey:CompetitionID" json:"-"`
+	Members       []TeamMember    `gorm:"foreignKey:TeamID" json:"-"`
+}
+
+// TeamMember model (a user can be in one team per competition)
+type TeamMember struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	TeamID        uint      `gorm:"not null;index" json:"team_id"`
+	CompetitionID uint      `gorm:"not null;uniqueIndex:idx_team_member_competition" json:"competition_id"`
+	UserID        uint      `gorm:"not null;uniqueIndex:idx_team_member_competition" json:"user_id"`
+	Role          string    `gorm:"type:varchar(50);default:member" json:"role"` // "captain" or "member"
+	JoinedAt      time.Time `json:"joined_at"`
+	User          User      `gorm:"foreignKey:UserID" json:"-"`
 }
 
 // Database operations using GORM
 
-// GetOrCreateUser gets user by telegram_id or creates a new one
-func GetOrCreateUser(telegramID int64, firstName, lastName, username, photoURL string) (*User, error) {
+// GetOrCreateUser gets user by telegram_id or creates a new one.
+// referralCode is only applied when a new user is created.
+func GetOrCreateUser(telegramID int64, firstName, lastName, username, photoURL, referralCode string) (*User, error) {
 	var user User
 	result := DB.Where("telegram_id = ?", telegramID).First(&user)
 
@@ -168,7 +624,7 @@ func GetOrCreateUser(telegramID int64, firstName, lastName, username, photoURL s
 			PhotoURL:   photoURL,
 			Role:       "student",
 		}
-		if err := DB.Create(&user).Error; err != nil {
+		if err := createUserWithReferral(&user, referralCode); err != nil {
 			return nil, err
 		}
 	} else if result.Error != nil {
@@ -178,8 +634,9 @@ func GetOrCreateUser(telegramID int64, firstName, lastName, username, photoURL s
 	return &user, nil
 }
 
-// GetOrCreateUserByPhone gets user by phone number or creates a new one
-func GetOrCreateUserByPhone(phoneNumber, firstName, lastName string) (*User, error) {
+// GetOrCreateUserByPhone gets user by phone number or creates a new one.
+// referralCode is only applied when a new user is created.
+func GetOrCreateUserByPhone(phoneNumber, firstName, lastName, referralCode string) (*User, error) {
 	var user User
 	result := DB.Where("phone_number = ?", phoneNumber).First(&user)
 
@@ -192,7 +649,7 @@ func GetOrCreateUserByPhone(phoneNumber, firstName, lastName string) (*User, err
 			Username:    firstName + "_" + lastName, // Simple default username
 			Role:        "student",
 		}
-		if err := DB.Create(&user).Error; err != nil {
+		if err := createUserWithReferral(&user, referralCode); err != nil {
 			return nil, err
 		}
 	} else if result.Error != nil {
@@ -202,136 +659,815 @@ func GetOrCreateUserByPhone(phoneNumber, firstName, lastName string) (*User, err
 	return &user, nil
 }
 
-// GetUserByID gets user by ID
-func GetUserByID(userID uint) (*User, error) {
-	var user User
-	if err := DB.First(&user, userID).Error; err != nil {
-		return nil, err
-	}
-	return &user, nil
+// createUserWithReferral creates a new user and, if referralCode belongs to
+// an existing user, links the two: a pending referral plus mutual friendship.
+// Unknown codes are ignored so a typo never blocks sign-up.
+func createUserWithReferral(user *User, referralCode string) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var referrer User
+		hasReferrer := false
+		if code := strings.ToUpper(strings.TrimSpace(referralCode)); code != "" {
+			hasReferrer = tx.Where("referral_code = ?", code).First(&referrer).Error == nil
+		}
+		if hasReferrer {
+			user.ReferredByID = &referrer.ID
+		}
+
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		if !hasReferrer {
+			return nil
+		}
+
+		if err := tx.Create(&Referral{
+			ReferrerID: referrer.ID,
+			RefereeID:  user.ID,
+			Status:     "pending",
+		}).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&[]Friendship{
+			{UserID: referrer.ID, FriendID: user.ID},
+			{UserID: user.ID, FriendID: referrer.ID},
+		}).Error
+	})
 }
 
-// UpdateUser updates user profile
-func UpdateUser(userID uint, resumeLink string, stack []string) error {
-	return DB.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
-		"resume_link": resumeLink,
-		"stack":       stack,
-	}).Error
+// referralRequiredTasks is how many tasks an invited user must complete
+// before the referral is rewarded
+func referralRequiredTasks() int {
+	return getEnvInt("REFERRAL_REQUIRED_TASKS", 3)
 }
 
-// GetTasksWithStatus gets all tasks with their status for a user (filtered by language)
-func GetTasksWithStatus(userID uint) ([]TaskResponse, error) {
-	var tasks []Task
-	// Filter by Russian language only to avoid duplicates
-	if err := DB.Where("language = ?", "ru").Order("position").Find(&tasks).Error; err != nil {
+// referralReward is the number of points both users receive
+func referralReward() int {
+	return getEnvInt("REFERRAL_REWARD", 200)
+}
+
+// rewardReferralIfEligible pays out the referee's pending referral once they
+// have completed enough tasks. Only verified accounts earn it: the referee
+// must have signed in with Telegram, whose login data is signed by the bot,
+// because phone sign-up accepts any unverified number and could be scripted
+// to farm rewards. Banned and shadow-banned referees don't earn it either;
+// their referral stays pending and is paid if they are unbanned and complete
+// another task. The conditional status update guarantees a single reward per
+// referred account even under concurrent submissions.
+func rewardReferralIfEligible(tx *gorm.DB, refereeID uint) error {
+	var referral Referral
+	if err := tx.Where("referee_id = ? AND status = ?", refereeID, "pending").First(&referral).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	var referee User
+	if err := tx.Select("id", "status", "telegram_id").First(&referee, refereeID).Error; err != nil {
+		return err
+	}
+	if referee.Status != UserActive || referee.TelegramID == nil {
+		return nil
+	}
+
+	var completed int64
+	if err := tx.Model(&UserTask{}).Where("user_id = ? AND status = ?", refereeID, "completed").Count(&completed).Error; err != nil {
+		return err
+	}
+	if completed < int64(referralRequiredTasks()) {
+		return nil
+	}
+
+	reward := referralReward()
+	now := time.Now()
+	result := tx.Model(&Referral{}).
+		Where("id = ? AND status = ?", referral.ID, "pending").
+		Updates(map[string]interface{}{
+			"status":      "rewarded",
+			"reward":      reward,
+			"rewarded_at": &now,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+
+	for _, userID := range []uint{referral.ReferrerID, referral.RefereeID} {
+		if err := changeBalance(tx, userID, reward, balanceChange{Reason: BalanceReferral}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetReferralStats gets the user's referral code and invited users
+func GetReferralStats(userID uint) (*ReferralStatsResponse, error) {
+	user, err := GetUserByID(userID)
+	if err != nil {
 		return nil, err
 	}
 
-	var responses []TaskResponse
-	for _, task := range tasks {
-		var userTask UserTask
-		result := DB.Where("user_id = ? AND task_id = ?", userID, task.ID).First(&userTask)
+	var referrals []Referral
+	if err := DB.Where("referrer_id = ?", userID).
+		Preload("Referee").
+		Order("created_at DESC").
+		Find(&referrals).Error; err != nil {
+		return nil, err
+	}
 
-		status := "locked"
-		if result.Error == nil {
-			status = userTask.Status
+	// Completed task counts of all referees in one grouped query
+	completed := DB.Model(&UserTask{}).
+		Select("user_id, COUNT(*) AS cnt").
+		Where("status = ?", "completed").
+		Group("user_id")
+	var counts []struct {
+		RefereeID uint
+		Cnt       int
+	}
+	if err := DB.Table("referrals").
+		Select("referrals.referee_id, COALESCE(ct.cnt, 0) AS cnt").
+		Joins("LEFT JOIN (?) AS ct ON ct.user_id = referrals.referee_id", completed).
+		Where("referrals.referrer_id = ?", userID).
+		Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	completedByReferee := make(map[uint]int, len(counts))
+	for _, count := range counts {
+		completedByReferee[count.RefereeID] = count.Cnt
+	}
+
+	stats := &ReferralStatsResponse{
+		ReferralCode:  user.ReferralCode,
+		RequiredTasks: referralRequiredTasks(),
+		Reward:        referralReward(),
+		Referrals:     make([]ReferralEntry, 0),
+	}
+	for _, r := range referrals {
+		entry := ReferralEntry{
+			Username:            r.Referee.PublicName(),
+			Status:              r.Status,
+			CompletedTasksCount: completedByReferee[r.RefereeID],
+			JoinedAt:            r.CreatedAt.Format(time.RFC3339),
+		}
+		if r.RewardedAt != nil {
+			entry.RewardedAt = r.RewardedAt.Format(time.RFC3339)
+		}
+		stats.Referrals = append(stats.Referrals, entry)
+
+		stats.InvitedCount++
+		if r.Status == "rewarded" {
+			stats.RewardedCount++
+			stats.PointsEarned += r.Reward
 		} else {
-			// Check if this is the first task or previous task is completed
-			if task.Position == 0 {
-				// First task is always available
-				status = "available"
-			} else {
-				// Check if previous task is completed (same language)
-				var prevTask Task
-				if err := DB.Where("position < ? AND language = ?", task.Position, "ru").Order("position DESC").First(&prevTask).Error; err == nil {
-					var prevUserTask UserTask
-					if DB.Where("user_id = ? AND task_id = ? AND status = ?", userID, prevTask.ID, "completed").First(&prevUserTask).Error == nil {
-						status = "available"
-					}
-				}
-			}
+			stats.PendingCount++
 		}
+	}
 
-		responses = append(responses, TaskResponse{
-			ID:       int(task.ID),
-			Title:    task.Title,
-			Type:     task.Type,
-			Status:   status,
-			Reward:   task.Reward,
-			Position: task.Position,
-		})
+	return stats, nil
+}
+
+// GetAdminReferralStats gets program-wide referral totals and top referrers
+func GetAdminReferralStats() (*AdminReferralStatsResponse, error) {
+	var totals struct {
+		TotalReferrals int
+		RewardedCount  int
+		PendingCount   int
+		PointsAwarded  int
+	}
+	if err := DB.Model(&Referral{}).
+		Select(`COUNT(*) AS total_referrals,
+			COUNT(*) FILTER (WHERE status = 'rewarded') AS rewarded_count,
+			COUNT(*) FILTER (WHERE status = 'pending') AS pending_count,
+			COALESCE(SUM(reward) * 2, 0) AS points_awarded`).
+		Scan(&totals).Error; err != nil {
+		return nil, err
 	}
 
-	return responses, nil
+	stats := &AdminReferralStatsResponse{
+		TotalReferrals: totals.TotalReferrals,
+		RewardedCount:  totals.RewardedCount,
+		PendingCount:   totals.PendingCount,
+		PointsAwarded:  totals.PointsAwarded,
+		TopReferrers:   make([]AdminReferrerEntry, 0),
+	}
+
+	if err := DB.Model(&Referral{}).
+		Select(`referrals.referrer_id AS user_id, users.username, users.first_name, users.last_name,
+			COUNT(*) AS invited_count,
+			COUNT(*) FILTER (WHERE referrals.status = 'rewarded') AS rewarded_count`).
+		Joins("JOIN users ON users.id = referrals.referrer_id").
+		Group("referrals.referrer_id, users.username, users.first_name, users.last_name").
+		Order("invited_count DESC").
+		Limit(50).
+		Scan(&stats.TopReferrers).Error; err != nil {
+		return nil, err
+	}
+
+	return stats, nil
 }
 
-// GetTaskByID gets task details by ID
-func GetTaskByID(taskID uint) (*TaskDetailResponse, error) {
-	var task Task
-	if err := DB.First(&task, taskID).Error; err != nil {
+// ListCompetitions gets all team competitions, newest first
+func ListCompetitions() ([]CompetitionResponse, error) {
+	var competitions []TeamCompetition
+	if err := DB.Order("starts_at DESC").Find(&competitions).Error; err != nil {
 		return nil, err
 	}
 
-	// Convert QuestionItem to QuestionItemResponse
-	var questions []QuestionItemResponse
-	for _, q := range task.Questions {
-		questions = append(questions, QuestionItemResponse{
-			Type:          q.Type,
-			Text:          q.Text,
-			Options:       q.Options,
-			CorrectAnswer: q.CorrectAnswer,
-		})
+	responses := make([]CompetitionResponse, 0)
+	for _, competition := range competitions {
+		responses = append(responses, competitionToResponse(competition))
 	}
+	return responses, nil
+}
 
-	return &TaskDetailResponse{
-		ID:            int(task.ID),
-		Question:      task.Question,
-		Options:       task.Options,
-		Type:          task.Type,
-		Questions:     questions,
-		CorrectAnswer: task.CorrectAnswer,
-	}, nil
+func competitionToResponse(competition TeamCompetition) CompetitionResponse {
+	response := CompetitionResponse{
+		ID:           int(competition.ID),
+		Name:         competition.Name,
+		Description:  competition.Description,
+		StartsAt:     competition.StartsAt.Format(time.RFC3339),
+		EndsAt:       competition.EndsAt.Format(time.RFC3339),
+		TeamCapacity: competition.TeamCapacity,
+		Status:       competition.Status,
+	}
+	if competition.ClosedAt != nil {
+		response.ClosedAt = competition.ClosedAt.Format(time.RFC3339)
+	}
+	return response
 }
 
-// SubmitTaskAnswer submits task answer and updates user progress
-func SubmitTaskAnswer(userID, taskID uint, answer string) (bool, int, error) {
-	var task Task
-	if err := DB.First(&task, taskID).Error; err != nil {
-		return false, 0, err
+// CreateCompetition creates a team competition (admin only)
+func CreateCompetition(req CreateCompetitionRequest) (*CompetitionResponse, error) {
+	startsAt, err := time.Parse(time.RFC3339, req.StartsAt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid starts_at")
+	}
+	endsAt, err := time.Parse(time.RFC3339, req.EndsAt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ends_at")
+	}
+	if !endsAt.After(startsAt) {
+		return nil, fmt.Errorf("ends_at must be after starts_at")
 	}
 
-	isCorrect := answer == task.CorrectAnswer
-	if task.Type == "survey" {
-		isCorrect = true
+	capacity := req.TeamCapacity
+	if capacity <= 0 {
+		capacity = 5
 	}
-	earned := 0
 
-	if isCorrect {
-		earned = task.Reward
+	competition := TeamCompetition{
+		Name:         req.Name,
+		Description:  req.Description,
+		StartsAt:     startsAt,
+		EndsAt:       endsAt,
+		TeamCapacity: capacity,
+		Status:       "active",
+	}
+	if err := DB.Create(&competition).Error; err != nil {
+		return nil, err
+	}
 
-		// Start transaction
-		tx := DB.Begin()
-		defer func() {
-			if r := recover(); r != nil {
-				tx.Rollback()
+	response := competitionToResponse(competition)
+	return &response, nil
+}
+
+// teamScoreQuery aggregates each team's score: points earned by its members
+// from tasks completed inside the event window and after they joined. Pass
+// DB, or tx to read inside a transaction.
+func teamScoreQuery(db *gorm.DB, competitionID uint) *gorm.DB {
+	return db.Table("teams").
+		Select(`teams.id AS team_id, teams.name,
+			COUNT(DISTINCT team_members.user_id) AS member_count,
+			COALESCE(SUM(user_tasks.earned), 0) AS score`).
+		Joins("JOIN team_competitions ON team_competitions.id = teams.competition_id").
+		Joins("LEFT JOIN team_members ON team_members.team_id = teams.id").
+		Joins(`LEFT JOIN user_tasks ON user_tasks.user_id = team_members.user_id
+			AND user_tasks.status = 'completed'
+			AND user_tasks.completed_at >= GREATEST(team_competitions.starts_at, team_members.joined_at)
+			AND user_tasks.completed_at < team_competitions.ends_at
+			AND user_tasks.user_id IN (SELECT id FROM users WHERE status = 'active')`).
+		Where("teams.competition_id = ?", competitionID).
+		Group("teams.id, teams.name")
+}
+
+// GetTeamLeaderboard ranks the teams of a competition. Closed competitions
+// use the scores frozen at closing time.
+func GetTeamLeaderboard(competitionID uint) (*TeamLeaderboardResponse, error) {
+	var competition TeamCompetition
+	if err := DB.First(&competition, competitionID).Error; err != nil {
+		return nil, err
+	}
+
+	entries := make([]TeamLeaderboardEntry, 0)
+	if competition.Status == "closed" {
+		var teams []Team
+		if err := DB.Where("competition_id = ?", competitionID).
+			Preload("Members").
+			Order("final_rank, id").
+			Find(&teams).Error; err != nil {
+			return nil, err
+		}
+		for _, team := range teams {
+			entry := TeamLeaderboardEntry{
+				TeamID:      int(team.ID),
+				Name:        team.Name,
+				MemberCount: len(team.Members),
 			}
-		}()
+			if team.FinalRank != nil {
+				entry.Rank = *team.FinalRank
+			}
+			if team.FinalScore != nil {
+				entry.Score = *team.FinalScore
+			}
+			entries = append(entries, entry)
+		}
+	} else {
+		if err := teamScoreQuery(DB, competitionID).
+			Order("score DESC, teams.id").
+			Scan(&entries).Error; err != nil {
+			return nil, err
+		}
+		for i := range entries {
+			entries[i].Rank = i + 1
+		}
+	}
 
-		// Update user balance
-		if err := tx.Model(&User{}).Where("id = ?", userID).UpdateColumn("balance", gorm.Expr("balance + ?", earned)).Error; err != nil {
-			tx.Rollback()
-			return false, 0, err
+	return &TeamLeaderboardResponse{
+		Competition: competitionToResponse(competition),
+		Teams:       entries,
+	}, nil
+}
+
+// CloseCompetition freezes final team scores and ranks (admin only)
+func CloseCompetition(competitionID uint) (*TeamLeaderboardResponse, error) {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var competition TeamCompetition
+		if err := tx.First(&competition, competitionID).Error; err != nil {
+			return err
+		}
+		if competition.Status == "closed" {
+			return fmt.Errorf("competition already closed")
 		}
 
-		// Update streak
-		var user User
-		if err := tx.First(&user, userID).Error; err != nil {
-			tx.Rollback()
-			return false, 0, err
+		var entries []TeamLeaderboardEntry
+		if err := teamScoreQuery(tx, competitionID).
+			Order("score DESC, teams.id").
+			Scan(&entries).Error; err != nil {
+			return err
+		}
+		for i, entry := range entries {
+			rank := i + 1
+			score := entry.Score
+			if err := tx.Model(&Team{}).Where("id = ?", entry.TeamID).Updates(map[string]interface{}{
+				"final_score": score,
+				"final_rank":  rank,
+			}).Error; err != nil {
+				return err
+			}
 		}
 
 		now := time.Now()
-		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		return tx.Model(&competition).Updates(map[string]interface{}{
+			"status":    "closed",
+			"closed_at": &now,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return GetTeamLeaderboard(competitionID)
+}
+
+// isDuplicateKey reports whether err is a unique index violation
+func isDuplicateKey(err error) bool {
+	if translator, ok := DB.Dialector.(gorm.ErrorTranslator); ok {
+		err = translator.Translate(err)
+	}
+	return errors.Is(err, gorm.ErrDuplicatedKey)
+}
+
+// openCompetition loads a competition that still accepts team changes
+func openCompetition(tx *gorm.DB, competitionID uint) (*TeamCompetition, error) {
+	var competition TeamCompetition
+	if err := tx.First(&competition, competitionID).Error; err != nil {
+		return nil, err
+	}
+	if competition.Status != "active" || !time.Now().Before(competition.EndsAt) {
+		return nil, fmt.Errorf("competition is not active")
+	}
+	return &competition, nil
+}
+
+// CreateTeam creates a team in a competition with the user as captain
+func CreateTeam(userID, competitionID uint, name string) (*TeamResponse, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("team name is required")
+	}
+
+	var team Team
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := openCompetition(tx, competitionID); err != nil {
+			return err
+		}
+
+		var count int64
+		tx.Model(&TeamMember{}).Where("competition_id = ? AND user_id = ?", competitionID, userID).Count(&count)
+		if count > 0 {
+			return fmt.Errorf("already in a team")
+		}
+		tx.Model(&Team{}).Where("competition_id = ? AND LOWER(name) = LOWER(?)", competitionID, name).Count(&count)
+		if count > 0 {
+			return fmt.Errorf("team name already taken")
+		}
+
+		team = Team{
+			CompetitionID: competitionID,
+			Name:          name,
+			JoinCode:      generateReferralCode(),
+			CaptainID:     userID,
+		}
+		if err := tx.Create(&team).Error; err != nil {
+			// A concurrent request took the name after the check above
+			if isDuplicateKey(err) {
+				return fmt.Errorf("team name already taken")
+			}
+			return err
+		}
+
+		return tx.Create(&TeamMember{
+			TeamID:        team.ID,
+			CompetitionID: competitionID,
+			UserID:        userID,
+			Role:          "captain",
+			JoinedAt:      time.Now(),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return GetTeam(team.ID, userID)
+}
+
+// JoinTeam adds the user to the team with the given join code
+func JoinTeam(userID uint, code string) (*TeamResponse, error) {
+	var team Team
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		// Lock the team row so concurrent joins can't exceed capacity
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("join_code = ?", strings.ToUpper(strings.TrimSpace(code))).
+			First(&team).Error; err != nil {
+			return fmt.Errorf("team not found")
+		}
+
+		competition, err := openCompetition(tx, team.CompetitionID)
+		if err != nil {
+			return err
+		}
+
+		var count int64
+		tx.Model(&TeamMember{}).Where("competition_id = ? AND user_id = ?", team.CompetitionID, userID).Count(&count)
+		if count > 0 {
+			return fmt.Errorf("already in a team")
+		}
+
+		tx.Model(&TeamMember{}).Where("team_id = ?", team.ID).Count(&count)
+		if count >= int64(competition.TeamCapacity) {
+			return fmt.Errorf("team is full")
+		}
+
+		return tx.Create(&TeamMember{
+			TeamID:        team.ID,
+			CompetitionID: team.CompetitionID,
+			UserID:        userID,
+			Role:          "member",
+			JoinedAt:      time.Now(),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return GetTeam(team.ID, userID)
+}
+
+// removeTeamMember removes a member; if the captain leaves, captaincy passes
+// to the longest-standing member, and an empty team is deleted
+func removeTeamMember(tx *gorm.DB, team Team, userID uint) error {
+	result := tx.Where("team_id = ? AND user_id = ?", team.ID, userID).Delete(&TeamMember{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("not a team member")
+	}
+	if team.CaptainID != userID {
+		return nil
+	}
+
+	var next TeamMember
+	if err := tx.Where("team_id = ?", team.ID).Order("joined_at, id").First(&next).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return tx.Delete(&Team{}, team.ID).Error
+		}
+		return err
+	}
+	if err := tx.Model(&next).Update("role", "captain").Error; err != nil {
+		return err
+	}
+	return tx.Model(&Team{}).Where("id = ?", team.ID).Update("captain_id", next.UserID).Error
+}
+
+// LeaveTeam removes the user from a team
+func LeaveTeam(userID, teamID uint) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var team Team
+		if err := tx.First(&team, teamID).Error; err != nil {
+			return fmt.Errorf("team not found")
+		}
+		if _, err := openCompetition(tx, team.CompetitionID); err != nil {
+			return err
+		}
+		return removeTeamMember(tx, team, userID)
+	})
+}
+
+// KickTeamMember removes a member from the team (captain only)
+func KickTeamMember(captainID, teamID, memberID uint) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var team Team
+		if err := tx.First(&team, teamID).Error; err != nil {
+			return fmt.Errorf("team not found")
+		}
+		if team.CaptainID != captainID {
+			return fmt.Errorf("only the captain can remove members")
+		}
+		if memberID == captainID {
+			return fmt.Errorf("captain cannot remove themselves")
+		}
+		if _, err := openCompetition(tx, team.CompetitionID); err != nil {
+			return err
+		}
+		return removeTeamMember(tx, team, memberID)
+	})
+}
+
+// GetTeam gets team details with members and current score. The join code
+// is only included for members of the team.
+func GetTeam(teamID, viewerID uint) (*TeamResponse, error) {
+	var team Team
+	if err := DB.Preload("Members", func(db *gorm.DB) *gorm.DB {
+		return db.Order("joined_at, id")
+	}).Preload("Members.User").Preload("Competition").First(&team, teamID).Error; err != nil {
+		return nil, err
+	}
+
+	response := &TeamResponse{
+		ID:            int(team.ID),
+		CompetitionID: int(team.CompetitionID),
+		Name:          team.Name,
+		CaptainID:     int(team.CaptainID),
+		Capacity:      team.Competition.TeamCapacity,
+		Members:       make([]TeamMemberResponse, 0),
+	}
+
+	isMember := false
+	for _, member := range team.Members {
+		if member.UserID == viewerID {
+			isMember = true
+		}
+		response.Members = append(response.Members, TeamMemberResponse{
+			UserID:   int(member.UserID),
+			Username: member.User.PublicName(),
+			Role:     member.Role,
+			JoinedAt: member.JoinedAt.Format(time.RFC3339),
+		})
+	}
+	if isMember {
+		response.JoinCode = team.JoinCode
+	}
+
+	if team.FinalScore != nil {
+		response.Score = *team.FinalScore
+	} else {
+		var entry TeamLeaderboardEntry
+		teamScoreQuery(DB, team.CompetitionID).Where("teams.id = ?", team.ID).Scan(&entry)
+		response.Score = entry.Score
+	}
+
+	return response, nil
+}
+
+// GetUserTeams gets every team the user belongs to
+func GetUserTeams(userID uint) ([]TeamResponse, error) {
+	var memberships []TeamMember
+	if err := DB.Where("user_id = ?", userID).Order("joined_at DESC").Find(&memberships).Error; err != nil {
+		return nil, err
+	}
+
+	teams := make([]TeamResponse, 0)
+	for _, membership := range memberships {
+		team, err := GetTeam(membership.TeamID, userID)
+		if err != nil {
+			return nil, err
+		}
+		teams = append(teams, *team)
+	}
+	return teams, nil
+}
+
+// GetUserByID gets user by ID
+func GetUserByID(userID uint) (*User, error) {
+	var user User
+	if err := DB.First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// UpdateUser updates user profile
+func UpdateUser(userID uint, req UpdateUserRequest) error {
+	updates := map[string]interface{}{
+		"resume_link": req.ResumeLink,
+		"stack":       req.Stack,
+	}
+	// Cohort fields are only overwritten when provided, so older clients
+	// that send just resume_link/stack don't wipe them
+	if university := strings.TrimSpace(req.University); university != "" {
+		updates["university"] = university
+	}
+	if track := normalizeTrack(req.Track); track != "" {
+		updates["track"] = track
+	}
+	if req.Language != "" {
+		updates["language"] = normalizeLanguage(req.Language)
+	}
+	return DB.Model(&User{}).Where("id = ?", userID).Updates(updates).Error
+}
+
+// normalizeTrack converts an internship program name ("Backend Development",
+// "Backend", "data science") into a stable track key ("backend", "data_science")
+func normalizeTrack(track string) string {
+	track = strings.ToLower(strings.TrimSpace(track))
+	track = strings.TrimSuffix(track, " development")
+	return strings.Join(strings.Fields(track), "_")
+}
+
+// profileUpdatesFromSurvey maps survey answers to user profile columns using
+// the ProfileField of each question. Answers are aligned with task.Questions.
+func profileUpdatesFromSurvey(task Task, answers []string) map[string]interface{} {
+	updates := map[string]interface{}{}
+	for i, q := range task.Questions {
+		if i >= len(answers) {
+			break
+		}
+		answer := strings.TrimSpace(answers[i])
+		if answer == "" {
+			continue
+		}
+		switch q.ProfileField {
+		case "university":
+			updates["university"] = answer
+		case "track":
+			updates["track"] = normalizeTrack(answer)
+		}
+	}
+	return updates
+}
+
+// GetTasksWithStatus gets all tasks with their status for a user (filtered by language)
+func GetTasksWithStatus(userID uint) ([]TaskResponse, error) {
+	var tasks []Task
+	// Filter by Russian language only to avoid duplicates
+	if err := DB.Where("language = ?", "ru").Order("position").Find(&tasks).Error; err != nil {
+		return nil, err
+	}
+
+	var responses []TaskResponse
+	for _, task := range tasks {
+		var userTask UserTask
+		result := DB.Where("user_id = ? AND task_id = ?", userID, task.ID).First(&userTask)
+
+		status := "locked"
+		if result.Error == nil {
+			status = userTask.Status
+		} else {
+			// Check if this is the first task or previous task is completed
+			if task.Position == 0 {
+				// First task is always available
+				status = "available"
+			} else {
+				// Check if previous task is completed (same language)
+				var prevTask Task
+				if err := DB.Where("position < ? AND language = ?", task.Position, "ru").Order("position DESC").First(&prevTask).Error; err == nil {
+					var prevUserTask UserTask
+					if DB.Where("user_id = ? AND task_id = ? AND status = ?", userID, prevTask.ID, "completed").First(&prevUserTask).Error == nil {
+						status = "available"
+					}
+				}
+			}
+		}
+
+		responses = append(responses, TaskResponse{
+			ID:       int(task.ID),
+			Title:    task.Title,
+			Type:     task.Type,
+			Status:   status,
+			Reward:   task.Reward,
+			Position: task.Position,
+		})
+	}
+
+	return responses, nil
+}
+
+// GetTaskByID gets task details by ID
+func GetTaskByID(taskID uint) (*TaskDetailResponse, error) {
+	var task Task
+	if err := DB.First(&task, taskID).Error; err != nil {
+		return nil, err
+	}
+
+	// Convert QuestionItem to QuestionItemResponse
+	var questions []QuestionItemResponse
+	for _, q := range task.Questions {
+		questions = append(questions, QuestionItemResponse{
+			Type:          q.Type,
+			Text:          q.Text,
+			Options:       q.Options,
+			CorrectAnswer: q.CorrectAnswer,
+		})
+	}
+
+	return &TaskDetailResponse{
+		ID:            int(task.ID),
+		Question:      task.Question,
+		Options:       task.Options,
+		Type:          task.Type,
+		Questions:     questions,
+		CorrectAnswer: task.CorrectAnswer,
+	}, nil
+}
+
+// SubmitTaskAnswer submits task answer and updates user progress.
+// For surveys, answers holds the response to each question.
+func SubmitTaskAnswer(userID, taskID uint, answer string, answers []string) (bool, int, error) {
+	var task Task
+	if err := DB.First(&task, taskID).Error; err != nil {
+		return false, 0, err
+	}
+
+	isCorrect := answer == task.CorrectAnswer
+	if task.Type == "survey" {
+		isCorrect = true
+	}
+	earned := 0
+
+	// Every submission is kept for the admin user page and anti-cheat
+	if err := checkAnswerSpeed(DB, userID, taskID, time.Now()); err != nil {
+		return false, 0, err
+	}
+	if err := DB.Create(&TaskAttempt{
+		UserID:  userID,
+		TaskID:  taskID,
+		Answer:  answer,
+		Answers: answers,
+		Correct: isCorrect,
+	}).Error; err != nil {
+		return false, 0, err
+	}
+
+	if isCorrect {
+		earned = task.Reward
+
+		// Start transaction
+		tx := DB.Begin()
+		defer func() {
+			if r := recover(); r != nil {
+				tx.Rollback()
+			}
+		}()
+
+		// Update user balance
+		if err := changeBalance(tx, userID, earned, balanceChange{Reason: BalanceTaskReward, TaskID: &taskID}); err != nil {
+			tx.Rollback()
+			return false, 0, err
+		}
+
+		// Update streak
+		var user User
+		if err := tx.First(&user, userID).Error; err != nil {
+			tx.Rollback()
+			return false, 0, err
+		}
+
+		now := time.Now()
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
 
 		if user.LastTaskDate != nil {
 			lastDate := time.Date(user.LastTaskDate.Year(), user.LastTaskDate.Month(), user.LastTaskDate.Day(), 0, 0, 0, 0, user.LastTaskDate.Location())
@@ -367,6 +1503,16 @@ func SubmitTaskAnswer(userID, taskID uint, answer string) (bool, int, error) {
 			}
 		}
 
+		// Copy profile survey answers (university, track) to the user
+		if task.Type == "survey" {
+			if updates := profileUpdatesFromSurvey(task, answers); len(updates) > 0 {
+				if err := tx.Model(&User{}).Where("id = ?", userID).Updates(updates).Error; err != nil {
+					tx.Rollback()
+					return false, 0, err
+				}
+			}
+		}
+
 		// Update or create user_task
 		nowTime := time.Now()
 		userTask := UserTask{
@@ -388,6 +1534,12 @@ func SubmitTaskAnswer(userID, taskID uint, answer string) (bool, int, error) {
 			return false, 0, err
 		}
 
+		// Pay out the referral bonus once the invited user is active enough
+		if err := rewardReferralIfEligible(tx, userID); err != nil {
+			tx.Rollback()
+			return false, 0, err
+		}
+
 		if err := tx.Commit().Error; err != nil {
 			return false, 0, err
 		}
@@ -396,30 +1548,97 @@ func SubmitTaskAnswer(userID, taskID uint, answer string) (bool, int, error) {
 	return isCorrect, earned, nil
 }
 
-// GetShopItems gets all shop items
-func GetShopItems() ([]ShopItemResponse, error) {
+// GetShopItems gets all shop items. If userID is set, items are
+// personalized for that user (e.g. whether they can afford them).
+func GetShopItems(userID uint) ([]ShopItemResponse, error) {
 	var items []ShopItem
-	if err := DB.Order("id").Find(&items).Error; err != nil {
+	if err := DB.Preload("Variants", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).Where("archived_at IS NULL").Order("id").Find(&items).Error; err != nil {
 		return nil, err
 	}
 
+	var user *User
+	var stats shopBuyerStats
+	if userID > 0 {
+		user, _ = GetUserByID(userID)
+		if user != nil {
+			var err error
+			if stats, err = loadShopBuyerStats(DB, userID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	now := time.Now()
 	var responses []ShopItemResponse
 	for _, item := range items {
-		responses = append(responses, ShopItemResponse{
-			ID:          int(item.ID),
-			Name:        item.Name,
-			Description: item.Description,
-			Price:       item.Price,
-			Image:       item.Image,
-			Stock:       item.Stock,
-		})
+		response := ShopItemResponse{
+			ID:           int(item.ID),
+			Name:         item.Name,
+			Description:  item.Description,
+			Price:        item.Price,
+			Image:        item.Image,
+			ThumbnailURL: item.ThumbnailURL,
+			Category:     item.Category,
+			Stock:        item.Stock,
+			Variants:     variantsToResponse(item.Variants),
+			Rules:        shopItemRulesToResponse(item),
+		}
+		if user != nil {
+			affordable := user.Balance >= item.Price
+			response.Affordable = &affordable
+			response.LockedReason = item.LockReason(*user, stats, now)
+			purchased := stats.Purchased[item.ID]
+			response.PurchasedCount = &purchased
+		} else {
+			response.LockedReason = item.timeLockReason(now)
+		}
+		responses = append(responses, response)
 	}
 
 	return responses, nil
 }
 
-// BuyItem creates a purchase
-func BuyItem(userID, itemID uint, email string) (string, error) {
+func variantsToResponse(variants []ShopItemVariant) []ShopItemVariantResponse {
+	responses := make([]ShopItemVariantResponse, 0, len(variants))
+	for _, v := range variants {
+		responses = append(responses, ShopItemVariantResponse{
+			ID:    int(v.ID),
+			SKU:   v.SKU,
+			Size:  v.Size,
+			Color: v.Color,
+			Label: v.Label(),
+			Stock: v.Stock,
+		})
+	}
+	return responses
+}
+
+// syncItemStock recalculates an item's stock from its variants. Items
+// without variants keep their own stock.
+func syncItemStock(tx *gorm.DB, itemID uint) error {
+	var count int64
+	if err := tx.Model(&ShopItemVariant{}).Where("item_id = ?", itemID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+	return tx.Model(&ShopItem{}).Where("id = ?", itemID).
+		UpdateColumn("stock", gorm.Expr("(SELECT COALESCE(SUM(stock), 0) FROM shop_item_variants WHERE item_id = ?)", itemID)).Error
+}
+
+// BuyItem creates a purchase. req.VariantID is required for items that have
+// variants and must be 0 otherwise; req.PromoCode optionally lowers the price.
+func BuyItem(userID uint, req BuyItemRequest) (*BuyItemResponse, error) {
+	itemID, variantID := uint(req.ItemID), uint(req.VariantID)
+
+	email, err := normalizePurchaseEmail(req.Email)
+	if err != nil {
+		return nil, err
+	}
+
 	tx := DB.Begin()
 	defer func() {
 		if r := recover(); r != nil {
@@ -427,61 +1646,459 @@ func BuyItem(userID, itemID uint, email string) (string, error) {
 		}
 	}()
 
-	// Check user balance and item stock
+	// Check user balance and item stock. The user row is locked so that
+	// concurrent purchases can't bypass the per-user limit.
 	var user User
-	if err := tx.First(&user, userID).Error; err != nil {
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
 		tx.Rollback()
-		return "", err
+		return nil, err
 	}
 
 	var item ShopItem
-	if err := tx.First(&item, itemID).Error; err != nil {
+	if err := tx.Preload("Variants").First(&item, itemID).Error; err != nil {
 		tx.Rollback()
-		return "", err
+		return nil, err
+	}
+	if item.ArchivedAt != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("item not available")
 	}
 
-	if user.Balance < item.Price {
+	stats, err := loadShopBuyerStats(tx, userID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	now := time.Now()
+	if reason := item.LockReason(user, stats, now); reason != "" {
 		tx.Rollback()
-		return "", fmt.Errorf("insufficient balance")
+		return nil, &ShopRestrictionError{Code: reason}
 	}
 
-	if item.Stock <= 0 {
+	fulfillment, err := resolveFulfillment(tx, req.FulfillmentRequest)
+	if err != nil {
 		tx.Rollback()
-		return "", fmt.Errorf("item out of stock")
+		return nil, err
+	}
+
+	variantRef, err := stockTarget(item, variantID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	price := item.Price
+	var promo *PromoCode
+	discount := 0
+	if strings.TrimSpace(req.PromoCode) != "" {
+		if promo, discount, err = checkPromoCode(tx, req.PromoCode, userID, item, now, true); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		price -= discount
+	}
+
+	if user.Balance < price {
+		tx.Rollback()
+		return nil, fmt.Errorf("insufficient balance")
 	}
 
 	// Deduct balance
-	if err := tx.Model(&User{}).Where("id = ?", userID).UpdateColumn("balance", gorm.Expr("balance - ?", item.Price)).Error; err != nil {
+	purchaseID := uuid.New().String()
+	if err := changeBalance(tx, userID, -price, balanceChange{Reason: BalancePurchase, PurchaseID: purchaseID}); err != nil {
 		tx.Rollback()
-		return "", err
+		return nil, err
 	}
 
-	// Decrease stock
-	if err := tx.Model(&ShopItem{}).Where("id = ?", itemID).UpdateColumn("stock", gorm.Expr("stock - 1")).Error; err != nil {
+	// Decrease stock; changeStock's conditional update makes concurrent
+	// purchases of the last unit safe
+	if err := changeStock(tx, itemID, variantRef, -1, stockChange{Reason: StockSale, PurchaseID: purchaseID}); err != nil {
 		tx.Rollback()
-		return "", err
+		return nil, err
 	}
 
 	// Create purchase
-	purchaseID := uuid.New().String()
 	purchase := Purchase{
-		UserID:     userID,
-		ItemID:     itemID,
-		PurchaseID: purchaseID,
-		Status:     "pending",
-		Email:      email,
+		UserID:            userID,
+		ItemID:            itemID,
+		PurchaseID:        purchaseID,
+		Status:            PurchasePending,
+		Email:             email,
+		FulfillmentMethod: fulfillment.Method,
+		PickupLocationID:  fulfillment.PickupLocationID,
+		ShippingAddress:   fulfillment.ShippingAddress,
+		Price:             price,
+		Discount:          discount,
+	}
+	purchase.VariantID = variantRef
+	if promo != nil {
+		purchase.PromoCodeID = &promo.ID
 	}
 
 	if err := tx.Create(&purchase).Error; err != nil {
 		tx.Rollback()
-		return "", err
+		return nil, err
+	}
+
+	if err := enqueuePurchaseEmail(tx, EmailPurchaseConfirmation, purchase); err != nil {
+		tx.Rollback()
+		return nil, err
 	}
 
 	if err := tx.Commit().Error; err != nil {
-		return "", err
+		return nil, err
+	}
+
+	return &BuyItemResponse{PurchaseID: purchaseID, Price: price, Discount: discount}, nil
+}
+
+func shopItemToAdminResponse(item ShopItem) AdminShopItemResponse {
+	response := AdminShopItemResponse{
+		ID:           int(item.ID),
+		Name:         item.Name,
+		Description:  item.Description,
+		Price:        item.Price,
+		Image:        item.Image,
+		ThumbnailURL: item.ThumbnailURL,
+		Category:     item.Category,
+		Stock:        item.Stock,
+		Archived:     item.ArchivedAt != nil,
+		CreatedAt:    item.CreatedAt.Format(time.RFC3339),
+		Variants:     variantsToResponse(item.Variants),
+		Rules:        shopItemRulesToResponse(item),
+
+		LowStockThreshold: item.LowStockThreshold,
+	}
+	if item.ArchivedAt != nil {
+		response.ArchivedAt = item.ArchivedAt.Format(time.RFC3339)
+	}
+	return response
+}
+
+// getAdminShopItem loads an item with its variants in admin format
+func getAdminShopItem(itemID uint) (*AdminShopItemResponse, error) {
+	var item ShopItem
+	if err := DB.Preload("Variants", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).First(&item, itemID).Error; err != nil {
+		return nil, err
+	}
+	waitlist, err := pendingWaitlistCounts(DB.Where("item_id = ?", itemID))
+	if err != nil {
+		return nil, err
+	}
+	response := shopItemToAdminResponse(item)
+	response.WaitlistCount = waitlist[item.ID]
+	return &response, nil
+}
+
+// GetAdminShopItems gets all shop items including archived ones (admin only)
+func GetAdminShopItems() ([]AdminShopItemResponse, error) {
+	var items []ShopItem
+	if err := DB.Preload("Variants", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).Order("id").Find(&items).Error; err != nil {
+		return nil, err
+	}
+
+	waitlist, err := pendingWaitlistCounts(DB)
+	if err != nil {
+		return nil, err
+	}
+
+	responses := make([]AdminShopItemResponse, 0)
+	for _, item := range items {
+		response := shopItemToAdminResponse(item)
+		response.WaitlistCount = waitlist[item.ID]
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
+
+// CreateShopItem creates a shop item (admin only)
+func CreateShopItem(req CreateShopItemRequest, adminID uint) (*AdminShopItemResponse, error) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	if req.Price < 0 || req.Stock < 0 {
+		return nil, fmt.Errorf("price and stock cannot be negative")
+	}
+	if req.LowStockThreshold < 0 {
+		return nil, fmt.Errorf("limits cannot be negative")
+	}
+
+	item := ShopItem{
+		Name:              name,
+		Description:       req.Description,
+		Price:             req.Price,
+		Image:             req.Image,
+		Category:          strings.TrimSpace(req.Category),
+		LowStockThreshold: req.LowStockThreshold,
+	}
+	if err := applyShopItemRules(&item, req.ShopItemRulesRequest); err != nil {
+		return nil, err
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&item).Error; err != nil {
+			return err
+		}
+		// Initial stock is recorded as a restock so the history adds up
+		return changeStock(tx, item.ID, nil, req.Stock, stockChange{Reason: StockRestock, AdminID: &adminID, Note: "initial stock"})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return getAdminShopItem(item.ID)
+}
+
+// UpdateShopItem updates an item's details (admin only). Stock is changed
+// through RestockItem and variants.
+func UpdateShopItem(itemID uint, req UpdateShopItemRequest) (*AdminShopItemResponse, error) {
+	var item ShopItem
+	if err := DB.First(&item, itemID).Error; err != nil {
+		return nil, err
+	}
+
+	// Update fields if provided
+	if name := strings.TrimSpace(req.Name); name != "" {
+		item.Name = name
+	}
+	if req.Description != nil {
+		item.Description = *req.Description
+	}
+	if req.Price != nil {
+		if *req.Price < 0 {
+			return nil, fmt.Errorf("price and stock cannot be negative")
+		}
+		item.Price = *req.Price
+	}
+	if req.Image != "" {
+		item.Image = req.Image
+	}
+	if req.Category != nil {
+		item.Category = strings.TrimSpace(*req.Category)
+	}
+	if req.LowStockThreshold != nil {
+		if *req.LowStockThreshold < 0 {
+			return nil, fmt.Errorf("limits cannot be negative")
+		}
+		item.LowStockThreshold = *req.LowStockThreshold
+	}
+	if err := applyShopItemRules(&item, req.ShopItemRulesRequest); err != nil {
+		return nil, err
+	}
+
+	// Stock is left out so concurrent purchases aren't overwritten
+	if err := DB.Omit("Variants", "Stock").Save(&item).Error; err != nil {
+		return nil, err
+	}
+	return getAdminShopItem(item.ID)
+}
+
+// SetShopItemArchived archives (soft-deletes) or restores an item (admin only).
+// Archived items disappear from the shop but existing purchases keep them.
+func SetShopItemArchived(itemID uint, archived bool) (*AdminShopItemResponse, error) {
+	var item ShopItem
+	if err := DB.First(&item, itemID).Error; err != nil {
+		return nil, err
 	}
 
-	return purchaseID, nil
+	var archivedAt *time.Time
+	if archived {
+		now := time.Now()
+		archivedAt = &now
+	}
+	if err := DB.Model(&item).Update("archived_at", archivedAt).Error; err != nil {
+		return nil, err
+	}
+	return getAdminShopItem(item.ID)
+}
+
+// RestockItem adds stock to an item or, for items with variants, to one of
+// its variants (admin only)
+func RestockItem(itemID uint, variantID uint, quantity int, adminID uint) (*AdminShopItemResponse, error) {
+	if quantity <= 0 {
+		return nil, fmt.Errorf("quantity must be positive")
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var item ShopItem
+		if err := tx.Preload("Variants").First(&item, itemID).Error; err != nil {
+			return err
+		}
+		target, err := stockTarget(item, variantID)
+		if err != nil {
+			return err
+		}
+		return changeStock(tx, itemID, target, quantity, stockChange{Reason: StockRestock, AdminID: &adminID})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return getAdminShopItem(itemID)
+}
+
+// SetShopItemImage replaces an item's image and thumbnail (admin only)
+func SetShopItemImage(itemID uint, imageURL, thumbnailURL string) (*AdminShopItemResponse, error) {
+	var item ShopItem
+	if err := DB.First(&item, itemID).Error; err != nil {
+		return nil, err
+	}
+
+	oldImage, oldThumbnail := item.Image, item.ThumbnailURL
+	if err := DB.Model(&item).Updates(map[string]interface{}{
+		"image":         imageURL,
+		"thumbnail_url": thumbnailURL,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	RemoveShopImage(oldImage)
+	RemoveShopImage(oldThumbnail)
+
+	return getAdminShopItem(item.ID)
+}
+
+// GetItemVariants gets the variants of a shop item (admin only)
+func GetItemVariants(itemID uint) ([]ShopItemVariantResponse, error) {
+	var item ShopItem
+	if err := DB.First(&item, itemID).Error; err != nil {
+		return nil, err
+	}
+
+	var variants []ShopItemVariant
+	if err := DB.Where("item_id = ?", itemID).Order("id").Find(&variants).Error; err != nil {
+		return nil, err
+	}
+	return variantsToResponse(variants), nil
+}
+
+// CreateItemVariant adds a variant to a shop item (admin only)
+func CreateItemVariant(itemID uint, req VariantRequest, adminID uint) (*ShopItemVariantResponse, error) {
+	var variant ShopItemVariant
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var item ShopItem
+		if err := tx.First(&item, itemID).Error; err != nil {
+			return err
+		}
+
+		sku := strings.TrimSpace(req.SKU)
+		if sku == "" {
+			return fmt.Errorf("sku is required")
+		}
+		var count int64
+		tx.Model(&ShopItemVariant{}).Where("sku = ?", sku).Count(&count)
+		if count > 0 {
+			return fmt.Errorf("sku already exists")
+		}
+
+		stock := 0
+		if req.Stock != nil {
+			stock = *req.Stock
+		}
+		if stock < 0 {
+			return fmt.Errorf("stock cannot be negative")
+		}
+
+		variant = ShopItemVariant{
+			ItemID: itemID,
+			SKU:    sku,
+			Size:   req.Size,
+			Color:  req.Color,
+		}
+		if err := tx.Create(&variant).Error; err != nil {
+			return err
+		}
+		if err := syncItemStock(tx, itemID); err != nil {
+			return err
+		}
+		if err := changeStock(tx, itemID, &variant.ID, stock, stockChange{Reason: StockRestock, AdminID: &adminID, Note: "initial stock"}); err != nil {
+			return err
+		}
+		variant.Stock = stock
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &variantsToResponse([]ShopItemVariant{variant})[0], nil
+}
+
+// UpdateItemVariant updates a variant's SKU, options or stock (admin only).
+// Setting the stock is recorded as a correction.
+func UpdateItemVariant(variantID uint, req VariantRequest, adminID uint) (*ShopItemVariantResponse, error) {
+	var variant ShopItemVariant
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&variant, variantID).Error; err != nil {
+			return err
+		}
+
+		if sku := strings.TrimSpace(req.SKU); sku != "" && sku != variant.SKU {
+			var count int64
+			tx.Model(&ShopItemVariant{}).Where("sku = ? AND id <> ?", sku, variantID).Count(&count)
+			if count > 0 {
+				return fmt.Errorf("sku already exists")
+			}
+			variant.SKU = sku
+		}
+		if req.Size != "" {
+			variant.Size = req.Size
+		}
+		if req.Color != "" {
+			variant.Color = req.Color
+		}
+		delta := 0
+		if req.Stock != nil {
+			if *req.Stock < 0 {
+				return fmt.Errorf("stock cannot be negative")
+			}
+			delta = *req.Stock - variant.Stock
+		}
+
+		if err := tx.Omit("Stock").Save(&variant).Error; err != nil {
+			return err
+		}
+		if err := changeStock(tx, variant.ItemID, &variant.ID, delta, stockChange{Reason: StockCorrection, AdminID: &adminID, Note: fmt.Sprintf("stock set to %d", variant.Stock+delta)}); err != nil {
+			return err
+		}
+		variant.Stock += delta
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &variantsToResponse([]ShopItemVariant{variant})[0], nil
+}
+
+// DeleteItemVariant deletes a variant that has never been purchased (admin only)
+func DeleteItemVariant(variantID uint, adminID uint) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var variant ShopItemVariant
+		if err := tx.First(&variant, variantID).Error; err != nil {
+			return err
+		}
+
+		var count int64
+		tx.Model(&Purchase{}).Where("variant_id = ?", variantID).Count(&count)
+		if count > 0 {
+			return fmt.Errorf("variant has purchases")
+		}
+
+		// Write off the remaining stock so the item history adds up
+		if err := changeStock(tx, variant.ItemID, &variant.ID, -variant.Stock, stockChange{Reason: StockCorrection, AdminID: &adminID, Note: "variant deleted"}); err != nil {
+			return err
+		}
+		if err := tx.Where("variant_id = ?", variantID).Delete(&WaitlistEntry{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&variant).Error; err != nil {
+			return err
+		}
+		return syncItemStock(tx, variant.ItemID)
+	})
 }
 
 // GetUserInventory gets user's purchases
@@ -489,6 +2106,9 @@ func GetUserInventory(userID uint) ([]InventoryItemResponse, error) {
 	var purchases []Purchase
 	if err := DB.Where("user_id = ?", userID).
 		Preload("Item").
+		Preload("Variant").
+		Preload("PickupLocation").
+		Preload("Order").
 		Order("purchased_at DESC").
 		Find(&purchases).Error; err != nil {
 		return nil, err
@@ -496,21 +2116,45 @@ func GetUserInventory(userID uint) ([]InventoryItemResponse, error) {
 
 	var inventory []InventoryItemResponse
 	for _, purchase := range purchases {
-		inventory = append(inventory, InventoryItemResponse{
-			ID:          int(purchase.ID),
-			ItemID:      int(purchase.ItemID),
-			ItemName:    purchase.Item.Name,
-			PurchaseID:  purchase.PurchaseID,
-			Status:      purchase.Status,
-			PurchasedAt: purchase.PurchasedAt.Format(time.RFC3339),
-		})
+		entry := InventoryItemResponse{
+			ID:              int(purchase.ID),
+			ItemID:          int(purchase.ItemID),
+			ItemName:        purchase.Item.Name,
+			Variant:         purchase.VariantLabel(),
+			PurchaseID:      purchase.PurchaseID,
+			Price:           purchase.Price,
+			Discount:        purchase.Discount,
+			Status:          purchase.Status,
+			Fulfillment:     purchase.FulfillmentMethod,
+			ShippingAddress: purchase.ShippingAddress,
+			TrackingNumber:  purchase.TrackingNumber,
+			PurchasedAt:     purchase.PurchasedAt.Format(time.RFC3339),
+		}
+		if purchase.PickupLocation != nil {
+			location := pickupLocationToResponse(*purchase.PickupLocation)
+			entry.PickupLocation = &location
+		}
+		if purchase.Order != nil {
+			entry.OrderID = purchase.Order.OrderID
+		}
+		inventory = append(inventory, entry)
 	}
 
 	return inventory, nil
 }
 
-// RedeemPurchase redeems a purchase (admin only)
-func RedeemPurchase(purchaseID string) (*RedeemResponse, error) {
+// RedeemPurchase redeems the purchase (or, for order tokens, the order) a
+// signed QR token points to. The token must be valid, unexpired, issued to the
+// owner and not used before. The hand-over is logged for adminID.
+func RedeemPurchase(token string, adminID uint) (*RedeemResponse, error) {
+	claims, err := ParseRedemptionToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.OrderID != "" {
+		return redeemOrder(claims, adminID)
+	}
+
 	tx := DB.Begin()
 	defer func() {
 		if r := recover(); r != nil {
@@ -519,97 +2163,240 @@ func RedeemPurchase(purchaseID string) (*RedeemResponse, error) {
 	}()
 
 	var purchase Purchase
-	if err := tx.Where("purchase_id = ?", purchaseID).
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("purchase_id = ? AND user_id = ?", claims.PurchaseID, claims.UserID).
 		Preload("Item").
+		Preload("Variant").
 		Preload("User").
 		First(&purchase).Error; err != nil {
 		tx.Rollback()
 		return nil, err
 	}
 
-	if purchase.Status == "redeemed" {
+	if err := checkRedeemable(purchase); err != nil {
 		tx.Rollback()
-		return nil, fmt.Errorf("purchase already redeemed")
+		return nil, err
 	}
 
-	now := time.Now()
-	if err := tx.Model(&purchase).Updates(map[string]interface{}{
-		"status":      "redeemed",
-		"redeemed_at": &now,
-	}).Error; err != nil {
+	if err := consumeRedemptionNonce(tx, claims); err != nil {
 		tx.Rollback()
 		return nil, err
 	}
 
-	if err := tx.Commit().Error; err != nil {
+	previousStatus := purchase.Status
+	if err := applyPurchaseTransition(tx, &purchase, PurchaseDelivered, ""); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	now := time.Now()
+	entry, err := recordRedemption(tx, purchase, previousStatus, "", adminID, now)
+	if err != nil {
+		tx.Rollback()
 		return nil, err
 	}
 
-	userName := purchase.User.FirstName
-	if purchase.User.LastName != "" {
-		userName += " " + purchase.User.LastName
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
 	}
 
 	return &RedeemResponse{
-		Success: true,
-		Item:    purchase.Item.Name,
-		User:    userName,
+		Success:      true,
+		Item:         purchase.Item.Name,
+		Variant:      purchase.VariantLabel(),
+		User:         userFullName(purchase.User),
+		RedemptionID: int(entry.ID),
+		UndoUntil:    now.Add(redemptionUndoWindow()).Format(time.RFC3339),
 	}, nil
 }
 
-// GetLeaderboard gets top users and current user position
-func GetLeaderboard(currentUserID uint) (*LeaderboardResponse, error) {
-	// Get top 20 users
-	var users []User
-	if err := DB.Order("balance DESC, (SELECT COUNT(*) FROM user_tasks WHERE user_tasks.user_id = users.id AND user_tasks.status = 'completed') DESC").
-		Limit(20).
-		Find(&users).Error; err != nil {
+// LeaderboardFilter selects which users are ranked together
+type LeaderboardFilter struct {
+	Scope      string // "global", "university", "track" or "friends"
+	University string
+	Track      string
+	UserID     uint // owner of the friend list for the "friends" scope
+}
+
+// leaderboardQuery builds a ranked user query for the given scope. Ranks are
+// computed with a window function so the page, the current user and their
+// neighbors are always consistent with each other.
+func leaderboardQuery(filter LeaderboardFilter) *gorm.DB {
+	completed := DB.Model(&UserTask{}).
+		Select("user_id, COUNT(*) AS cnt").
+		Where("status = ?", "completed").
+		Group("user_id")
+
+	ranked := DB.Table("users").
+		Select(`users.id AS user_id, `+publicNameSQL+` AS username, users.balance, users.current_streak,
+			COALESCE(ct.cnt, 0) AS completed_tasks_count,
+			ROW_NUMBER() OVER (ORDER BY users.balance DESC, COALESCE(ct.cnt, 0) DESC, users.id) AS rank`).
+		Joins("LEFT JOIN (?) AS ct ON ct.user_id = users.id", completed).
+		Where("users.hide_from_leaderboard = ?", false).
+		// Shadow-banned users still see themselves so the ban goes unnoticed
+		Where("users.status = ? OR users.id = ?", UserActive, filter.UserID)
+
+	switch filter.Scope {
+	case "university":
+		ranked = ranked.Where("LOWER(users.university) = LOWER(?)", filter.University)
+	case "track":
+		ranked = ranked.Where("users.track = ?", filter.Track)
+	case "friends":
+		ranked = ranked.Where("users.id = ? OR users.id IN (?)", filter.UserID,
+			DB.Model(&Friendship{}).Select("friend_id").Where("user_id = ?", filter.UserID))
+	}
+
+	return DB.Table("(?) AS ranked", ranked)
+}
+
+// GetLeaderboard gets a page of ranked users for the filter and, if
+// currentUserID is set, the current user's position and neighbors (±5 ranks)
+func GetLeaderboard(filter LeaderboardFilter, currentUserID uint, page, pageSize int) (*LeaderboardResponse, error) {
+	var total int64
+	if err := leaderboardQuery(filter).Count(&total).Error; err != nil {
 		return nil, err
 	}
 
-	var topUsers []LeaderboardEntry
-	for rank, user := range users {
-		var completedTasksCount int64
-		DB.Model(&UserTask{}).Where("user_id = ? AND status = ?", user.ID, "completed").Count(&completedTasksCount)
+	topUsers := make([]LeaderboardEntry, 0)
+	if err := leaderboardQuery(filter).
+		Order("rank").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Scan(&topUsers).Error; err != nil {
+		return nil, err
+	}
 
-		topUsers = append(topUsers, LeaderboardEntry{
-			Rank:                rank + 1,
-			UserID:              int(user.ID),
-			Username:            user.Username,
-			Balance:             user.Balance,
-			CompletedTasksCount: int(completedTasksCount),
-			CurrentStreak:       user.CurrentStreak,
-		})
+	response := &LeaderboardResponse{
+		Scope:    filter.Scope,
+		TopUsers: topUsers,
+		Page:     page,
+		PageSize: pageSize,
+		Total:    total,
 	}
 
 	// Get current user position
-	var currentUser *LeaderboardEntry
 	if currentUserID > 0 {
-		var user User
-		if err := DB.First(&user, currentUserID).Error; err == nil {
-			var userRank int64
-			DB.Model(&User{}).
-				Where("balance > ? OR (balance = ? AND id < ?)", user.Balance, user.Balance, user.ID).
-				Count(&userRank)
-
-			var completedTasksCount int64
-			DB.Model(&UserTask{}).Where("user_id = ? AND status = ?", user.ID, "completed").Count(&completedTasksCount)
-
-			currentUser = &LeaderboardEntry{
-				Rank:                int(userRank) + 1,
-				UserID:              int(user.ID),
-				Username:            user.Username,
-				Balance:             user.Balance,
-				CompletedTasksCount: int(completedTasksCount),
-				CurrentStreak:       user.CurrentStreak,
+		var current LeaderboardEntry
+		result := leaderboardQuery(filter).Where("user_id = ?", currentUserID).Limit(1).Scan(&current)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected > 0 {
+			response.CurrentUser = &current
+
+			neighbors := make([]LeaderboardEntry, 0)
+			if err := leaderboardQuery(filter).
+				Where("rank BETWEEN ? AND ?", current.Rank-leaderboardNeighborRange, current.Rank+leaderboardNeighborRange).
+				Order("rank").
+				Scan(&neighbors).Error; err != nil {
+				return nil, err
 			}
+			response.Neighbors = neighbors
 		}
 	}
 
-	return &LeaderboardResponse{
-		TopUsers:    topUsers,
-		CurrentUser: currentUser,
-	}, nil
+	return response, nil
+}
+
+// leaderboardNeighborRange is how many ranks above and below the current user are returned
+const leaderboardNeighborRange = 5
+
+// UpdatePrivacy sets the user's public nickname and leaderboard visibility.
+// A nil field is left unchanged; an empty nickname clears it.
+func UpdatePrivacy(userID uint, nickname *string, hide *bool) error {
+	updates := map[string]interface{}{}
+
+	if nickname != nil {
+		name := strings.TrimSpace(*nickname)
+		if name == "" {
+			updates["nickname"] = nil
+		} else {
+			if err := ValidateNickname(name); err != nil {
+				return err
+			}
+			var count int64
+			if err := DB.Model(&User{}).Where("LOWER(nickname) = LOWER(?) AND id <> ?", name, userID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return fmt.Errorf("nickname already taken")
+			}
+			updates["nickname"] = name
+		}
+	}
+	if hide != nil {
+		updates["hide_from_leaderboard"] = *hide
+	}
+
+	if len(updates) == 0 {
+		return nil
+	}
+	if err := DB.Model(&User{}).Where("id = ?", userID).Updates(updates).Error; err != nil {
+		// A concurrent request took the nickname after the check above
+		if isDuplicateKey(err) {
+			return fmt.Errorf("nickname already taken")
+		}
+		return err
+	}
+	return nil
+}
+
+// FindUserByNickname gets a user by public nickname (case-insensitive)
+func FindUserByNickname(nickname string) (*User, error) {
+	var user User
+	if err := DB.Where("LOWER(nickname) = LOWER(?)", strings.TrimSpace(nickname)).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// AddFriend adds friendID to the user's friend list
+func AddFriend(userID, friendID uint) error {
+	if userID == friendID {
+		return fmt.Errorf("cannot add yourself")
+	}
+
+	var friend User
+	if err := DB.First(&friend, friendID).Error; err != nil {
+		return err
+	}
+
+	friendship := Friendship{UserID: userID, FriendID: friendID}
+	return DB.Where("user_id = ? AND friend_id = ?", userID, friendID).FirstOrCreate(&friendship).Error
+}
+
+// RemoveFriend removes friendID from the user's friend list
+func RemoveFriend(userID, friendID uint) error {
+	return DB.Where("user_id = ? AND friend_id = ?", userID, friendID).Delete(&Friendship{}).Error
+}
+
+// GetFriends gets the user's friend list
+func GetFriends(userID uint) ([]FriendResponse, error) {
+	var friendships []Friendship
+	if err := DB.Where("user_id = ?", userID).
+		Preload("Friend").
+		Order("created_at").
+		Find(&friendships).Error; err != nil {
+		return nil, err
+	}
+
+	friends := make([]FriendResponse, 0)
+	for _, f := range friendships {
+		friend := FriendResponse{
+			UserID:   int(f.FriendID),
+			Username: f.Friend.PublicName(),
+			AddedAt:  f.CreatedAt.Format(time.RFC3339),
+		}
+		// Anyone can add anyone, so the balance is only shown for users who
+		// would also appear on the leaderboard
+		if !f.Friend.HideFromLeaderboard && f.Friend.Status == UserActive {
+			balance := f.Friend.Balance
+			friend.Balance = &balance
+		}
+		friends = append(friends, friend)
+	}
+
+	return friends, nil
 }
 
 // GetUserMetrics gets detailed user metrics
@@ -631,15 +2418,15 @@ func GetUserMetrics(userID uint) (map[string]interface{}, error) {
 	var totalSpent int
 	DB.Model(&Purchase{}).
 		Joins("JOIN shop_items ON purchases.item_id = shop_items.id").
-		Where("purchases.user_id = ?", userID).
+		Where("purchases.user_id = ? AND purchases.status <> ?", userID, PurchaseCancelled).
 		Select("COALESCE(SUM(shop_items.price), 0)").
 		Scan(&totalSpent)
 
 	var itemsPurchased int64
-	DB.Model(&Purchase{}).Where("user_id = ?", userID).Count(&itemsPurchased)
+	DB.Model(&Purchase{}).Where("user_id = ? AND status <> ?", userID, PurchaseCancelled).Count(&itemsPurchased)
 
 	var itemsRedeemed int64
-	DB.Model(&Purchase{}).Where("user_id = ? AND status = ?", userID, "redeemed").Count(&itemsRedeemed)
+	DB.Model(&Purchase{}).Where("user_id = ? AND status = ?", userID, PurchaseDelivered).Count(&itemsRedeemed)
 
 	metrics := map[string]interface{}{
 		"user_id":               user.ID,
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var nicknamePattern = regexp.MustCompile(`^[\p{L}\p{N}_.-]{3,24}$`)
+
+// bannedNicknameParts are lowercase fragments that may not appear in a public
+// nickname. Matching is done on a normalized form, see normalizeForProfanity.
+var bannedNicknameParts = []string{
+	"fuck", "shit", "bitch", "cunt", "dick", "pussy", "whore", "slut", "nigg", "fag",
+	"хуй", "хуе", "хуё", "пизд", "бля", "еба", "ебл", "ёб", "сука", "суки", "мудак", "мудил", "гандон", "пидор", "пидар", "залуп", "шлюх",
+	"admin", "moderator", "админ", "модератор",
+}
+
+// leetReplacer undoes common character substitutions before profanity checks
+var leetReplacer = strings.NewReplacer(
+	"0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s",
+	"_", "", ".", "", "-", "",
+)
+
+func normalizeForProfanity(s string) string {
+	return leetReplacer.Replace(strings.ToLower(s))
+}
+
+// ValidateNickname checks the format of a public nickname and rejects profanity
+func ValidateNickname(nickname string) error {
+	if !nicknamePattern.MatchString(nickname) {
+		return fmt.Errorf("nickname must be 3-24 letters, digits, '_', '.' or '-'")
+	}
+
+	normalized := normalizeForProfanity(nickname)
+	for _, part := range bannedNicknameParts {
+		if strings.Contains(normalized, part) {
+			return fmt.Errorf("nickname is not allowed")
+		}
+	}
+
+	return nil
+}
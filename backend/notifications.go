@@ -0,0 +1,430 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	_ "time/tzdata" // quiet hours need time zones even in minimal containers
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Telegram notifications are queued in the notifications table and sent by a
+// background worker. Preferences (opt-out per category, quiet hours) are
+// checked when a message is sent, so changing them also affects queued ones.
+// Messages that arrive during quiet hours are postponed to the end of the
+// quiet period, or expire if they're no longer relevant by then.
+
+// Notification kinds
+const (
+	NotifyStreakReminder  = "streak_reminder"
+	NotifyTaskUnlocked    = "task_unlocked"
+	NotifyPurchaseReady   = "purchase_ready"
+	NotifyPurchaseShipped = "purchase_shipped"
+)
+
+const (
+	notificationBatchSize  = 50
+	notificationClaimLease = 15 * time.Minute // how long claimed rows are hidden from other workers
+	defaultTimezone        = "Europe/Moscow"
+)
+
+var notificationTexts = map[string]map[string]string{
+	NotifyStreakReminder: {
+		"ru": "🔥 Твоя серия — %d дн. подряд! Выполни задание сегодня, чтобы её не потерять.",
+		"en": "🔥 You're on a %d-day streak! Complete a task today to keep it going.",
+	},
+	NotifyTaskUnlocked: {
+		"ru": "🆕 Доступно новое задание: %s",
+		"en": "🆕 A new task is available: %s",
+	},
+	NotifyPurchaseReady: {
+		"ru": "🎁 Ваш мерч готов к выдаче: %s. Пункт выдачи: %s",
+		"en": "🎁 Your merch is ready for pickup: %s. Pickup point: %s",
+	},
+	NotifyPurchaseShipped: {
+		"ru": "📦 Ваш заказ отправлен: %s. Трек-номер: %s",
+		"en": "📦 Your order has been shipped: %s. Tracking number: %s",
+	},
+}
+
+func notificationText(kind, language string, args ...interface{}) string {
+	return fmt.Sprintf(notificationTexts[kind][normalizeLanguage(language)], args...)
+}
+
+func defaultNotificationPreference(userID uint) NotificationPreference {
+	return NotificationPreference{
+		UserID:          userID,
+		Enabled:         true,
+		StreakReminders: true,
+		TaskUnlocks:     true,
+		PurchaseUpdates: true,
+		Timezone:        defaultTimezone,
+	}
+}
+
+func getNotificationPreference(db *gorm.DB, userID uint) (NotificationPreference, error) {
+	pref := defaultNotificationPreference(userID)
+	err := db.Where("user_id = ?", userID).First(&pref).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return pref, err
+	}
+	return pref, nil
+}
+
+// Allows reports whether the user wants notifications of this kind
+func (p NotificationPreference) Allows(kind string) bool {
+	if !p.Enabled {
+		return false
+	}
+	switch kind {
+	case NotifyStreakReminder:
+		return p.StreakReminders
+	case NotifyTaskUnlocked:
+		return p.TaskUnlocks
+	case NotifyPurchaseReady, NotifyPurchaseShipped, NotifyBackInStock:
+		return p.PurchaseUpdates
+	}
+	return true
+}
+
+// QuietUntil returns the end of the current quiet period, or false if now is
+// outside quiet hours. Quiet hours may wrap around midnight (e.g. 22-8).
+func (p NotificationPreference) QuietUntil(now time.Time) (time.Time, bool) {
+	if p.QuietHoursStart == nil || p.QuietHoursEnd == nil || *p.QuietHoursStart == *p.QuietHoursEnd {
+		return time.Time{}, false
+	}
+	location, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		location, _ = time.LoadLocation(defaultTimezone)
+	}
+
+	local := now.In(location)
+	start, end, hour := *p.QuietHoursStart, *p.QuietHoursEnd, local.Hour()
+	quiet := hour >= start && hour < end
+	if start > end {
+		quiet = hour >= start || hour < end
+	}
+	if !quiet {
+		return time.Time{}, false
+	}
+
+	until := time.Date(local.Year(), local.Month(), local.Day(), end, 0, 0, 0, location)
+	if !until.After(local) {
+		until = until.AddDate(0, 0, 1)
+	}
+	return until, true
+}
+
+// enqueueNotification queues a Telegram message. A non-empty dedupKey makes
+// the call idempotent.
+func enqueueNotification(tx *gorm.DB, userID uint, kind, text, dedupKey string, expiresAt *time.Time) error {
+	notification := Notification{
+		UserID:        userID,
+		Kind:          kind,
+		Text:          text,
+		Status:        "pending",
+		NextAttemptAt: time.Now(),
+		ExpiresAt:     expiresAt,
+	}
+	if dedupKey != "" {
+		notification.DedupKey = &dedupKey
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&notification).Error
+}
+
+// enqueuePurchaseNotification tells the buyer that their merch is ready for
+// pickup or has been shipped
+func enqueuePurchaseNotification(tx *gorm.DB, purchase Purchase) error {
+	var user User
+	if err := tx.First(&user, purchase.UserID).Error; err != nil {
+		return err
+	}
+	if user.TelegramID == nil {
+		return nil
+	}
+	var item ShopItem
+	if err := tx.First(&item, purchase.ItemID).Error; err != nil {
+		return err
+	}
+
+	dedupKey := fmt.Sprintf("purchase:%s:%s", purchase.PurchaseID, purchase.Status)
+	switch purchase.Status {
+	case PurchaseReadyForPickup:
+		location := "-"
+		if purchase.PickupLocationID != nil {
+			var pickup PickupLocation
+			if err := tx.First(&pickup, *purchase.PickupLocationID).Error; err == nil {
+				location = pickup.Name
+				if pickup.OpeningHours != "" {
+					location += " (" + pickup.OpeningHours + ")"
+				}
+			}
+		}
+		text := notificationText(NotifyPurchaseReady, user.Language, item.Name, location)
+		return enqueueNotification(tx, user.ID, NotifyPurchaseReady, text, dedupKey, nil)
+	case PurchaseShipped:
+		tracking := purchase.TrackingNumber
+		if tracking == "" {
+			tracking = "-"
+		}
+		text := notificationText(NotifyPurchaseShipped, user.Language, item.Name, tracking)
+		return enqueueNotification(tx, user.ID, NotifyPurchaseShipped, text, dedupKey, nil)
+	}
+	return nil
+}
+
+// enqueueTaskUnlockNotifications queues a message for every Telegram user who gets access
+// to a newly published task, i.e. who completed the task before it
+func enqueueTaskUnlockNotifications(task Task) error {
+	query := DB.Model(&User{}).Select("users.id, users.language").Where("users.telegram_id IS NOT NULL")
+
+	var prevTask Task
+	err := DB.Where("position < ? AND language = ?", task.Position, task.Language).Order("position DESC").First(&prevTask).Error
+	if err == nil {
+		query = query.Joins("JOIN user_tasks ON user_tasks.user_id = users.id").
+			Where("user_tasks.task_id = ? AND user_tasks.status = ?", prevTask.ID, "completed")
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	var recipients []struct {
+		ID       uint
+		Language string
+	}
+	if err := query.Scan(&recipients).Error; err != nil {
+		return err
+	}
+
+	for _, recipient := range recipients {
+		text := notificationText(NotifyTaskUnlocked, recipient.Language, task.Title)
+		dedupKey := fmt.Sprintf("task:%d:%d", task.ID, recipient.ID)
+		if err := enqueueNotification(DB, recipient.ID, NotifyTaskUnlocked, text, dedupKey, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueueStreakReminders reminds users whose streak breaks at midnight because
+// they haven't completed a task today. Runs at most once per user per day.
+func enqueueStreakReminders(now time.Time) error {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	yesterday := today.AddDate(0, 0, -1)
+	midnight := today.AddDate(0, 0, 1)
+
+	var users []User
+	if err := DB.Where("telegram_id IS NOT NULL AND current_streak > 0 AND last_task_date = ?", yesterday).
+		Find(&users).Error; err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		text := notificationText(NotifyStreakReminder, user.Language, user.CurrentStreak)
+		dedupKey := fmt.Sprintf("streak:%d:%s", user.ID, today.Format("2006-01-02"))
+		if err := enqueueNotification(DB, user.ID, NotifyStreakReminder, text, dedupKey, &midnight); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartNotificationWorker sends queued notifications every NOTIFY_POLL_INTERVAL
+// seconds and queues streak reminders from STREAK_REMINDER_HOUR (server time)
+func StartNotificationWorker(sender TelegramSender) {
+	interval := time.Duration(getEnvInt("NOTIFY_POLL_INTERVAL", 15)) * time.Second
+	reminderHour := getEnvInt("STREAK_REMINDER_HOUR", 18)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var lastReminderDay string
+		for range ticker.C {
+			now := time.Now()
+			if day := now.Format("2006-01-02"); now.Hour() >= reminderHour && day != lastReminderDay {
+				if err := enqueueStreakReminders(now); err != nil {
+					log.Printf("streak reminders: %v", err)
+				} else {
+					lastReminderDay = day
+				}
+			}
+			if err := processNotifications(sender); err != nil {
+				log.Printf("notifications: %v", err)
+			}
+		}
+	}()
+}
+
+// processNotifications sends one batch of due notifications. The batch is
+// claimed in a short transaction and sent outside it, so a failed update
+// can't roll back (and later resend) messages that were already delivered.
+func processNotifications(sender TelegramSender) error {
+	maxAttempts := getEnvInt("NOTIFY_MAX_ATTEMPTS", 5)
+
+	batch, err := claimNotificationBatch(time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, notification := range batch {
+		user, pref, err := loadNotificationRecipient(DB, notification.UserID)
+		if err != nil {
+			log.Printf("notifications: notification %d: %v", notification.ID, err)
+			continue
+		}
+		updates := deliverNotification(sender, notification, user, pref, maxAttempts, time.Now())
+		if err := DB.Model(&Notification{}).Where("id = ?", notification.ID).Updates(updates).Error; err != nil {
+			log.Printf("notifications: notification %d: %v", notification.ID, err)
+		}
+	}
+	return nil
+}
+
+// claimNotificationBatch takes due notifications for this worker by moving
+// next_attempt_at past notificationClaimLease, so other workers skip them
+// while they are sent. Notifications of a worker that dies mid-batch become
+// due again once the lease is over.
+func claimNotificationBatch(now time.Time) ([]Notification, error) {
+	var batch []Notification
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", "pending", now).
+			Order("id").Limit(notificationBatchSize).Find(&batch).Error; err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, 0, len(batch))
+		for _, notification := range batch {
+			ids = append(ids, notification.ID)
+		}
+		return tx.Model(&Notification{}).Where("id IN ?", ids).
+			Update("next_attempt_at", now.Add(notificationClaimLease)).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// loadNotificationRecipient loads the user a notification goes to and their
+// preferences; the user is nil when the account no longer exists
+func loadNotificationRecipient(tx *gorm.DB, userID uint) (*User, NotificationPreference, error) {
+	var user User
+	if err := tx.First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, NotificationPreference{}, nil
+		}
+		return nil, NotificationPreference{}, err
+	}
+	pref, err := getNotificationPreference(tx, user.ID)
+	if err != nil {
+		return nil, NotificationPreference{}, err
+	}
+	return &user, pref, nil
+}
+
+// deliverNotification applies preferences and quiet hours, sends the message
+// and returns the row updates
+func deliverNotification(sender TelegramSender, notification Notification, user *User, pref NotificationPreference, maxAttempts int, now time.Time) map[string]interface{} {
+	if notification.ExpiresAt != nil && now.After(*notification.ExpiresAt) {
+		return map[string]interface{}{"status": "expired"}
+	}
+	if user == nil || user.TelegramID == nil || !pref.Allows(notification.Kind) {
+		return map[string]interface{}{"status": "skipped"}
+	}
+
+	if until, quiet := pref.QuietUntil(now); quiet {
+		if notification.ExpiresAt != nil && until.After(*notification.ExpiresAt) {
+			return map[string]interface{}{"status": "expired"}
+		}
+		return map[string]interface{}{"next_attempt_at": until}
+	}
+
+	attempts := notification.Attempts + 1
+	updates := map[string]interface{}{"attempts": attempts}
+	if err := sender.SendMessage(*user.TelegramID, notification.Text); err != nil {
+		updates["last_error"] = err.Error()
+		var telegramErr *TelegramError
+		switch {
+		case errors.As(err, &telegramErr) && telegramErr.Permanent(), attempts >= maxAttempts:
+			updates["status"] = "failed"
+		case errors.As(err, &telegramErr) && telegramErr.RetryAfter > 0:
+			updates["next_attempt_at"] = now.Add(telegramErr.RetryAfter)
+		default:
+			updates["next_attempt_at"] = now.Add(retryDelay(attempts))
+		}
+		return updates
+	}
+
+	updates["status"] = "sent"
+	updates["sent_at"] = &now
+	updates["last_error"] = ""
+	return updates
+}
+
+// GetNotificationSettings returns the user's notification settings
+func GetNotificationSettings(userID uint) (*NotificationSettingsResponse, error) {
+	pref, err := getNotificationPreference(DB, userID)
+	if err != nil {
+		return nil, err
+	}
+	response := notificationSettingsToResponse(pref)
+	return &response, nil
+}
+
+// UpdateNotificationSettings replaces the user's notification settings
+func UpdateNotificationSettings(userID uint, req NotificationSettingsRequest) (*NotificationSettingsResponse, error) {
+	if (req.QuietHoursStart == nil) != (req.QuietHoursEnd == nil) {
+		return nil, fmt.Errorf("quiet hours need both start and end")
+	}
+	for _, hour := range []*int{req.QuietHoursStart, req.QuietHoursEnd} {
+		if hour != nil && (*hour < 0 || *hour > 23) {
+			return nil, fmt.Errorf("quiet hours must be between 0 and 23")
+		}
+	}
+	timezone := req.Timezone
+	if timezone == "" {
+		timezone = defaultTimezone
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return nil, fmt.Errorf("unknown timezone")
+	}
+
+	pref := NotificationPreference{
+		UserID:          userID,
+		Enabled:         req.Enabled,
+		StreakReminders: req.StreakReminders,
+		TaskUnlocks:     req.TaskUnlocks,
+		PurchaseUpdates: req.PurchaseUpdates,
+		QuietHoursStart: req.QuietHoursStart,
+		QuietHoursEnd:   req.QuietHoursEnd,
+		Timezone:        timezone,
+	}
+	// Save with explicit columns so false values aren't replaced by defaults
+	if err := DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"enabled", "streak_reminders", "task_unlocks", "purchase_updates", "quiet_hours_start", "quiet_hours_end", "timezone"}),
+	}).Select("*").Create(&pref).Error; err != nil {
+		return nil, err
+	}
+
+	response := notificationSettingsToResponse(pref)
+	return &response, nil
+}
+
+func notificationSettingsToResponse(pref NotificationPreference) NotificationSettingsResponse {
+	return NotificationSettingsResponse{
+		Enabled:         pref.Enabled,
+		StreakReminders: pref.StreakReminders,
+		TaskUnlocks:     pref.TaskUnlocks,
+		PurchaseUpdates: pref.PurchaseUpdates,
+		QuietHoursStart: pref.QuietHoursStart,
+		QuietHoursEnd:   pref.QuietHoursEnd,
+		Timezone:        pref.Timezone,
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeBotToken = "123:test-token"
+
+// fakeBotAPI imitates the sendMessage method of the Telegram Bot API. Each
+// call answers with the next queued reply, or with success when none is left.
+type fakeBotAPI struct {
+	*httptest.Server
+	mu       sync.Mutex
+	replies  []fakeBotReply
+	messages []fakeBotMessage
+}
+
+type fakeBotReply struct {
+	Status      int
+	Description string
+	RetryAfter  int
+}
+
+type fakeBotMessage struct {
+	ChatID int64  `json:"chat_id"`
+	Text   string `json:"text"`
+}
+
+func newFakeBotAPI(t *testing.T, replies ...fakeBotReply) *fakeBotAPI {
+	t.Helper()
+	api := &fakeBotAPI{replies: replies}
+	api.Server = httptest.NewServer(http.HandlerFunc(api.handle))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func (api *fakeBotAPI) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost || r.URL.Path != "/bot"+fakeBotToken+"/sendMessage" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error_code": 404, "description": "Not Found"})
+		return
+	}
+	var message fakeBotMessage
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error_code": 400, "description": "Bad Request: invalid JSON"})
+		return
+	}
+
+	api.mu.Lock()
+	api.messages = append(api.messages, message)
+	reply := fakeBotReply{Status: http.StatusOK}
+	if len(api.replies) > 0 {
+		reply, api.replies = api.replies[0], api.replies[1:]
+	}
+	api.mu.Unlock()
+
+	w.WriteHeader(reply.Status)
+	if reply.Status == http.StatusOK {
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": map[string]interface{}{"message_id": 1}})
+		return
+	}
+	response := map[string]interface{}{"ok": false, "error_code": reply.Status, "description": reply.Description}
+	if reply.RetryAfter > 0 {
+		response["parameters"] = map[string]interface{}{"retry_after": reply.RetryAfter}
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func (api *fakeBotAPI) sender() *BotAPISender {
+	return &BotAPISender{BaseURL: api.URL, Token: fakeBotToken, Client: api.Client()}
+}
+
+func (api *fakeBotAPI) sent() []fakeBotMessage {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return append([]fakeBotMessage(nil), api.messages...)
+}
+
+func testRecipient() (*User, NotificationPreference) {
+	telegramID := int64(555)
+	pref := defaultNotificationPreference(1)
+	pref.Timezone = "UTC"
+	return &User{ID: 1, TelegramID: &telegramID}, pref
+}
+
+func testNotification(attempts int) Notification {
+	return Notification{ID: 1, UserID: 1, Kind: NotifyPurchaseReady, Text: "Your order is ready", Attempts: attempts}
+}
+
+var testNow = time.Date(2025, 1, 15, 12, 0, 0, 0, time.UTC)
+
+func TestDeliverNotificationSent(t *testing.T) {
+	api := newFakeBotAPI(t)
+	user, pref := testRecipient()
+
+	updates := deliverNotification(api.sender(), testNotification(0), user, pref, 5, testNow)
+
+	if updates["status"] != "sent" || updates["attempts"] != 1 || updates["last_error"] != "" {
+		t.Fatalf("updates %v", updates)
+	}
+	if sentAt, _ := updates["sent_at"].(*time.Time); sentAt == nil || !sentAt.Equal(testNow) {
+		t.Fatalf("sent_at %v", updates["sent_at"])
+	}
+	sent := api.sent()
+	if len(sent) != 1 || sent[0].ChatID != 555 || sent[0].Text != "Your order is ready" {
+		t.Fatalf("messages %+v", sent)
+	}
+}
+
+func TestDeliverNotificationRetriesServerErrors(t *testing.T) {
+	api := newFakeBotAPI(t, fakeBotReply{Status: http.StatusBadGateway, Description: "Bad Gateway"})
+	user, pref := testRecipient()
+
+	updates := deliverNotification(api.sender(), testNotification(1), user, pref, 5, testNow)
+
+	if _, failed := updates["status"]; failed {
+		t.Fatalf("5xx should be retried, got status %v", updates["status"])
+	}
+	if updates["attempts"] != 2 {
+		t.Fatalf("attempts %v", updates["attempts"])
+	}
+	if next := updates["next_attempt_at"]; next != testNow.Add(retryDelay(2)) {
+		t.Fatalf("next_attempt_at %v, want backoff %v", next, retryDelay(2))
+	}
+	if lastError, _ := updates["last_error"].(string); !strings.Contains(lastError, "502") {
+		t.Fatalf("last_error %q", lastError)
+	}
+}
+
+func TestDeliverNotificationHonorsRetryAfter(t *testing.T) {
+	api := newFakeBotAPI(t, fakeBotReply{Status: http.StatusTooManyRequests, Description: "Too Many Requests: retry after 7", RetryAfter: 7})
+	user, pref := testRecipient()
+
+	updates := deliverNotification(api.sender(), testNotification(0), user, pref, 5, testNow)
+
+	if _, failed := updates["status"]; failed {
+		t.Fatalf("429 should be retried, got status %v", updates["status"])
+	}
+	if next := updates["next_attempt_at"]; next != testNow.Add(7*time.Second) {
+		t.Fatalf("next_attempt_at %v, want retry_after of 7s", next)
+	}
+}
+
+func TestDeliverNotificationFailsWhenBotBlocked(t *testing.T) {
+	api := newFakeBotAPI(t, fakeBotReply{Status: http.StatusForbidden, Description: "Forbidden: bot was blocked by the user"})
+	user, pref := testRecipient()
+
+	updates := deliverNotification(api.sender(), testNotification(0), user, pref, 5, testNow)
+
+	if updates["status"] != "failed" {
+		t.Fatalf("status %v, want failed", updates["status"])
+	}
+	if _, retried := updates["next_attempt_at"]; retried {
+		t.Fatal("a blocked bot should not be retried")
+	}
+	if lastError, _ := updates["last_error"].(string); !strings.Contains(lastError, "blocked") {
+		t.Fatalf("last_error %q", lastError)
+	}
+}
+
+func TestDeliverNotificationFailsAfterMaxAttempts(t *testing.T) {
+	api := newFakeBotAPI(t, fakeBotReply{Status: http.StatusInternalServerError, Description: "Internal Server Error"})
+	user, pref := testRecipient()
+
+	updates := deliverNotification(api.sender(), testNotification(4), user, pref, 5, testNow)
+
+	if updates["status"] != "failed" || updates["attempts"] != 5 {
+		t.Fatalf("updates %v", updates)
+	}
+}
+
+func TestDeliverNotificationDefersDuringQuietHours(t *testing.T) {
+	api := newFakeBotAPI(t)
+	user, pref := testRecipient()
+	start, end := 22, 8
+	pref.QuietHoursStart, pref.QuietHoursEnd = &start, &end
+
+	now := time.Date(2025, 1, 15, 23, 30, 0, 0, time.UTC)
+	updates := deliverNotification(api.sender(), testNotification(0), user, pref, 5, now)
+
+	want := time.Date(2025, 1, 16, 8, 0, 0, 0, time.UTC)
+	if next, _ := updates["next_attempt_at"].(time.Time); !next.Equal(want) {
+		t.Fatalf("next_attempt_at %v, want %v", updates["next_attempt_at"], want)
+	}
+	if _, counted := updates["attempts"]; counted {
+		t.Fatal("a deferral should not count as an attempt")
+	}
+	if len(api.sent()) != 0 {
+		t.Fatal("message sent during quiet hours")
+	}
+
+	// Notifications that expire before the quiet hours end are dropped
+	expiresAt := time.Date(2025, 1, 16, 6, 0, 0, 0, time.UTC)
+	notification := testNotification(0)
+	notification.ExpiresAt = &expiresAt
+	if updates := deliverNotification(api.sender(), notification, user, pref, 5, now); updates["status"] != "expired" {
+		t.Fatalf("status %v, want expired", updates["status"])
+	}
+}
+
+func TestDeliverNotificationSkipsWithoutTelegramOrConsent(t *testing.T) {
+	api := newFakeBotAPI(t)
+	user, pref := testRecipient()
+
+	if updates := deliverNotification(api.sender(), testNotification(0), &User{ID: 1}, pref, 5, testNow); updates["status"] != "skipped" {
+		t.Fatalf("no Telegram ID: status %v", updates["status"])
+	}
+	if updates := deliverNotification(api.sender(), testNotification(0), nil, pref, 5, testNow); updates["status"] != "skipped" {
+		t.Fatalf("deleted user: status %v", updates["status"])
+	}
+	pref.PurchaseUpdates = false
+	if updates := deliverNotification(api.sender(), testNotification(0), user, pref, 5, testNow); updates["status"] != "skipped" {
+		t.Fatalf("opted out: status %v", updates["status"])
+	}
+	if len(api.sent()) != 0 {
+		t.Fatal("message sent to a user who can't or won't receive it")
+	}
+}
+
+func TestBotAPISenderHidesToken(t *testing.T) {
+	sender := &BotAPISender{BaseURL: "http://127.0.0.1:1", Token: fakeBotToken, Client: &http.Client{Timeout: time.Second}}
+	err := sender.SendMessage(555, "hello")
+	if err == nil || strings.Contains(err.Error(), fakeBotToken) {
+		t.Fatalf("error %v", err)
+	}
+}
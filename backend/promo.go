@@ -0,0 +1,440 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Promo code discount types
+const (
+	PromoPercent = "percent" // DiscountValue is a percentage of the price (1-100)
+	PromoFixed   = "fixed"   // DiscountValue is a number of points
+)
+
+// Promo code error codes returned in the "code" field of purchase errors
+const (
+	PromoNotFound      = "promo_not_found"
+	PromoNotYetValid   = "promo_not_yet_valid"
+	PromoExpired       = "promo_expired"
+	PromoNotApplicable = "promo_not_applicable"
+	PromoUsageLimit    = "promo_usage_limit_reached"
+	PromoUserLimit     = "promo_user_limit_reached"
+)
+
+var promoErrorMessages = map[string]string{
+	PromoNotFound:      "promo code not found",
+	PromoNotYetValid:   "promo code is not valid yet",
+	PromoExpired:       "promo code has expired",
+	PromoNotApplicable: "promo code does not apply to this item",
+	PromoUsageLimit:    "promo code has been used up",
+	PromoUserLimit:     "you have already used this promo code",
+}
+
+// PromoCodeError is returned by BuyItem when a promo code can't be applied
+type PromoCodeError struct {
+	Code string
+}
+
+func (e *PromoCodeError) Error() string {
+	return promoErrorMessages[e.Code]
+}
+
+var promoCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,50}$`)
+
+func normalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Applies reports whether the code's scope covers the item
+func (p PromoCode) Applies(item ShopItem) bool {
+	if p.ItemID != nil {
+		return *p.ItemID == item.ID
+	}
+	if p.Category != "" {
+		return strings.EqualFold(p.Category, item.Category)
+	}
+	return true
+}
+
+// DiscountFor returns the discount in points for a price. The discount never
+// exceeds the price, so a 100% or large fixed code makes the item free.
+func (p PromoCode) DiscountFor(price int) int {
+	discount := p.DiscountValue
+	if p.DiscountType == PromoPercent {
+		discount = price * p.DiscountValue / 100
+	}
+	if discount > price {
+		discount = price
+	}
+	return discount
+}
+
+// promoCodeUses counts purchases made with a code; cancelled purchases give
+// the use back
+func promoCodeUses(db *gorm.DB, promoID uint, userID uint) (int64, error) {
+	query := db.Model(&Purchase{}).Where("promo_code_id = ? AND status <> ?", promoID, PurchaseCancelled)
+	if userID > 0 {
+		query = query.Where("user_id = ?", userID)
+	}
+	var count int64
+	err := query.Count(&count).Error
+	return count, err
+}
+
+// checkPromoCode validates a promo code for a purchase of item by userID and
+// returns the code and the discount. With lock set the code row is locked so
+// concurrent purchases can't exceed the usage limits.
+func checkPromoCode(db *gorm.DB, code string, userID uint, item ShopItem, now time.Time, lock bool) (*PromoCode, int, error) {
+	query := db
+	if lock {
+		query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+	var promo PromoCode
+	if err := query.Where("code = ? AND active = ?", normalizePromoCode(code), true).First(&promo).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, 0, &PromoCodeError{Code: PromoNotFound}
+		}
+		return nil, 0, err
+	}
+
+	if promo.ValidFrom != nil && now.Before(*promo.ValidFrom) {
+		return nil, 0, &PromoCodeError{Code: PromoNotYetValid}
+	}
+	if promo.ValidUntil != nil && !now.Before(*promo.ValidUntil) {
+		return nil, 0, &PromoCodeError{Code: PromoExpired}
+	}
+	if !promo.Applies(item) {
+		return nil, 0, &PromoCodeError{Code: PromoNotApplicable}
+	}
+
+	if promo.MaxUses > 0 {
+		uses, err := promoCodeUses(db, promo.ID, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		if uses >= int64(promo.MaxUses) {
+			return nil, 0, &PromoCodeError{Code: PromoUsageLimit}
+		}
+	}
+	if promo.MaxUsesPerUser > 0 {
+		uses, err := promoCodeUses(db, promo.ID, userID)
+		if err != nil {
+			return nil, 0, err
+		}
+		if uses >= int64(promo.MaxUsesPerUser) {
+			return nil, 0, &PromoCodeError{Code: PromoUserLimit}
+		}
+	}
+
+	return &promo, promo.DiscountFor(item.Price), nil
+}
+
+// PreviewPromoCode shows the price of an item with a promo code without
+// using the code
+func PreviewPromoCode(userID uint, req PromoCodePreviewRequest) (*PromoCodePreviewResponse, error) {
+	var item ShopItem
+	if err := DB.First(&item, req.ItemID).Error; err != nil {
+		return nil, err
+	}
+	if item.ArchivedAt != nil {
+		return nil, fmt.Errorf("item not available")
+	}
+
+	promo, discount, err := checkPromoCode(DB, req.Code, userID, item, time.Now(), false)
+	if err != nil {
+		return nil, err
+	}
+	return &PromoCodePreviewResponse{
+		Code:        promo.Code,
+		Description: promo.Description,
+		ItemID:      int(item.ID),
+		Price:       item.Price,
+		Discount:    discount,
+		FinalPrice:  item.Price - discount,
+	}, nil
+}
+
+// applyPromoCodeRequest copies the provided fields from an admin request and
+// validates the result
+func applyPromoCodeRequest(db *gorm.DB, promo *PromoCode, req PromoCodeRequest) error {
+	if req.Code != nil {
+		promo.Code = normalizePromoCode(*req.Code)
+	}
+	if !promoCodePattern.MatchString(promo.Code) {
+		return fmt.Errorf("invalid promo code")
+	}
+	if req.Description != nil {
+		promo.Description = strings.TrimSpace(*req.Description)
+	}
+	if req.DiscountType != nil {
+		promo.DiscountType = *req.DiscountType
+	}
+	if req.DiscountValue != nil {
+		promo.DiscountValue = *req.DiscountValue
+	}
+	switch promo.DiscountType {
+	case PromoPercent:
+		if promo.DiscountValue < 1 || promo.DiscountValue > 100 {
+			return fmt.Errorf("invalid discount")
+		}
+	case PromoFixed:
+		if promo.DiscountValue < 1 {
+			return fmt.Errorf("invalid discount")
+		}
+	default:
+		return fmt.Errorf("invalid discount type")
+	}
+
+	if req.ItemID != nil {
+		promo.ItemID = nil
+		if *req.ItemID > 0 {
+			var item ShopItem
+			if err := db.First(&item, *req.ItemID).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return fmt.Errorf("item not found")
+				}
+				return err
+			}
+			promo.ItemID = &item.ID
+		}
+	}
+	if req.Category != nil {
+		promo.Category = strings.TrimSpace(*req.Category)
+	}
+	if promo.ItemID != nil && promo.Category != "" {
+		return fmt.Errorf("promo code can be scoped to an item or a category, not both")
+	}
+
+	for _, v := range []*int{req.MaxUses, req.MaxUsesPerUser} {
+		if v != nil && *v < 0 {
+			return fmt.Errorf("limits cannot be negative")
+		}
+	}
+	if req.MaxUses != nil {
+		promo.MaxUses = *req.MaxUses
+	}
+	if req.MaxUsesPerUser != nil {
+		promo.MaxUsesPerUser = *req.MaxUsesPerUser
+	}
+
+	parseBound := func(value *string, name string) (*time.Time, bool, error) {
+		if value == nil {
+			return nil, false, nil
+		}
+		if *value == "" {
+			return nil, true, nil
+		}
+		t, err := time.Parse(time.RFC3339, *value)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid %s", name)
+		}
+		return &t, true, nil
+	}
+	from, setFrom, err := parseBound(req.ValidFrom, "valid_from")
+	if err != nil {
+		return err
+	}
+	until, setUntil, err := parseBound(req.ValidUntil, "valid_until")
+	if err != nil {
+		return err
+	}
+	if setFrom {
+		promo.ValidFrom = from
+	}
+	if setUntil {
+		promo.ValidUntil = until
+	}
+	if promo.ValidFrom != nil && promo.ValidUntil != nil && !promo.ValidUntil.After(*promo.ValidFrom) {
+		return fmt.Errorf("valid_until must be after valid_from")
+	}
+
+	if req.Active != nil {
+		promo.Active = *req.Active
+	}
+	return nil
+}
+
+// promoCodeStats are the usage numbers shown to admins
+type promoCodeStats struct {
+	PromoCodeID   uint
+	Uses          int64
+	Users         int64
+	TotalDiscount int64
+}
+
+func loadPromoCodeStats(db *gorm.DB) (map[uint]promoCodeStats, error) {
+	var rows []promoCodeStats
+	if err := db.Model(&Purchase{}).
+		Select("promo_code_id, COUNT(*) AS uses, COUNT(DISTINCT user_id) AS users, COALESCE(SUM(discount), 0) AS total_discount").
+		Where("promo_code_id IS NOT NULL AND status <> ?", PurchaseCancelled).
+		Group("promo_code_id").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	stats := make(map[uint]promoCodeStats, len(rows))
+	for _, row := range rows {
+		stats[row.PromoCodeID] = row
+	}
+	return stats, nil
+}
+
+func promoCodeToResponse(promo PromoCode, stats promoCodeStats) PromoCodeResponse {
+	response := PromoCodeResponse{
+		ID:             int(promo.ID),
+		Code:           promo.Code,
+		Description:    promo.Description,
+		DiscountType:   promo.DiscountType,
+		DiscountValue:  promo.DiscountValue,
+		Category:       promo.Category,
+		MaxUses:        promo.MaxUses,
+		MaxUsesPerUser: promo.MaxUsesPerUser,
+		Active:         promo.Active,
+		CreatedAt:      promo.CreatedAt.Format(time.RFC3339),
+		Uses:           stats.Uses,
+		Users:          stats.Users,
+		TotalDiscount:  stats.TotalDiscount,
+	}
+	if promo.ItemID != nil {
+		itemID := int(*promo.ItemID)
+		response.ItemID = &itemID
+		if promo.Item != nil {
+			response.ItemName = promo.Item.Name
+		}
+	}
+	if promo.ValidFrom != nil {
+		response.ValidFrom = promo.ValidFrom.Format(time.RFC3339)
+	}
+	if promo.ValidUntil != nil {
+		response.ValidUntil = promo.ValidUntil.Format(time.RFC3339)
+	}
+	if promo.MaxUses > 0 {
+		remaining := int64(promo.MaxUses) - stats.Uses
+		if remaining < 0 {
+			remaining = 0
+		}
+		response.Remaining = &remaining
+	}
+	return response
+}
+
+// GetPromoCodes lists all promo codes with their usage (admin only)
+func GetPromoCodes() ([]PromoCodeResponse, error) {
+	var promos []PromoCode
+	if err := DB.Preload("Item").Order("id DESC").Find(&promos).Error; err != nil {
+		return nil, err
+	}
+	stats, err := loadPromoCodeStats(DB)
+	if err != nil {
+		return nil, err
+	}
+
+	responses := make([]PromoCodeResponse, 0, len(promos))
+	for _, promo := range promos {
+		responses = append(responses, promoCodeToResponse(promo, stats[promo.ID]))
+	}
+	return responses, nil
+}
+
+// GetPromoCode returns a promo code with its usage (admin only)
+func GetPromoCode(promoID uint) (*PromoCodeResponse, error) {
+	var promo PromoCode
+	if err := DB.Preload("Item").First(&promo, promoID).Error; err != nil {
+		return nil, err
+	}
+	stats, err := loadPromoCodeStats(DB.Where("promo_code_id = ?", promoID))
+	if err != nil {
+		return nil, err
+	}
+	response := promoCodeToResponse(promo, stats[promo.ID])
+	return &response, nil
+}
+
+// CreatePromoCode creates a promo code (admin only). New codes are active
+// unless the request says otherwise.
+func CreatePromoCode(req PromoCodeRequest) (*PromoCodeResponse, error) {
+	if req.Code == nil || req.DiscountType == nil || req.DiscountValue == nil {
+		return nil, fmt.Errorf("code, discount_type and discount_value are required")
+	}
+	promo := PromoCode{Active: true}
+	if err := applyPromoCodeRequest(DB, &promo, req); err != nil {
+		return nil, err
+	}
+
+	var existing int64
+	if err := DB.Model(&PromoCode{}).Where("code = ?", promo.Code).Count(&existing).Error; err != nil {
+		return nil, err
+	}
+	if existing > 0 {
+		return nil, fmt.Errorf("promo code already exists")
+	}
+
+	if err := DB.Create(&promo).Error; err != nil {
+		return nil, err
+	}
+	return GetPromoCode(promo.ID)
+}
+
+// UpdatePromoCode updates a promo code (admin only). The code itself can't be
+// changed once the promo code has been used.
+func UpdatePromoCode(promoID uint, req PromoCodeRequest) (*PromoCodeResponse, error) {
+	var promo PromoCode
+	if err := DB.First(&promo, promoID).Error; err != nil {
+		return nil, err
+	}
+
+	if req.Code != nil && normalizePromoCode(*req.Code) != promo.Code {
+		used, err := promoCodeUsed(promo.ID)
+		if err != nil {
+			return nil, err
+		}
+		if used {
+			return nil, fmt.Errorf("promo code in use")
+		}
+		var existing int64
+		if err := DB.Model(&PromoCode{}).Where("code = ? AND id <> ?", normalizePromoCode(*req.Code), promo.ID).
+			Count(&existing).Error; err != nil {
+			return nil, err
+		}
+		if existing > 0 {
+			return nil, fmt.Errorf("promo code already exists")
+		}
+	}
+
+	if err := applyPromoCodeRequest(DB, &promo, req); err != nil {
+		return nil, err
+	}
+	if err := DB.Omit("Item").Save(&promo).Error; err != nil {
+		return nil, err
+	}
+	return GetPromoCode(promo.ID)
+}
+
+// DeletePromoCode deletes an unused promo code (admin only). Codes that have
+// been used keep their purchases' history and can only be deactivated.
+func DeletePromoCode(promoID uint) error {
+	var promo PromoCode
+	if err := DB.First(&promo, promoID).Error; err != nil {
+		return err
+	}
+	used, err := promoCodeUsed(promo.ID)
+	if err != nil {
+		return err
+	}
+	if used {
+		return fmt.Errorf("promo code in use")
+	}
+	return DB.Delete(&promo).Error
+}
+
+// promoCodeUsed reports whether any purchase, including cancelled ones,
+// references the code
+func promoCodeUsed(promoID uint) (bool, error) {
+	var count int64
+	err := DB.Model(&Purchase{}).Where("promo_code_id = ?", promoID).Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Admin purchase list. Pages are addressed with an opaque cursor holding the
+// sort value and ID of the last row, so new purchases arriving while the
+// merch team scrolls don't shift or duplicate rows.
+
+const csvExportBatchSize = 500
+
+// PurchaseFilter selects purchases for GET /api/admin/purchases
+type PurchaseFilter struct {
+	Statuses    []string
+	ItemID      uint
+	UserID      uint
+	Email       string // case-insensitive substring
+	Fulfillment string
+	From        *time.Time // purchased at or after
+	To          *time.Time // purchased before
+	Sort        string     // "purchased_at" (default) or "price"
+	Ascending   bool
+}
+
+var purchaseSortColumns = map[string]string{
+	"purchased_at": "purchases.purchased_at",
+	"price":        "purchases.price",
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// csvSafe stops spreadsheet apps from evaluating user-provided text such as
+// names and addresses as formulas
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func (f PurchaseFilter) apply(db *gorm.DB) *gorm.DB {
+	if len(f.Statuses) > 0 {
+		db = db.Where("purchases.status IN ?", f.Statuses)
+	}
+	if f.ItemID > 0 {
+		db = db.Where("purchases.item_id = ?", f.ItemID)
+	}
+	if f.UserID > 0 {
+		db = db.Where("purchases.user_id = ?", f.UserID)
+	}
+	if f.Email != "" {
+		db = db.Where("LOWER(purchases.email) LIKE ?", "%"+likeEscaper.Replace(strings.ToLower(f.Email))+"%")
+	}
+	if f.Fulfillment != "" {
+		db = db.Where("purchases.fulfillment_method = ?", f.Fulfillment)
+	}
+	if f.From != nil {
+		db = db.Where("purchases.purchased_at >= ?", *f.From)
+	}
+	if f.To != nil {
+		db = db.Where("purchases.purchased_at < ?", *f.To)
+	}
+	return db
+}
+
+func (f PurchaseFilter) sortColumn() string {
+	if column, ok := purchaseSortColumns[f.Sort]; ok {
+		return column
+	}
+	return purchaseSortColumns["purchased_at"]
+}
+
+func encodePurchaseCursor(purchase Purchase, sort string) string {
+	value := purchase.PurchasedAt.UTC().Format(time.RFC3339Nano)
+	if sort == "price" {
+		value = strconv.Itoa(purchase.Price)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(value + "|" + strconv.FormatUint(uint64(purchase.ID), 10)))
+}
+
+// afterCursor restricts db to the rows following cursor in the filter's order
+func (f PurchaseFilter) afterCursor(db *gorm.DB, cursor string) (*gorm.DB, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	var value interface{}
+	if f.Sort == "price" {
+		price, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		value = price
+	} else {
+		purchasedAt, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		value = purchasedAt
+	}
+
+	op := "<"
+	if f.Ascending {
+		op = ">"
+	}
+	return db.Where("("+f.sortColumn()+", purchases.id) "+op+" (?, ?)", value, id), nil
+}
+
+// listPurchases returns up to limit purchases after cursor and the cursor of
+// the next page ("" on the last page)
+func listPurchases(filter PurchaseFilter, cursor string, limit int) ([]Purchase, string, error) {
+	query := filter.apply(fulfillmentQuery().Preload("Order").Preload("PromoCode"))
+	if cursor != "" {
+		var err error
+		if query, err = filter.afterCursor(query, cursor); err != nil {
+			return nil, "", err
+		}
+	}
+	direction := " DESC"
+	if filter.Ascending {
+		direction = " ASC"
+	}
+
+	// One extra row tells whether there is a next page
+	var purchases []Purchase
+	if err := query.Order(filter.sortColumn() + direction).Order("purchases.id" + direction).
+		Limit(limit + 1).Find(&purchases).Error; err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(purchases) > limit {
+		purchases = purchases[:limit]
+		next = encodePurchaseCursor(purchases[limit-1], filter.Sort)
+	}
+	return purchases, next, nil
+}
+
+func purchaseToAdminEntry(purchase Purchase) AdminPurchaseEntry {
+	entry := AdminPurchaseEntry{
+		FulfillmentEntry: purchaseToFulfillmentEntry(purchase),
+		ItemID:           int(purchase.ItemID),
+		Price:            purchase.Price,
+		Discount:         purchase.Discount,
+	}
+	if purchase.Order != nil {
+		entry.OrderID = purchase.Order.OrderID
+	}
+	if purchase.PromoCode != nil {
+		entry.PromoCode = purchase.PromoCode.Code
+	}
+	if purchase.RedeemedAt != nil {
+		entry.RedeemedAt = purchase.RedeemedAt.Format(time.RFC3339)
+	}
+	return entry
+}
+
+// GetAdminPurchases lists purchases for the admin panel (admin only)
+func GetAdminPurchases(filter PurchaseFilter, cursor string, limit int) (*AdminPurchasesResponse, error) {
+	purchases, next, err := listPurchases(filter, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	if err := filter.apply(DB.Model(&Purchase{})).Count(&total).Error; err != nil {
+		return nil, err
+	}
+
+	response := &AdminPurchasesResponse{
+		Purchases:  make([]AdminPurchaseEntry, 0, len(purchases)),
+		NextCursor: next,
+		Total:      total,
+	}
+	for _, purchase := range purchases {
+		response.Purchases = append(response.Purchases, purchaseToAdminEntry(purchase))
+	}
+	return response, nil
+}
+
+var purchaseCSVHeader = []string{
+	"purchase_id", "order_id", "purchased_at", "status", "user_id", "user_name", "email",
+	"item_id", "item_name", "variant", "price", "discount", "promo_code",
+	"fulfillment", "pickup_location", "shipping_address", "tracking_number", "redeemed_at",
+}
+
+// WritePurchasesCSV exports every purchase matching filter in batches, so
+// large exports don't have to fit in memory (admin only)
+func WritePurchasesCSV(w io.Writer, filter PurchaseFilter) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(purchaseCSVHeader); err != nil {
+		return err
+	}
+
+	cursor := ""
+	for {
+		purchases, next, err := listPurchases(filter, cursor, csvExportBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, purchase := range purchases {
+			entry := purchaseToAdminEntry(purchase)
+			location := ""
+			if entry.PickupLocation != nil {
+				location = entry.PickupLocation.Name
+			}
+			if err := writer.Write([]string{
+				entry.PurchaseID, entry.OrderID, entry.PurchasedAt, entry.Status,
+				strconv.Itoa(entry.UserID), csvSafe(entry.UserName), csvSafe(entry.Email),
+				strconv.Itoa(entry.ItemID), csvSafe(entry.ItemName), entry.Variant,
+				strconv.Itoa(entry.Price), strconv.Itoa(entry.Discount), entry.PromoCode,
+				entry.Fulfillment, csvSafe(location), csvSafe(entry.ShippingAddress), csvSafe(entry.TrackingNumber), entry.RedeemedAt,
+			}); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
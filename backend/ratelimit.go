@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Rate limiting with token buckets. Each rule has a bucket per client IP and,
+// behind AuthMiddleware, one per user: a bucket holds up to Burst tokens,
+// every request takes one and tokens refill evenly over Period. Buckets live
+// in memory, or in Postgres (RATE_LIMIT_STORE=postgres) when several
+// instances run behind a load balancer and must share them.
+
+// RateLimit is a token bucket size and refill period, e.g. 10 per minute
+type RateLimit struct {
+	Burst  int
+	Period time.Duration
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Burst > 0 && l.Period > 0
+}
+
+// RateLimitRule is the configuration of one throttled endpoint group. A zero
+// limit disables that bucket.
+type RateLimitRule struct {
+	Name string
+	IP   RateLimit
+	User RateLimit
+}
+
+// rateLimitBucket is the state of one token bucket
+type rateLimitBucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+// take refills the bucket up to now and takes a token. When the bucket is
+// empty it returns false and how long until the next token.
+func (b *rateLimitBucket) take(limit RateLimit, now time.Time) (bool, time.Duration) {
+	perToken := limit.Period / time.Duration(limit.Burst)
+	if b.UpdatedAt.IsZero() {
+		b.Tokens = float64(limit.Burst)
+	} else if elapsed := now.Sub(b.UpdatedAt); elapsed > 0 {
+		b.Tokens = math.Min(float64(limit.Burst), b.Tokens+float64(elapsed)/float64(perToken))
+	}
+	b.UpdatedAt = now
+
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.Tokens) * float64(perToken))
+}
+
+// RateLimitStore keeps token buckets by key
+type RateLimitStore interface {
+	Take(key string, limit RateLimit, now time.Time) (bool, time.Duration, error)
+}
+
+// memoryRateLimitStore keeps buckets in process memory. Full buckets are
+// dropped now and then so idle clients don't pile up.
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	rateLimitBucket
+	limit RateLimit
+}
+
+const rateLimitSweepInterval = time.Minute
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: make(map[string]*memoryBucket)}
+}
+
+func (s *memoryRateLimitStore) Take(key string, limit RateLimit, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= rateLimitSweepInterval {
+		for k, bucket := range s.buckets {
+			if now.Sub(bucket.UpdatedAt) >= bucket.limit.Period {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{}
+		s.buckets[key] = bucket
+	}
+	bucket.limit = limit
+	allowed, retryAfter := bucket.take(limit, now)
+	return allowed, retryAfter, nil
+}
+
+// postgresRateLimitStore shares buckets between instances; each take locks
+// the bucket row for the length of a short transaction. Rows untouched for
+// a day are deleted now and then.
+type postgresRateLimitStore struct {
+	db        *gorm.DB
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func (s *postgresRateLimitStore) Take(key string, limit RateLimit, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	if now.Sub(s.lastSweep) >= time.Hour {
+		s.lastSweep = now
+		if err := s.db.Where("refilled_at < ?", now.AddDate(0, 0, -1)).Delete(&RateLimitBucket{}).Error; err != nil {
+			log.Printf("rate limit cleanup: %v", err)
+		}
+	}
+	s.mu.Unlock()
+
+	var allowed bool
+	var retryAfter time.Duration
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&RateLimitBucket{Key: key, Tokens: float64(limit.Burst), RefilledAt: now}).Error; err != nil {
+			return err
+		}
+		var row RateLimitBucket
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("key = ?", key).First(&row).Error; err != nil {
+			return err
+		}
+
+		bucket := rateLimitBucket{Tokens: row.Tokens, UpdatedAt: row.RefilledAt}
+		allowed, retryAfter = bucket.take(limit, now)
+		return tx.Model(&RateLimitBucket{}).Where("key = ?", key).Updates(map[string]interface{}{
+			"tokens":      bucket.Tokens,
+			"refilled_at": bucket.UpdatedAt,
+		}).Error
+	})
+	return allowed, retryAfter, err
+}
+
+// RateLimiter checks requests against rules
+type RateLimiter struct {
+	store RateLimitStore
+	now   func() time.Time // replaceable in tests
+}
+
+// NewRateLimiterFromEnv picks the bucket store from RATE_LIMIT_STORE
+// ("memory", the default, or "postgres")
+func NewRateLimiterFromEnv() *RateLimiter {
+	var store RateLimitStore = newMemoryRateLimitStore()
+	if os.Getenv("RATE_LIMIT_STORE") == "postgres" {
+		store = &postgresRateLimitStore{db: DB}
+	}
+	return &RateLimiter{store: store, now: time.Now}
+}
+
+// rateLimitRuleFromEnv reads a rule's limits from RATE_LIMIT_<NAME>_IP and
+// RATE_LIMIT_<NAME>_USER, written as "<burst>/<period>" (e.g. "10/1m") or
+// "off", falling back to the defaults when unset or invalid
+func rateLimitRuleFromEnv(name string, ip, user RateLimit) RateLimitRule {
+	prefix := "RATE_LIMIT_" + strings.ToUpper(name)
+	return RateLimitRule{
+		Name: name,
+		IP:   rateLimitFromEnv(prefix+"_IP", ip),
+		User: rateLimitFromEnv(prefix+"_USER", user),
+	}
+}
+
+func rateLimitFromEnv(name string, def RateLimit) RateLimit {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return def
+	}
+	if value == "off" {
+		return RateLimit{}
+	}
+	limit, err := parseRateLimit(value)
+	if err != nil {
+		log.Printf("%s: %v, using the default", name, err)
+		return def
+	}
+	return limit
+}
+
+func parseRateLimit(value string) (RateLimit, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q", value)
+	}
+	burst, err := strconv.Atoi(parts[0])
+	if err != nil || burst <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q", value)
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q", value)
+	}
+	return RateLimit{Burst: burst, Period: period}, nil
+}
+
+// allow takes a token from each of the request's buckets for rule and
+// returns the longest wait when one of them is empty
+func (l *RateLimiter) allow(rule RateLimitRule, ip string, userID int) (bool, time.Duration) {
+	now := l.now()
+	keys := map[string]RateLimit{rule.Name + ":ip:" + ip: rule.IP}
+	if userID > 0 {
+		keys[rule.Name+":user:"+strconv.Itoa(userID)] = rule.User
+	}
+
+	allowed := true
+	var wait time.Duration
+	for key, limit := range keys {
+		if !limit.enabled() {
+			continue
+		}
+		ok, retryAfter, err := l.store.Take(key, limit, now)
+		if err != nil {
+			// A broken store must not take the endpoints down with it
+			log.Printf("rate limit %s: %v", rule.Name, err)
+			continue
+		}
+		if !ok {
+			allowed = false
+			if retryAfter > wait {
+				wait = retryAfter
+			}
+		}
+	}
+	return allowed, wait
+}
+
+// Middleware throttles the routes it is attached to. Put it after
+// AuthMiddleware to also limit per user.
+func (l *RateLimiter) Middleware(rule RateLimitRule) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := GetUserIDFromContext(c)
+		allowed, wait := l.allow(rule, c.ClientIP(), userID)
+		if !allowed {
+			seconds := int(math.Ceil(wait.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			c.Header("Retry-After", strconv.Itoa(seconds))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeClock is a settable clock for the rate limiter
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestRateLimiter() (*RateLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	return &RateLimiter{store: newMemoryRateLimitStore(), now: clock.Now}, clock
+}
+
+// newTestRouter serves GET /limited behind the limiter. A userID above zero
+// plays the part of AuthMiddleware.
+func newTestRouter(t *testing.T, limiter *RateLimiter, rule RateLimitRule, userID int) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	if err := r.SetTrustedProxies(trustedProxiesFromEnv()); err != nil {
+		t.Fatal(err)
+	}
+	r.GET("/limited", func(c *gin.Context) {
+		if userID > 0 {
+			c.Set("user_id", userID)
+		}
+		c.Next()
+	}, limiter.Middleware(rule), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	return r
+}
+
+func request(r *gin.Engine, remoteAddr string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/limited", nil)
+	req.RemoteAddr = remoteAddr
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimitBurstExhaustion(t *testing.T) {
+	limiter, _ := newTestRateLimiter()
+	rule := RateLimitRule{Name: "test", IP: RateLimit{Burst: 3, Period: time.Minute}}
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.allow(rule, "203.0.113.1", 0); !ok {
+			t.Fatalf("request %d of the burst was throttled", i+1)
+		}
+	}
+	if ok, _ := limiter.allow(rule, "203.0.113.1", 0); ok {
+		t.Fatal("request after the burst was allowed")
+	}
+}
+
+func TestRateLimitRefill(t *testing.T) {
+	limiter, clock := newTestRateLimiter()
+	rule := RateLimitRule{Name: "test", IP: RateLimit{Burst: 3, Period: time.Minute}}
+
+	for i := 0; i < 3; i++ {
+		limiter.allow(rule, "203.0.113.1", 0)
+	}
+
+	// One token every 20 seconds
+	clock.Advance(19 * time.Second)
+	if ok, wait := limiter.allow(rule, "203.0.113.1", 0); ok || wait != time.Second {
+		t.Fatalf("before refill: allowed %v, wait %v; want throttled, wait 1s", ok, wait)
+	}
+	clock.Advance(time.Second)
+	if ok, _ := limiter.allow(rule, "203.0.113.1", 0); !ok {
+		t.Fatal("request after one refill period was throttled")
+	}
+	if ok, _ := limiter.allow(rule, "203.0.113.1", 0); ok {
+		t.Fatal("a single refilled token was used twice")
+	}
+
+	// A long pause refills up to the burst, not beyond
+	clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.allow(rule, "203.0.113.1", 0); !ok {
+			t.Fatalf("request %d after a full refill was throttled", i+1)
+		}
+	}
+	if ok, _ := limiter.allow(rule, "203.0.113.1", 0); ok {
+		t.Fatal("bucket refilled beyond its burst")
+	}
+}
+
+func TestRateLimitRetryAfter(t *testing.T) {
+	limiter, clock := newTestRateLimiter()
+	rule := RateLimitRule{Name: "test", IP: RateLimit{Burst: 2, Period: time.Minute}}
+	r := newTestRouter(t, limiter, rule, 0)
+
+	for i := 0; i < 2; i++ {
+		if w := request(r, "203.0.113.1:1234", nil); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i+1, w.Code)
+		}
+	}
+
+	w := request(r, "203.0.113.1:1234", nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "30" {
+		t.Fatalf("Retry-After %q, want 30", got)
+	}
+
+	// Partial seconds round up, and never below one second
+	clock.Advance(29*time.Second + 500*time.Millisecond)
+	if got := request(r, "203.0.113.1:1234", nil).Header().Get("Retry-After"); got != "1" {
+		t.Fatalf("Retry-After %q, want 1", got)
+	}
+	clock.Advance(500 * time.Millisecond)
+	if w := request(r, "203.0.113.1:1234", nil); w.Code != http.StatusOK {
+		t.Fatalf("status %d after waiting Retry-After, want 200", w.Code)
+	}
+}
+
+func TestRateLimitSeparateIPAndUserBuckets(t *testing.T) {
+	limiter, _ := newTestRateLimiter()
+	rule := RateLimitRule{
+		Name: "test",
+		IP:   RateLimit{Burst: 3, Period: time.Minute},
+		User: RateLimit{Burst: 2, Period: time.Minute},
+	}
+
+	// The user bucket runs out first and follows the user across IPs
+	if ok, _ := limiter.allow(rule, "203.0.113.1", 7); !ok {
+		t.Fatal("first request throttled")
+	}
+	if ok, _ := limiter.allow(rule, "203.0.113.2", 7); !ok {
+		t.Fatal("second request throttled")
+	}
+	if ok, _ := limiter.allow(rule, "203.0.113.3", 7); ok {
+		t.Fatal("user bucket not shared across IPs")
+	}
+
+	// Another user on the same IP has their own user bucket, but shares the
+	// IP bucket, which the throttled request above did not drain
+	if ok, _ := limiter.allow(rule, "203.0.113.1", 8); !ok {
+		t.Fatal("other user throttled by the first user's bucket")
+	}
+	if ok, _ := limiter.allow(rule, "203.0.113.1", 9); !ok {
+		t.Fatal("third user throttled before the IP bucket ran out")
+	}
+	if ok, _ := limiter.allow(rule, "203.0.113.1", 10); ok {
+		t.Fatal("IP bucket not shared between users")
+	}
+
+	// Anonymous requests only use the IP bucket
+	if ok, _ := limiter.allow(rule, "203.0.113.4", 0); !ok {
+		t.Fatal("anonymous request on a fresh IP throttled")
+	}
+}
+
+func TestRateLimitDisabledBucket(t *testing.T) {
+	limiter, _ := newTestRateLimiter()
+	rule := RateLimitRule{Name: "test", User: RateLimit{Burst: 1, Period: time.Minute}}
+
+	for i := 0; i < 10; i++ {
+		if ok, _ := limiter.allow(rule, "203.0.113.1", 0); !ok {
+			t.Fatal("request throttled by a disabled IP limit")
+		}
+	}
+}
+
+func TestRateLimitIgnoresSpoofedForwardedFor(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "")
+	limiter, _ := newTestRateLimiter()
+	rule := RateLimitRule{Name: "test", IP: RateLimit{Burst: 1, Period: time.Minute}}
+	r := newTestRouter(t, limiter, rule, 0)
+
+	if w := request(r, "203.0.113.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}); w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if w := request(r, "203.0.113.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.2"}); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d with a new X-Forwarded-For, want 429", w.Code)
+	}
+}
+
+func TestRateLimitTrustedProxy(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+	limiter, _ := newTestRateLimiter()
+	rule := RateLimitRule{Name: "test", IP: RateLimit{Burst: 1, Period: time.Minute}}
+	r := newTestRouter(t, limiter, rule, 0)
+
+	// Behind the proxy, clients are told apart by X-Forwarded-For
+	for _, client := range []string{"198.51.100.1", "198.51.100.2"} {
+		if w := request(r, "10.0.0.5:1234", map[string]string{"X-Forwarded-For": client}); w.Code != http.StatusOK {
+			t.Fatalf("client %s: status %d", client, w.Code)
+		}
+	}
+	if w := request(r, "10.0.0.5:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d for a repeated client, want 429", w.Code)
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := parseRateLimit("10/1m")
+	if err != nil || limit != (RateLimit{Burst: 10, Period: time.Minute}) {
+		t.Fatalf("got %+v, %v", limit, err)
+	}
+	for _, value := range []string{"10", "0/1m", "-1/1m", "10/0s", "x/1m", "10/soon"} {
+		if _, err := parseRateLimit(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
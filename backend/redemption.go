@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Redemption tokens are what the purchase QR code contains. A token is
+// "<payload>.<signature>" where payload is the base64url encoding of
+// "purchase_id|user_id|nonce|expires_unix" and signature is its HMAC-SHA256.
+// Tokens live for a short time and the client fetches a fresh one while the
+// QR code is on screen, so a screenshot is useless shortly after it's taken.
+// Each nonce can be redeemed once.
+//
+// Order tokens use the "x5o1" prefix and carry the order ID instead; they
+// hand over every open pickup line of a cart checkout at once.
+
+const (
+	redemptionTokenPrefix      = "x5r1"
+	orderRedemptionTokenPrefix = "x5o1"
+)
+
+var redemptionSecret = []byte(getRedemptionSecret())
+
+func getRedemptionSecret() string {
+	if secret := os.Getenv("REDEMPTION_SECRET"); secret != "" {
+		return secret
+	}
+	// Derive a separate key so a redemption token is never a valid JWT signature input
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("redemption"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func redemptionTokenTTL() time.Duration {
+	return time.Duration(getEnvInt("REDEMPTION_TOKEN_TTL", 120)) * time.Second
+}
+
+// RedemptionClaims is the verified content of a redemption token. Exactly one
+// of PurchaseID and OrderID is set.
+type RedemptionClaims struct {
+	PurchaseID string
+	OrderID    string
+	UserID     uint
+	Nonce      string
+	ExpiresAt  time.Time
+}
+
+func signRedemptionPayload(payload string) string {
+	mac := hmac.New(sha256.New, redemptionSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IssueRedemptionToken creates a fresh token for a pending purchase owned by userID
+func IssueRedemptionToken(userID uint, purchaseID string) (string, time.Time, error) {
+	var purchase Purchase
+	if err := DB.Where("purchase_id = ? AND user_id = ?", purchaseID, userID).First(&purchase).Error; err != nil {
+		return "", time.Time{}, err
+	}
+	if err := checkRedeemable(purchase); err != nil {
+		return "", time.Time{}, err
+	}
+	return issueRedemptionToken(purchase, redemptionTokenTTL())
+}
+
+// IssueOrderRedemptionToken creates a fresh token for an order owned by
+// userID that still has lines to pick up
+func IssueOrderRedemptionToken(userID uint, orderID string) (string, time.Time, error) {
+	var order Order
+	if err := DB.Where("order_id = ? AND user_id = ?", orderID, userID).Preload("Purchases").First(&order).Error; err != nil {
+		return "", time.Time{}, err
+	}
+	if _, err := redeemableOrderLines(order.Purchases); err != nil {
+		return "", time.Time{}, err
+	}
+	return issueOrderRedemptionToken(order, redemptionTokenTTL())
+}
+
+// issueRedemptionToken signs a token for purchase valid for ttl
+func issueRedemptionToken(purchase Purchase, ttl time.Duration) (string, time.Time, error) {
+	return signRedemptionToken(redemptionTokenPrefix, purchase.PurchaseID, purchase.UserID, ttl)
+}
+
+// issueOrderRedemptionToken signs a token for order valid for ttl
+func issueOrderRedemptionToken(order Order, ttl time.Duration) (string, time.Time, error) {
+	return signRedemptionToken(orderRedemptionTokenPrefix, order.OrderID, order.UserID, ttl)
+}
+
+func signRedemptionToken(prefix, id string, userID uint, ttl time.Duration) (string, time.Time, error) {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(strings.Join([]string{
+		id,
+		strconv.FormatUint(uint64(userID), 10),
+		hex.EncodeToString(nonce),
+		strconv.FormatInt(expiresAt.Unix(), 10),
+	}, "|")))
+
+	return prefix + "." + payload + "." + signRedemptionPayload(payload), expiresAt, nil
+}
+
+// ParseRedemptionToken verifies a token's signature and expiry
+func ParseRedemptionToken(token string) (*RedemptionClaims, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 || (parts[0] != redemptionTokenPrefix && parts[0] != orderRedemptionTokenPrefix) {
+		return nil, fmt.Errorf("invalid token")
+	}
+	payload, signature := parts[1], parts[2]
+	if !hmac.Equal([]byte(signature), []byte(signRedemptionPayload(payload))) {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+	fields := strings.Split(string(raw), "|")
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("invalid token")
+	}
+	userID, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+	expires, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	claims := &RedemptionClaims{
+		UserID:    uint(userID),
+		Nonce:     fields[2],
+		ExpiresAt: time.Unix(expires, 0),
+	}
+	// The prefix isn't signed, but purchase and order IDs are random UUIDs,
+	// so swapping it can't make a token match anything
+	if parts[0] == orderRedemptionTokenPrefix {
+		claims.OrderID = fields[0]
+	} else {
+		claims.PurchaseID = fields[0]
+	}
+	if time.Now().After(claims.ExpiresAt) {
+		return nil, fmt.Errorf("token expired")
+	}
+	return claims, nil
+}
+
+// consumeRedemptionNonce marks a token as used inside the redeem transaction
+func consumeRedemptionNonce(tx *gorm.DB, claims *RedemptionClaims) error {
+	used := UsedRedemptionToken{Nonce: claims.Nonce, PurchaseID: claims.PurchaseID, UsedAt: time.Now()}
+	if claims.OrderID != "" {
+		used.PurchaseID = claims.OrderID
+	}
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&used)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("token already used")
+	}
+	return nil
+}
+
+// RenderRedemptionQR renders a token as a PNG or SVG QR code
+func RenderRedemptionQR(token, format string, size int) ([]byte, string, error) {
+	qr, err := qrcode.New(token, qrcode.Medium)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if format == "svg" {
+		return []byte(qrToSVG(qr.Bitmap())), "image/svg+xml", nil
+	}
+	png, err := qr.PNG(size)
+	if err != nil {
+		return nil, "", err
+	}
+	return png, "image/png", nil
+}
+
+// qrToSVG draws one rect per dark module; the bitmap already includes the quiet zone
+func qrToSVG(bitmap [][]bool) string {
+	n := len(bitmap)
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, n, n)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/>`, n, n)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, `<rect x="%d" y="%d" width="1" height="1"/>`, x, y)
+			}
+		}
+	}
+	b.WriteString(`</svg>`)
+	return b.String()
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The desk scanner first previews what a QR code would hand over and then
+// confirms with POST /api/admin/redeem. Every handed-over purchase is logged
+// with the operator so the desk can reconcile at the end of the day. An
+// operator can undo their own redemption for a short time in case the wrong
+// item was given out; the delivery receipt email waits until then.
+
+func redemptionUndoWindow() time.Duration {
+	return time.Duration(getEnvInt("REDEMPTION_UNDO_WINDOW", 300)) * time.Second
+}
+
+func userFullName(user User) string {
+	name := user.FirstName
+	if user.LastName != "" {
+		name += " " + user.LastName
+	}
+	return name
+}
+
+// recordRedemption logs a QR hand-over inside the redeem transaction and
+// holds back the receipt email until the undo window has passed
+func recordRedemption(tx *gorm.DB, purchase Purchase, previousStatus, orderID string, adminID uint, now time.Time) (RedemptionLog, error) {
+	entry := RedemptionLog{
+		PurchaseID:     purchase.PurchaseID,
+		OrderID:        orderID,
+		UserID:         purchase.UserID,
+		AdminID:        adminID,
+		PreviousStatus: previousStatus,
+		RedeemedAt:     now,
+	}
+	if err := tx.Create(&entry).Error; err != nil {
+		return entry, err
+	}
+	err := tx.Model(&EmailOutbox{}).
+		Where("purchase_id = ? AND kind = ? AND status = ?", purchase.PurchaseID, EmailPurchaseDelivered, "pending").
+		Update("next_attempt_at", now.Add(redemptionUndoWindow())).Error
+	return entry, err
+}
+
+func previewQuery() *gorm.DB {
+	return DB.Model(&Purchase{}).
+		Preload("User").
+		Preload("Item").
+		Preload("Variant").
+		Preload("PickupLocation").
+		Preload("Order")
+}
+
+func purchaseToPreview(purchase Purchase) PurchasePreviewResponse {
+	preview := PurchasePreviewResponse{
+		PurchaseID:  purchase.PurchaseID,
+		ItemID:      int(purchase.ItemID),
+		ItemName:    purchase.Item.Name,
+		Variant:     purchase.VariantLabel(),
+		Image:       purchase.Item.Image,
+		UserID:      int(purchase.UserID),
+		UserName:    userFullName(purchase.User),
+		PhotoURL:    purchase.User.PhotoURL,
+		Status:      purchase.Status,
+		Fulfillment: purchase.FulfillmentMethod,
+		PurchasedAt: purchase.PurchasedAt.Format(time.RFC3339),
+	}
+	if purchase.Item.ThumbnailURL != "" {
+		preview.Image = purchase.Item.ThumbnailURL
+	}
+	if purchase.Order != nil {
+		preview.OrderID = purchase.Order.OrderID
+	}
+	if purchase.PickupLocation != nil {
+		location := pickupLocationToResponse(*purchase.PickupLocation)
+		preview.PickupLocation = &location
+	}
+	if purchase.RedeemedAt != nil {
+		preview.RedeemedAt = purchase.RedeemedAt.Format(time.RFC3339)
+	}
+
+	switch err := checkRedeemable(purchase); {
+	case err == nil:
+		preview.Redeemable = true
+	case err.Error() == "purchase already redeemed":
+		preview.NotRedeemableReason = "already_redeemed"
+	default:
+		preview.NotRedeemableReason = "not_redeemable"
+	}
+	return preview
+}
+
+// GetPurchasePreview looks up a purchase for the desk (admin only)
+func GetPurchasePreview(purchaseID string) (*PurchasePreviewResponse, error) {
+	var purchase Purchase
+	if err := previewQuery().Where("purchase_id = ?", purchaseID).First(&purchase).Error; err != nil {
+		return nil, err
+	}
+	preview := purchaseToPreview(purchase)
+	return &preview, nil
+}
+
+// PreviewRedemption verifies a scanned token without using it and returns
+// the purchases it would hand over (admin only)
+func PreviewRedemption(token string) (*RedemptionPreviewResponse, error) {
+	claims, err := ParseRedemptionToken(token)
+	if err != nil {
+		return nil, err
+	}
+	var used int64
+	if err := DB.Model(&UsedRedemptionToken{}).Where("nonce = ?", claims.Nonce).Count(&used).Error; err != nil {
+		return nil, err
+	}
+	if used > 0 {
+		return nil, fmt.Errorf("token already used")
+	}
+
+	response := &RedemptionPreviewResponse{
+		ExpiresAt: claims.ExpiresAt.Format(time.RFC3339),
+		Purchases: []PurchasePreviewResponse{},
+	}
+	var purchases []Purchase
+	if claims.OrderID != "" {
+		var order Order
+		if err := DB.Where("order_id = ? AND user_id = ?", claims.OrderID, claims.UserID).First(&order).Error; err != nil {
+			return nil, err
+		}
+		response.OrderID = order.OrderID
+		if err := previewQuery().Where("order_id = ?", order.ID).Order("id").Find(&purchases).Error; err != nil {
+			return nil, err
+		}
+	} else if err := previewQuery().Where("purchase_id = ? AND user_id = ?", claims.PurchaseID, claims.UserID).
+		Find(&purchases).Error; err != nil {
+		return nil, err
+	}
+	if len(purchases) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	for _, purchase := range purchases {
+		response.Purchases = append(response.Purchases, purchaseToPreview(purchase))
+	}
+	return response, nil
+}
+
+// UndoRedemption reverts an accidental hand-over. Only the operator who
+// redeemed the purchase can undo it, and only within the undo window.
+func UndoRedemption(redemptionID, adminID uint) (*RedemptionLogEntry, error) {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var entry RedemptionLog
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&entry, redemptionID).Error; err != nil {
+			return err
+		}
+		if entry.UndoneAt != nil {
+			return fmt.Errorf("redemption already undone")
+		}
+		if entry.AdminID != adminID {
+			return fmt.Errorf("redemption belongs to another operator")
+		}
+		now := time.Now()
+		if now.Sub(entry.RedeemedAt) > redemptionUndoWindow() {
+			return fmt.Errorf("undo window expired")
+		}
+
+		var purchase Purchase
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("purchase_id = ?", entry.PurchaseID).First(&purchase).Error; err != nil {
+			return err
+		}
+		if purchase.Status != PurchaseDelivered {
+			return fmt.Errorf("purchase changed since redemption")
+		}
+
+		if err := tx.Model(&purchase).Updates(map[string]interface{}{
+			"status":            entry.PreviousStatus,
+			"redeemed_at":       nil,
+			"status_updated_at": &now,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("purchase_id = ? AND kind = ? AND status = ?", purchase.PurchaseID, EmailPurchaseDelivered, "pending").
+			Delete(&EmailOutbox{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&entry).Updates(map[string]interface{}{
+			"undone_at":    &now,
+			"undone_by_id": adminID,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var entry RedemptionLog
+	if err := redemptionLogQuery().First(&entry, redemptionID).Error; err != nil {
+		return nil, err
+	}
+	response := redemptionLogToEntry(entry, time.Now())
+	return &response, nil
+}
+
+// RedemptionLogFilter selects redemptions for GET /api/admin/redemptions
+type RedemptionLogFilter struct {
+	AdminID uint // 0 = all operators
+	From    time.Time
+	To      time.Time
+}
+
+func redemptionLogQuery() *gorm.DB {
+	return DB.Model(&RedemptionLog{}).
+		Preload("Purchase.Item").
+		Preload("Purchase.Variant").
+		Preload("User").
+		Preload("Admin")
+}
+
+func redemptionLogToEntry(entry RedemptionLog, now time.Time) RedemptionLogEntry {
+	response := RedemptionLogEntry{
+		ID:             int(entry.ID),
+		PurchaseID:     entry.PurchaseID,
+		OrderID:        entry.OrderID,
+		ItemName:       entry.Purchase.Item.Name,
+		Variant:        entry.Purchase.VariantLabel(),
+		UserID:         int(entry.UserID),
+		UserName:       userFullName(entry.User),
+		AdminID:        int(entry.AdminID),
+		AdminName:      userFullName(entry.Admin),
+		PreviousStatus: entry.PreviousStatus,
+		RedeemedAt:     entry.RedeemedAt.Format(time.RFC3339),
+		Undoable:       entry.UndoneAt == nil && now.Sub(entry.RedeemedAt) <= redemptionUndoWindow(),
+	}
+	if response.AdminName == "" {
+		response.AdminName = entry.Admin.Username
+	}
+	if entry.UndoneAt != nil {
+		response.UndoneAt = entry.UndoneAt.Format(time.RFC3339)
+	}
+	if entry.UndoneByID != nil {
+		undoneBy := int(*entry.UndoneByID)
+		response.UndoneByID = &undoneBy
+	}
+	return response
+}
+
+// GetRedemptionLog lists redemptions newest first with a per-item summary for
+// reconciliation (admin only)
+func GetRedemptionLog(filter RedemptionLogFilter, page, pageSize int) (*RedemptionLogResponse, error) {
+	scope := func(db *gorm.DB) *gorm.DB {
+		db = db.Where("redemption_logs.redeemed_at >= ? AND redemption_logs.redeemed_at < ?", filter.From, filter.To)
+		if filter.AdminID > 0 {
+			db = db.Where("redemption_logs.admin_id = ?", filter.AdminID)
+		}
+		return db
+	}
+
+	var total int64
+	if err := DB.Model(&RedemptionLog{}).Scopes(scope).Count(&total).Error; err != nil {
+		return nil, err
+	}
+
+	var entries []RedemptionLog
+	if err := redemptionLogQuery().Scopes(scope).Order("redeemed_at DESC, id DESC").
+		Offset((page - 1) * pageSize).Limit(pageSize).Find(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	response := &RedemptionLogResponse{
+		Redemptions: make([]RedemptionLogEntry, 0, len(entries)),
+		Summary:     []RedemptionSummaryLine{},
+		Page:        page,
+		PageSize:    pageSize,
+		Total:       total,
+	}
+	for _, entry := range entries {
+		response.Redemptions = append(response.Redemptions, redemptionLogToEntry(entry, now))
+	}
+
+	// Item and variant names are joined in; deleted variants have no label
+	var rows []struct {
+		ItemName string
+		SKU      *string // nil without a variant
+		Size     string
+		Color    string
+		Count    int
+	}
+	if err := DB.Model(&RedemptionLog{}).Scopes(scope).
+		Joins("JOIN purchases ON purchases.purchase_id = redemption_logs.purchase_id").
+		Joins("LEFT JOIN shop_items ON shop_items.id = purchases.item_id").
+		Joins("LEFT JOIN shop_item_variants ON shop_item_variants.id = purchases.variant_id").
+		Where("redemption_logs.undone_at IS NULL").
+		Select(`COALESCE(shop_items.name, '') AS item_name, shop_item_variants.sku,
+			COALESCE(shop_item_variants.size, '') AS size, COALESCE(shop_item_variants.color, '') AS color,
+			COUNT(*) AS count`).
+		Group("purchases.item_id, purchases.variant_id, shop_items.name, shop_item_variants.size, shop_item_variants.color, shop_item_variants.sku").
+		Order("count DESC").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		line := RedemptionSummaryLine{ItemName: row.ItemName, Count: row.Count}
+		if row.SKU != nil {
+			line.Variant = ShopItemVariant{SKU: *row.SKU, Size: row.Size, Color: row.Color}.Label()
+		}
+		response.Summary = append(response.Summary, line)
+	}
+	return response, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Resume uploads. Students upload one PDF resume, which replaces the previous
+// one. Files are checked by content, passed through the virus scanner and
+// stored outside the public /uploads mount; only admins can download them.
+
+const (
+	maxResumeSize        = 10 << 20 // 10 MB
+	resumeSniffedBytes   = 512
+	resumeTrailerBytes   = 1024 // %%EOF must appear this close to the end
+	maxResumeNameLength  = 255
+	virusScanTimeout     = time.Minute
+	defaultResumeDir     = "./private/resumes"
+	resumeFileExtension  = ".pdf"
+	resumeFilePermission = 0600
+)
+
+// resumeDir is where resumes are stored, from RESUME_DIR. It must not be
+// served as static files.
+func resumeDir() string {
+	if dir := os.Getenv("RESUME_DIR"); dir != "" {
+		return dir
+	}
+	return defaultResumeDir
+}
+
+// VirusScanner checks an uploaded file before it is stored. Scan returns
+// errFileInfected for malicious files and other errors when the scan itself
+// fails; uploads are rejected either way. Implementations must be safe for
+// concurrent use.
+type VirusScanner interface {
+	Scan(data []byte) error
+}
+
+var errFileInfected = fmt.Errorf("file rejected by virus scan")
+
+// NewVirusScannerFromEnv runs VIRUS_SCAN_COMMAND (e.g. "clamdscan --no-summary -")
+// on every upload; without it files are not scanned
+func NewVirusScannerFromEnv() VirusScanner {
+	command := strings.Fields(os.Getenv("VIRUS_SCAN_COMMAND"))
+	if len(command) == 0 {
+		return NoopVirusScanner{}
+	}
+	return &CommandVirusScanner{Command: command}
+}
+
+// NoopVirusScanner accepts every file; it is the default when no scanner is
+// configured
+type NoopVirusScanner struct{}
+
+func (NoopVirusScanner) Scan(data []byte) error {
+	return nil
+}
+
+// CommandVirusScanner pipes the file into a scanner command. Following the
+// ClamAV convention, exit status 0 means clean and 1 means infected.
+type CommandVirusScanner struct {
+	Command []string
+}
+
+func (s *CommandVirusScanner) Scan(data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), virusScanTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	output, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		log.Printf("virus scan: %s", strings.TrimSpace(string(output)))
+		return errFileInfected
+	}
+	if err != nil {
+		return fmt.Errorf("virus scan: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// resumeScanner checks resume uploads; main replaces it with the configured one
+var resumeScanner VirusScanner = NoopVirusScanner{}
+
+func resumeFileToResponse(file ResumeFile) ResumeFileResponse {
+	return ResumeFileResponse{
+		OriginalName: file.OriginalName,
+		Size:         file.Size,
+		SHA256:       file.SHA256,
+		UploadedAt:   file.UploadedAt.Format(time.RFC3339),
+	}
+}
+
+// resumeOriginalName keeps the base name of the uploaded file for downloads
+func resumeOriginalName(name string) string {
+	name = strings.TrimSpace(filepath.Base(strings.ReplaceAll(name, `\`, "/")))
+	if !utf8.ValidString(name) || name == "." || name == "/" || name == "" {
+		name = "resume.pdf"
+	}
+	for len(name) > maxResumeNameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+// validateResume accepts PDF documents only, judged by their content rather
+// than the file name or the client's Content-Type
+func validateResume(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("file is empty")
+	}
+	if len(data) > maxResumeSize {
+		return fmt.Errorf("file is too large")
+	}
+	sniffLen := len(data)
+	if sniffLen > resumeSniffedBytes {
+		sniffLen = resumeSniffedBytes
+	}
+	if http.DetectContentType(data[:sniffLen]) != "application/pdf" {
+		return fmt.Errorf("resume must be a PDF")
+	}
+	trailer := data
+	if len(trailer) > resumeTrailerBytes {
+		trailer = trailer[len(trailer)-resumeTrailerBytes:]
+	}
+	if !bytes.Contains(trailer, []byte("%%EOF")) {
+		return fmt.Errorf("invalid PDF")
+	}
+	return nil
+}
+
+// SaveResume validates, scans and stores a student's resume, replacing the
+// previous one
+func SaveResume(userID uint, fileHeader *multipart.FileHeader) (*ResumeFileResponse, error) {
+	if fileHeader.Size > maxResumeSize {
+		return nil, fmt.Errorf("file is too large")
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// The header size can lie; never read more than the limit
+	data, err := io.ReadAll(io.LimitReader(file, maxResumeSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if err := validateResume(data); err != nil {
+		return nil, err
+	}
+	if err := resumeScanner.Scan(data); err != nil {
+		return nil, err
+	}
+
+	dir := resumeDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	resume := ResumeFile{
+		UserID:       userID,
+		StoredName:   uuid.New().String() + resumeFileExtension,
+		OriginalName: resumeOriginalName(fileHeader.Filename),
+		Size:         int64(len(data)),
+		SHA256:       hex.EncodeToString(sum[:]),
+		UploadedAt:   time.Now(),
+	}
+	path := filepath.Join(dir, resume.StoredName)
+	if err := os.WriteFile(path, data, resumeFilePermission); err != nil {
+		return nil, err
+	}
+
+	var previous string
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		var existing ResumeFile
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", userID).Take(&existing).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return tx.Create(&resume).Error
+		}
+		if err != nil {
+			return err
+		}
+		previous = existing.StoredName
+		return tx.Save(&resume).Error
+	})
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	if previous != "" {
+		os.Remove(filepath.Join(dir, previous))
+	}
+
+	response := resumeFileToResponse(resume)
+	return &response, nil
+}
+
+// GetResume returns a user's resume and the path of the stored file
+func GetResume(userID uint) (*ResumeFile, string, error) {
+	var resume ResumeFile
+	if err := DB.Where("user_id = ?", userID).Take(&resume).Error; err != nil {
+		return nil, "", err
+	}
+	return &resume, filepath.Join(resumeDir(), filepath.Base(resume.StoredName)), nil
+}
+
+// DeleteResume removes a student's resume
+func DeleteResume(userID uint) error {
+	var resume ResumeFile
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", userID).Take(&resume).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&resume).Error
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(resumeDir(), filepath.Base(resume.StoredName))); err != nil && !os.IsNotExist(err) {
+		log.Printf("delete resume %s: %v", resume.StoredName, err)
+	}
+	return nil
+}
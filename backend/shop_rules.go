@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Lock reason codes returned in ShopItemResponse.LockedReason and in the
+// "code" field of purchase errors
+const (
+	LockNotYetAvailable      = "not_yet_available"
+	LockNoLongerAvailable    = "no_longer_available"
+	LockRoleNotAllowed       = "role_not_allowed"
+	LockTrackNotAllowed      = "track_not_allowed"
+	LockUniversityNotAllowed = "university_not_allowed"
+	LockNotEnoughTasks       = "not_enough_tasks"
+	LockStreakTooLow         = "streak_too_low"
+	LockPurchaseLimit        = "purchase_limit_reached"
+)
+
+var lockReasonMessages = map[string]string{
+	LockNotYetAvailable:      "item is not available yet",
+	LockNoLongerAvailable:    "item is no longer available",
+	LockRoleNotAllowed:       "item is not available for your role",
+	LockTrackNotAllowed:      "item is not available for your track",
+	LockUniversityNotAllowed: "item is not available for your university",
+	LockNotEnoughTasks:       "complete more tasks to unlock this item",
+	LockStreakTooLow:         "reach a longer streak to unlock this item",
+	LockPurchaseLimit:        "purchase limit reached for this item",
+}
+
+// ShopRestrictionError is returned by BuyItem when an item's rules don't
+// allow the user to buy it
+type ShopRestrictionError struct {
+	Code string
+}
+
+func (e *ShopRestrictionError) Error() string {
+	return lockReasonMessages[e.Code]
+}
+
+// shopBuyerStats holds the per-user numbers the item rules are checked against
+type shopBuyerStats struct {
+	CompletedTasks int64
+	Purchased      map[uint]int64 // item ID -> purchases
+}
+
+func loadShopBuyerStats(db *gorm.DB, userID uint) (shopBuyerStats, error) {
+	stats := shopBuyerStats{Purchased: map[uint]int64{}}
+	if err := db.Model(&UserTask{}).Where("user_id = ? AND status = ?", userID, "completed").
+		Count(&stats.CompletedTasks).Error; err != nil {
+		return stats, err
+	}
+
+	var rows []struct {
+		ItemID uint
+		Count  int64
+	}
+	if err := db.Model(&Purchase{}).Select("item_id, COUNT(*) AS count").
+		Where("user_id = ? AND status <> ?", userID, PurchaseCancelled).Group("item_id").Scan(&rows).Error; err != nil {
+		return stats, err
+	}
+	for _, row := range rows {
+		stats.Purchased[row.ItemID] = row.Count
+	}
+	return stats, nil
+}
+
+// timeLockReason checks the availability window; it applies to anonymous
+// visitors as well
+func (item ShopItem) timeLockReason(now time.Time) string {
+	if item.AvailableFrom != nil && now.Before(*item.AvailableFrom) {
+		return LockNotYetAvailable
+	}
+	if item.AvailableUntil != nil && !now.Before(*item.AvailableUntil) {
+		return LockNoLongerAvailable
+	}
+	return ""
+}
+
+// LockReason returns why user can't buy the item, or "" if the rules allow it.
+// Stock and balance are not rules and are checked separately.
+func (item ShopItem) LockReason(user User, stats shopBuyerStats, now time.Time) string {
+	if reason := item.timeLockReason(now); reason != "" {
+		return reason
+	}
+	if len(item.AllowedRoles) > 0 && !containsFold(item.AllowedRoles, user.Role) {
+		return LockRoleNotAllowed
+	}
+	if len(item.AllowedTracks) > 0 && !containsFold(item.AllowedTracks, user.Track) {
+		return LockTrackNotAllowed
+	}
+	if len(item.AllowedUniversities) > 0 && !containsFold(item.AllowedUniversities, user.University) {
+		return LockUniversityNotAllowed
+	}
+	if item.MinCompletedTasks > 0 && stats.CompletedTasks < int64(item.MinCompletedTasks) {
+		return LockNotEnoughTasks
+	}
+	if item.MinStreak > 0 && user.CurrentStreak < item.MinStreak {
+		return LockStreakTooLow
+	}
+	if item.MaxPerUser > 0 && stats.Purchased[item.ID] >= int64(item.MaxPerUser) {
+		return LockPurchaseLimit
+	}
+	return ""
+}
+
+func containsFold(values []string, value string) bool {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return false
+	}
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyShopItemRules copies the provided rule fields from an admin request.
+// Empty time strings clear the corresponding bound.
+func applyShopItemRules(item *ShopItem, rules ShopItemRulesRequest) error {
+	parseBound := func(value *string, name string) (*time.Time, bool, error) {
+		if value == nil {
+			return nil, false, nil
+		}
+		if *value == "" {
+			return nil, true, nil
+		}
+		t, err := time.Parse(time.RFC3339, *value)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid %s", name)
+		}
+		return &t, true, nil
+	}
+
+	from, setFrom, err := parseBound(rules.AvailableFrom, "available_from")
+	if err != nil {
+		return err
+	}
+	until, setUntil, err := parseBound(rules.AvailableUntil, "available_until")
+	if err != nil {
+		return err
+	}
+	if setFrom {
+		item.AvailableFrom = from
+	}
+	if setUntil {
+		item.AvailableUntil = until
+	}
+	if item.AvailableFrom != nil && item.AvailableUntil != nil && !item.AvailableUntil.After(*item.AvailableFrom) {
+		return fmt.Errorf("available_until must be after available_from")
+	}
+
+	for _, v := range []*int{rules.MaxPerUser, rules.MinCompletedTasks, rules.MinStreak} {
+		if v != nil && *v < 0 {
+			return fmt.Errorf("limits cannot be negative")
+		}
+	}
+	if rules.MaxPerUser != nil {
+		item.MaxPerUser = *rules.MaxPerUser
+	}
+	if rules.MinCompletedTasks != nil {
+		item.MinCompletedTasks = *rules.MinCompletedTasks
+	}
+	if rules.MinStreak != nil {
+		item.MinStreak = *rules.MinStreak
+	}
+
+	if rules.AllowedRoles != nil {
+		item.AllowedRoles = StringArray(*rules.AllowedRoles)
+	}
+	if rules.AllowedTracks != nil {
+		tracks := make(StringArray, 0, len(*rules.AllowedTracks))
+		for _, track := range *rules.AllowedTracks {
+			tracks = append(tracks, normalizeTrack(track))
+		}
+		item.AllowedTracks = tracks
+	}
+	if rules.AllowedUniversities != nil {
+		item.AllowedUniversities = StringArray(*rules.AllowedUniversities)
+	}
+	return nil
+}
+
+func shopItemRulesToResponse(item ShopItem) ShopItemRulesResponse {
+	rules := ShopItemRulesResponse{
+		MaxPerUser:          item.MaxPerUser,
+		MinCompletedTasks:   item.MinCompletedTasks,
+		MinStreak:           item.MinStreak,
+		AllowedRoles:        append([]string{}, item.AllowedRoles...),
+		AllowedTracks:       append([]string{}, item.AllowedTracks...),
+		AllowedUniversities: append([]string{}, item.AllowedUniversities...),
+	}
+	if item.AvailableFrom != nil {
+		rules.AvailableFrom = item.AvailableFrom.Format(time.RFC3339)
+	}
+	if item.AvailableUntil != nil {
+		rules.AvailableUntil = item.AvailableUntil.Format(time.RFC3339)
+	}
+	return rules
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// TelegramSender sends a text message to a Telegram chat. For a private chat
+// with the bot the chat ID is the user's Telegram ID.
+type TelegramSender interface {
+	SendMessage(chatID int64, text string) error
+}
+
+// TelegramError is a failed Bot API call
+type TelegramError struct {
+	StatusCode  int
+	Description string
+	RetryAfter  time.Duration // set for 429 Too Many Requests
+}
+
+func (e *TelegramError) Error() string {
+	return fmt.Sprintf("telegram: %d %s", e.StatusCode, e.Description)
+}
+
+// Permanent reports whether retrying can't help, e.g. the user blocked the
+// bot (403) or never started a chat with it (400 chat not found)
+func (e *TelegramError) Permanent() bool {
+	return e.StatusCode == http.StatusForbidden || e.StatusCode == http.StatusBadRequest
+}
+
+// NewTelegramSenderFromEnv returns a Bot API sender when TELEGRAM_BOT_TOKEN is
+// set and a logging sender otherwise. TELEGRAM_API_URL points the sender at a
+// different server, e.g. a local fake Bot API.
+func NewTelegramSenderFromEnv() TelegramSender {
+	token := os.Getenv("TELEGRAM_BOT_TOKEN")
+	if token == "" || token == "default-bot-token" {
+		return &LogTelegramSender{}
+	}
+
+	baseURL := os.Getenv("TELEGRAM_API_URL")
+	if baseURL == "" {
+		baseURL = "https://api.telegram.org"
+	}
+	return &BotAPISender{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Token:   token,
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// BotAPISender talks to the Telegram Bot API over HTTP
+type BotAPISender struct {
+	BaseURL string
+	Token   string
+	Client  *http.Client
+}
+
+type telegramResponse struct {
+	OK          bool   `json:"ok"`
+	Description string `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+func (s *BotAPISender) SendMessage(chatID int64, text string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"chat_id":                  chatID,
+		"text":                     text,
+		"disable_web_page_preview": true,
+	})
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/bot%s/sendMessage", s.BaseURL, s.Token)
+	resp, err := s.Client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// Don't leak the token through the URL in the error message
+		return fmt.Errorf("telegram: request failed: %s", strings.ReplaceAll(err.Error(), s.Token, "***"))
+	}
+	defer resp.Body.Close()
+
+	var result telegramResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return &TelegramError{StatusCode: resp.StatusCode, Description: "invalid response"}
+	}
+	if !result.OK || resp.StatusCode != http.StatusOK {
+		return &TelegramError{
+			StatusCode:  resp.StatusCode,
+			Description: result.Description,
+			RetryAfter:  time.Duration(result.Parameters.RetryAfter) * time.Second,
+		}
+	}
+	return nil
+}
+
+// LogTelegramSender only logs messages; used when no bot token is configured
+type LogTelegramSender struct{}
+
+func (s *LogTelegramSender) SendMessage(chatID int64, text string) error {
+	log.Printf("telegram to=%d\n%s", chatID, text)
+	return nil
+}
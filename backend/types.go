@@ -9,12 +9,15 @@ type TelegramAuthRequest struct {
 	Username  string `json:"username,omitempty"`
 	PhotoURL  string `json:"photo_url,omitempty"`
 	AuthDate  int64  `json:"auth_date"`
+
+	ReferralCode string `json:"referral_code,omitempty"`
 }
 
 type PhoneAuthRequest struct {
-	FirstName   string `json:"first_name"`
-	LastName    string `json:"last_name"`
-	PhoneNumber string `json:"phone_number"`
+	FirstName    string `json:"first_name"`
+	LastName     string `json:"last_name"`
+	PhoneNumber  string `json:"phone_number"`
+	ReferralCode string `json:"referral_code,omitempty"`
 }
 
 type AuthResponse struct {
@@ -32,11 +35,70 @@ type UserResponse struct {
 	CurrentStreak       int    `json:"current_streak"`
 	CompletedTasksCount int    `json:"completed_tasks_count"`
 	Role                string `json:"role"` // "student" or "admin"
+	University          string `json:"university"`
+	Track               string `json:"track"`
+	Nickname            string `json:"nickname"`
+	PublicName          string `json:"public_name"`
+	HideFromLeaderboard bool   `json:"hide_from_leaderboard"`
+	ReferralCode        string `json:"referral_code"`
+	Language            string `json:"language"`
+	// Uploaded PDF resume, null when none
+	Resume *ResumeFileResponse `json:"resume"`
+}
+
+// ResumeFileResponse describes an uploaded resume; the file itself is only
+// available to admins
+type ResumeFileResponse struct {
+	OriginalName string `json:"original_name"`
+	Size         int64  `json:"size"` // bytes
+	SHA256       string `json:"sha256"`
+	UploadedAt   string `json:"uploaded_at"`
+}
+
+type UpdatePrivacyRequest struct {
+	Nickname            *string `json:"nickname,omitempty"` // empty string clears the nickname
+	HideFromLeaderboard *bool   `json:"hide_from_leaderboard,omitempty"`
+}
+
+// NotificationSettingsRequest replaces all Telegram notification settings
+type NotificationSettingsRequest struct {
+	Enabled         bool   `json:"enabled"`
+	StreakReminders bool   `json:"streak_reminders"`
+	TaskUnlocks     bool   `json:"task_unlocks"`
+	PurchaseUpdates bool   `json:"purchase_updates"`
+	QuietHoursStart *int   `json:"quiet_hours_start"` // local hour 0-23, null disables quiet hours
+	QuietHoursEnd   *int   `json:"quiet_hours_end"`
+	Timezone        string `json:"timezone"` // IANA name, defaults to Europe/Moscow
+}
+
+type NotificationSettingsResponse struct {
+	Enabled         bool   `json:"enabled"`
+	StreakReminders bool   `json:"streak_reminders"`
+	TaskUnlocks     bool   `json:"task_unlocks"`
+	PurchaseUpdates bool   `json:"purchase_updates"`
+	QuietHoursStart *int   `json:"quiet_hours_start"`
+	QuietHoursEnd   *int   `json:"quiet_hours_end"`
+	Timezone        string `json:"timezone"`
 }
 
 type UpdateUserRequest struct {
 	ResumeLink string   `json:"resume_link,omitempty"`
 	Stack      []string `json:"stack,omitempty"`
+	University string   `json:"university,omitempty"`
+	Track      string   `json:"track,omitempty"`
+	Language   string   `json:"language,omitempty"` // "ru" or "en"
+}
+
+type AddFriendRequest struct {
+	UserID   int    `json:"user_id,omitempty"`
+	Nickname string `json:"nickname,omitempty"` // alternative to user_id
+}
+
+type FriendResponse struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"` // public name
+	Balance  *int   `json:"balance"`  // null for users left out of the leaderboard
+	AddedAt  string `json:"added_at"`
 }
 
 // Task types
@@ -66,8 +128,9 @@ type TaskDetailResponse struct {
 }
 
 type SubmitTaskRequest struct {
-	Answer      string `json:"answer,omitempty"`
-	AnswerIndex int    `json:"answer_index,omitempty"`
+	Answer      string   `json:"answer,omitempty"`
+	AnswerIndex int      `json:"answer_index,omitempty"`
+	Answers     []string `json:"answers,omitempty"` // survey answers, one per question
 }
 
 type SubmitTaskResponse struct {
@@ -79,56 +142,554 @@ type SubmitTaskResponse struct {
 
 // Shop types
 type ShopItemResponse struct {
-	ID          int    `json:"id"`
-	Name        string `json:"name"`
-	Price       int    `json:"price"`
-	Image       string `json:"image"`
-	Stock       int    `json:"stock"`
-	Description string `json:"description,omitempty"`
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Price        int    `json:"price"`
+	Image        string `json:"image"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	Stock        int    `json:"stock"`
+	Description  string `json:"description,omitempty"`
+	Category     string `json:"category,omitempty"`
+	Affordable   *bool  `json:"affordable,omitempty"` // only set for authenticated requests
+	// LockedReason is a lock code (e.g. "purchase_limit_reached") when the
+	// item's rules don't allow the current user to buy it
+	LockedReason   string                    `json:"locked_reason,omitempty"`
+	PurchasedCount *int64                    `json:"purchased_count,omitempty"` // only set for authenticated requests
+	Rules          ShopItemRulesResponse     `json:"rules"`
+	Variants       []ShopItemVariantResponse `json:"variants"`
+}
+
+type ShopItemRulesResponse struct {
+	MaxPerUser          int      `json:"max_per_user"`
+	AvailableFrom       string   `json:"available_from,omitempty"`
+	AvailableUntil      string   `json:"available_until,omitempty"`
+	MinCompletedTasks   int      `json:"min_completed_tasks"`
+	MinStreak           int      `json:"min_streak"`
+	AllowedRoles        []string `json:"allowed_roles"`
+	AllowedTracks       []string `json:"allowed_tracks"`
+	AllowedUniversities []string `json:"allowed_universities"`
+}
+
+// ShopItemRulesRequest is embedded in the admin item requests. Only provided
+// fields are changed; an empty available_from/available_until clears the bound.
+type ShopItemRulesRequest struct {
+	MaxPerUser          *int      `json:"max_per_user"`
+	AvailableFrom       *string   `json:"available_from"`
+	AvailableUntil      *string   `json:"available_until"`
+	MinCompletedTasks   *int      `json:"min_completed_tasks"`
+	MinStreak           *int      `json:"min_streak"`
+	AllowedRoles        *[]string `json:"allowed_roles"`
+	AllowedTracks       *[]string `json:"allowed_tracks"`
+	AllowedUniversities *[]string `json:"allowed_universities"`
+}
+
+type AdminShopItemResponse struct {
+	ID           int                       `json:"id"`
+	Name         string                    `json:"name"`
+	Description  string                    `json:"description"`
+	Price        int                       `json:"price"`
+	Image        string                    `json:"image"`
+	ThumbnailURL string                    `json:"thumbnail_url"`
+	Category     string                    `json:"category"`
+	Stock        int                       `json:"stock"`
+	Archived     bool                      `json:"archived"`
+	ArchivedAt   string                    `json:"archived_at,omitempty"`
+	CreatedAt    string                    `json:"created_at"`
+	Rules        ShopItemRulesResponse     `json:"rules"`
+	Variants     []ShopItemVariantResponse `json:"variants"`
+
+	LowStockThreshold int   `json:"low_stock_threshold"`
+	WaitlistCount     int64 `json:"waitlist_count"` // users waiting for a restock
+}
+
+type CreateShopItemRequest struct {
+	Name              string `json:"name" binding:"required"`
+	Description       string `json:"description"`
+	Price             int    `json:"price" binding:"min=0"` // 0 for free items
+	Image             string `json:"image"`
+	Category          string `json:"category"`
+	Stock             int    `json:"stock"`
+	LowStockThreshold int    `json:"low_stock_threshold"`
+	ShopItemRulesRequest
+}
+
+type UpdateShopItemRequest struct {
+	Name              string  `json:"name"`
+	Description       *string `json:"description"` // empty clears the description
+	Price             *int    `json:"price"`
+	Image             string  `json:"image"`
+	Category          *string `json:"category"` // empty clears the category
+	LowStockThreshold *int    `json:"low_stock_threshold"`
+	ShopItemRulesRequest
+}
+
+type RestockRequest struct {
+	Quantity  int `json:"quantity" binding:"required"`
+	VariantID int `json:"variant_id,omitempty"` // required for items with variants
+}
+
+// StockAdjustmentRequest is a manual stock correction; delta may be negative
+type StockAdjustmentRequest struct {
+	Delta     int    `json:"delta" binding:"required"`
+	VariantID int    `json:"variant_id,omitempty"` // required for items with variants
+	Note      string `json:"note" binding:"required"`
+}
+
+type StockMovementResponse struct {
+	ID         int    `json:"id"`
+	VariantID  *int   `json:"variant_id,omitempty"`
+	Variant    string `json:"variant,omitempty"`
+	Delta      int    `json:"delta"`
+	StockAfter int    `json:"stock_after"`
+	Reason     string `json:"reason"` // "sale", "restock", "refund" or "correction"
+	PurchaseID string `json:"purchase_id,omitempty"`
+	AdminID    *int   `json:"admin_id,omitempty"`
+	Note       string `json:"note,omitempty"`
+	CreatedAt  string `json:"created_at"`
+}
+
+type StockMovementsResponse struct {
+	Movements []StockMovementResponse `json:"movements"`
+	Page      int                     `json:"page"`
+	PageSize  int                     `json:"page_size"`
+	Total     int64                   `json:"total"`
+}
+
+type WaitlistRequest struct {
+	VariantID int `json:"variant_id,omitempty"` // 0 = any variant
+}
+
+type WaitlistEntryResponse struct {
+	ItemID     int    `json:"item_id"`
+	ItemName   string `json:"item_name"`
+	Image      string `json:"image"`
+	VariantID  int    `json:"variant_id,omitempty"`
+	Variant    string `json:"variant,omitempty"`
+	InStock    bool   `json:"in_stock"`
+	JoinedAt   string `json:"joined_at"`
+	NotifiedAt string `json:"notified_at,omitempty"`
+}
+
+type ShopItemVariantResponse struct {
+	ID    int    `json:"id"`
+	SKU   string `json:"sku"`
+	Size  string `json:"size,omitempty"`
+	Color string `json:"color,omitempty"`
+	Label string `json:"label"`
+	Stock int    `json:"stock"`
+}
+
+type VariantRequest struct {
+	SKU   string `json:"sku"`
+	Size  string `json:"size"`
+	Color string `json:"color"`
+	Stock *int   `json:"stock"`
 }
 
 type BuyItemRequest struct {
-	ItemID int    `json:"item_id"`
-	Email  string `json:"email"`
+	ItemID    int    `json:"item_id"`
+	VariantID int    `json:"variant_id,omitempty"` // required for items with variants
+	Email     string `json:"email"`
+	PromoCode string `json:"promo_code,omitempty"`
+	FulfillmentRequest
+}
+
+// FulfillmentRequest is embedded in BuyItemRequest and CheckoutRequest
+type FulfillmentRequest struct {
+	Fulfillment      string `json:"fulfillment,omitempty"`        // "pickup" (default) or "delivery"
+	PickupLocationID int    `json:"pickup_location_id,omitempty"` // required for pickup when pickup locations exist
+	ShippingAddress  string `json:"shipping_address,omitempty"`   // required for delivery
 }
 
 type BuyItemResponse struct {
 	PurchaseID string `json:"purchase_id"`
+	Price      int    `json:"price"`              // points paid
+	Discount   int    `json:"discount,omitempty"` // points saved with a promo code
 }
 
-type InventoryItemResponse struct {
-	ID          int    `json:"id"`
+// Promo code types
+type PromoCodePreviewRequest struct {
+	Code   string `json:"code" binding:"required"`
+	ItemID int    `json:"item_id" binding:"required"`
+}
+
+type PromoCodePreviewResponse struct {
+	Code        string `json:"code"`
+	Description string `json:"description,omitempty"`
 	ItemID      int    `json:"item_id"`
-	ItemName    string `json:"item_name"`
-	PurchaseID  string `json:"purchase_id"`
-	Status      string `json:"status"` // "pending" or "redeemed"
-	PurchasedAt string `json:"purchased_at"`
+	Price       int    `json:"price"`
+	Discount    int    `json:"discount"`
+	FinalPrice  int    `json:"final_price"`
+}
+
+// PromoCodeRequest is used to create and update promo codes. Only provided
+// fields are changed; an empty valid_from/valid_until clears the bound and
+// item_id 0 clears the item scope.
+type PromoCodeRequest struct {
+	Code           *string `json:"code"`
+	Description    *string `json:"description"`
+	DiscountType   *string `json:"discount_type"` // "percent" or "fixed"
+	DiscountValue  *int    `json:"discount_value"`
+	ItemID         *int    `json:"item_id"`
+	Category       *string `json:"category"`
+	MaxUses        *int    `json:"max_uses"`
+	MaxUsesPerUser *int    `json:"max_uses_per_user"`
+	ValidFrom      *string `json:"valid_from"`
+	ValidUntil     *string `json:"valid_until"`
+	Active         *bool   `json:"active"`
+}
+
+type PromoCodeResponse struct {
+	ID             int    `json:"id"`
+	Code           string `json:"code"`
+	Description    string `json:"description"`
+	DiscountType   string `json:"discount_type"`
+	DiscountValue  int    `json:"discount_value"`
+	ItemID         *int   `json:"item_id,omitempty"`
+	ItemName       string `json:"item_name,omitempty"`
+	Category       string `json:"category,omitempty"`
+	MaxUses        int    `json:"max_uses"`
+	MaxUsesPerUser int    `json:"max_uses_per_user"`
+	ValidFrom      string `json:"valid_from,omitempty"`
+	ValidUntil     string `json:"valid_until,omitempty"`
+	Active         bool   `json:"active"`
+	CreatedAt      string `json:"created_at"`
+	// Usage, not counting cancelled purchases
+	Uses          int64  `json:"uses"`
+	Users         int64  `json:"users"`
+	TotalDiscount int64  `json:"total_discount"`
+	Remaining     *int64 `json:"remaining,omitempty"` // only set when max_uses is limited
+}
+
+type InventoryItemResponse struct {
+	ID              int                     `json:"id"`
+	ItemID          int                     `json:"item_id"`
+	ItemName        string                  `json:"item_name"`
+	Variant         string                  `json:"variant,omitempty"`
+	PurchaseID      string                  `json:"purchase_id"`
+	Price           int                     `json:"price"`
+	Discount        int                     `json:"discount,omitempty"`
+	Status          string                  `json:"status"` // see fulfillment.go
+	Fulfillment     string                  `json:"fulfillment"`
+	PickupLocation  *PickupLocationResponse `json:"pickup_location,omitempty"`
+	ShippingAddress string                  `json:"shipping_address,omitempty"`
+	TrackingNumber  string                  `json:"tracking_number,omitempty"`
+	OrderID         string                  `json:"order_id,omitempty"` // set for purchases made through the cart
+	PurchasedAt     string                  `json:"purchased_at"`
+}
+
+// Cart types
+type CartItemRequest struct {
+	ItemID    int `json:"item_id" binding:"required"`
+	VariantID int `json:"variant_id,omitempty"` // required for items with variants
+	Quantity  int `json:"quantity"`             // defaults to 1 when adding
+}
+
+type CartItemResponse struct {
+	ItemID    int    `json:"item_id"`
+	VariantID int    `json:"variant_id,omitempty"`
+	Name      string `json:"name"`
+	Variant   string `json:"variant,omitempty"`
+	Image     string `json:"image"`
+	Price     int    `json:"price"`
+	Quantity  int    `json:"quantity"`
+	LineTotal int    `json:"line_total"`
+	Stock     int    `json:"stock"`
+	Available bool   `json:"available"` // in the shop and enough stock right now
+}
+
+type CartResponse struct {
+	Items      []CartItemResponse `json:"items"`
+	Total      int                `json:"total"`
+	Balance    int                `json:"balance"`
+	Affordable bool               `json:"affordable"`
+}
+
+type CheckoutRequest struct {
+	Email string `json:"email"`
+	FulfillmentRequest
+}
+
+type OrderLineResponse struct {
+	PurchaseID     string `json:"purchase_id"`
+	ItemID         int    `json:"item_id"`
+	ItemName       string `json:"item_name"`
+	Variant        string `json:"variant,omitempty"`
+	Price          int    `json:"price"`
+	Status         string `json:"status"`
+	TrackingNumber string `json:"tracking_number,omitempty"`
+}
+
+type OrderResponse struct {
+	OrderID         string                  `json:"order_id"`
+	Total           int                     `json:"total"`
+	Fulfillment     string                  `json:"fulfillment"`
+	PickupLocation  *PickupLocationResponse `json:"pickup_location,omitempty"`
+	ShippingAddress string                  `json:"shipping_address,omitempty"`
+	Redeemable      bool                    `json:"redeemable"` // the order QR code can be used
+	CreatedAt       string                  `json:"created_at"`
+	Lines           []OrderLineResponse     `json:"lines"`
+}
+
+type PickupLocationResponse struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Address      string `json:"address"`
+	OpeningHours string `json:"opening_hours"`
+	Active       bool   `json:"active"`
+}
+
+type PickupLocationRequest struct {
+	Name         string `json:"name"`
+	Address      string `json:"address"`
+	OpeningHours string `json:"opening_hours"`
+	Active       *bool  `json:"active"`
+}
+
+type FulfillmentEntry struct {
+	PurchaseID      string                  `json:"purchase_id"`
+	Status          string                  `json:"status"`
+	Fulfillment     string                  `json:"fulfillment"`
+	UserID          int                     `json:"user_id"`
+	UserName        string                  `json:"user_name"`
+	Email           string                  `json:"email,omitempty"`
+	ItemName        string                  `json:"item_name"`
+	Variant         string                  `json:"variant,omitempty"`
+	PickupLocation  *PickupLocationResponse `json:"pickup_location,omitempty"`
+	ShippingAddress string                  `json:"shipping_address,omitempty"`
+	TrackingNumber  string                  `json:"tracking_number,omitempty"`
+	PurchasedAt     string                  `json:"purchased_at"`
+	StatusUpdatedAt string                  `json:"status_updated_at,omitempty"`
+	NextStatuses    []string                `json:"next_statuses"`
+}
+
+// AdminPurchaseEntry is a row of the admin purchase list
+type AdminPurchaseEntry struct {
+	FulfillmentEntry
+	ItemID     int    `json:"item_id"`
+	Price      int    `json:"price"`
+	Discount   int    `json:"discount"`
+	PromoCode  string `json:"promo_code,omitempty"`
+	OrderID    string `json:"order_id,omitempty"`
+	RedeemedAt string `json:"redeemed_at,omitempty"`
+}
+
+type AdminPurchasesResponse struct {
+	Purchases  []AdminPurchaseEntry `json:"purchases"`
+	NextCursor string               `json:"next_cursor,omitempty"` // pass as ?cursor= for the next page
+	Total      int64                `json:"total"`                 // matching purchases over all pages
+}
+
+type UpdatePurchaseStatusRequest struct {
+	Status         string `json:"status" binding:"required"`
+	TrackingNumber string `json:"tracking_number"`
 }
 
 // Admin types
 type RedeemRequest struct {
-	PurchaseID string `json:"purchase_id"`
+	Token string `json:"token" binding:"required"` // signed redemption token from the purchase QR code
+}
+
+type RedemptionTokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt string `json:"expires_at"`
 }
 
 type RedeemResponse struct {
-	Success bool   `json:"success"`
-	Item    string `json:"item"`
-	User    string `json:"user"`
+	Success      bool   `json:"success"`
+	Item         string `json:"item"` // for orders, a comma-separated summary of Items
+	Variant      string `json:"variant,omitempty"`
+	User         string `json:"user"`
+	RedemptionID int    `json:"redemption_id,omitempty"` // for single purchases; see POST /api/admin/redemptions/{id}/undo
+	UndoUntil    string `json:"undo_until"`
+	// Set when an order QR code was scanned
+	OrderID string                 `json:"order_id,omitempty"`
+	Items   []RedeemedItemResponse `json:"items,omitempty"`
+}
+
+type RedeemedItemResponse struct {
+	PurchaseID   string `json:"purchase_id"`
+	Item         string `json:"item"`
+	Variant      string `json:"variant,omitempty"`
+	RedemptionID int    `json:"redemption_id"`
+}
+
+// PurchasePreviewResponse is what the desk sees before handing an item over
+type PurchasePreviewResponse struct {
+	PurchaseID     string                  `json:"purchase_id"`
+	OrderID        string                  `json:"order_id,omitempty"`
+	ItemID         int                     `json:"item_id"`
+	ItemName       string                  `json:"item_name"`
+	Variant        string                  `json:"variant,omitempty"`
+	Image          string                  `json:"image"`
+	UserID         int                     `json:"user_id"`
+	UserName       string                  `json:"user_name"`
+	PhotoURL       string                  `json:"photo_url,omitempty"`
+	Status         string                  `json:"status"`
+	Fulfillment    string                  `json:"fulfillment"`
+	PickupLocation *PickupLocationResponse `json:"pickup_location,omitempty"`
+	PurchasedAt    string                  `json:"purchased_at"`
+	RedeemedAt     string                  `json:"redeemed_at,omitempty"`
+	Redeemable     bool                    `json:"redeemable"`
+	// "already_redeemed" or "not_redeemable" when Redeemable is false
+	NotRedeemableReason string `json:"not_redeemable_reason,omitempty"`
+}
+
+// RedemptionPreviewResponse lists what a scanned QR code would hand over
+type RedemptionPreviewResponse struct {
+	OrderID   string                    `json:"order_id,omitempty"`
+	ExpiresAt string                    `json:"expires_at"` // confirm before the token expires
+	Purchases []PurchasePreviewResponse `json:"purchases"`
+}
+
+type RedemptionLogEntry struct {
+	ID             int    `json:"id"`
+	PurchaseID     string `json:"purchase_id"`
+	OrderID        string `json:"order_id,omitempty"`
+	ItemName       string `json:"item_name"`
+	Variant        string `json:"variant,omitempty"`
+	UserID         int    `json:"user_id"`
+	UserName       string `json:"user_name"`
+	AdminID        int    `json:"admin_id"`
+	AdminName      string `json:"admin_name"`
+	PreviousStatus string `json:"previous_status"`
+	RedeemedAt     string `json:"redeemed_at"`
+	UndoneAt       string `json:"undone_at,omitempty"`
+	UndoneByID     *int   `json:"undone_by_id,omitempty"`
+	Undoable       bool   `json:"undoable"` // still within the undo window
+}
+
+type RedemptionSummaryLine struct {
+	ItemName string `json:"item_name"`
+	Variant  string `json:"variant,omitempty"`
+	Count    int    `json:"count"`
+}
+
+type RedemptionLogResponse struct {
+	Redemptions []RedemptionLogEntry `json:"redemptions"`
+	// Summary counts the handed-over items of the whole filter, not just this
+	// page, excluding undone redemptions
+	Summary  []RedemptionSummaryLine `json:"summary"`
+	Page     int                     `json:"page"`
+	PageSize int                     `json:"page_size"`
+	Total    int64                   `json:"total"`
+}
+
+// Referral types
+type ReferralEntry struct {
+	Username            string `json:"username"` // public name
+	Status              string `json:"status"`   // "pending" or "rewarded"
+	CompletedTasksCount int    `json:"completed_tasks_count"`
+	JoinedAt            string `json:"joined_at"`
+	RewardedAt          string `json:"rewarded_at,omitempty"`
+}
+
+type ReferralStatsResponse struct {
+	ReferralCode  string          `json:"referral_code"`
+	RequiredTasks int             `json:"required_tasks"`
+	Reward        int             `json:"reward"`
+	InvitedCount  int             `json:"invited_count"`
+	RewardedCount int             `json:"rewarded_count"`
+	PendingCount  int             `json:"pending_count"`
+	PointsEarned  int             `json:"points_earned"`
+	Referrals     []ReferralEntry `json:"referrals"`
+}
+
+type AdminReferrerEntry struct {
+	UserID        int    `json:"user_id"`
+	Username      string `json:"username"`
+	FirstName     string `json:"first_name"`
+	LastName      string `json:"last_name"`
+	InvitedCount  int    `json:"invited_count"`
+	RewardedCount int    `json:"rewarded_count"`
+}
+
+type AdminReferralStatsResponse struct {
+	TotalReferrals int                  `json:"total_referrals"`
+	RewardedCount  int                  `json:"rewarded_count"`
+	PendingCount   int                  `json:"pending_count"`
+	PointsAwarded  int                  `json:"points_awarded"` // referrer + referee rewards
+	TopReferrers   []AdminReferrerEntry `json:"top_referrers"`
+}
+
+// Team types
+type CompetitionResponse struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Description  string `json:"description,omitempty"`
+	StartsAt     string `json:"starts_at"`
+	EndsAt       string `json:"ends_at"`
+	TeamCapacity int    `json:"team_capacity"`
+	Status       string `json:"status"` // "active" or "closed"
+	ClosedAt     string `json:"closed_at,omitempty"`
+}
+
+type CreateCompetitionRequest struct {
+	Name         string `json:"name" binding:"required"`
+	Description  string `json:"description"`
+	StartsAt     string `json:"starts_at" binding:"required"` // RFC3339
+	EndsAt       string `json:"ends_at" binding:"required"`   // RFC3339
+	TeamCapacity int    `json:"team_capacity"`
+}
+
+type CreateTeamRequest struct {
+	CompetitionID int    `json:"competition_id" binding:"required"`
+	Name          string `json:"name" binding:"required"`
+}
+
+type JoinTeamRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type TeamMemberResponse struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"` // public name
+	Role     string `json:"role"`     // "captain" or "member"
+	JoinedAt string `json:"joined_at"`
+}
+
+type TeamResponse struct {
+	ID            int                  `json:"id"`
+	CompetitionID int                  `json:"competition_id"`
+	Name          string               `json:"name"`
+	JoinCode      string               `json:"join_code,omitempty"` // only visible to members
+	CaptainID     int                  `json:"captain_id"`
+	Capacity      int                  `json:"capacity"`
+	Score         int                  `json:"score"`
+	Members       []TeamMemberResponse `json:"members"`
+}
+
+type TeamLeaderboardEntry struct {
+	Rank        int    `json:"rank"`
+	TeamID      int    `json:"team_id"`
+	Name        string `json:"name"`
+	MemberCount int    `json:"member_count"`
+	Score       int    `json:"score"`
+}
+
+type TeamLeaderboardResponse struct {
+	Competition CompetitionResponse    `json:"competition"`
+	Teams       []TeamLeaderboardEntry `json:"teams"`
 }
 
 // Leaderboard types
 type LeaderboardEntry struct {
 	Rank                int    `json:"rank"`
 	UserID              int    `json:"user_id"`
-	Username            string `json:"username"`
+	Username            string `json:"username"` // public name: nickname or "Player #<id>"
 	Balance             int    `json:"balance"`
 	CompletedTasksCount int    `json:"completed_tasks_count"`
 	CurrentStreak       int    `json:"current_streak"`
 }
 
 type LeaderboardResponse struct {
+	Scope       string             `json:"scope"` // "global", "university", "track" or "friends"
 	TopUsers    []LeaderboardEntry `json:"top_users"`
+	Page        int                `json:"page"`
+	PageSize    int                `json:"page_size"`
+	Total       int64              `json:"total"`
 	CurrentUser *LeaderboardEntry  `json:"current_user,omitempty"`
+	Neighbors   []LeaderboardEntry `json:"neighbors,omitempty"` // ranks ±5 around the current user
 }
 
 // Admin types for dashboard
@@ -142,6 +703,136 @@ type AdminMetricsResponse struct {
 	AvgTasksPerUser     float64 `json:"avg_tasks_per_user"`
 }
 
+// AnalyticsSeriesRange is the range of an admin analytics time series.
+// Periods are given by their first day (YYYY-MM-DD).
+type AnalyticsSeriesRange struct {
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Granularity string `json:"granularity"` // "day", "week" or "month"
+}
+
+type CountPoint struct {
+	Period string `json:"period"`
+	Count  int64  `json:"count"`
+	Users  *int64 `json:"users,omitempty"` // distinct users, for task completions
+}
+
+type CountSeriesResponse struct {
+	AnalyticsSeriesRange
+	Points []CountPoint `json:"points"`
+	Total  int64        `json:"total"`
+}
+
+type ActiveUsersPoint struct {
+	Period      string `json:"period"`
+	ActiveUsers int64  `json:"active_users"` // active during the period
+	DAU         int64  `json:"dau"`          // active on the last day of the period
+	WAU         int64  `json:"wau"`          // active in the 7 days up to the end of the period
+	MAU         int64  `json:"mau"`          // active in the 30 days up to the end of the period
+}
+
+type ActiveUsersResponse struct {
+	AnalyticsSeriesRange
+	Points []ActiveUsersPoint `json:"points"`
+}
+
+type PointsPoint struct {
+	Period   string `json:"period"`
+	Earned   int64  `json:"earned"`   // task rewards and referral bonuses
+	Spent    int64  `json:"spent"`    // shop purchases
+	Refunded int64  `json:"refunded"` // cancelled purchases
+	Adjusted int64  `json:"adjusted"` // admin adjustments and revoked rewards, may be negative
+	Net      int64  `json:"net"`      // change of all balances together
+}
+
+type PointsResponse struct {
+	AnalyticsSeriesRange
+	Points      []PointsPoint `json:"points"`
+	TotalEarned int64         `json:"total_earned"`
+	TotalSpent  int64         `json:"total_spent"`
+}
+
+type PurchasePoint struct {
+	Period      string `json:"period"`
+	Count       int64  `json:"count"`
+	PointsSpent int64  `json:"points_spent"`
+}
+
+type PurchaseSeries struct {
+	ItemID      int             `json:"item_id"`
+	ItemName    string          `json:"item_name"`
+	Points      []PurchasePoint `json:"points"`
+	TotalCount  int64           `json:"total_count"`
+	TotalPoints int64           `json:"total_points"`
+}
+
+type PurchaseSeriesResponse struct {
+	AnalyticsSeriesRange
+	Items []PurchaseSeries `json:"items"`
+}
+
+type FunnelStep struct {
+	Step         string  `json:"step"` // "registered", "task" or "purchase"
+	Label        string  `json:"label"`
+	Position     *int    `json:"position,omitempty"`  // task position
+	TaskType     string  `json:"task_type,omitempty"` // "quiz" or "survey"
+	Users        int64   `json:"users"`
+	FromPrevious float64 `json:"from_previous"` // share of the previous step
+	FromStart    float64 `json:"from_start"`    // share of registered users
+}
+
+type FunnelResponse struct {
+	Steps []FunnelStep `json:"steps"`
+}
+
+type RetentionWeek struct {
+	Week  int     `json:"week"` // weeks after registration, from 0
+	Users int64   `json:"users"`
+	Rate  float64 `json:"rate"`
+}
+
+type RetentionCohort struct {
+	Cohort    string          `json:"cohort"` // first day of the registration week
+	Users     int64           `json:"users"`
+	Retention []RetentionWeek `json:"retention"` // finished weeks only
+}
+
+type RetentionResponse struct {
+	Weeks   int               `json:"weeks"`
+	Cohorts []RetentionCohort `json:"cohorts"`
+}
+
+type LevelTimeStep struct {
+	FromPosition  *int   `json:"from_position"` // null for registration
+	FromLabel     string `json:"from_label"`
+	ToPosition    int    `json:"to_position"`
+	ToLabel       string `json:"to_label"`
+	Users         int64  `json:"users"` // users who completed both steps
+	MedianSeconds int64  `json:"median_seconds"`
+}
+
+type LevelTimesResponse struct {
+	Steps []LevelTimeStep `json:"steps"`
+}
+
+type AdminNotificationResponse struct {
+	ID        int    `json:"id"`
+	Kind      string `json:"kind"` // "low_stock" or "out_of_stock"
+	ItemID    *int   `json:"item_id,omitempty"`
+	VariantID *int   `json:"variant_id,omitempty"`
+	Message   string `json:"message"`
+	Read      bool   `json:"read"`
+	CreatedAt string `json:"created_at"`
+}
+
+type AdminNotificationsResponse struct {
+	Notifications []AdminNotificationResponse `json:"notifications"`
+	Unread        int64                       `json:"unread"`
+	Page          int                         `json:"page"`
+	PageSize      int                         `json:"page_size"`
+	Total         int64                       `json:"total"`
+}
+
 type AdminUserResponse struct {
 	ID                  int    `json:"id"`
 	Username            string `json:"username"`
@@ -152,9 +843,249 @@ type AdminUserResponse struct {
 	CurrentStreak       int    `json:"current_streak"`
 	CompletedTasksCount int    `json:"completed_tasks_count"`
 	Role                string `json:"role"`
+	Status              string `json:"status"` // "active", "shadow_banned" or "banned"
 	CreatedAt           string `json:"created_at"`
 }
 
+type AdminUsersResponse struct {
+	Users    []AdminUserResponse `json:"users"`
+	Page     int                 `json:"page"`
+	PageSize int                 `json:"page_size"`
+	Total    int64               `json:"total"`
+	// Totals over all matching users, not just this page
+	TotalBalance        int64 `json:"total_balance"`
+	TotalCompletedTasks int64 `json:"total_completed_tasks"`
+}
+
+type AdminUserProfile struct {
+	AdminUserResponse
+	TelegramID   *int64  `json:"telegram_id"`
+	PhotoURL     string  `json:"photo_url"`
+	Nickname     *string `json:"nickname"`
+	University   string  `json:"university"`
+	Track        string  `json:"track"`
+	Language     string  `json:"language"`
+	ReferralCode string  `json:"referral_code"`
+	LastTaskDate string  `json:"last_task_date,omitempty"`
+	BanReason    string  `json:"ban_reason,omitempty"`
+	BannedAt     string  `json:"banned_at,omitempty"`
+}
+
+type AdminUserTaskProgress struct {
+	TaskID        int    `json:"task_id"`
+	Title         string `json:"title"`
+	Type          string `json:"type"`
+	Position      int    `json:"position"`
+	Status        string `json:"status"` // "locked", "available", "completed"
+	Reward        int    `json:"reward"`
+	Earned        int    `json:"earned"`
+	CompletedAt   string `json:"completed_at,omitempty"`
+	Attempts      int    `json:"attempts"`
+	LastAttemptAt string `json:"last_attempt_at,omitempty"`
+}
+
+type TaskAttemptResponse struct {
+	ID        int      `json:"id"`
+	TaskID    int      `json:"task_id"`
+	TaskTitle string   `json:"task_title"`
+	Answer    string   `json:"answer"`
+	Answers   []string `json:"answers,omitempty"`
+	Correct   bool     `json:"correct"`
+	CreatedAt string   `json:"created_at"`
+}
+
+type BalanceTransactionResponse struct {
+	ID           int    `json:"id"`
+	Delta        int    `json:"delta"`
+	BalanceAfter int    `json:"balance_after"`
+	Reason       string `json:"reason"` // "task_reward", "referral", "purchase", "refund", "task_reset" or "admin_adjustment"
+	TaskID       *int   `json:"task_id,omitempty"`
+	PurchaseID   string `json:"purchase_id,omitempty"`
+	OrderID      string `json:"order_id,omitempty"`
+	AdminID      *int   `json:"admin_id,omitempty"`
+	Note         string `json:"note,omitempty"`
+	CreatedAt    string `json:"created_at"`
+}
+
+type BalanceHistoryResponse struct {
+	Transactions []BalanceTransactionResponse `json:"transactions"`
+	Page         int                          `json:"page"`
+	PageSize     int                          `json:"page_size"`
+	Total        int64                        `json:"total"`
+}
+
+type AdminAuditLogEntry struct {
+	ID             int    `json:"id"`
+	AdminID        int    `json:"admin_id"`
+	AdminName      string `json:"admin_name"`
+	TargetUserID   int    `json:"target_user_id"`
+	TargetUserName string `json:"target_user_name"`
+	Action         string `json:"action"` // "balance_adjustment", "task_reset", "role_change", "ban", "shadow_ban", "unban" or "flags_reviewed"
+	Details        string `json:"details,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+	CreatedAt      string `json:"created_at"`
+}
+
+type AdminAuditLogResponse struct {
+	Entries  []AdminAuditLogEntry `json:"entries"`
+	Page     int                  `json:"page"`
+	PageSize int                  `json:"page_size"`
+	Total    int64                `json:"total"`
+}
+
+type UserFlagResponse struct {
+	ID           int    `json:"id"`
+	Kind         string `json:"kind"` // "fast_answer", "shared_ip", "shared_device" or "balance_spike"
+	Details      string `json:"details"`
+	Status       string `json:"status"` // "open", "dismissed" or "confirmed"
+	ReviewedByID *int   `json:"reviewed_by_id,omitempty"`
+	ReviewedAt   string `json:"reviewed_at,omitempty"`
+	CreatedAt    string `json:"created_at"`
+}
+
+type FlagQueueEntry struct {
+	User           AdminUserProfile   `json:"user"`
+	Flags          []UserFlagResponse `json:"flags"` // open flags
+	FirstFlaggedAt string             `json:"first_flagged_at"`
+}
+
+type FlagQueueResponse struct {
+	Users    []FlagQueueEntry `json:"users"`
+	Page     int              `json:"page"`
+	PageSize int              `json:"page_size"`
+	Total    int64            `json:"total"`
+}
+
+type FlagReviewRequest struct {
+	Decision string `json:"decision" binding:"required"` // "dismiss", "shadow_ban" or "ban"
+	Reason   string `json:"reason"`                      // required to ban
+}
+
+// AdminUserDetailResponse is the admin user page. Attempts, purchases,
+// balance history, flags and audit log hold the latest 50 entries each.
+type AdminUserDetailResponse struct {
+	Profile        AdminUserProfile             `json:"profile"`
+	Tasks          []AdminUserTaskProgress      `json:"tasks"`
+	Attempts       []TaskAttemptResponse        `json:"attempts"`
+	Purchases      []AdminPurchaseEntry         `json:"purchases"`
+	BalanceHistory []BalanceTransactionResponse `json:"balance_history"`
+	Flags          []UserFlagResponse           `json:"flags"`
+	AuditLog       []AdminAuditLogEntry         `json:"audit_log"`
+}
+
+// BalanceAdjustmentRequest is a manual balance change; delta may be negative
+type BalanceAdjustmentRequest struct {
+	Delta  int    `json:"delta" binding:"required"`
+	Reason string `json:"reason"` // required, shown in the user's balance history
+}
+
+type TaskResetRequest struct {
+	RevokeReward bool   `json:"revoke_reward"` // also take back the points earned for the task
+	Reason       string `json:"reason"`
+}
+
+type UserRoleRequest struct {
+	Role   string `json:"role" binding:"required"` // "student" or "admin"
+	Reason string `json:"reason"`
+}
+
+type UserBanRequest struct {
+	Reason string `json:"reason"` // required to ban
+}
+
+// CandidateResponse is a student in the candidate pipeline. Status, tags
+// and updated_at are empty until the student is marked as a candidate.
+type CandidateResponse struct {
+	UserID          int      `json:"user_id"`
+	FirstName       string   `json:"first_name"`
+	LastName        string   `json:"last_name"`
+	Username        string   `json:"username"`
+	PhoneNumber     string   `json:"phone_number"`
+	TelegramID      *int64   `json:"telegram_id"`
+	University      string   `json:"university"`
+	Track           string   `json:"track"`
+	Stack           []string `json:"stack"`
+	ResumeLink      string   `json:"resume_link"`
+	HasResumeFile   bool     `json:"has_resume_file"` // download at /api/admin/users/{id}/resume
+	UserStatus      string   `json:"user_status"`     // moderation status
+	RegisteredAt    string   `json:"registered_at"`
+	Marked          bool     `json:"marked"`
+	Status          string   `json:"status"` // "new", "contacted", "interviewing", "offered" or "rejected"
+	Tags            []string `json:"tags"`
+	UpdatedAt       string   `json:"updated_at,omitempty"`
+	CompletedLevels int      `json:"completed_levels"` // completed quiz tasks
+	QuizAttempts    int      `json:"quiz_attempts"`
+	QuizAccuracy    *float64 `json:"quiz_accuracy"` // share of correct quiz answers, null without answers
+	PointsEarned    int      `json:"points_earned"`
+}
+
+type CandidatesResponse struct {
+	Candidates []CandidateResponse `json:"candidates"`
+	Page       int                 `json:"page"`
+	PageSize   int                 `json:"page_size"`
+	Total      int64               `json:"total"`
+}
+
+type CandidateNoteResponse struct {
+	ID         int    `json:"id"`
+	AuthorID   int    `json:"author_id"`
+	AuthorName string `json:"author_name"`
+	Body       string `json:"body"`
+	CreatedAt  string `json:"created_at"`
+}
+
+type CandidateDetailResponse struct {
+	Candidate CandidateResponse       `json:"candidate"`
+	Tasks     []AdminUserTaskProgress `json:"tasks"`
+	Notes     []CandidateNoteResponse `json:"notes"` // newest first
+}
+
+// CandidateUpdateRequest marks a student as a candidate; omitted fields are
+// left alone, tags replace the current tags
+type CandidateUpdateRequest struct {
+	Status *string  `json:"status"`
+	Tags   []string `json:"tags"`
+}
+
+type CandidateNoteRequest struct {
+	Body string `json:"body" binding:"required"`
+}
+
+// JSONResume is a candidate in the JSON Resume schema (https://jsonresume.org/schema)
+type JSONResume struct {
+	Basics    JSONResumeBasics      `json:"basics"`
+	Education []JSONResumeEducation `json:"education"`
+	Skills    []JSONResumeSkill     `json:"skills"`
+	Meta      JSONResumeMeta        `json:"meta"`
+}
+
+type JSONResumeBasics struct {
+	Name     string              `json:"name"`
+	Label    string              `json:"label,omitempty"`
+	Phone    string              `json:"phone,omitempty"`
+	URL      string              `json:"url,omitempty"`
+	Profiles []JSONResumeProfile `json:"profiles"`
+}
+
+type JSONResumeProfile struct {
+	Network  string `json:"network"`
+	Username string `json:"username"`
+	URL      string `json:"url"`
+}
+
+type JSONResumeEducation struct {
+	Institution string `json:"institution"`
+}
+
+type JSONResumeSkill struct {
+	Name string `json:"name"`
+}
+
+type JSONResumeMeta struct {
+	LastModified string            `json:"lastModified"`
+	Candidate    CandidateResponse `json:"candidate"` // pipeline status and quiz performance
+}
+
 type AdminTaskResponse struct {
 	ID            int      `json:"id"`
 	Title         string   `json:"title"`
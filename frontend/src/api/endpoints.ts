@@ -50,6 +50,20 @@ export interface BuyItemResponse {
   purchase_id: string;
 }
 
+export interface RedemptionTokenResponse {
+  token: string;
+  expires_at: string;
+}
+
+export interface ShopItemVariant {
+  id: number;
+  sku: string;
+  size?: string;
+  color?: string;
+  label: string;
+  stock: number;
+}
+
 export interface ShopItem {
   id: number;
   name: string;
@@ -57,6 +71,7 @@ export interface ShopItem {
   price: number;
   image: string;
   stock: number;
+  variants: ShopItemVariant[];
 }
 
 // --- Endpoints ---
@@ -122,8 +137,8 @@ export const api = {
       const { data } = await client.get<TaskDetail>(`/api/tasks/${taskId}`);
       return data;
     },
-    submit: async (taskId: number, answer?: string, answerIndex?: number) => {
-      const { data } = await client.post<SubmitTaskResponse>(`/api/tasks/${taskId}/submit`, { answer, answer_index: answerIndex });
+    submit: async (taskId: number, answer?: string, answerIndex?: number, answers?: string[]) => {
+      const { data } = await client.post<SubmitTaskResponse>(`/api/tasks/${taskId}/submit`, { answer, answer_index: answerIndex, answers });
       return data;
     },
   },
@@ -132,8 +147,16 @@ export const api = {
       const { data } = await client.get<ShopItem[]>('/api/shop/items');
       return data;
     },
-    buy: async (itemId: number, email: string) => {
-      const { data } = await client.post<BuyItemResponse>('/api/shop/buy', { item_id: itemId, email });
+    buy: async (itemId: number, email: string, variantId?: number) => {
+      const { data } = await client.post<BuyItemResponse>('/api/shop/buy', { item_id: itemId, variant_id: variantId, email });
+      return data;
+    },
+    redemptionToken: async (purchaseId: string) => {
+      const { data } = await client.get<RedemptionTokenResponse>(`/api/user/inventory/${purchaseId}/redemption-token`);
+      return data;
+    },
+    orderRedemptionToken: async (orderId: string) => {
+      const { data } = await client.get<RedemptionTokenResponse>(`/api/user/orders/${orderId}/redemption-token`);
       return data;
     },
   },
@@ -146,8 +169,8 @@ export const api = {
       const { data } = await adminClient.get<AdminMetricsResponse>('/api/admin/metrics');
       return data;
     },
-    getUsers: async () => {
-      const { data } = await adminClient.get<AdminUserResponse[]>('/api/admin/users');
+    getUsers: async (params?: AdminUsersQuery) => {
+      const { data } = await adminClient.get<AdminUsersResponse>('/api/admin/users', { params });
       return data;
     },
     getTasks: async () => {
@@ -192,6 +215,29 @@ export interface AdminUserResponse {
   created_at: string;
 }
 
+export interface AdminUsersQuery {
+  q?: string;
+  role?: string;
+  min_balance?: number;
+  min_streak?: number;
+  min_completed?: number;
+  registered_from?: string;
+  registered_to?: string;
+  sort?: 'created_at' | 'balance' | 'streak' | 'completed' | 'name';
+  order?: 'asc' | 'desc';
+  page?: number;
+  page_size?: number;
+}
+
+export interface AdminUsersResponse {
+  users: AdminUserResponse[];
+  page: number;
+  page_size: number;
+  total: number;
+  total_balance: number;
+  total_completed_tasks: number;
+}
+
 export interface AdminTaskResponse {
   id: number;
   title: string;
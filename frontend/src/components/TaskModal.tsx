@@ -26,6 +26,7 @@ export const TaskModal = ({ levelId, onClose }: TaskModalProps) => {
   // Multi-question state
   const [currentQuestionIndex, setCurrentQuestionIndex] = useState(0);
   const [results, setResults] = useState<boolean[]>([]);
+  const [answers, setAnswers] = useState<string[]>([]);
   const [showSummary, setShowSummary] = useState(false);
 
   useEffect(() => {
@@ -89,6 +90,14 @@ export const TaskModal = ({ levelId, onClose }: TaskModalProps) => {
     const newResults = [...results, isCorrect];
     setResults(newResults);
 
+    // Survey answers are sent in question order; the profile survey fills the
+    // user's university and track from them
+    const answer = currentQuestion.type === 'text'
+        ? textAnswer.trim()
+        : selectedOption !== null ? currentQuestion.options[selectedOption] ?? '' : '';
+    const newAnswers = [...answers, answer];
+    setAnswers(newAnswers);
+
     if (currentQuestionIndex < totalQuestions - 1) {
         // Next question
         setCurrentQuestionIndex(prev => prev + 1);
@@ -97,8 +106,8 @@ export const TaskModal = ({ levelId, onClose }: TaskModalProps) => {
     } else {
         // Finished all questions
         // Submit to backend to mark completion and get reward
-        // We send the last answer index, though for surveys it might not matter
-        await completeLevel(levelId, selectedOption || 0);
+        // We send the last answer index for quizzes and every answer for surveys
+        await completeLevel(levelId, selectedOption || 0, taskDetail?.type === 'survey' ? newAnswers : undefined);
         
         setShowConfetti(true);
         setShowSummary(true);
@@ -9,8 +9,8 @@ interface GameContextType {
   login: (userData: Partial<TelegramAuthRequest>) => Promise<void>;
   loginWithPhone: (userData: PhoneAuthRequest) => Promise<void>;
   logout: () => void;
-  completeLevel: (levelId: number, answerIndex?: number) => Promise<boolean>;
-  buyItem: (itemId: number, email: string) => Promise<string | null>;
+  completeLevel: (levelId: number, answerIndex?: number, answers?: string[]) => Promise<boolean>;
+  buyItem: (itemId: number, email: string, variantId?: number) => Promise<string | null>;
 }
 
 const GameContext = createContext<GameContextType | undefined>(undefined);
@@ -90,9 +90,9 @@ export const GameProvider = ({ children }: { children: ReactNode }) => {
     }
   };
 
-  const completeLevel = async (levelId: number, answerIndex?: number) => {
+  const completeLevel = async (levelId: number, answerIndex?: number, answers?: string[]) => {
     try {
-      const response = await api.tasks.submit(levelId, undefined, answerIndex);
+      const response = await api.tasks.submit(levelId, undefined, answerIndex, answers);
       if (response.success) {
         setUserBalance(response.new_balance);
         // Refresh tasks to update status
@@ -107,9 +107,9 @@ export const GameProvider = ({ children }: { children: ReactNode }) => {
     }
   };
 
-  const buyItem = async (itemId: number, email: string): Promise<string | null> => {
+  const buyItem = async (itemId: number, email: string, variantId?: number): Promise<string | null> => {
     try {
-      const result = await api.shop.buy(itemId, email);
+      const result = await api.shop.buy(itemId, email, variantId);
       // Refetch user data to update balance
       const user = await api.user.me();
       setUserBalance(user.balance);
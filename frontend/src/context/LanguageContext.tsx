@@ -29,6 +29,9 @@ const translations = {
     'shop.success': 'Purchase successful!',
     'shop.failed': 'Purchase failed.',
     'shop.email_required': 'Please enter your email.',
+    'shop.variant_prompt': 'Choose an option:',
+    'shop.variant_required': 'Please choose an option.',
+    'shop.out_of_stock': 'Out of stock',
     'map.loading': 'Loading...',
     'map.start': 'START',
     'login.title': 'X5 Journey',
@@ -71,6 +74,9 @@ const translations = {
     'shop.success': 'Покупка успешна!',
     'shop.failed': 'Ошибка покупки.',
     'shop.email_required': 'Пожалуйста, введите ваш email.',
+    'shop.variant_prompt': 'Выберите вариант:',
+    'shop.variant_required': 'Пожалуйста, выберите вариант.',
+    'shop.out_of_stock': 'Нет в наличии',
     'map.loading': 'Загрузка...',
     'map.start': 'СТАРТ',
     'login.title': 'X5 Journey',
@@ -63,8 +63,8 @@ export const AdminPage = () => {
   const loadUsers = async () => {
     setLoading(true);
     try {
-      const data = await api.admin.getUsers();
-      setUsers(data);
+      const data = await api.admin.getUsers({ page_size: 200 });
+      setUsers(data.users);
     } catch (error) {
       console.error('Failed to load users', error);
     } finally {
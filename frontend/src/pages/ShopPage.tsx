@@ -1,4 +1,5 @@
 import { useState, useEffect } from 'react';
+import { useSearchParams } from 'react-router-dom';
 import { useGame } from '../context/GameContext';
 import { Button } from '../components/Button';
 import { Coins, X, CheckCircle, Loader2 } from 'lucide-react';
@@ -14,12 +15,55 @@ export const ShopPage = () => {
   const [shopItems, setShopItems] = useState<ShopItem[]>([]);
   const [loading, setLoading] = useState(true);
   const [selectedItem, setSelectedItem] = useState<number | null>(null);
+  const [selectedVariant, setSelectedVariant] = useState<number | null>(null);
   const [email, setEmail] = useState('');
   const [showModal, setShowModal] = useState(false);
   const [modalStep, setModalStep] = useState<ModalStep>('email');
   const [purchaseId, setPurchaseId] = useState<string>('');
+  const [orderId, setOrderId] = useState<string>('');
+  const [searchParams, setSearchParams] = useSearchParams();
+  const [redemptionToken, setRedemptionToken] = useState<string>('');
   const [isLoading, setIsLoading] = useState(false);
 
+  // Confirmation emails link here with ?purchase= or ?order= to show the pickup QR
+  useEffect(() => {
+    const linkedPurchase = searchParams.get('purchase');
+    const linkedOrder = searchParams.get('order');
+    if (!linkedPurchase && !linkedOrder) return;
+    setPurchaseId(linkedPurchase ?? '');
+    setOrderId(linkedOrder ?? '');
+    setModalStep('qr');
+    setShowModal(true);
+  }, [searchParams]);
+
+  // The QR code holds a short-lived signed token; refresh it shortly before it expires
+  useEffect(() => {
+    if (modalStep !== 'qr' || (!purchaseId && !orderId)) return;
+
+    let timer: ReturnType<typeof setTimeout>;
+    let cancelled = false;
+    const refresh = async () => {
+      try {
+        const { token, expires_at } = orderId
+          ? await api.shop.orderRedemptionToken(orderId)
+          : await api.shop.redemptionToken(purchaseId);
+        if (cancelled) return;
+        setRedemptionToken(token);
+        const delay = Math.max(new Date(expires_at).getTime() - Date.now() - 10_000, 5_000);
+        timer = setTimeout(refresh, delay);
+      } catch (error) {
+        console.error('Failed to refresh redemption token:', error);
+        if (!cancelled) timer = setTimeout(refresh, 5_000);
+      }
+    };
+    refresh();
+
+    return () => {
+      cancelled = true;
+      clearTimeout(timer);
+    };
+  }, [modalStep, purchaseId, orderId]);
+
   useEffect(() => {
     const fetchItems = async () => {
       try {
@@ -36,24 +80,41 @@ export const ShopPage = () => {
 
   const handleBuyClick = (itemId: number) => {
     setSelectedItem(itemId);
+    setSelectedVariant(null);
     setShowModal(true);
     setModalStep('email');
     setPurchaseId('');
+    setOrderId('');
+    setRedemptionToken('');
   };
 
   const handleCloseModal = () => {
     setShowModal(false);
     setEmail('');
     setSelectedItem(null);
+    setSelectedVariant(null);
     setModalStep('email');
     setPurchaseId('');
+    setOrderId('');
+    setRedemptionToken('');
+    if (searchParams.has('purchase') || searchParams.has('order')) {
+      setSearchParams({}, { replace: true });
+    }
   };
 
+  const selectedItemData = shopItems.find(item => item.id === selectedItem);
+  const selectedVariantData = selectedItemData?.variants?.find(variant => variant.id === selectedVariant);
+
   const handleConfirmBuy = async () => {
+    // Items with variants (e.g. sizes) can only be bought as a specific variant
+    if (selectedItemData?.variants?.length && !selectedVariant) {
+      alert(t('shop.variant_required'));
+      return;
+    }
     if (selectedItem && email) {
       setIsLoading(true);
       try {
-        const purchaseIdResult = await buyItem(selectedItem, email);
+        const purchaseIdResult = await buyItem(selectedItem, email, selectedVariant ?? undefined);
         if (purchaseIdResult) {
           setPurchaseId(purchaseIdResult);
           setModalStep('qr');
@@ -70,8 +131,6 @@ export const ShopPage = () => {
     }
   };
 
-  const selectedItemData = shopItems.find(item => item.id === selectedItem);
-
   if (loading) {
     return (
       <div className="p-4 flex items-center justify-center min-h-[50vh]">
@@ -123,6 +182,29 @@ export const ShopPage = () => {
             {modalStep === 'email' ? (
               <>
                 <h2 className="text-xl font-bold mb-4 text-gray-800">{t('shop.confirm')}</h2>
+                {selectedItemData?.variants?.length ? (
+                  <>
+                    <p className="mb-2 text-gray-600">{t('shop.variant_prompt')}</p>
+                    <div className="flex flex-wrap gap-2 mb-4">
+                      {selectedItemData.variants.map((variant) => (
+                        <button
+                          key={variant.id}
+                          type="button"
+                          onClick={() => setSelectedVariant(variant.id)}
+                          disabled={variant.stock <= 0}
+                          title={variant.stock <= 0 ? t('shop.out_of_stock') : undefined}
+                          className={`px-4 py-2 rounded-xl border-2 font-bold transition-colors disabled:opacity-40 disabled:line-through ${
+                            selectedVariant === variant.id
+                              ? 'border-green-500 bg-green-50 text-green-700'
+                              : 'border-gray-200 bg-white text-gray-700'
+                          }`}
+                        >
+                          {variant.label}
+                        </button>
+                      ))}
+                    </div>
+                  </>
+                ) : null}
                 <p className="mb-4 text-gray-600">{t('shop.email_prompt')}</p>
                 <input
                   type="email"
@@ -143,15 +225,19 @@ export const ShopPage = () => {
                 <h2 className="text-xl font-bold mb-2 text-gray-800">{t('shop.success')}</h2>
                 {selectedItemData && (
                   <p className="text-gray-600 mb-4">
-                    {selectedItemData.name} - {selectedItemData.price} ⭐
+                    {selectedItemData.name}{selectedVariantData ? ` (${selectedVariantData.label})` : ''} - {selectedItemData.price} ⭐
                   </p>
                 )}
                 <div className="bg-gray-50 p-4 rounded-xl mb-4">
-                  <QRCodeSVG 
-                    value={`purchase:${purchaseId}:${email}:${selectedItem}`}
-                    size={180}
-                    className="mx-auto"
-                  />
+                  {redemptionToken ? (
+                    <QRCodeSVG 
+                      value={redemptionToken}
+                      size={180}
+                      className="mx-auto"
+                    />
+                  ) : (
+                    <Loader2 className="animate-spin mx-auto text-gray-400" size={40} />
+                  )}
                 </div>
                 <p className="text-sm text-gray-500 mb-4">
                   Покажите этот QR-код для получения награды